@@ -0,0 +1,96 @@
+package tdigest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Builder collects the settings of a digest and checks them all
+// together before building it, which suits settings coming from a
+// configuration: the setters can be chained and errors only show up
+// in Build.
+//
+//	digest, err := tdigest.NewBuilder().
+//		Compression(cfg.Compression).
+//		Capacity(cfg.Capacity).
+//		Build()
+//
+// Settings left alone keep the defaults of New.
+type Builder struct {
+	compression float64
+	capacity    int
+	hasCapacity bool
+	rng         RNG
+	hasRNG      bool
+}
+
+// NewBuilder creates a builder with the default settings of New.
+func NewBuilder() *Builder {
+	return &Builder{compression: 100}
+}
+
+// Compression sets the compression of the digest, see the option of
+// the same name. It must be a finite number >= 1.
+func (b *Builder) Compression(compression float64) *Builder {
+	b.compression = compression
+	return b
+}
+
+// Capacity sets how many centroids the digest has room for upfront,
+// see InitialCapacity. It must be >= 0, and no more than the digest
+// can ever hold with the chosen compression since the extra room
+// would never be used.
+func (b *Builder) Capacity(capacity int) *Builder {
+	b.capacity, b.hasCapacity = capacity, true
+	return b
+}
+
+// RandomSource sets the random number generator of the digest, see
+// RandomNumberGenerator. It must not be nil.
+func (b *Builder) RandomSource(rng RNG) *Builder {
+	b.rng, b.hasRNG = rng, true
+	return b
+}
+
+// Build checks the settings and creates a digest with them. The
+// error describes the first invalid setting, in the order of the
+// setters, and no digest is created then.
+//
+// The builder can be reused: every call creates a new digest.
+func (b *Builder) Build() (*TDigest, error) {
+	err := b.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	options := []tdigestOption{Compression(b.compression)}
+	if b.hasCapacity {
+		options = append(options, InitialCapacity(b.capacity))
+	}
+	if b.hasRNG {
+		options = append(options, RandomNumberGenerator(b.rng))
+	}
+	return New(options...)
+}
+
+func (b *Builder) validate() error {
+	if !(b.compression >= 1) || math.IsInf(b.compression, 1) {
+		return errors.New("Compression should be a number >= 1")
+	}
+
+	if b.hasCapacity {
+		if b.capacity < 0 {
+			return errors.New("Initial capacity should be >= 0")
+		}
+		// The digest compresses itself past this many centroids
+		if limit := math.Floor(defaultBufferFactor*b.compression) + 1; float64(b.capacity) > limit {
+			return fmt.Errorf("Initial capacity should be <= %.0f with a compression of %g, got %d", limit, b.compression, b.capacity)
+		}
+	}
+
+	if b.hasRNG && b.rng == nil {
+		return errors.New("Random source should not be nil")
+	}
+	return nil
+}
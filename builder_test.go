@@ -0,0 +1,61 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	digest, err := NewBuilder().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults, _ := New()
+	if digest.compression != defaults.compression || cap(digest.summary.means) != cap(defaults.summary.means) {
+		t.Errorf("Expected the defaults of New, got a compression of %f and a capacity of %d", digest.compression, cap(digest.summary.means))
+	}
+
+	builder := NewBuilder().Compression(20).Capacity(50).RandomSource(newLocalRNG(0xB0B))
+	digest, err = builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.compression != 20 || cap(digest.summary.means) != 50 {
+		t.Errorf("Expected a compression of 20 and a capacity of 50, got %f and %d", digest.compression, cap(digest.summary.means))
+	}
+
+	// Every build creates a new digest
+	_ = digest.Add(1)
+	other, _ := builder.Build()
+	if other == digest || other.Count() != 0 {
+		t.Errorf("Expected builds to create fresh digests")
+	}
+
+	// The largest useful capacity is allowed
+	if _, err := NewBuilder().Compression(1.5).Capacity(31).Build(); err != nil {
+		t.Errorf("Expected a capacity of 31 to be fine for a compression of 1.5, got %s", err)
+	}
+}
+
+func TestBuilderInvalid(t *testing.T) {
+	inputs := []struct {
+		name    string
+		builder *Builder
+	}{
+		{"low compression", NewBuilder().Compression(0.5)},
+		{"NaN compression", NewBuilder().Compression(math.NaN())},
+		{"infinite compression", NewBuilder().Compression(math.Inf(1))},
+		{"negative capacity", NewBuilder().Capacity(-1)},
+		{"capacity beyond the compression", NewBuilder().Compression(10).Capacity(202)},
+		{"capacity beyond a fractional compression", NewBuilder().Compression(1.5).Capacity(32)},
+		{"nil random source", NewBuilder().RandomSource(nil)},
+		// Settings are checked together, even if set in another order
+		{"capacity beyond a later compression", NewBuilder().Capacity(1000).Compression(10)},
+	}
+	for _, input := range inputs {
+		digest, err := input.builder.Build()
+		if err == nil || digest != nil {
+			t.Errorf("%s: expected Build() to fail", input.name)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package tdigest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// compactMagic prefixes every payload produced by AsCompactBytes,
+// telling it apart from the (versioned or not) AsBytes format. It is
+// followed by a version byte.
+var compactMagic = []byte{'t', 'd', 'c'}
+
+const (
+	compactVersion1 byte = 1
+	// compactVersion1 with the exact min and max (float64) of the
+	// digest after the compression
+	compactVersion2 byte = 2
+	// means quantized to compactMantissaBits and varint-encoded
+	// instead of float32 deltas
+	compactVersion3 byte = 3
+
+	compactVersion = compactVersion3
+)
+
+// compactEscape marks a mean stored as a full float64 in place of a
+// float32 delta, in versions 1 and 2 of the format. Deltas are never
+// NaN, so this is unambiguous.
+const compactEscape uint32 = 0x7fc00001
+
+const (
+	// Mantissa bits kept of the distance between a mean and the base
+	// of the payload, see AsCompactBytes
+	compactMantissaBits = 16
+	compactShift        = 52 - compactMantissaBits
+	// Keys at or above this one encode positive distances
+	compactPositive uint64 = 1 << (63 - compactShift)
+)
+
+// AsCompactBytes serializes the digest into a compact byte array.
+//
+// The layout is: the magic header, the compression, min and max
+// (float64), the number of centroids (uvarint), the means and,
+// lastly, the counts (uvarint).
+//
+// Means are stored as their distance to a base, the value of [min,
+// max] closest to zero: zero when the digest spans it, else whichever
+// extreme is closer to it. The distances are rounded to 16 bits of
+// mantissa, a relative error of at most 2^-17 (about 8e-6) that is
+// far below the accuracy of the digest itself, and exact when the
+// distance is an integer below 2^17. They are then mapped to integers
+// that grow with them, and the differences between consecutive ones
+// are varint-encoded, usually in one to three bytes.
+//
+// Payloads are typically 40% smaller than with AsBytes, which already
+// varint-encodes the counts: those take as many bytes as the means
+// here. The size can't shrink much further without losing accuracy.
+// Unlike AsBytes, which turns means beyond the range of a float32 into
+// infinities and loses precision along the digest, every finite
+// digest round-trips. The magic header also lets FromCompactBytes
+// reject payloads in any other format.
+func (t *TDigest) AsCompactBytes() []byte {
+	n := t.summary.Len()
+	b := make([]byte, 0, len(compactMagic)+1+24+binary.MaxVarintLen64*(2*n+1))
+
+	b = append(b, compactMagic...)
+	b = append(b, compactVersion)
+	var tmp [8]byte
+	for _, x := range []float64{t.compression, t.min, t.max} {
+		endianess.PutUint64(tmp[:], math.Float64bits(x))
+		b = append(b, tmp[:]...)
+	}
+	b = appendUvarint(b, uint64(n))
+
+	base := compactBase(t.min, t.max)
+	var previous uint64
+	for _, mean := range t.summary.means {
+		key := compactKey(base, mean)
+		b = appendUvarint(b, key-previous)
+		previous = key
+	}
+
+	for _, count := range t.summary.counts {
+		b = appendUvarint(b, count)
+	}
+	return b
+}
+
+// compactBase returns the value the means of a digest with the given
+// extremes are stored relative to, see AsCompactBytes.
+func compactBase(min, max float64) float64 {
+	switch {
+	case min > 0:
+		return min
+	case max < 0:
+		return max
+	}
+	return 0
+}
+
+// compactKey maps mean, relative to base, to the key that stores it.
+// Keys grow with the means, so sorted means give sorted keys.
+func compactKey(base, mean float64) uint64 {
+	// adding zero turns -0 into 0, which sorts the same
+	bits := math.Float64bits(mean - base + 0)
+	magnitude := bits &^ (1 << 63)
+	negative := bits != magnitude
+
+	key := func(rounded uint64) uint64 {
+		if negative {
+			return compactPositive - 1 - rounded
+		}
+		return compactPositive + rounded
+	}
+
+	k := key((magnitude + 1<<(compactShift-1)) >> compactShift)
+	if !isFinite(compactMean(base, k)) {
+		// Rounding up overflowed, rounding down can't
+		k = key(magnitude >> compactShift)
+	}
+	return k
+}
+
+// compactMean returns the mean stored with the given key.
+func compactMean(base float64, key uint64) float64 {
+	if key >= compactPositive {
+		return base + math.Float64frombits((key-compactPositive)<<compactShift)
+	}
+	return base - math.Float64frombits((compactPositive-1-key)<<compactShift)
+}
+
+// FromCompactBytes deserializes a digest serialized with
+// AsCompactBytes.
+//
+// Like FromBytes, the compression option is ignored since the
+// correct value comes from the buffer. Buffers in any other format,
+// or whose centroids fail the checks of Validate, are rejected.
+func FromCompactBytes(buf []byte, options ...tdigestOption) (*TDigest, error) {
+	if !bytes.HasPrefix(buf, compactMagic) || len(buf) == len(compactMagic) {
+		return nil, errors.New("not a compact tdigest encoding")
+	}
+	version := buf[len(compactMagic)]
+	if version == 0 || version > compactVersion {
+		return nil, fmt.Errorf("unsupported format version: %d", version)
+	}
+	buf = buf[len(compactMagic)+1:]
+
+	header := 8
+	if version >= compactVersion2 {
+		header += 16
+	}
+	if len(buf) < header {
+		return nil, errors.New("buffer too small for deserialization")
+	}
+	compression := math.Float64frombits(endianess.Uint64(buf))
+	min, max := math.NaN(), math.NaN()
+	if version >= compactVersion2 {
+		min = math.Float64frombits(endianess.Uint64(buf[8:]))
+		max = math.Float64frombits(endianess.Uint64(buf[16:]))
+	}
+	buf = buf[header:]
+
+	numCentroids, read := binary.Uvarint(buf)
+	if read < 1 {
+		return nil, errors.New("error decoding varint")
+	}
+	buf = buf[read:]
+
+	if numCentroids > 1<<22 {
+		return nil, errors.New("bad number of centroids in serialization")
+	}
+	n := int(numCentroids)
+
+	t, err := newWithoutSummary(options...)
+	if err != nil {
+		return nil, err
+	}
+	t.compression = compression
+	t.summary = newSummary(n)
+	t.summary.means = t.summary.means[:n]
+	t.summary.counts = t.summary.counts[:n]
+
+	if version >= compactVersion3 {
+		buf, err = t.summary.decodeCompactMeans(buf, compactBase(min, max))
+	} else {
+		buf, err = t.summary.decodeFloat32Means(buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < n; i++ {
+		count, read := binary.Uvarint(buf)
+		if read < 1 {
+			return nil, errors.New("error decoding varint")
+		}
+		buf = buf[read:]
+		t.summary.counts[i] = count
+	}
+
+	if len(buf) != 0 {
+		return nil, errors.New("buffer has unread data")
+	}
+	t.count, err = validateCentroids(t.summary.means, t.summary.counts)
+	if err != nil {
+		return nil, err
+	}
+	t.setExtremes(min, max)
+	return t, nil
+}
+
+// decodeCompactMeans decodes the means of a compactVersion3 payload
+// into the summary, returning the rest of the buffer.
+func (s *summary) decodeCompactMeans(buf []byte, base float64) ([]byte, error) {
+	var key uint64
+	for i := range s.means {
+		delta, read := binary.Uvarint(buf)
+		if read < 1 {
+			return nil, errors.New("error decoding varint")
+		}
+		buf = buf[read:]
+		if delta >= 2*compactPositive-key {
+			return nil, errors.New("bad mean in serialization")
+		}
+		key += delta
+		s.means[i] = compactMean(base, key)
+	}
+	return buf, nil
+}
+
+// decodeFloat32Means decodes the means of a payload in version 1 or
+// 2 of the format into the summary, returning the rest of the buffer.
+func (s *summary) decodeFloat32Means(buf []byte) ([]byte, error) {
+	var x float64
+	for i := range s.means {
+		if len(buf) < 4 {
+			return nil, errors.New("buffer too small for deserialization")
+		}
+		delta := endianess.Uint32(buf)
+		buf = buf[4:]
+
+		if delta == compactEscape {
+			if len(buf) < 8 {
+				return nil, errors.New("buffer too small for deserialization")
+			}
+			x = math.Float64frombits(endianess.Uint64(buf))
+			buf = buf[8:]
+		} else {
+			x += float64(math.Float32frombits(delta))
+		}
+		s.means[i] = x
+	}
+	return buf, nil
+}
+
+// MarshalText implements encoding.TextMarshaler, so that digests can
+// be embedded in text formats such as YAML or TOML, or logged. The
+// text is the AsCompactBytes payload encoded in (standard, padded)
+// base64: about 40 characters, plus 5 per centroid, which is as many
+// as there are samples for small digests.
+func (t TDigest) MarshalText() ([]byte, error) {
+	payload := t.AsCompactBytes()
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(payload)))
+	base64.StdEncoding.Encode(text, payload)
+	return text, nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the
+// output of MarshalText. Any previously collected data is discarded,
+// but the digest keeps its settings, like with UnmarshalJSON. The
+// digest is left untouched on errors.
+func (t *TDigest) UnmarshalText(text []byte) error {
+	payload := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(payload, text)
+	if err != nil {
+		return err
+	}
+	decoded, err := FromCompactBytes(payload[:n])
+	if err != nil {
+		return err
+	}
+
+	err = t.loadCentroids(decoded.compression, decoded.summary.means, decoded.summary.counts)
+	if err != nil {
+		return err
+	}
+	t.min, t.max = decoded.min, decoded.max
+	return nil
+}
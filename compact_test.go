@@ -0,0 +1,252 @@
+package tdigest
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	t1 := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = t1.Add(rand.NormFloat64() * 1000)
+	}
+
+	payload := t1.AsCompactBytes()
+
+	t2, err := FromCompactBytes(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if t1.Count() != t2.Count() || t1.Compression() != t2.Compression() || t1.summary.Len() != t2.summary.Len() {
+		t.Fatalf("Deserialized to something different. t1=%v t2=%v", t1, t2)
+	}
+
+	if t1.Min() != t2.Min() || t1.Max() != t2.Max() {
+		t.Errorf("Extremes changed: %v %v != %v %v", t2.Min(), t2.Max(), t1.Min(), t1.Max())
+	}
+
+	base := compactBase(t1.Min(), t1.Max())
+	for i, mean := range t1.summary.means {
+		if math.Abs(t2.summary.means[i]-mean) > math.Abs(mean-base)/(1<<17) {
+			t.Errorf("Mean %d lost too much precision: %v != %v", i, t2.summary.means[i], mean)
+		}
+		if t2.summary.counts[i] != t1.summary.counts[i] {
+			t.Errorf("Count %d changed: %d != %d", i, t2.summary.counts[i], t1.summary.counts[i])
+		}
+	}
+}
+
+func TestCompactSize(t *testing.T) {
+	r := rand.New(rand.NewSource(0xC0))
+	distributions := []struct {
+		name   string
+		sample func() float64
+	}{
+		{"uniform", r.Float64},
+		{"normal", r.NormFloat64},
+		{"log-normal", func() float64 { return math.Exp(3 * r.NormFloat64()) }},
+		{"timestamps", func() float64 { return 1.6e9 + 86400*r.Float64() }},
+	}
+
+	for _, distribution := range distributions {
+		name, sample := distribution.name, distribution.sample
+		digest := uncheckedNew(LocalRandomNumberGenerator(1))
+		for i := 0; i < 100000; i++ {
+			_ = digest.Add(sample())
+		}
+		_ = digest.ForceCompress()
+
+		payload := digest.AsCompactBytes()
+		binary, _ := digest.AsBytes()
+		if float64(len(payload)) > 0.7*float64(len(binary)) {
+			t.Errorf("%s: expected at most 70%% of the %d bytes of AsBytes, got %d bytes for %d centroids", name, len(binary), len(payload), digest.summary.Len())
+		}
+
+		decoded, err := FromCompactBytes(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Quantiles are interpolated between neighbouring means, each
+		// within 2^-17 of its distance to the base
+		base := compactBase(digest.Min(), digest.Max())
+		for _, q := range []float64{0.001, 0.01, 0.5, 0.99, 0.999} {
+			expected := digest.Quantile(q)
+			lower, upper := digest.Quantile(math.Max(q-0.05, 0)), digest.Quantile(math.Min(q+0.05, 1))
+			if math.Abs(decoded.Quantile(q)-expected) > math.Max(math.Abs(lower-base), math.Abs(upper-base))/(1<<17) {
+				t.Errorf("%s: Quantile(%g) changed: %v != %v", name, q, decoded.Quantile(q), expected)
+			}
+		}
+	}
+}
+
+func TestCompactBeyondFloat32(t *testing.T) {
+	t1 := uncheckedNew()
+	for _, x := range []float64{-1e300, 0, 1e-300, 1, 1e300} {
+		_ = t1.Add(x)
+	}
+
+	t2, err := FromCompactBytes(t1.AsCompactBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, mean := range t1.summary.means {
+		if math.Abs(t2.summary.means[i]-mean) > math.Abs(mean)/(1<<17) {
+			t.Errorf("Expected mean %d to round-trip: %v != %v", i, t2.summary.means[i], mean)
+		}
+	}
+	if t2.summary.means[1] != 0 || t2.summary.means[3] != 1 {
+		t.Errorf("Expected small integers to round-trip exactly, got %v", t2.summary.means)
+	}
+
+	// which AsBytes can't do
+	payload, _ := t1.AsBytes()
+	t3, err := FromBytes(bytes.NewReader(payload))
+	if err == nil && t3.Validate() == nil {
+		t.Errorf("Expected AsBytes to lose means beyond the range of a float32")
+	}
+}
+
+func TestCompactRejectsOtherFormats(t *testing.T) {
+	digest := uncheckedNew()
+	_ = digest.Add(1)
+
+	payload, _ := digest.AsBytes()
+	_, err := FromCompactBytes(payload)
+	if err == nil {
+		t.Errorf("Expected FromCompactBytes to reject the AsBytes format")
+	}
+
+	payload = digest.AsCompactBytes()
+	for i := 0; i < len(payload); i++ {
+		_, err = FromCompactBytes(payload[:i])
+		if err == nil {
+			t.Errorf("Expected truncated payload (%d bytes) to be rejected", i)
+		}
+	}
+
+	_, err = FromCompactBytes(append(payload, 0))
+	if err == nil {
+		t.Errorf("Expected trailing data to be rejected")
+	}
+}
+
+func TestCompactOlderVersions(t *testing.T) {
+	payload := []byte{'t', 'd', 'c', 1,
+		0x40, 0x59, 0, 0, 0, 0, 0, 0, // compression = 100
+		0x02,             // two centroids
+		0x3f, 0x80, 0, 0, // delta = 1
+		0x3f, 0x80, 0, 0, // delta = 1
+		0x01, 0x02, // counts
+	}
+
+	digest, err := FromCompactBytes(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No exact extremes in this version, so the means are used
+	if digest.Count() != 3 || digest.Min() != 1 || digest.Max() != 2 {
+		t.Errorf("Unexpected digest decoded: count=%d min=%v max=%v", digest.Count(), digest.Min(), digest.Max())
+	}
+
+	// Version 2 adds the extremes, and escapes means beyond float32
+	payload = []byte{'t', 'd', 'c', 2,
+		0x40, 0x59, 0, 0, 0, 0, 0, 0, // compression = 100
+		0x3f, 0xf0, 0, 0, 0, 0, 0, 0, // min = 1
+		0x7e, 0x37, 0xe4, 0x3c, 0x88, 0x00, 0x75, 0x9c, // max = 1e300
+		0x02,             // two centroids
+		0x3f, 0x80, 0, 0, // delta = 1
+		0x7f, 0xc0, 0, 0x01, 0x7e, 0x37, 0xe4, 0x3c, 0x88, 0x00, 0x75, 0x9c, // escaped 1e300
+		0x01, 0x02, // counts
+	}
+	digest, err = FromCompactBytes(payload)
+	if err != nil || digest.Count() != 3 || digest.Max() != 1e300 || digest.summary.means[1] != 1e300 {
+		t.Errorf("Unexpected digest decoded: %v (%v)", digest, err)
+	}
+
+	_, err = FromCompactBytes([]byte{'t', 'd', 'c', compactVersion + 1})
+	if err == nil {
+		t.Errorf("Expected an unknown version to be rejected")
+	}
+}
+
+func BenchmarkAsCompactBytes(b *testing.B) {
+	b.ReportAllocs()
+
+	t1, _ := New(Compression(100))
+	for i := 0; i < 100; i++ {
+		t1.Add(rand.Float64())
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		t1.AsCompactBytes()
+	}
+}
+
+func TestTextMarshaler(t *testing.T) {
+	var _ encoding.TextMarshaler = TDigest{}
+	var _ encoding.TextUnmarshaler = &TDigest{}
+
+	r := rand.New(rand.NewSource(0x7E37))
+	digest := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = digest.Add(r.ExpFloat64())
+	}
+
+	text, err := digest.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TDigest
+	if err := decoded.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Count() != digest.Count() || decoded.Compression() != digest.Compression() || decoded.Min() != digest.Min() || decoded.Max() != digest.Max() {
+		t.Fatalf("Decoded to something different: %v != %v", &decoded, digest)
+	}
+	for _, q := range []float64{0.001, 0.01, 0.25, 0.5, 0.75, 0.99, 0.999} {
+		if math.Abs(decoded.Quantile(q)-digest.Quantile(q)) > 1e-5*digest.Quantile(q) {
+			t.Errorf("Quantile(%f) changed: %v != %v", q, decoded.Quantile(q), digest.Quantile(q))
+		}
+	}
+
+	// Previous samples are discarded, settings are kept
+	piecewise := uncheckedNew(QuantileInterpolation(PiecewiseInterpolation))
+	_ = piecewise.Add(-42)
+	if err := piecewise.UnmarshalText(text); err != nil || piecewise.Count() != digest.Count() || piecewise.interpolation != PiecewiseInterpolation {
+		t.Errorf("Expected the samples to be replaced and the settings kept, got %d samples (%v)", piecewise.Count(), err)
+	}
+
+	// Small digests make for short lines
+	small := uncheckedNew()
+	for i := 0; i < 20; i++ {
+		_ = small.Add(float64(i))
+	}
+	if text, _ := small.MarshalText(); len(text) > 40+6*20 {
+		t.Errorf("Expected a short text for 20 samples, got %d characters: %s", len(text), text)
+	}
+
+	empty := uncheckedNew()
+	text, _ = empty.MarshalText()
+	if err := decoded.UnmarshalText(text); err != nil || decoded.Count() != 0 || !math.IsNaN(decoded.Quantile(0.5)) {
+		t.Errorf("Expected an empty digest, got %d samples (%v)", decoded.Count(), err)
+	}
+
+	before, _ := digest.AsBytes()
+	for _, input := range []string{"not base64!", base64.StdEncoding.EncodeToString(compactMagic)} {
+		if err := digest.UnmarshalText([]byte(input)); err == nil {
+			t.Errorf("Expected %q to be rejected", input)
+		}
+	}
+	if after, _ := digest.AsBytes(); !bytes.Equal(before, after) {
+		t.Errorf("Expected the digest to be left untouched on errors")
+	}
+}
@@ -0,0 +1,100 @@
+package tdigest
+
+import "sync"
+
+// Concurrent is a digest that is safe for concurrent use by multiple
+// goroutines.
+//
+// Writes (Add, AddWeighted, Merge) are serialized, while reads
+// (Quantile, CDF, Count) only take a read lock, so concurrent queries
+// don't block each other. Writes also rebuild the digest's cumulative
+// counts before releasing the lock, so that queries in between don't
+// have to sum the counts.
+type Concurrent struct {
+	mu     sync.RWMutex
+	digest *TDigest
+}
+
+// NewConcurrent creates a new concurrency-safe digest, see New.
+func NewConcurrent(options ...tdigestOption) (*Concurrent, error) {
+	digest, err := New(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &Concurrent{digest: digest}, nil
+}
+
+// Add is an alias for AddWeighted(x,1), see TDigest.Add.
+func (c *Concurrent) Add(value float64) error {
+	return c.AddWeighted(value, 1)
+}
+
+// AddWeighted registers a new sample in the digest, see
+// TDigest.AddWeighted.
+func (c *Concurrent) AddWeighted(value float64, count uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.digest.summary.cachePrefixSums()
+	return c.digest.AddWeighted(value, count)
+}
+
+// Merge joins a given digest into itself, see TDigest.Merge. The
+// other digest must not be modified concurrently.
+func (c *Concurrent) Merge(other *TDigest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.digest.summary.cachePrefixSums()
+	return c.digest.Merge(other)
+}
+
+// Quantile returns the desired percentile estimation, see
+// TDigest.Quantile.
+func (c *Concurrent) Quantile(q float64) float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.digest.Quantile(q)
+}
+
+// CDF computes the fraction in which all samples are less than or
+// equal to the given value, see TDigest.CDF.
+func (c *Concurrent) CDF(value float64) float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.digest.CDF(value)
+}
+
+// ExportCentroids returns copies of the means and counts of the
+// centroids, see TDigest.ExportCentroids. They are copied under the
+// read lock, so they always come from the same state of the digest.
+func (c *Concurrent) ExportCentroids() (means []float64, counts []uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.digest.ExportCentroids()
+}
+
+// Count returns the total number of samples this digest represents,
+// see TDigest.Count.
+func (c *Concurrent) Count() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.digest.Count()
+}
+
+// Snapshot returns a copy of the digest as it is now, which can be
+// queried without any locking while this one keeps ingesting samples.
+//
+// The snapshot is a point-in-time copy: it doesn't see samples added
+// afterwards, so callers wanting fresh estimates must take a new one.
+// Taking it only holds the read lock while the centroids are copied,
+// which is cheap (two slices of at most the compression times the
+// buffer factor elements, see BufferFactor, and usually far fewer),
+// making it viable to take one per query.
+//
+// The snapshot must be treated as read-only: it shares its random
+// number generator with this digest, so adding samples to it or
+// merging it would race with concurrent writers.
+func (c *Concurrent) Snapshot() *TDigest {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.digest.Clone()
+}
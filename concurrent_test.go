@@ -0,0 +1,163 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestConcurrent(t *testing.T) {
+	digest, err := NewConcurrent(Compression(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, readers, samples = 8, 8, 5000
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for j := 0; j < samples; j++ {
+				if err := digest.Add(r.Float64()); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(int64(i))
+	}
+
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < samples/10; j++ {
+				// The merged samples at 2 may come before most others
+				if q := digest.Quantile(0.5); !math.IsNaN(q) && (q < 0 || q > 2) {
+					t.Errorf("Unexpected median %f", q)
+					return
+				}
+				_ = digest.CDF(0.5)
+			}
+		}()
+	}
+
+	other := uncheckedNew()
+	_ = other.AddWeighted(2, 1000)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := digest.Merge(other); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	wg.Wait()
+
+	if digest.Count() != writers*samples+1000 {
+		t.Errorf("Expected %d samples, got %d", writers*samples+1000, digest.Count())
+	}
+
+	if math.Abs(digest.CDF(1)-float64(writers*samples)/float64(digest.Count())) > 0.01 {
+		t.Errorf("Unexpected CDF(1): %f", digest.CDF(1))
+	}
+}
+
+func TestConcurrentWritesWarmCaches(t *testing.T) {
+	digest, _ := NewConcurrent()
+	other := uncheckedNew()
+	_ = other.AddWeighted(2, 10)
+
+	// Queries never have to write to the digest, they only take the
+	// read lock
+	writes := []func() error{
+		func() error { return digest.Add(1) },
+		func() error { return digest.AddWeighted(3, 5) },
+		func() error { return digest.Merge(other) },
+	}
+	for i, write := range writes {
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+		if !digest.digest.summary.cached {
+			t.Errorf("Expected write %d to cache the cumulative counts", i)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	digest, _ := NewConcurrent()
+	for i := 0; i < 1000; i++ {
+		_ = digest.Add(float64(i))
+	}
+
+	snapshot := digest.Snapshot()
+	median := snapshot.Quantile(0.5)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			_ = digest.Add(1e6)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if snapshot.Quantile(0.5) != median || snapshot.Count() != 1000 {
+				t.Errorf("Expected the snapshot to be unaffected by later samples")
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	if digest.Count() != 11000 || digest.Snapshot().Count() != 11000 {
+		t.Errorf("Expected a new snapshot to see the new samples")
+	}
+}
+
+func TestConcurrentExportCentroids(t *testing.T) {
+	digest, _ := NewConcurrent(Compression(20))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100000; i++ {
+			_ = digest.Add(float64(i % 1000))
+		}
+	}()
+
+	// Every export is a consistent state of the digest, even while it
+	// is written to (run with -race)
+	for i := 0; i < 100; i++ {
+		means, counts := digest.ExportCentroids()
+		if _, err := NewFromCentroids(means, counts, 20); err != nil {
+			t.Fatalf("Expected a consistent export, got %s", err)
+		}
+		for j := 1; j < len(means); j++ {
+			if means[j] < means[j-1] {
+				t.Fatalf("Expected sorted means, got %f after %f", means[j], means[j-1])
+			}
+		}
+	}
+	wg.Wait()
+
+	means, counts := digest.ExportCentroids()
+	restored, err := NewFromCentroids(means, counts, 20)
+	if err != nil || restored.Count() != digest.Count() {
+		t.Errorf("Expected all %d samples to be exported, got %d (%v)", digest.Count(), restored.Count(), err)
+	}
+}
+
+func TestNewConcurrentInvalidOptions(t *testing.T) {
+	digest, err := NewConcurrent(Compression(0))
+	if err == nil || digest != nil {
+		t.Errorf("Expected an error for a bad compression")
+	}
+}
@@ -0,0 +1,88 @@
+package tdigest
+
+import (
+	"context"
+	"fmt"
+)
+
+// contextBatchSize is how many samples AddBatchContext adds between
+// checks of its context.
+const contextBatchSize = 1 << 16
+
+// AddBatchContext works as AddBatch, but adds the samples in batches
+// of 65536, checking the context before each of them.
+//
+// Once the context is done, this returns its error right away: the
+// digest is then valid but only holds the samples of the batches that
+// were added. Invalid samples or an overflowing count are still
+// reported before adding anything.
+func (t *TDigest) AddBatchContext(ctx context.Context, values []float64) error {
+	for _, value := range values {
+		if !isFinite(value) {
+			return fmt.Errorf("illegal datapoint <value: %.4f, count: 1>", value)
+		}
+	}
+	err := checkCountOverflow(t.count, uint64(len(values)))
+	if err != nil {
+		return err
+	}
+
+	for len(values) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := len(values)
+		if n > contextBatchSize {
+			n = contextBatchSize
+		}
+		err = t.AddBatch(values[:n])
+		if err != nil {
+			return err
+		}
+		values = values[n:]
+	}
+	return nil
+}
+
+// MergeAllContext works as MergeAll, but checks the context before
+// merging each digest.
+//
+// Once the context is done, this returns its error right away, along
+// with the digest built so far: it is valid but only holds the digests
+// that were merged (and may not be compressed again, see MergeMany).
+// An overflowing count is still reported before merging anything.
+func MergeAllContext(ctx context.Context, digests []*TDigest, options ...tdigestOption) (*TDigest, error) {
+	t, err := New(options...)
+	if err != nil {
+		return nil, err
+	}
+	err = checkTotalCount(0, digests)
+	if err != nil {
+		return nil, err
+	}
+
+	recompress := false
+	for _, other := range digests {
+		if err := ctx.Err(); err != nil {
+			return t, err
+		}
+		if other == nil {
+			continue
+		}
+		err = t.merge(other)
+		if err != nil {
+			return nil, err
+		}
+		t.updateExtremes(other.min, other.max)
+		recompress = recompress || (other.summary.Len() > 0 && other.compression != t.compression)
+	}
+
+	if recompress {
+		err = t.Compress()
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.summary.cachePrefixSums()
+	return t, nil
+}
@@ -0,0 +1,102 @@
+package tdigest
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// countdownContext is canceled once its error was checked a given
+// number of times.
+type countdownContext struct {
+	context.Context
+	checks int
+}
+
+func (c *countdownContext) Err() error {
+	if c.checks == 0 {
+		return context.Canceled
+	}
+	c.checks--
+	return nil
+}
+
+func TestAddBatchContext(t *testing.T) {
+	data := make([]float64, 5*contextBatchSize+10)
+	for i := range data {
+		data[i] = rand.Float64()
+	}
+
+	td := uncheckedNew()
+	if err := td.AddBatchContext(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	if td.Count() != uint64(len(data)) {
+		t.Errorf("Expected %d samples, got %d", len(data), td.Count())
+	}
+	assertDifferenceSmallerThan(td, 0.5, 0.02, t)
+	assertDifferenceSmallerThan(td, 0.99, 0.005, t)
+
+	// Canceled after three batches
+	td = uncheckedNew()
+	err := td.AddBatchContext(&countdownContext{Context: context.Background(), checks: 3}, data)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the context error, got %v", err)
+	}
+	if td.Count() != 3*contextBatchSize {
+		t.Errorf("Expected %d samples, got %d", 3*contextBatchSize, td.Count())
+	}
+	if err := td.Validate(); err != nil {
+		t.Errorf("Expected a valid digest, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	td = uncheckedNew()
+	if err := td.AddBatchContext(ctx, data); !errors.Is(err, context.Canceled) || td.Count() != 0 {
+		t.Errorf("Expected nothing to be added with a done context, got %d samples (%v)", td.Count(), err)
+	}
+
+	// Invalid samples are rejected upfront
+	data[len(data)-1] = math.NaN()
+	if err := td.AddBatchContext(context.Background(), data); err == nil || td.Count() != 0 {
+		t.Errorf("Expected a batch containing NaN to be rejected as a whole")
+	}
+}
+
+func TestMergeAllContext(t *testing.T) {
+	partials, _ := buildPartials(100, 1000, 0xC7C)
+	partials[3] = nil
+
+	merged, err := MergeAllContext(context.Background(), partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := MergeAll(partials)
+	if merged.Count() != expected.Count() || merged.Quantile(0.5) != expected.Quantile(0.5) {
+		t.Errorf("Expected the same digest as MergeAll")
+	}
+
+	// Canceled after ten digests, one of them nil
+	merged, err = MergeAllContext(&countdownContext{Context: context.Background(), checks: 10}, partials)
+	if !errors.Is(err, context.Canceled) || merged == nil {
+		t.Fatalf("Expected the context error and a partial digest, got %v", err)
+	}
+	if merged.Count() != 9000 {
+		t.Errorf("Expected 9000 samples, got %d", merged.Count())
+	}
+	if err := merged.Validate(); err != nil {
+		t.Errorf("Expected a valid digest, got %v", err)
+	}
+
+	huge := uncheckedNew()
+	_ = huge.AddWeighted(0, math.MaxUint64-10)
+	if _, err := MergeAllContext(context.Background(), append(partials, huge)); err == nil || errors.Is(err, context.Canceled) {
+		t.Errorf("Expected MergeAllContext to check for overflows, got %v", err)
+	}
+	if _, err := MergeAllContext(context.Background(), partials, Compression(0)); err == nil {
+		t.Errorf("Expected invalid options to be rejected")
+	}
+}
@@ -0,0 +1,43 @@
+package tdigest
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+// WriteCSV writes the centroids of the digest to w as CSV, one row
+// per centroid in ascending order of mean, preceded by a header row:
+//
+//	mean,count,cumulative_count
+//
+// Like the summary's HeadSum, cumulative_count is the sum of the
+// counts of all centroids *before* the row's centroid, so it starts
+// at zero. Means are formatted with the minimal number of digits
+// that represents them exactly.
+func (t *TDigest) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+
+	err := writer.Write([]string{"mean", "count", "cumulative_count"})
+	if err != nil {
+		return err
+	}
+
+	var cumulative uint64
+	row := make([]string, 3)
+	t.ForEachCentroid(func(mean float64, count uint64) bool {
+		row[0] = strconv.FormatFloat(mean, 'g', -1, 64)
+		row[1] = strconv.FormatUint(count, 10)
+		row[2] = strconv.FormatUint(cumulative, 10)
+		cumulative += count
+
+		err = writer.Write(row)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,75 @@
+package tdigest
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestWriteCSV(t *testing.T) {
+	digest := uncheckedNew()
+	_ = digest.AddWeighted(0.5, 1)
+	_ = digest.AddWeighted(1, 2)
+	_ = digest.AddWeighted(2.25, 3)
+
+	var buf bytes.Buffer
+	err := digest.WriteCSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "mean,count,cumulative_count\n0.5,1,0\n1,2,1\n2.25,3,3\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected CSV output:\n%s", buf.String())
+	}
+}
+
+func TestWriteCSVMatchesCentroids(t *testing.T) {
+	digest := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = digest.Add(rand.NormFloat64())
+	}
+
+	var buf bytes.Buffer
+	err := digest.WriteCSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != digest.summary.Len()+1 {
+		t.Fatalf("Expected %d rows, got %d", digest.summary.Len()+1, len(records))
+	}
+
+	for i, record := range records[1:] {
+		mean, _ := strconv.ParseFloat(record[0], 64)
+		count, _ := strconv.ParseUint(record[1], 10, 64)
+		cumulative, _ := strconv.ParseFloat(record[2], 64)
+
+		if mean != digest.summary.Mean(i) || count != digest.summary.Count(i) || cumulative != digest.summary.HeadSum(i) {
+			t.Fatalf("Row %d doesn't match its centroid: %v", i, record)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWriteCSVError(t *testing.T) {
+	digest := uncheckedNew()
+	_ = digest.Add(1)
+
+	if digest.WriteCSV(failingWriter{}) == nil {
+		t.Errorf("Expected WriteCSV to report write errors")
+	}
+}
@@ -0,0 +1,178 @@
+package tdigest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// Weight of a sample added at the digest's reference time. Older
+	// centroids are scaled down relative to it, so it sets how finely
+	// decayed counts are represented.
+	decayResolution = 1 << 16
+	// Scale at which the decay is folded into the centroid counts
+	decayRescaleThreshold = 1 << 40
+	// Total count at which the decay is folded in whatever the scale,
+	// since samples coming fast enough overflow the count first
+	decayCountThreshold = 1 << 62
+)
+
+// DecayingTDigest is a digest in which samples lose weight as they
+// age, so that estimates track the recent distribution: a sample
+// counts half as much as one added a half-life later.
+//
+// Decaying every centroid on each addition would be costly, so the
+// digest does the equivalent in reverse: new samples are given an
+// exponentially growing weight, registered as a count in units of
+// 1/65536 of a sample added at the latest time, and the accumulated
+// growth is folded into the existing counts, which get
+// multiplied by the decay factor, once it or the total count becomes
+// large. Quantiles and CDFs only depend on the relative weights, so
+// they are exact at all times.
+//
+// Like TDigest, it is not safe for concurrent use.
+type DecayingTDigest struct {
+	digest   *TDigest
+	halfLife time.Duration
+	// weight of a sample added at time last
+	weight float64
+	last   time.Time
+	// weight not registered in any centroid yet, see WeightedTDigest
+	residual float64
+}
+
+// NewDecaying creates a digest whose samples lose half their weight
+// every halfLife, with the given options (see New).
+func NewDecaying(halfLife time.Duration, options ...tdigestOption) (*DecayingTDigest, error) {
+	if halfLife <= 0 {
+		return nil, errors.New("half-life should be positive")
+	}
+
+	digest, err := New(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &DecayingTDigest{
+		digest:   digest,
+		halfLife: halfLife,
+		weight:   decayResolution,
+	}, nil
+}
+
+// Add registers a new sample observed now, see AddAt.
+func (d *DecayingTDigest) Add(value float64) error {
+	return d.AddAt(value, time.Now())
+}
+
+// AddAt registers a new sample observed at the given time, decaying
+// the samples added before it.
+//
+// Samples may be added out of order: one older than the latest
+// addition is registered with its weight at that time.
+func (d *DecayingTDigest) AddAt(value float64, at time.Time) error {
+	if !isFinite(value) {
+		return fmt.Errorf("illegal datapoint <value: %.4f>", value)
+	}
+	if d.last.IsZero() {
+		d.last = at
+	}
+
+	weight := d.weight * math.Exp2(float64(at.Sub(d.last))/float64(d.halfLife))
+	if at.After(d.last) {
+		d.weight, d.last = weight, at
+	}
+	if d.weight > decayRescaleThreshold || float64(d.digest.Count())+d.weight > decayCountThreshold {
+		weight = d.rescale(weight)
+	}
+
+	exact := weight + d.residual
+	count := math.Round(exact)
+	if count <= 0 {
+		// too old to register on its own
+		d.residual = exact
+		return nil
+	}
+	err := d.digest.AddWeighted(value, uint64(count))
+	if err != nil {
+		return err
+	}
+	d.residual = exact - count
+	return nil
+}
+
+// rescale folds the growth of the weights into the centroid counts,
+// bringing the weight of a sample added at the latest time back to
+// decayResolution, or lower if the counts would still be too large,
+// and returns the given weight rescaled alike.
+func (d *DecayingTDigest) rescale(weight float64) float64 {
+	target := float64(decayResolution)
+	if count := float64(d.digest.Count()) / d.weight * target; count > decayCountThreshold/2 {
+		target *= decayCountThreshold / 2 / count
+	}
+
+	factor := target / d.weight
+	d.residual = d.residual*factor + d.digest.scaleCounts(factor)
+	if weight == d.weight {
+		// may be infinite after a long pause
+		weight = target
+	} else {
+		weight *= factor
+	}
+	d.weight = target
+	return weight
+}
+
+// Quantile returns the desired percentile estimation of the decayed
+// distribution, see TDigest.Quantile.
+func (d *DecayingTDigest) Quantile(q float64) float64 {
+	return d.digest.Quantile(q)
+}
+
+// CDF computes the (decayed) fraction of samples less than or equal
+// to the given value, see TDigest.CDF.
+func (d *DecayingTDigest) CDF(value float64) float64 {
+	return d.digest.CDF(value)
+}
+
+// Count returns the decayed number of samples as of the latest
+// addition: a sample added at that time counts as one, one added a
+// half-life earlier as 0.5, and so on.
+func (d *DecayingTDigest) Count() float64 {
+	return (float64(d.digest.Count()) + d.residual) / d.weight
+}
+
+// HalfLife returns the time it takes for samples to lose half their
+// weight.
+func (d *DecayingTDigest) HalfLife() time.Duration {
+	return d.halfLife
+}
+
+// scaleCounts multiplies every centroid count by factor (at most 1),
+// rounding them like MergeScaled does, and returns the scaled mass
+// lost to the rounding. Centroids whose count drops to zero are
+// removed. Min() and Max() are left untouched unless the digest
+// becomes empty.
+func (t *TDigest) scaleCounts(factor float64) float64 {
+	s := t.summary
+	means, counts := s.means[:0], s.counts[:0]
+	var sum, previous float64
+	for i, mean := range s.means {
+		sum += float64(s.counts[i]) * factor
+		rounded := math.Round(sum)
+		if rounded > previous {
+			means = append(means, mean)
+			counts = append(counts, uint64(rounded-previous))
+		}
+		previous = rounded
+	}
+	s.means, s.counts = means, counts
+	s.invalidate()
+	t.count = uint64(previous)
+
+	if t.count == 0 {
+		t.resetExtremes()
+	}
+	return sum - previous
+}
@@ -0,0 +1,169 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestDecayingNewerValuesDominate(t *testing.T) {
+	r := rand.New(rand.NewSource(0xDECA))
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	digest, err := NewDecaying(time.Minute, LocalRandomNumberGenerator(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A burst of old values...
+	for i := 0; i < 10000; i++ {
+		_ = digest.AddAt(100+r.Float64(), start)
+	}
+	if digest.Quantile(0.5) < 100 {
+		t.Fatalf("Expected the burst to make up the whole digest, got median %f", digest.Quantile(0.5))
+	}
+
+	// ...followed by a steady trickle of new ones, a second apart
+	var share float64
+	for i := 1; i <= 3600; i++ {
+		_ = digest.AddAt(r.Float64(), start.Add(time.Duration(i)*time.Second))
+
+		if i%600 == 0 {
+			newShare := 1 - digest.CDF(50)
+			if newShare > share && share != 0 {
+				t.Errorf("Expected the burst to keep losing weight, went from %f to %f after %ds", share, newShare, i)
+			}
+			share = newShare
+		}
+	}
+
+	// After an hour (60 half-lives), the burst is long forgotten
+	if digest.CDF(1) != 1 || digest.Quantile(0.99) > 1 {
+		t.Errorf("Expected the burst to be forgotten, got CDF(1)=%f and Quantile(0.99)=%f", digest.CDF(1), digest.Quantile(0.99))
+	}
+
+	// A sample per second with a one minute half-life adds up to
+	// 1/(1-2^(-1/60)) ~ 87 samples
+	expected := 1 / (1 - math.Exp2(-1.0/60))
+	if math.Abs(digest.Count()-expected) > 0.01*expected {
+		t.Errorf("Expected a decayed count around %f, got %f", expected, digest.Count())
+	}
+}
+
+func TestDecayingCount(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	digest, _ := NewDecaying(time.Hour)
+
+	for i := 0; i < 1000; i++ {
+		_ = digest.AddAt(1, start)
+	}
+	if digest.Count() != 1000 {
+		t.Errorf("Expected a count of 1000, got %f", digest.Count())
+	}
+
+	_ = digest.AddAt(2, start.Add(time.Hour))
+	if math.Abs(digest.Count()-501) > 1e-3 {
+		t.Errorf("Expected the old samples to count half, got a count of %f", digest.Count())
+	}
+
+	// Out of order samples have the weight they had back then
+	_ = digest.AddAt(3, start.Add(-time.Hour))
+	if math.Abs(digest.Count()-501.25) > 1e-3 {
+		t.Errorf("Expected the late sample to count a quarter, got a count of %f", digest.Count())
+	}
+
+	// Way too old to register anything
+	if digest.AddAt(4, start.Add(-2000*time.Hour)) != nil || math.Abs(digest.Count()-501.25) > 1e-3 {
+		t.Errorf("Expected an ancient sample to be ignored, got a count of %f", digest.Count())
+	}
+
+	// Samples too old to register on their own still add up
+	for i := 0; i < 1000; i++ {
+		_ = digest.AddAt(5, start.Add(-20*time.Hour))
+	}
+	if expected := 501.25 + 1000*math.Exp2(-21); math.Abs(digest.Count()-expected) > 1e-9 {
+		t.Errorf("Expected old samples to add %f to the count, got a count of %f", 1000*math.Exp2(-21), digest.Count())
+	}
+
+	if digest.AddAt(math.NaN(), start) == nil {
+		t.Errorf("Expected NaN to be rejected")
+	}
+}
+
+func TestDecayingRescale(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	digest, _ := NewDecaying(time.Second, LocalRandomNumberGenerator(1))
+
+	// Many half-lives go by, the weights must be folded back into
+	// the counts rather than overflow
+	for i := 0; i < 10000; i++ {
+		err := digest.AddAt(float64(i%10), start.Add(time.Duration(i)*time.Second/10))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Ten samples per half-life add up to 1/(1-2^(-1/10)) ~ 14.9
+	expected := 1 / (1 - math.Exp2(-1.0/10))
+	if math.Abs(digest.Count()-expected) > 0.01*expected {
+		t.Errorf("Expected a decayed count around %f, got %f", expected, digest.Count())
+	}
+	if digest.weight > decayRescaleThreshold || digest.digest.Count() > 1<<50 {
+		t.Errorf("Expected the counts to have been rescaled, got weight %f and count %d", digest.weight, digest.digest.Count())
+	}
+
+	// After a long pause the older samples vanish altogether
+	_ = digest.AddAt(42, start.Add(1000*time.Hour))
+	if digest.digest.summary.Len() != 1 || digest.Count() != 1 || digest.Quantile(0) != 42 {
+		t.Errorf("Expected only the latest sample to remain, got %d centroids and a count of %f", digest.digest.summary.Len(), digest.Count())
+	}
+}
+
+func TestDecayingHighRate(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	digest, _ := NewDecaying(20*time.Millisecond, LocalRandomNumberGenerator(1))
+
+	// The state after a sample per nanosecond for a few half-lives:
+	// the counts are close to overflowing while the weights are still
+	// below decayRescaleThreshold. Adding those samples one by one
+	// would take too long
+	digest.weight, digest.last = 1<<39, start
+	for i := 0; i < 1000; i++ {
+		_ = digest.digest.AddWeighted(float64(i), (math.MaxUint64-1<<50)/1000)
+	}
+	history := digest.Count()
+
+	expected := history * math.Exp2(-float64(9999*time.Microsecond)/float64(20*time.Millisecond))
+	for i := 0; i < 10000; i++ {
+		at := time.Duration(i) * time.Microsecond
+		err := digest.AddAt(float64(i%1000), start.Add(at))
+		if err != nil {
+			t.Fatalf("Unexpected error after %d samples: %s", i, err)
+		}
+		expected += math.Exp2(-float64(9999*time.Microsecond-at) / float64(20*time.Millisecond))
+	}
+	if digest.digest.Count() > decayCountThreshold {
+		t.Errorf("Expected the counts to have been rescaled, got a count of %d", digest.digest.Count())
+	}
+	if math.Abs(digest.Count()-expected) > 0.001*expected {
+		t.Errorf("Expected a decayed count around %f, got %f", expected, digest.Count())
+	}
+	if math.Abs(digest.Quantile(0.5)-500) > 10 {
+		t.Errorf("Expected a median around 500, got %f", digest.Quantile(0.5))
+	}
+}
+
+func TestNewDecaying(t *testing.T) {
+	if _, err := NewDecaying(0); err == nil {
+		t.Errorf("Expected a zero half-life to be rejected")
+	}
+	if _, err := NewDecaying(time.Second, Compression(-1)); err == nil {
+		t.Errorf("Expected invalid options to be rejected")
+	}
+
+	digest, err := NewDecaying(time.Second)
+	if err != nil || digest.HalfLife() != time.Second || digest.Count() != 0 {
+		t.Errorf("Unexpected digest: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package tdigest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// Scales allowed by OpenTelemetry
+	minExponentialScale = -10
+	maxExponentialScale = 20
+
+	// Upper bound on the buckets of either range of an exponential
+	// histogram, to keep high scales over wide ranges from exhausting
+	// memory
+	maxExponentialBuckets = 1 << 16
+)
+
+// ExponentialHistogram is a histogram with exponentially growing
+// buckets, laid out like OpenTelemetry (OTLP) exponential histogram
+// data points so it can be copied into one field by field.
+//
+// Positive values fall into the buckets of Positive: bucket i covers
+// (base^i, base^(i+1)] where base = 2^(2^-Scale). Negative values go
+// to the buckets of Negative by their absolute value, and zeros are
+// counted by ZeroCount.
+type ExponentialHistogram struct {
+	Scale     int32
+	Count     uint64
+	Sum       float64
+	Min       float64
+	Max       float64
+	ZeroCount uint64
+	Positive  ExponentialBuckets
+	Negative  ExponentialBuckets
+}
+
+// ExponentialBuckets is a range of consecutive exponential histogram
+// buckets: BucketCounts[i] is the count of bucket Offset+i.
+type ExponentialBuckets struct {
+	Offset       int32
+	BucketCounts []uint64
+}
+
+// ToExponentialHistogram converts the digest into an exponential
+// histogram with the given scale, between -10 and 20 as OpenTelemetry
+// requires.
+//
+// Centroids don't keep track of how their samples are spread, so the
+// whole count of each centroid goes into the bucket of its mean. The
+// higher the scale, the narrower the buckets (each is about
+// 2^(2^-scale)-1 wide, relative to its bounds), which makes the
+// conversion more accurate but needs more buckets to cover the range
+// of the digest: an error is returned if either range would need more
+// than 65536 buckets.
+//
+// Count, Sum, Min and Max are those of the digest, see Sum(). Min and
+// Max are NaN for an empty digest.
+func (t *TDigest) ToExponentialHistogram(scale int) (*ExponentialHistogram, error) {
+	if scale < minExponentialScale || scale > maxExponentialScale {
+		return nil, fmt.Errorf("scale must be between %d and %d, got %d", minExponentialScale, maxExponentialScale, scale)
+	}
+
+	h := &ExponentialHistogram{
+		Scale: int32(scale),
+		Count: t.count,
+		Sum:   t.Sum(),
+		Min:   t.Min(),
+		Max:   t.Max(),
+	}
+
+	// Means are sorted: negative ones come first, with decreasing
+	// absolute values, and the positive ones follow
+	var negative, positive []int
+	for i, mean := range t.summary.means {
+		if math.IsInf(mean, 0) {
+			return nil, errors.New("infinite values can't be mapped to exponential buckets")
+		}
+		switch {
+		case mean < 0:
+			negative = append(negative, i)
+		case mean > 0:
+			positive = append(positive, i)
+		default:
+			h.ZeroCount += t.summary.counts[i]
+		}
+	}
+
+	var err error
+	h.Negative, err = t.exponentialBuckets(negative, scale)
+	if err != nil {
+		return nil, err
+	}
+	h.Positive, err = t.exponentialBuckets(positive, scale)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// exponentialBuckets distributes the centroids at the given indices,
+// all of the same sign, into buckets by their absolute mean.
+func (t *TDigest) exponentialBuckets(centroids []int, scale int) (ExponentialBuckets, error) {
+	if len(centroids) == 0 {
+		return ExponentialBuckets{}, nil
+	}
+
+	first := exponentialIndex(math.Abs(t.summary.Mean(centroids[0])), scale)
+	last := exponentialIndex(math.Abs(t.summary.Mean(centroids[len(centroids)-1])), scale)
+	if first > last {
+		first, last = last, first
+	}
+	if last-first >= maxExponentialBuckets {
+		return ExponentialBuckets{}, fmt.Errorf("too many buckets at scale %d, use a lower one", scale)
+	}
+
+	buckets := ExponentialBuckets{
+		Offset:       int32(first),
+		BucketCounts: make([]uint64, last-first+1),
+	}
+	for _, i := range centroids {
+		buckets.BucketCounts[exponentialIndex(math.Abs(t.summary.Mean(i)), scale)-first] += t.summary.Count(i)
+	}
+	return buckets, nil
+}
+
+// exponentialIndex returns the index of the bucket holding the
+// (positive, finite) value v at the given scale, i.e. ceil(log_b(v))-1
+// with b = 2^(2^-scale).
+func exponentialIndex(v float64, scale int) int {
+	// v = frac·2^exp, with frac in [0.5, 1)
+	frac, exp := math.Frexp(v)
+	if scale <= 0 {
+		// Base 2 buckets are just the exponent, merged 2^-scale at
+		// a time. Exact powers of two are the upper bound of theirs.
+		if frac == 0.5 {
+			exp--
+		}
+		return (exp - 1) >> -scale
+	}
+
+	if frac == 0.5 {
+		// Logarithms may be off by one here
+		return (exp-1)<<scale - 1
+	}
+	return int(math.Ceil(math.Log2(v)*math.Ldexp(1, scale))) - 1
+}
@@ -0,0 +1,150 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// exponentialQuantile estimates the q quantile of an exponential
+// histogram, as the geometric middle of the bucket holding it.
+func exponentialQuantile(h *ExponentialHistogram, q float64) float64 {
+	base := math.Exp2(math.Exp2(-float64(h.Scale)))
+	rank := uint64(math.Ceil(q * float64(h.Count)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i := len(h.Negative.BucketCounts) - 1; i >= 0; i-- {
+		seen += h.Negative.BucketCounts[i]
+		if seen >= rank {
+			return -math.Pow(base, float64(int(h.Negative.Offset)+i)+0.5)
+		}
+	}
+	seen += h.ZeroCount
+	if seen >= rank {
+		return 0
+	}
+	for i, count := range h.Positive.BucketCounts {
+		seen += count
+		if seen >= rank {
+			return math.Pow(base, float64(int(h.Positive.Offset)+i)+0.5)
+		}
+	}
+	return math.NaN()
+}
+
+func TestToExponentialHistogram(t *testing.T) {
+	td := uncheckedNew()
+	for i := 0; i < 100000; i++ {
+		_ = td.Add(math.Exp(rand.NormFloat64()))
+	}
+
+	for _, scale := range []int{-2, 0, 3, 8} {
+		h, err := td.ToExponentialHistogram(scale)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var total uint64
+		for _, count := range h.Positive.BucketCounts {
+			total += count
+		}
+		if total != td.Count() || h.Count != td.Count() || h.ZeroCount != 0 || len(h.Negative.BucketCounts) != 0 {
+			t.Errorf("scale=%d: expected all %d samples in positive buckets, got %d", scale, td.Count(), total)
+		}
+		if h.Min != td.Min() || h.Max != td.Max() || h.Sum != td.Sum() || h.Scale != int32(scale) {
+			t.Errorf("scale=%d: unexpected summary fields %+v", scale, h)
+		}
+
+		// Half a bucket, relative
+		tolerance := math.Exp2(math.Exp2(-float64(scale))/2) - 1
+		for _, q := range []float64{0.5, 0.99} {
+			expected, got := td.Quantile(q), exponentialQuantile(h, q)
+			if math.Abs(got-expected) > tolerance*expected*1.01+0.01*expected {
+				t.Errorf("scale=%d: expected Quantile(%g) close to %f, got %f", scale, q, expected, got)
+			}
+		}
+	}
+}
+
+func TestExponentialHistogramSigns(t *testing.T) {
+	td := uncheckedNew()
+	for _, x := range []float64{-8, -3, -0.5, 0, 0, 1, 2, 4, 5} {
+		_ = td.Add(x)
+	}
+
+	h, err := td.ToExponentialHistogram(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Base 2: buckets (2^i, 2^(i+1)]
+	// -8 -> 2, -3 -> 1, -0.5 -> -2; 1 -> -1, 2 -> 0, 4 -> 1, 5 -> 2
+	if h.ZeroCount != 2 {
+		t.Errorf("Expected 2 zeros, got %d", h.ZeroCount)
+	}
+	if h.Negative.Offset != -2 || !reflect.DeepEqual(h.Negative.BucketCounts, []uint64{1, 0, 0, 1, 1}) {
+		t.Errorf("Unexpected negative buckets: %+v", h.Negative)
+	}
+	if h.Positive.Offset != -1 || !reflect.DeepEqual(h.Positive.BucketCounts, []uint64{1, 1, 1, 1}) {
+		t.Errorf("Unexpected positive buckets: %+v", h.Positive)
+	}
+}
+
+func TestExponentialIndex(t *testing.T) {
+	for _, input := range []struct {
+		v     float64
+		scale int
+		index int
+	}{
+		{1, 0, -1},
+		{1.5, 0, 0},
+		{2, 0, 0},
+		{2.5, 0, 1},
+		{1024, 0, 9},
+		{1025, 0, 10},
+		{0.5, 0, -2},
+		{16, -1, 1},
+		{17, -1, 2},
+		{4, 1, 3},
+		{1.414, 1, 0},
+		{1.415, 1, 1},
+		{1.5, 1, 1},
+		{math.SmallestNonzeroFloat64, 0, -1075},
+	} {
+		if index := exponentialIndex(input.v, input.scale); index != input.index {
+			t.Errorf("exponentialIndex(%g, %d) = %d, wanted %d", input.v, input.scale, index, input.index)
+		}
+	}
+}
+
+func TestToExponentialHistogramErrors(t *testing.T) {
+	td := uncheckedNew()
+	if _, err := td.ToExponentialHistogram(21); err == nil {
+		t.Errorf("Expected an out of range scale to be rejected")
+	}
+
+	h, err := td.ToExponentialHistogram(20)
+	if err != nil || h.Count != 0 || !math.IsNaN(h.Min) {
+		t.Errorf("Unexpected histogram for an empty digest: %+v, %v", h, err)
+	}
+
+	_ = td.Add(1e-300)
+	_ = td.Add(1e300)
+	if _, err := td.ToExponentialHistogram(20); err == nil {
+		t.Errorf("Expected too many buckets to be rejected")
+	}
+	if _, err := td.ToExponentialHistogram(0); err != nil {
+		t.Errorf("Expected a wide range to fit at a low scale: %v", err)
+	}
+
+	// Add() rejects infinities, but payloads written by other tools
+	// may still hold them
+	td.summary.means[td.summary.Len()-1] = math.Inf(1)
+	if _, err := td.ToExponentialHistogram(0); err == nil {
+		t.Errorf("Expected infinite values to be rejected")
+	}
+}
@@ -0,0 +1,45 @@
+package tdigest
+
+import "expvar"
+
+// expvarDigest is the JSON representation of a digest published with
+// expvar. Quantiles are left out for empty digests, like Min and Max
+// in jsonDigest.
+type expvarDigest struct {
+	Count uint64   `json:"count"`
+	P50   *float64 `json:"p50,omitempty"`
+	P90   *float64 `json:"p90,omitempty"`
+	P99   *float64 `json:"p99,omitempty"`
+}
+
+// Expvar returns an expvar.Var describing the digests returned by
+// snapshot as a JSON object with their `count`, `p50`, `p90` and
+// `p99`.
+//
+// The snapshot function is called on every read, so the values are
+// always fresh. It must return a digest that isn't modified while it
+// is read, e.g. Concurrent.Snapshot:
+//
+//	expvar.Publish("latency", tdigest.Expvar(digest.Snapshot))
+//
+// A digest only used by the goroutine reading the variable can be
+// returned as is.
+func Expvar(snapshot func() *TDigest) expvar.Var {
+	return expvar.Func(func() interface{} {
+		t := snapshot()
+		v := expvarDigest{Count: t.Count()}
+		if v.Count > 0 {
+			qs := t.Quantiles(0.5, 0.9, 0.99)
+			v.P50, v.P90, v.P99 = &qs[0], &qs[1], &qs[2]
+		}
+		return v
+	})
+}
+
+// PublishExpvar publishes Expvar(snapshot) under the given name, see
+// expvar.Publish. Like it, this panics if the name is already in use.
+func PublishExpvar(name string, snapshot func() *TDigest) expvar.Var {
+	v := Expvar(snapshot)
+	expvar.Publish(name, v)
+	return v
+}
@@ -0,0 +1,44 @@
+package tdigest
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"testing"
+)
+
+func TestExpvar(t *testing.T) {
+	digest, _ := NewConcurrent()
+	v := PublishExpvar("test_tdigest_latency", digest.Snapshot)
+
+	if published := expvar.Get("test_tdigest_latency"); published == nil || published.String() != v.String() {
+		t.Fatalf("Expected the variable to be published")
+	}
+	if v.String() != `{"count":0}` {
+		t.Errorf("Unexpected value for an empty digest: %s", v)
+	}
+
+	for i := 1; i <= 1000; i++ {
+		_ = digest.Add(float64(i))
+	}
+
+	var decoded struct {
+		Count         uint64
+		P50, P90, P99 float64
+	}
+	err := json.Unmarshal([]byte(v.String()), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Count != 1000 || math.Abs(decoded.P50-500) > 5 || math.Abs(decoded.P90-900) > 5 || math.Abs(decoded.P99-990) > 5 {
+		t.Errorf("Unexpected value: %s", v)
+	}
+
+	// Values are computed on every read
+	_ = digest.AddWeighted(5000, 1000)
+	err = json.Unmarshal([]byte(v.String()), &decoded)
+	if err != nil || decoded.Count != 2000 || decoded.P99 != 5000 {
+		t.Errorf("Expected a fresh value, got %s", v)
+	}
+}
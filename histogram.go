@@ -0,0 +1,100 @@
+package tdigest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Histogram estimates how many samples fall in each of the buckets
+// delimited by the given boundaries, which must be sorted in strictly
+// increasing order.
+//
+// The i-th bucket holds the samples in (boundaries[i-1], boundaries[i]],
+// with the first one starting at -Inf. An extra overflow bucket with
+// the samples above the last boundary is appended, so the result has
+// len(boundaries)+1 elements and always adds up to Count().
+//
+// Counts are derived from the (rounded) ranks of the boundaries, see
+// Rank.
+func (t *TDigest) Histogram(boundaries []float64) ([]uint64, error) {
+	for i, b := range boundaries {
+		if math.IsNaN(b) || (i > 0 && b <= boundaries[i-1]) {
+			return nil, errors.New("histogram boundaries must be sorted in increasing order")
+		}
+	}
+
+	buckets := make([]uint64, len(boundaries)+1)
+	walker := &cdfWalker{}
+	var previous uint64
+	for i, b := range boundaries {
+		rank := uint64(math.Round(t.estimateRank(b, walker)))
+		buckets[i] = rank - previous
+		previous = rank
+	}
+	buckets[len(boundaries)] = t.count - previous
+
+	return buckets, nil
+}
+
+// FromHistogram builds a digest out of pre-aggregated histogram
+// buckets, laid out like the result of Histogram: counts[i] is the
+// number of samples in (boundaries[i-1], boundaries[i]] and the last
+// count is that of the overflow bucket, above the last boundary. The
+// boundaries may also end with +Inf, in which case there are as many
+// counts as boundaries. Counts are per bucket: Prometheus-style
+// cumulative counts must be turned into differences first.
+//
+// Each bucket becomes a single centroid at its midpoint, via
+// AddCentroid, and empty buckets are skipped. Buckets without an
+// upper or lower bound can't have a midpoint: the overflow bucket is
+// placed at the last boundary and the first one at the first
+// boundary.
+//
+// The digest knows nothing about how samples are spread within a
+// bucket, so quantile estimates can be off by up to half the width of
+// the bucket they fall in, or by any amount in the first and overflow
+// buckets. Min() and Max() are those of the centroids. Narrow buckets
+// around the quantiles of interest keep the error small.
+//
+// The digest is created with the given options, see New.
+func FromHistogram(boundaries []float64, counts []uint64, options ...tdigestOption) (*TDigest, error) {
+	if n := len(boundaries); n > 0 && math.IsInf(boundaries[n-1], 1) && len(counts) == n {
+		boundaries = boundaries[:n-1]
+	}
+	if len(boundaries) == 0 || len(counts) != len(boundaries)+1 {
+		return nil, fmt.Errorf("histogram needs at least one boundary and one more count, got %d boundaries and %d counts", len(boundaries), len(counts))
+	}
+	for i, b := range boundaries {
+		if math.IsNaN(b) || math.IsInf(b, 0) || (i > 0 && b <= boundaries[i-1]) {
+			return nil, errors.New("histogram boundaries must be finite and sorted in increasing order")
+		}
+	}
+
+	t, err := New(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+
+		var mean float64
+		switch i {
+		case 0:
+			mean = boundaries[0]
+		case len(boundaries):
+			mean = boundaries[len(boundaries)-1]
+		default:
+			mean = boundaries[i-1] + (boundaries[i]-boundaries[i-1])/2
+		}
+
+		err = t.AddCentroid(mean, count)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
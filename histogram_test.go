@@ -0,0 +1,142 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	td := uncheckedNew()
+	for i := 0; i < 100000; i++ {
+		_ = td.Add(rand.Float64() * 100)
+	}
+
+	boundaries := []float64{10, 25, 50, 90}
+	buckets, err := td.Histogram(boundaries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(buckets) != len(boundaries)+1 {
+		t.Fatalf("Expected %d buckets, got %d", len(boundaries)+1, len(buckets))
+	}
+
+	var total uint64
+	for _, count := range buckets {
+		total += count
+	}
+	if total != td.Count() {
+		t.Errorf("Expected buckets to add up to %d, got %d", td.Count(), total)
+	}
+
+	expected := []float64{10000, 15000, 25000, 40000, 10000}
+	for i, count := range buckets {
+		if math.Abs(float64(count)-expected[i]) > 0.05*expected[i] {
+			t.Errorf("Expected bucket %d to hold about %.0f samples, got %d", i, expected[i], count)
+		}
+	}
+}
+
+func TestHistogramEdgeCases(t *testing.T) {
+	td := uncheckedNew()
+
+	buckets, err := td.Histogram([]float64{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buckets[0] != 0 || buckets[1] != 0 || buckets[2] != 0 {
+		t.Errorf("Expected empty buckets for an empty digest, got %v", buckets)
+	}
+
+	_ = td.AddWeighted(5, 3)
+
+	buckets, _ = td.Histogram(nil)
+	if len(buckets) != 1 || buckets[0] != 3 {
+		t.Errorf("Expected a single overflow bucket with everything, got %v", buckets)
+	}
+
+	buckets, _ = td.Histogram([]float64{4, 5, 6})
+	if buckets[0] != 0 || buckets[1] != 3 || buckets[2] != 0 || buckets[3] != 0 {
+		t.Errorf("Expected samples equal to a boundary to fall in its bucket, got %v", buckets)
+	}
+
+	for _, boundaries := range [][]float64{{2, 1}, {1, 1}, {math.NaN()}} {
+		_, err = td.Histogram(boundaries)
+		if err == nil {
+			t.Errorf("Expected boundaries %v to be rejected", boundaries)
+		}
+	}
+}
+
+func TestFromHistogram(t *testing.T) {
+	// Uniform samples between 0 and 100, in buckets 1 wide
+	boundaries := make([]float64, 101)
+	counts := make([]uint64, 102)
+	for i := range boundaries {
+		boundaries[i] = float64(i)
+	}
+	for i := 1; i <= 100; i++ {
+		counts[i] = 1000
+	}
+
+	td, err := FromHistogram(boundaries, counts, Compression(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if td.Count() != 100000 || td.Compression() != 200 || td.Min() != 0.5 || td.Max() != 99.5 {
+		t.Errorf("Unexpected digest: count=%d compression=%f min=%f max=%f", td.Count(), td.Compression(), td.Min(), td.Max())
+	}
+	for _, q := range []float64{0.1, 0.5, 0.9, 0.99} {
+		if math.Abs(td.Quantile(q)-100*q) > 0.5 {
+			t.Errorf("Expected Quantile(%g) to be within half a bucket of %f, got %f", q, 100*q, td.Quantile(q))
+		}
+	}
+
+	// Round-trip through Histogram. The outer buckets depend on how
+	// the tails are interpolated up to Min() and Max(), so skip them.
+	buckets, _ := td.Histogram(boundaries)
+	for i := 2; i < 99; i++ {
+		count := buckets[i]
+		if math.Abs(float64(count)-float64(counts[i])) > 0.05*1000 {
+			t.Errorf("Expected bucket %d to hold about %d samples, got %d", i, counts[i], count)
+		}
+	}
+}
+
+func TestFromHistogramOpenBuckets(t *testing.T) {
+	td, err := FromHistogram([]float64{1, 2, math.Inf(1)}, []uint64{4, 0, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first bucket sits at its upper bound and the overflow one at
+	// the last finite boundary
+	means := []float64{}
+	td.ForEachCentroid(func(mean float64, count uint64) bool {
+		means = append(means, mean)
+		return true
+	})
+	if len(means) != 2 || means[0] != 1 || means[1] != 2 || td.Count() != 10 {
+		t.Errorf("Unexpected centroids %v and count %d", means, td.Count())
+	}
+
+	inputs := []struct {
+		boundaries []float64
+		counts     []uint64
+	}{
+		{nil, []uint64{1}},
+		{[]float64{1, 2}, []uint64{1, 2}},
+		{[]float64{2, 1}, []uint64{1, 2, 3}},
+		{[]float64{1, math.NaN()}, []uint64{1, 2, 3}},
+		{[]float64{math.Inf(-1), 1}, []uint64{1, 2, 3}},
+		{[]float64{1, math.Inf(1)}, []uint64{1, 2, 3}},
+		{[]float64{1}, []uint64{math.MaxUint64, 1}},
+	}
+	for _, input := range inputs {
+		if _, err := FromHistogram(input.boundaries, input.counts); err == nil {
+			t.Errorf("Expected FromHistogram(%v, %v) to fail", input.boundaries, input.counts)
+		}
+	}
+}
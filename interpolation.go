@@ -0,0 +1,165 @@
+package tdigest
+
+import (
+	"errors"
+	"math"
+)
+
+// Interpolation selects how Quantile estimates values between the
+// means of the centroids, see QuantileInterpolation.
+type Interpolation int
+
+const (
+	// LinearInterpolation interpolates linearly between the centers of
+	// neighboring centroids. Beyond the first and last centroids, the
+	// slope of the two outermost ones is extended, and the result is
+	// clamped to Min() and Max(). This is the default.
+	LinearInterpolation Interpolation = iota
+
+	// PiecewiseInterpolation interpolates linearly between centroids
+	// too, but models the tails after the exact extremes: quantiles
+	// below the center of the first centroid go from Min() up to its
+	// mean, and those above the last one from its mean up to Max(), in
+	// two linear pieces. The sample next to the extreme is placed so
+	// that the tail averages out to what the mean of the centroid
+	// implies, which keeps heavy tails (whose outermost centroids hold
+	// far apart samples) from overshooting towards a distant extreme.
+	// Estimates are monotone and reach Min() and Max() smoothly, where
+	// LinearInterpolation flattens out once clamped.
+	//
+	// It only makes a difference when the outermost centroids hold
+	// many samples, e.g. with a low compression or with ScaleK1, as
+	// DefaultScale keeps singletons at the tails.
+	PiecewiseInterpolation
+)
+
+// QuantileInterpolation sets how quantiles are interpolated between
+// centroids, see Interpolation. It only changes how the digest is
+// read, not what it stores, so digests with different interpolations
+// can be merged and serialized the same way.
+func QuantileInterpolation(interpolation Interpolation) tdigestOption { // nolint
+	return func(t *TDigest) error {
+		if interpolation != LinearInterpolation && interpolation != PiecewiseInterpolation {
+			return errors.New("Unknown interpolation")
+		}
+		t.interpolation = interpolation
+		return nil
+	}
+}
+
+// Ties selects what Quantile returns for quantiles that fall between
+// two centroids, see QuantileTies.
+//
+// Quantile(q) looks for the sample at index q·(Count()-1), counting
+// from 0, which may fall between the last sample of a centroid and
+// the first one of the next: a tie, such as the median of an even
+// number of samples. With two values only, half of the samples each,
+// Quantile(0.5) is such a tie.
+//
+// Except with InterpolateTies, the estimates on either side of a tie
+// move linearly from the mean of each centroid, at its center, to the
+// value of the tie, at its outermost sample. This keeps them monotone.
+type Ties int
+
+const (
+	// InterpolateTies treats ties like any other quantile,
+	// interpolating between centroids (see Interpolation). This is
+	// the default.
+	InterpolateTies Ties = iota
+
+	// LowerTies breaks ties with the mean of the lower centroid.
+	LowerTies
+
+	// UpperTies breaks ties with the mean of the upper centroid.
+	UpperTies
+
+	// MidpointTies breaks ties with the midpoint of the means of both
+	// centroids, whatever their counts.
+	MidpointTies
+)
+
+// QuantileTies sets how quantiles falling between two centroids are
+// estimated, see Ties. Like QuantileInterpolation, this only changes
+// how the digest is read. The quantiles beyond the centers of the
+// first and last centroids are left to the interpolation.
+//
+// Ties are told apart by comparing the index of the quantile to the
+// counts of the centroids, which are whole numbers, so the result
+// doesn't depend on rounding: the same digest gives the same
+// estimates everywhere.
+func QuantileTies(ties Ties) tdigestOption { // nolint
+	return func(t *TDigest) error {
+		if ties < InterpolateTies || ties > MidpointTies {
+			return errors.New("Unknown tie-breaking")
+		}
+		t.ties = ties
+		return nil
+	}
+}
+
+// tieQuantile estimates the quantile at the given index around the
+// ties chosen by ties, see Ties, and reports whether the index is
+// between the centers of two centroids at all. The digest must have
+// at least two centroids.
+func tieQuantile(s *summary, index float64, ties Ties) (float64, bool) {
+	// The centroid holding the sample at the index, or the last one
+	// before it if the index falls in a tie
+	i, first := s.FloorSum(index)
+	if i == -1 || first+float64(s.Count(i)) <= index {
+		return 0, false
+	}
+	last := first + float64(s.Count(i)-1)
+	center := first + (last-first)/2
+
+	switch {
+	case index == center:
+		return s.Mean(i), true
+	case index > last:
+		return breakTie(s, i, ties), true
+	case index > center && i+1 < s.Len():
+		return _quantile(index, center, last, s.Mean(i), breakTie(s, i, ties)), true
+	case index < center && i > 0:
+		return _quantile(index, first, center, breakTie(s, i-1, ties), s.Mean(i)), true
+	}
+	return 0, false
+}
+
+// breakTie returns the value chosen by ties for the tie between the
+// centroid at index i and the next one.
+func breakTie(s *summary, i int, ties Ties) float64 {
+	switch ties {
+	case LowerTies:
+		return s.Mean(i)
+	case UpperTies:
+		return s.Mean(i + 1)
+	default:
+		return s.Mean(i)/2 + s.Mean(i+1)/2
+	}
+}
+
+// tailQuantile estimates the value at the given index, between the
+// smallest sample (at index 0) and the center of the first centroid,
+// at index center, for PiecewiseInterpolation. The means of the first
+// two centroids are given. Mirrored, this works for the last centroid
+// too.
+func tailQuantile(index, center, mean, nextMean, min float64) float64 {
+	if center <= 1 {
+		if center <= 0 {
+			return mean
+		}
+		return _quantile(index, 0, center, min, mean)
+	}
+	// The lower half of the centroid is assumed to average out like
+	// its upper half, which spreads halfway to the next centroid
+	target := mean - (nextMean-mean)/4
+	target = math.Max(min/2+mean/2, math.Min(target, mean))
+	// Past the smallest sample, grow linearly from v to the mean,
+	// with v chosen so that the whole tail averages to the target:
+	// v = (2·center·target - (center-1)·mean - min) / center
+	v := target + (target-mean)*((center-1)/center) + (target-min)/center
+	v = math.Max(min, math.Min(v, mean))
+	if index <= 1 {
+		return _quantile(index, 0, 1, min, v)
+	}
+	return _quantile(index, 1, center, v, mean)
+}
@@ -0,0 +1,195 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestPiecewiseInterpolation(t *testing.T) {
+	r := rand.New(rand.NewSource(0x7A11))
+	data := make([]float64, 100000)
+	linear := uncheckedNew(Compression(10), Scale(ScaleK1), LocalRandomNumberGenerator(1))
+	for i := range data {
+		// Log-normal: heavy-tailed, with a few centroids holding many
+		// samples at either end
+		data[i] = math.Exp(r.NormFloat64())
+		_ = linear.Add(data[i])
+	}
+	_ = linear.Compress()
+	sort.Float64s(data)
+
+	piecewise := linear.Clone()
+	_ = QuantileInterpolation(PiecewiseInterpolation)(piecewise)
+
+	var linearError, piecewiseError float64
+	previous := math.Inf(-1)
+	for i := 0; i <= 200; i++ {
+		// The bottom and top 1% of the ranks
+		q := float64(i) / 20000
+		if i > 100 {
+			q = 1 - float64(200-i)/20000
+		}
+
+		exact := data[int(q*float64(len(data)-1))]
+		linearError += math.Abs(linear.Quantile(q)-exact) / exact
+		x := piecewise.Quantile(q)
+		piecewiseError += math.Abs(x-exact) / exact
+
+		if x < previous {
+			t.Errorf("Expected estimates to be monotone, got Quantile(%g) = %f after %f", q, x, previous)
+		}
+		previous = x
+	}
+
+	if piecewiseError >= linearError {
+		t.Errorf("Expected piecewise interpolation to be more accurate in the tails, got a total relative error of %f vs %f", piecewiseError, linearError)
+	}
+	if piecewise.Quantile(0) != data[0] || piecewise.Quantile(1) != data[len(data)-1] {
+		t.Errorf("Expected the extremes to be exact, got %f and %f", piecewise.Quantile(0), piecewise.Quantile(1))
+	}
+
+	// Only queries differ, the centroids are the same
+	if !piecewise.Equals(linear, 0) || piecewise.Quantile(0.5) != linear.Quantile(0.5) {
+		t.Errorf("Expected the interpolation to only change the tails")
+	}
+}
+
+func TestQuantileInterpolation(t *testing.T) {
+	td := uncheckedNew(QuantileInterpolation(PiecewiseInterpolation))
+	for i := 0; i < 1000; i++ {
+		_ = td.Add(float64(i))
+	}
+
+	// Neither format stores the interpolation, decoding keeps the
+	// one of the digest
+	if td.Clone().interpolation != PiecewiseInterpolation {
+		t.Errorf("Expected Clone() to keep the interpolation")
+	}
+	buf, _ := td.AsBytes()
+	if err := td.FromBytes(buf); err != nil || td.interpolation != PiecewiseInterpolation {
+		t.Errorf("Expected FromBytes() to keep the interpolation, got %v", err)
+	}
+	data, _ := td.MarshalJSON()
+	if err := td.UnmarshalJSON(data); err != nil || td.interpolation != PiecewiseInterpolation {
+		t.Errorf("Expected UnmarshalJSON() to keep the interpolation, got %v", err)
+	}
+
+	if _, err := New(QuantileInterpolation(Interpolation(42))); err == nil {
+		t.Errorf("Expected unknown interpolations to be rejected")
+	}
+}
+
+func TestQuantileTies(t *testing.T) {
+	inputs := []struct {
+		ties     Ties
+		expected float64
+	}{
+		{InterpolateTies, 1.5},
+		{LowerTies, 1},
+		{UpperTies, 2},
+		{MidpointTies, 1.5},
+	}
+	for _, input := range inputs {
+		td := uncheckedNew(QuantileTies(input.ties))
+		_ = td.AddCentroid(1, 50)
+		_ = td.AddCentroid(2, 50)
+
+		if median := td.Quantile(0.5); median != input.expected {
+			t.Errorf("ties=%d: expected a median of %f, got %f", input.ties, input.expected, median)
+		}
+		if qs := td.Quantiles(0.1, 0.5, 0.9); qs[1] != input.expected {
+			t.Errorf("ties=%d: expected Quantiles() to break ties the same way, got %f", input.ties, qs[1])
+		}
+		// Estimates lead up to the tie, then away from it
+		if below, above := td.Quantile(0.49), td.Quantile(0.51); !(1 <= below && below <= input.expected && input.expected <= above && above <= 2) {
+			t.Errorf("ties=%d: expected quantiles around the median to be between 1 and %f, then up to 2, got %f and %f", input.ties, input.expected, below, above)
+		}
+	}
+
+	// The midpoint doesn't depend on the counts, interpolation does
+	td := uncheckedNew(QuantileTies(MidpointTies))
+	_ = td.AddCentroid(1, 30)
+	_ = td.AddCentroid(2, 71)
+	if q := td.Quantile(0.2995); q != 1.5 {
+		t.Errorf("Expected the midpoint of the means, got %f", q)
+	}
+
+	// Singletons break ties like lower and upper medians
+	td = uncheckedNew(QuantileTies(LowerTies))
+	for _, x := range []float64{1, 2, 3, 4} {
+		_ = td.Add(x)
+	}
+	if td.Median() != 2 {
+		t.Errorf("Expected the lower median, got %f", td.Median())
+	}
+
+	// Clones and decoded digests break ties the same way
+	if td.Clone().ties != LowerTies {
+		t.Errorf("Expected Clone() to keep the tie-breaking")
+	}
+	buf, _ := td.AsBytes()
+	if err := td.FromBytes(buf); err != nil || td.ties != LowerTies {
+		t.Errorf("Expected FromBytes() to keep the tie-breaking, got %v", err)
+	}
+	data, _ := td.MarshalJSON()
+	if err := td.UnmarshalJSON(data); err != nil || td.ties != LowerTies {
+		t.Errorf("Expected UnmarshalJSON() to keep the tie-breaking, got %v", err)
+	}
+
+	for _, ties := range []Ties{-1, MidpointTies + 1} {
+		if _, err := New(QuantileTies(ties)); err == nil {
+			t.Errorf("Expected unknown tie-breaking %d to be rejected", ties)
+		}
+	}
+}
+
+func TestQuantileMonotonicity(t *testing.T) {
+	r := rand.New(rand.NewSource(0x1000))
+	distributions := []struct {
+		name   string
+		sample func() float64
+	}{
+		{"uniform", r.Float64},
+		{"normal", r.NormFloat64},
+		{"exponential", r.ExpFloat64},
+		{"pareto", func() float64 { return math.Pow(r.Float64(), -2) }},
+		{"discrete", func() float64 { return float64(r.Intn(5)) }},
+		{"bimodal", func() float64 { return 1e6*float64(r.Intn(2)) + r.NormFloat64() }},
+	}
+	settings := [][]tdigestOption{
+		{},
+		{Compression(5)},
+		{Scale(ScaleK1)},
+		{QuantileInterpolation(PiecewiseInterpolation)},
+		{QuantileTies(LowerTies)},
+		{QuantileTies(UpperTies)},
+		{QuantileTies(MidpointTies)},
+	}
+
+	quantiles := make([]float64, 1000)
+	for i := range quantiles {
+		quantiles[i] = float64(i) / float64(len(quantiles)-1)
+	}
+	for _, distribution := range distributions {
+		for i, options := range settings {
+			for _, n := range []int{10, 1000, 100000} {
+				td := uncheckedNew(append(options, LocalRandomNumberGenerator(1))...)
+				for j := 0; j < n; j++ {
+					_ = td.Add(distribution.sample())
+				}
+
+				estimates := td.Quantiles(quantiles...)
+				for j, q := range quantiles {
+					if td.Quantile(q) != estimates[j] {
+						t.Fatalf("%s, settings %d, %d samples: Quantile(%f)=%v but Quantiles() gave %v", distribution.name, i, n, q, td.Quantile(q), estimates[j])
+					}
+					if j > 0 && estimates[j] < estimates[j-1] {
+						t.Fatalf("%s, settings %d, %d samples: Quantile(%f)=%v is below Quantile(%f)=%v", distribution.name, i, n, q, estimates[j], quantiles[j-1], estimates[j-1])
+					}
+				}
+			}
+		}
+	}
+}
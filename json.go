@@ -0,0 +1,58 @@
+package tdigest
+
+import "encoding/json"
+
+// jsonDigest is the JSON representation of a digest. It mirrors the
+// summary struct: means[i] is the mean of the i-th centroid and
+// counts[i] is how many samples it holds.
+//
+// Min and Max are left out for empty digests, since JSON has no way
+// to represent their (infinite) values.
+type jsonDigest struct {
+	Compression float64   `json:"compression"`
+	Min         *float64  `json:"min,omitempty"`
+	Max         *float64  `json:"max,omitempty"`
+	Means       []float64 `json:"means"`
+	Counts      []uint64  `json:"counts"`
+}
+
+// MarshalJSON implements json.Marshaler.
+//
+// The digest is emitted as an object with the compression factor
+// and two parallel arrays, `means` and `counts`, sorted by mean.
+func (t TDigest) MarshalJSON() ([]byte, error) {
+	means, counts := t.summary.GetDataCopy()
+	v := jsonDigest{
+		Compression: t.compression,
+		Means:       means,
+		Counts:      counts,
+	}
+	if t.count > 0 {
+		v.Min, v.Max = &t.min, &t.max
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+//
+// Any previously collected data is discarded. A missing compression
+// field yields the default compression, so an empty object decodes
+// into a valid empty digest. Missing min and max fields are estimated
+// from the centroids.
+func (t *TDigest) UnmarshalJSON(data []byte) error {
+	var v jsonDigest
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+
+	err = t.loadCentroids(v.Compression, v.Means, v.Counts)
+	if err != nil {
+		return err
+	}
+
+	if v.Min != nil && v.Max != nil && t.count > 0 {
+		t.setExtremes(*v.Min, *v.Max)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package tdigest
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	t1 := uncheckedNew(Compression(50))
+	for i := 0; i < 10000; i++ {
+		_ = t1.Add(rand.NormFloat64())
+	}
+
+	payload, err := json.Marshal(t1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var t2 TDigest
+	err = json.Unmarshal(payload, &t2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []float64{0, 0.001, 0.1, 0.5, 0.9, 0.999, 1} {
+		if t1.Quantile(q) != t2.Quantile(q) {
+			t.Errorf("Quantile(%.3f) changed after round-trip: %v != %v", q, t1.Quantile(q), t2.Quantile(q))
+		}
+	}
+
+	assertSerialization(t, t1, &t2)
+}
+
+func TestJSONEmbedded(t *testing.T) {
+	type document struct {
+		Name   string   `json:"name"`
+		Digest *TDigest `json:"digest"`
+	}
+
+	digest := uncheckedNew()
+	for i := 0; i < 100; i++ {
+		_ = digest.Add(float64(i))
+	}
+
+	payload, err := json.Marshal(document{Name: "latency", Digest: digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc document
+	err = json.Unmarshal(payload, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Name != "latency" || doc.Digest.Count() != digest.Count() {
+		t.Errorf("Unexpected document after round-trip: %+v", doc)
+	}
+}
+
+func TestJSONEmptyObject(t *testing.T) {
+	var digest TDigest
+	err := json.Unmarshal([]byte("{}"), &digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if digest.Compression() != 100 {
+		t.Errorf("Expected default compression, got %f", digest.Compression())
+	}
+
+	if digest.Count() != 0 || !math.IsNaN(digest.Quantile(0.5)) {
+		t.Errorf("Expected an empty digest")
+	}
+
+	err = digest.Add(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.Quantile(0.5) != 1 {
+		t.Errorf("Expected empty digest to be usable after decoding")
+	}
+}
+
+func TestJSONExtremes(t *testing.T) {
+	digest := uncheckedNew()
+	_ = digest.Add(-1.5)
+	_ = digest.Add(2)
+
+	payload, _ := json.Marshal(digest)
+	expected := `{"compression":100,"min":-1.5,"max":2,"means":[-1.5,2],"counts":[1,1]}`
+	if string(payload) != expected {
+		t.Errorf("Unexpected encoding. Got %s, wanted %s", payload, expected)
+	}
+
+	payload, _ = json.Marshal(uncheckedNew())
+	expected = `{"compression":100,"means":[],"counts":[]}`
+	if string(payload) != expected {
+		t.Errorf("Unexpected encoding of an empty digest. Got %s, wanted %s", payload, expected)
+	}
+
+	var other TDigest
+	err := json.Unmarshal([]byte(`{"means": [1, 3], "counts": [2, 2]}`), &other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Min() != 1 || other.Max() != 3 {
+		t.Errorf("Expected missing extremes to come from the means, got %v %v", other.Min(), other.Max())
+	}
+}
+
+func TestJSONInvalid(t *testing.T) {
+	inputs := []string{
+		`{"means": [1, 2], "counts": [1]}`,
+		`{"means": [1], "counts": []}`,
+		`{"compression": 0.5}`,
+		`[]`,
+	}
+
+	for _, input := range inputs {
+		var digest TDigest
+		if json.Unmarshal([]byte(input), &digest) == nil {
+			t.Errorf("Expected error decoding %s", input)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package tdigest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MarshalMsgpack serializes the digest as a MessagePack map with the
+// same fields as the JSON encoding: `compression`, `min` and `max`
+// (unless the digest is empty), `means` and `counts`.
+//
+// Together with UnmarshalMsgpack, this implements the Marshaler and
+// Unmarshaler interfaces of the popular MessagePack libraries. Means
+// are always encoded as float64 and counts as uint64, regardless of
+// their magnitude, so payloads are identical across platforms.
+func (t TDigest) MarshalMsgpack() ([]byte, error) {
+	n := t.summary.Len()
+	b := make([]byte, 0, 64+18*n)
+
+	if t.count > 0 {
+		b = append(b, 0x85) // fixmap, 5 entries
+	} else {
+		b = append(b, 0x83)
+	}
+
+	b = appendMsgpackString(b, "compression")
+	b = appendMsgpackFloat64(b, t.compression)
+
+	if t.count > 0 {
+		b = appendMsgpackString(b, "min")
+		b = appendMsgpackFloat64(b, t.min)
+		b = appendMsgpackString(b, "max")
+		b = appendMsgpackFloat64(b, t.max)
+	}
+
+	b = appendMsgpackString(b, "means")
+	b = appendMsgpackArrayHeader(b, n)
+	for _, mean := range t.summary.means {
+		b = appendMsgpackFloat64(b, mean)
+	}
+
+	b = appendMsgpackString(b, "counts")
+	b = appendMsgpackArrayHeader(b, n)
+	for _, count := range t.summary.counts {
+		b = append(b, 0xcf)
+		b = appendBigEndian(b, count, 8)
+	}
+
+	return b, nil
+}
+
+// UnmarshalMsgpack reinitializes the digest from a MessagePack map
+// (see MarshalMsgpack), discarding any previously collected data.
+//
+// Any MessagePack numeric type is accepted for the fields and
+// unknown map keys are ignored. A missing compression yields the
+// default one, missing min and max are estimated from the centroids.
+func (t *TDigest) UnmarshalMsgpack(buf []byte) error {
+	r := msgpackReader{buf: buf}
+
+	var (
+		compression float64
+		means       []float64
+		counts      []uint64
+		min, max    = math.NaN(), math.NaN()
+	)
+
+	entries, err := r.readMapHeader()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < entries; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "compression":
+			compression, err = r.readFloat()
+		case "min":
+			min, err = r.readFloat()
+		case "max":
+			max, err = r.readFloat()
+		case "means":
+			var n int
+			n, err = r.readArrayHeader()
+			means = make([]float64, n)
+			for j := 0; j < n && err == nil; j++ {
+				means[j], err = r.readFloat()
+			}
+		case "counts":
+			var n int
+			n, err = r.readArrayHeader()
+			counts = make([]uint64, n)
+			for j := 0; j < n && err == nil; j++ {
+				counts[j], err = r.readUint()
+			}
+		default:
+			err = r.skip()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(r.buf) != 0 {
+		return errors.New("buffer has unread data")
+	}
+
+	err = t.loadCentroids(compression, means, counts)
+	if err != nil {
+		return err
+	}
+
+	if t.count > 0 {
+		t.setExtremes(min, max)
+	}
+	return nil
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	// All our keys are short enough for a fixstr
+	b = append(b, 0xa0|byte(len(s)))
+	return append(b, s...)
+}
+
+func appendMsgpackFloat64(b []byte, f float64) []byte {
+	b = append(b, 0xcb)
+	return appendBigEndian(b, math.Float64bits(f), 8)
+}
+
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return appendBigEndian(append(b, 0xdc), uint64(n), 2)
+	default:
+		return appendBigEndian(append(b, 0xdd), uint64(n), 4)
+	}
+}
+
+func appendBigEndian(b []byte, n uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(n>>(8*i)))
+	}
+	return b
+}
+
+var errMsgpackTruncated = errors.New("buffer too small for deserialization")
+
+// msgpackReader decodes the subset of MessagePack needed to read
+// digests back, consuming buf as it goes.
+type msgpackReader struct {
+	buf []byte
+}
+
+func (r *msgpackReader) readByte() (byte, error) {
+	if len(r.buf) < 1 {
+		return 0, errMsgpackTruncated
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b, nil
+}
+
+func (r *msgpackReader) readBigEndian(size int) (uint64, error) {
+	if len(r.buf) < size {
+		return 0, errMsgpackTruncated
+	}
+	var n uint64
+	for _, b := range r.buf[:size] {
+		n = n<<8 | uint64(b)
+	}
+	r.buf = r.buf[size:]
+	return n, nil
+}
+
+func (r *msgpackReader) readLength(size int) (int, error) {
+	n, err := r.readBigEndian(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(r.buf)) {
+		// every element takes at least one byte
+		return 0, errMsgpackTruncated
+	}
+	return int(n), nil
+}
+
+func (r *msgpackReader) readMapHeader() (int, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b&0xf0 == 0x80:
+		return int(b & 0x0f), nil
+	case b == 0xde:
+		return r.readLength(2)
+	case b == 0xdf:
+		return r.readLength(4)
+	}
+	return 0, fmt.Errorf("expected a msgpack map, got type 0x%02x", b)
+}
+
+func (r *msgpackReader) readArrayHeader() (int, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b&0xf0 == 0x90:
+		return int(b & 0x0f), nil
+	case b == 0xdc:
+		return r.readLength(2)
+	case b == 0xdd:
+		return r.readLength(4)
+	case b == 0xc0:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("expected a msgpack array, got type 0x%02x", b)
+}
+
+func (r *msgpackReader) readString() (string, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return "", err
+	}
+
+	var n int
+	switch {
+	case b&0xe0 == 0xa0:
+		n = int(b & 0x1f)
+	case b == 0xd9:
+		n, err = r.readLength(1)
+	case b == 0xda:
+		n, err = r.readLength(2)
+	case b == 0xdb:
+		n, err = r.readLength(4)
+	default:
+		return "", fmt.Errorf("expected a msgpack string, got type 0x%02x", b)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(r.buf) < n {
+		return "", errMsgpackTruncated
+	}
+
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s, nil
+}
+
+func (r *msgpackReader) readFloat() (float64, error) {
+	if len(r.buf) > 0 {
+		switch r.buf[0] {
+		case 0xca:
+			r.buf = r.buf[1:]
+			bits, err := r.readBigEndian(4)
+			return float64(math.Float32frombits(uint32(bits))), err
+		case 0xcb:
+			r.buf = r.buf[1:]
+			bits, err := r.readBigEndian(8)
+			return math.Float64frombits(bits), err
+		}
+	}
+
+	// Encoders may shrink integral floats down to integers
+	n, negative, err := r.readInt()
+	if negative {
+		return -float64(n), err
+	}
+	return float64(n), err
+}
+
+func (r *msgpackReader) readUint() (uint64, error) {
+	n, negative, err := r.readInt()
+	if err == nil && negative {
+		err = errors.New("unexpected negative integer")
+	}
+	return n, err
+}
+
+// readInt reads any msgpack integer, returning its magnitude and
+// whether it is negative.
+func (r *msgpackReader) readInt() (uint64, bool, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return uint64(b), false, nil
+	case b >= 0xe0:
+		return uint64(-int8(b)), true, nil
+	case b >= 0xcc && b <= 0xcf:
+		n, err := r.readBigEndian(1 << (b - 0xcc))
+		return n, false, err
+	case b >= 0xd0 && b <= 0xd3:
+		size := 1 << (b - 0xd0)
+		n, err := r.readBigEndian(size)
+		// sign-extend
+		shift := 64 - 8*size
+		v := int64(n<<shift) >> shift
+		if v < 0 {
+			return uint64(-v), true, err
+		}
+		return uint64(v), false, err
+	}
+	return 0, false, fmt.Errorf("expected a msgpack number, got type 0x%02x", b)
+}
+
+// skip consumes the next value, whatever its type.
+//
+// Arrays and maps are skipped by counting the values left to consume
+// rather than recursing, so deeply nested input can't exhaust the
+// stack.
+func (r *msgpackReader) skip() error {
+	for pending := 1; pending > 0; pending-- {
+		elements, err := r.skipHeader()
+		if err != nil {
+			return err
+		}
+		// Every value takes at least a byte
+		if elements > len(r.buf) {
+			return errMsgpackTruncated
+		}
+		pending += elements
+	}
+	return nil
+}
+
+// skipHeader consumes the next value, except for the elements of an
+// array or map, whose number it returns (two per map entry).
+func (r *msgpackReader) skipHeader() (int, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	var size, elements int
+	switch {
+	case b <= 0x7f, b >= 0xe0, b == 0xc0, b == 0xc2, b == 0xc3:
+		return 0, nil
+	case b&0xf0 == 0x80:
+		elements = 2 * int(b&0x0f)
+	case b&0xf0 == 0x90:
+		elements = int(b & 0x0f)
+	case b&0xe0 == 0xa0:
+		size = int(b & 0x1f)
+	case b == 0xc4, b == 0xd9:
+		size, err = r.readLength(1)
+	case b == 0xc5, b == 0xda:
+		size, err = r.readLength(2)
+	case b == 0xc6, b == 0xdb:
+		size, err = r.readLength(4)
+	case b == 0xc7, b == 0xc8, b == 0xc9:
+		// ext: length followed by a type byte
+		size, err = r.readLength(1 << (b - 0xc7))
+		size++
+	case b == 0xca:
+		size = 4
+	case b == 0xcb:
+		size = 8
+	case b >= 0xcc && b <= 0xcf:
+		size = 1 << (b - 0xcc)
+	case b >= 0xd0 && b <= 0xd3:
+		size = 1 << (b - 0xd0)
+	case b >= 0xd4 && b <= 0xd8:
+		// fixext: type byte plus 1, 2, 4, 8 or 16 bytes of data
+		size = 1 + 1<<(b-0xd4)
+	case b == 0xdc:
+		elements, err = r.readLength(2)
+	case b == 0xdd:
+		elements, err = r.readLength(4)
+	case b == 0xde:
+		elements, err = r.readLength(2)
+		elements *= 2
+	case b == 0xdf:
+		elements, err = r.readLength(4)
+		elements *= 2
+	default:
+		return 0, fmt.Errorf("unsupported msgpack type 0x%02x", b)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if len(r.buf) < size {
+		return 0, errMsgpackTruncated
+	}
+	r.buf = r.buf[size:]
+	return elements, nil
+}
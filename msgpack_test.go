@@ -0,0 +1,135 @@
+package tdigest
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(0xC0FFEE))
+
+	for i := 0; i < 50; i++ {
+		t1 := uncheckedNew(Compression(float64(1 + r.Intn(200))))
+		n := r.Intn(5000)
+		for j := 0; j < n; j++ {
+			_ = t1.AddWeighted(r.NormFloat64()*float64(1+r.Intn(1e6)), uint64(1+r.Intn(1e6)))
+		}
+
+		payload, err := t1.MarshalMsgpack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var t2 TDigest
+		err = t2.UnmarshalMsgpack(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if t1.Compression() != t2.Compression() || t1.Count() != t2.Count() ||
+			(n > 0 && (t1.Min() != t2.Min() || t1.Max() != t2.Max())) ||
+			!reflect.DeepEqual(t1.summary.means, t2.summary.means) ||
+			!reflect.DeepEqual(t1.summary.counts, t2.summary.counts) {
+			t.Fatalf("Deserialized to something different. n=%d", n)
+		}
+	}
+}
+
+func TestMsgpackWireFormat(t *testing.T) {
+	digest := uncheckedNew()
+	_ = digest.AddWeighted(1, 1)
+	_ = digest.AddWeighted(2, 2)
+
+	expected := []byte{0x85,
+		0xab, 'c', 'o', 'm', 'p', 'r', 'e', 's', 's', 'i', 'o', 'n', 0xcb, 0x40, 0x59, 0, 0, 0, 0, 0, 0,
+		0xa3, 'm', 'i', 'n', 0xcb, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0,
+		0xa3, 'm', 'a', 'x', 0xcb, 0x40, 0, 0, 0, 0, 0, 0, 0,
+		0xa5, 'm', 'e', 'a', 'n', 's', 0x92, 0xcb, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0, 0xcb, 0x40, 0, 0, 0, 0, 0, 0, 0,
+		0xa6, 'c', 'o', 'u', 'n', 't', 's', 0x92, 0xcf, 0, 0, 0, 0, 0, 0, 0, 1, 0xcf, 0, 0, 0, 0, 0, 0, 0, 2,
+	}
+
+	payload, err := digest.MarshalMsgpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(payload, expected) {
+		t.Errorf("Unexpected encoding. Got %x, wanted %x", payload, expected)
+	}
+
+	// What a size-optimizing encoder would produce for the same
+	// digest, with an extra (nested) entry that must be ignored
+	shrunk := []byte{0x84,
+		0xa5, 'm', 'e', 'a', 'n', 's', 0x92, 0x01, 0xca, 0x40, 0, 0, 0,
+		0xa5, 'e', 'x', 't', 'r', 'a', 0x92, 0x81, 0xa1, 'k', 0xc3, 0xc4, 0x01, 0xff,
+		0xa6, 'c', 'o', 'u', 'n', 't', 's', 0x92, 0x01, 0xcc, 0x02,
+		0xab, 'c', 'o', 'm', 'p', 'r', 'e', 's', 's', 'i', 'o', 'n', 0x64,
+	}
+
+	var other TDigest
+	err = other.UnmarshalMsgpack(shrunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSerialization(t, digest, &other)
+}
+
+func TestMsgpackInvalid(t *testing.T) {
+	digest := uncheckedNew()
+	_ = digest.Add(1)
+	payload, _ := digest.MarshalMsgpack()
+
+	for i := 0; i < len(payload); i++ {
+		var other TDigest
+		if other.UnmarshalMsgpack(payload[:i]) == nil {
+			t.Errorf("Expected truncated payload (%d bytes) to be rejected", i)
+		}
+	}
+
+	inputs := [][]byte{
+		{0x90},             // not a map
+		{0x81, 0x01, 0x01}, // non-string key
+		{0x81, 0xa6, 'c', 'o', 'u', 'n', 't', 's', 0x91, 0xff}, // negative count
+		{0x81, 0xa5, 'm', 'e', 'a', 'n', 's', 0x91, 0x01},      // means without counts
+		append(payload, 0xc0),                                  // trailing data
+	}
+
+	for _, input := range inputs {
+		var other TDigest
+		if other.UnmarshalMsgpack(input) == nil {
+			t.Errorf("Expected error decoding %x", input)
+		}
+	}
+}
+
+func TestMsgpackDeeplyNested(t *testing.T) {
+	digest := uncheckedNew()
+	_ = digest.AddWeighted(1, 1)
+	payload, _ := digest.MarshalMsgpack()
+
+	// An extra entry made of 16 million nested arrays, which must be
+	// skipped without running out of stack
+	const depth = 1 << 24
+	nested := append([]byte{payload[0] + 1, 0xa5, 'e', 'x', 't', 'r', 'a'}, bytes.Repeat([]byte{0x91}, depth)...)
+	nested = append(append(nested, 0xc0), payload[1:]...)
+
+	var other TDigest
+	err := other.UnmarshalMsgpack(nested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSerialization(t, digest, &other)
+
+	// Same, but truncated before the innermost value
+	truncated := append([]byte{payload[0] + 1, 0xa5, 'e', 'x', 't', 'r', 'a'}, bytes.Repeat([]byte{0x91}, depth)...)
+	if other.UnmarshalMsgpack(truncated) == nil {
+		t.Errorf("Expected truncated nested arrays to be rejected")
+	}
+
+	// Maps claiming more entries than there are bytes left
+	if other.UnmarshalMsgpack([]byte{0x81, 0xa1, 'x', 0xde, 0x00, 0x02, 0xc0, 0xc0, 0xc0}) == nil {
+		t.Errorf("Expected a truncated map to be rejected")
+	}
+}
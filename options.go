@@ -1,6 +1,9 @@
 package tdigest
 
-import "errors"
+import (
+	"errors"
+	"math"
+)
 
 type tdigestOption func(*TDigest) error
 
@@ -27,6 +30,26 @@ func Compression(compression float64) tdigestOption { // nolint
 	}
 }
 
+// InitialCapacity sets how many centroids the digest has room for
+// before it needs to grow its buffers. By default, it's estimated
+// from the compression.
+//
+// Digests that are known to stay small (or to grow big) can save
+// memory (or reallocations) this way. This has no effect on the
+// results.
+//
+// Capacity must be a value greater or equal to 0, will yield an
+// error otherwise.
+func InitialCapacity(capacity int) tdigestOption { // nolint
+	return func(t *TDigest) error {
+		if capacity < 0 {
+			return errors.New("Initial capacity should be >= 0")
+		}
+		t.summary = newSummary(capacity)
+		return nil
+	}
+}
+
 // RandomNumberGenerator sets the RNG to be used internally
 //
 // This allows changing which random number source is used when using
@@ -46,6 +69,49 @@ func RandomNumberGenerator(rng RNG) tdigestOption { // nolint
 // LocalRandomNumberGenerator makes the TDigest use the default
 // `math/random` functions but with an unshared source that is
 // seeded with the given `seed` parameter.
+//
+// Digests built with the same seed that are fed the same samples (in
+// the same order) are identical, down to their serialization. This
+// is the way to get reproducible digests.
 func LocalRandomNumberGenerator(seed int64) tdigestOption { // nolint
 	return RandomNumberGenerator(newLocalRNG(seed))
 }
+
+// Scale sets the scale function that bounds the size of centroids,
+// see ScaleFunction. DefaultScale is used if not set.
+func Scale(scale ScaleFunction) tdigestOption { // nolint
+	return func(t *TDigest) error {
+		if scale == nil {
+			return errors.New("Scale function should not be nil")
+		}
+		t.scale = scale
+		return nil
+	}
+}
+
+// BufferFactor sets how many centroids the digest may hold, as a
+// multiple of its compression, before it compresses itself. It
+// defaults to 20.
+//
+// Most samples join existing centroids, but some inputs keep adding
+// new ones: ordered samples, AddCentroid, merges... Compressing then
+// costs time proportional to the number of centroids. A lower factor
+// keeps the peak number of centroids (thus memory and serialization
+// size) down, at the expense of compressing more often and so of
+// slower additions. A higher factor trades memory for throughput.
+// Accuracy barely depends on it. A compressed digest typically holds
+// 5 to 15 centroids per unit of compression, depending on the scale
+// function and on the number of samples: factors below that make it
+// compress on nearly every addition.
+//
+// The factor must be a value greater or equal to 1, will yield an
+// error otherwise.
+func BufferFactor(factor float64) tdigestOption { // nolint
+	return func(t *TDigest) error {
+		if !(factor >= 1) || math.IsInf(factor, 1) {
+			return errors.New("Buffer factor should be a number >= 1")
+		}
+		t.bufferFactor = factor
+		return nil
+	}
+}
@@ -1,6 +1,11 @@
 package tdigest
 
-import "testing"
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+)
 
 func TestDefaults(t *testing.T) {
 	digest, err := New()
@@ -43,3 +48,98 @@ func TestRandomNumberGenerator(t *testing.T) {
 		}
 	}
 }
+
+func TestReproducibility(t *testing.T) {
+	build := func() []byte {
+		digest, _ := New(Compression(20), LocalRandomNumberGenerator(0xC0DE))
+		r := rand.New(rand.NewSource(42))
+		for i := 0; i < 10000; i++ {
+			_ = digest.Add(r.NormFloat64())
+		}
+
+		other, _ := New(LocalRandomNumberGenerator(0xC0DE))
+		for i := 0; i < 1000; i++ {
+			_ = other.Add(r.ExpFloat64())
+		}
+		_ = digest.Merge(other)
+
+		payload, _ := digest.AsBytes()
+		return payload
+	}
+
+	if !bytes.Equal(build(), build()) {
+		t.Errorf("Digests built with the same seed and inputs should serialize identically")
+	}
+}
+
+func TestScale(t *testing.T) {
+	digest, _ := New(Scale(ScaleK1))
+	if digest.scale != ScaleK1 {
+		t.Errorf("The scale option should change the new digest scale function")
+	}
+
+	digest, err := New(Scale(nil))
+	if err == nil || digest != nil {
+		t.Errorf("Trying to create a digest with a nil scale function should give an error")
+	}
+}
+
+func TestInitialCapacity(t *testing.T) {
+	digest, _ := New(InitialCapacity(7), Compression(1000))
+	if cap(digest.summary.means) != 7 || cap(digest.summary.counts) != 7 {
+		t.Errorf("The initial capacity option should size the new digest buffers, got %d", cap(digest.summary.means))
+	}
+
+	digest, _ = New()
+	if cap(digest.summary.means) != estimateCapacity(100) {
+		t.Errorf("Expected the capacity to be estimated from the compression by default, got %d", cap(digest.summary.means))
+	}
+
+	digest, err := New(InitialCapacity(-1))
+	if err == nil || digest != nil {
+		t.Errorf("Trying to create a digest with a negative capacity should give an error")
+	}
+}
+
+func TestBufferFactor(t *testing.T) {
+	for _, factor := range []float64{12, 20, 50} {
+		digest, _ := New(Compression(10), BufferFactor(factor), LocalRandomNumberGenerator(0xB0F))
+		// Ordered samples rarely join existing centroids
+		largest := 0
+		for i := 0; i < 100000; i++ {
+			_ = digest.Add(float64(i))
+			if digest.summary.Len() > largest {
+				largest = digest.summary.Len()
+			}
+		}
+		if float64(largest) > factor*10+1 {
+			t.Errorf("Expected at most %.0f centroids with factor %.0f, got %d", factor*10+1, factor, largest)
+		}
+		if largest < int(factor*10) {
+			t.Errorf("Expected the digest to grow up to %.0f centroids with factor %.0f, got %d", factor*10, factor, largest)
+		}
+		if math.Abs(digest.Median()-50000) > 500 {
+			t.Errorf("Expected a median close to 50000 with factor %.0f, got %f", factor, digest.Median())
+		}
+
+		// Clones get the buffer factor, and decoding into the digest
+		// keeps it whatever the format
+		if digest.Clone().bufferFactor != factor {
+			t.Errorf("Expected Clone() to keep the buffer factor")
+		}
+		buf, _ := digest.AsBytes()
+		if err := digest.FromBytes(buf); err != nil || digest.bufferFactor != factor {
+			t.Errorf("Expected FromBytes() to keep the buffer factor, got %v", err)
+		}
+		data, _ := digest.MarshalJSON()
+		if err := digest.UnmarshalJSON(data); err != nil || digest.bufferFactor != factor {
+			t.Errorf("Expected UnmarshalJSON() to keep the buffer factor, got %v", err)
+		}
+	}
+
+	for _, factor := range []float64{0, 0.5, -1, math.NaN(), math.Inf(1)} {
+		if digest, err := New(BufferFactor(factor)); err == nil || digest != nil {
+			t.Errorf("Trying to create a digest with a buffer factor of %f should give an error", factor)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package tdigest
+
+import (
+	"errors"
+	"sync"
+)
+
+// MergeParallel merges all the given digests, skipping nil ones, into
+// a new digest with the default settings (see New), spreading the
+// work over the given number of goroutines.
+//
+// The digests are split into one contiguous chunk per goroutine, each
+// merged into its own partial digest (see MergeAll), which are then
+// merged pairwise, level after level, with the merges of a level
+// running concurrently. Every goroutine only writes to the partial
+// digests it owns and the given digests are only read, so they must
+// not be modified until this returns.
+//
+// A single worker is the same as MergeAll. More workers only pay off
+// with many digests, the final levels of the tree keeping fewer and
+// fewer goroutines busy.
+//
+// The total count is checked upfront, so overflowing it doesn't merge
+// anything.
+func MergeParallel(digests []*TDigest, workers int) (*TDigest, error) {
+	if workers < 1 {
+		return nil, errors.New("number of workers should be >= 1")
+	}
+	err := checkTotalCount(0, digests)
+	if err != nil {
+		return nil, err
+	}
+
+	if workers > len(digests) {
+		workers = len(digests)
+	}
+	if workers <= 1 {
+		return MergeAll(digests)
+	}
+
+	partials := make([]*TDigest, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := range partials {
+		chunk := digests[i*len(digests)/workers : (i+1)*len(digests)/workers]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			partials[i], errs[i] = MergeAll(chunk)
+		}(i)
+	}
+	wg.Wait()
+
+	for {
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(partials) == 1 {
+			return partials[0], nil
+		}
+
+		// Merge every odd partial into the even one before it, then
+		// keep the even ones for the next level
+		for i := 0; i+1 < len(partials); i += 2 {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = partials[i].Merge(partials[i+1])
+			}(i)
+		}
+		wg.Wait()
+
+		n := 0
+		for i := 0; i < len(partials); i += 2 {
+			partials[n], errs[n] = partials[i], errs[i]
+			n++
+		}
+		partials, errs = partials[:n], errs[:n]
+	}
+}
@@ -0,0 +1,102 @@
+package tdigest
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func buildPartials(n, size int, seed int64) ([]*TDigest, []float64) {
+	r := rand.New(rand.NewSource(seed))
+	var data []float64
+	partials := make([]*TDigest, n)
+	for i := range partials {
+		partials[i] = uncheckedNew(LocalRandomNumberGenerator(int64(i)))
+		for j := 0; j < size; j++ {
+			x := r.ExpFloat64()
+			_ = partials[i].Add(x)
+			data = append(data, x)
+		}
+	}
+	return partials, data
+}
+
+func TestMergeParallel(t *testing.T) {
+	partials, data := buildPartials(1000, 100, 0x9A7A11E1)
+	partials[10], partials[500] = nil, nil
+	var count uint64
+	for _, partial := range partials {
+		if partial != nil {
+			count += partial.Count()
+		}
+	}
+	before := partials[1].Clone()
+
+	serial, err := MergeAll(partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Float64s(data)
+
+	for _, workers := range []int{1, 2, 3, 8, 2000} {
+		merged, err := MergeParallel(partials, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := merged.Validate(); err != nil {
+			t.Errorf("workers=%d: %v", workers, err)
+		}
+		if merged.Count() != count || merged.Min() != serial.Min() || merged.Max() != serial.Max() {
+			t.Errorf("workers=%d: expected %d samples from %f to %f, got %d from %f to %f", workers, count, serial.Min(), serial.Max(), merged.Count(), merged.Min(), merged.Max())
+		}
+
+		for _, q := range []float64{0.001, 0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+			expected := quantile(q, data)
+			if math.Abs(merged.Quantile(q)-expected) > 0.02*expected+0.001 {
+				t.Errorf("workers=%d: Quantile(%g) is %f, expected about %f", workers, q, merged.Quantile(q), expected)
+			}
+		}
+	}
+
+	if partials[1].Count() != before.Count() || partials[1].summary.Len() != before.summary.Len() {
+		t.Errorf("Expected the merged digests to be left untouched")
+	}
+
+	if merged, err := MergeParallel(partials, 1); err != nil || merged.Quantile(0.5) != serial.Quantile(0.5) {
+		t.Errorf("Expected a single worker to behave like MergeAll")
+	}
+
+	empty, err := MergeParallel(nil, 4)
+	if err != nil || empty.Count() != 0 {
+		t.Errorf("Expected an empty digest, got %d samples (%v)", empty.Count(), err)
+	}
+
+	if _, err := MergeParallel(partials, 0); err == nil {
+		t.Errorf("Expected a non-positive number of workers to be rejected")
+	}
+
+	huge := uncheckedNew()
+	_ = huge.AddWeighted(0, math.MaxUint64-10)
+	if _, err := MergeParallel(append(partials, huge), 4); err == nil {
+		t.Errorf("Expected MergeParallel to check for overflows")
+	}
+}
+
+func BenchmarkMergeParallel(b *testing.B) {
+	partials, _ := buildPartials(10000, 100, 0xBE7C)
+
+	b.Run("MergeAll", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			_, _ = MergeAll(partials)
+		}
+	})
+	for _, workers := range []int{2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				_, _ = MergeParallel(partials, workers)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package tdigest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Field numbers and wire types from tdigest.proto
+const (
+	protoFieldCompression = 1
+	protoFieldCount       = 2
+	protoFieldMeans       = 3
+	protoFieldCounts      = 4
+	protoFieldMin         = 5
+	protoFieldMax         = 6
+
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+// MarshalProto serializes the digest as a `TDigest` protocol buffers
+// message, as described by tdigest.proto.
+//
+// Means are encoded as packed doubles and counts as packed varints,
+// so small counts (the common case) take a single byte each.
+func (t TDigest) MarshalProto() ([]byte, error) {
+	n := t.summary.Len()
+	b := make([]byte, 0, 2*binary.MaxVarintLen64+(8+binary.MaxVarintLen64)*(n+4))
+
+	if t.compression != 0 {
+		b = appendProtoTag(b, protoFieldCompression, protoWireFixed64)
+		b = appendFixed64(b, math.Float64bits(t.compression))
+	}
+
+	if t.count != 0 {
+		b = appendProtoTag(b, protoFieldCount, protoWireVarint)
+		b = appendUvarint(b, t.count)
+	}
+
+	if n == 0 {
+		return b, nil
+	}
+
+	b = appendProtoTag(b, protoFieldMin, protoWireFixed64)
+	b = appendFixed64(b, math.Float64bits(t.min))
+	b = appendProtoTag(b, protoFieldMax, protoWireFixed64)
+	b = appendFixed64(b, math.Float64bits(t.max))
+
+	b = appendProtoTag(b, protoFieldMeans, protoWireBytes)
+	b = appendUvarint(b, uint64(8*n))
+	for _, mean := range t.summary.means {
+		b = appendFixed64(b, math.Float64bits(mean))
+	}
+
+	size := 0
+	for _, count := range t.summary.counts {
+		size += uvarintSize(count)
+	}
+	b = appendProtoTag(b, protoFieldCounts, protoWireBytes)
+	b = appendUvarint(b, uint64(size))
+	for _, count := range t.summary.counts {
+		b = appendUvarint(b, count)
+	}
+
+	return b, nil
+}
+
+// UnmarshalProto reinitializes the digest from a `TDigest` protocol
+// buffers message (see MarshalProto), discarding any previously
+// collected data.
+//
+// Both packed and unpacked encodings of the repeated fields are
+// accepted and unknown fields are skipped, as the protobuf spec
+// requires. Missing min and max fields are estimated from the
+// centroids.
+func (t *TDigest) UnmarshalProto(buf []byte) error {
+	var (
+		compression float64
+		count       uint64
+		means       []float64
+		counts      []uint64
+		min, max    = math.NaN(), math.NaN()
+	)
+
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errors.New("error decoding protobuf field tag")
+		}
+		buf = buf[n:]
+
+		field, wireType := tag>>3, tag&7
+		switch {
+		case field == protoFieldCompression && wireType == protoWireFixed64:
+			if len(buf) < 8 {
+				return errors.New("buffer too small for deserialization")
+			}
+			compression = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+			buf = buf[8:]
+		case (field == protoFieldMin || field == protoFieldMax) && wireType == protoWireFixed64:
+			if len(buf) < 8 {
+				return errors.New("buffer too small for deserialization")
+			}
+			x := math.Float64frombits(binary.LittleEndian.Uint64(buf))
+			if field == protoFieldMin {
+				min = x
+			} else {
+				max = x
+			}
+			buf = buf[8:]
+		case field == protoFieldCount && wireType == protoWireVarint:
+			count, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return errors.New("error decoding varint")
+			}
+			buf = buf[n:]
+		case field == protoFieldMeans && wireType == protoWireFixed64:
+			if len(buf) < 8 {
+				return errors.New("buffer too small for deserialization")
+			}
+			means = append(means, math.Float64frombits(binary.LittleEndian.Uint64(buf)))
+			buf = buf[8:]
+		case field == protoFieldMeans && wireType == protoWireBytes:
+			packed, rest, err := readProtoBytes(buf)
+			if err != nil {
+				return err
+			}
+			if len(packed)%8 != 0 {
+				return errors.New("malformed packed means")
+			}
+			for ; len(packed) > 0; packed = packed[8:] {
+				means = append(means, math.Float64frombits(binary.LittleEndian.Uint64(packed)))
+			}
+			buf = rest
+		case field == protoFieldCounts && wireType == protoWireVarint:
+			c, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return errors.New("error decoding varint")
+			}
+			counts = append(counts, c)
+			buf = buf[n:]
+		case field == protoFieldCounts && wireType == protoWireBytes:
+			packed, rest, err := readProtoBytes(buf)
+			if err != nil {
+				return err
+			}
+			for len(packed) > 0 {
+				c, n := binary.Uvarint(packed)
+				if n <= 0 {
+					return errors.New("error decoding varint")
+				}
+				counts = append(counts, c)
+				packed = packed[n:]
+			}
+			buf = rest
+		default:
+			rest, err := skipProtoField(buf, wireType)
+			if err != nil {
+				return err
+			}
+			buf = rest
+		}
+	}
+
+	err := t.loadCentroids(compression, means, counts)
+	if err != nil {
+		return err
+	}
+
+	if count != 0 && count != t.count {
+		return fmt.Errorf("count mismatch: message says %d but centroids hold %d", count, t.count)
+	}
+
+	if t.count > 0 {
+		t.setExtremes(min, max)
+	}
+	return nil
+}
+
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendUvarint(b []byte, n uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(tmp[:], n)
+	return append(b, tmp[:l]...)
+}
+
+func appendFixed64(b []byte, n uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], n)
+	return append(b, tmp[:]...)
+}
+
+func uvarintSize(n uint64) int {
+	size := 1
+	for ; n >= 0x80; n >>= 7 {
+		size++
+	}
+	return size
+}
+
+// readProtoBytes reads a length-delimited field, returning its
+// contents and the remainder of the buffer.
+func readProtoBytes(buf []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, nil, errors.New("error decoding varint")
+	}
+	buf = buf[n:]
+	if uint64(len(buf)) < length {
+		return nil, nil, errors.New("buffer too small for deserialization")
+	}
+	return buf[:length], buf[length:], nil
+}
+
+func skipProtoField(buf []byte, wireType uint64) ([]byte, error) {
+	switch wireType {
+	case protoWireVarint:
+		_, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errors.New("error decoding varint")
+		}
+		return buf[n:], nil
+	case protoWireFixed64:
+		if len(buf) < 8 {
+			return nil, errors.New("buffer too small for deserialization")
+		}
+		return buf[8:], nil
+	case protoWireBytes:
+		_, rest, err := readProtoBytes(buf)
+		return rest, err
+	case protoWireFixed32:
+		if len(buf) < 4 {
+			return nil, errors.New("buffer too small for deserialization")
+		}
+		return buf[4:], nil
+	}
+	return nil, fmt.Errorf("unsupported protobuf wire type: %d", wireType)
+}
@@ -0,0 +1,108 @@
+package tdigest
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestProtoRoundTrip(t *testing.T) {
+	t1 := uncheckedNew()
+	for i := 0; i < 1000000; i++ {
+		_ = t1.Add(rand.ExpFloat64())
+	}
+
+	payload, err := t1.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var t2 TDigest
+	err = t2.UnmarshalProto(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if t1.Min() != t2.Min() || t1.Max() != t2.Max() {
+		t.Errorf("Extremes changed after round-trip: %v %v != %v %v", t2.Min(), t2.Max(), t1.Min(), t1.Max())
+	}
+
+	if t1.Quantile(0.99) != t2.Quantile(0.99) {
+		t.Errorf("Quantile(0.99) changed after round-trip: %v != %v", t1.Quantile(0.99), t2.Quantile(0.99))
+	}
+
+	assertSerialization(t, t1, &t2)
+}
+
+func TestProtoWireFormat(t *testing.T) {
+	digest := uncheckedNew()
+	_ = digest.AddWeighted(1, 1)
+	_ = digest.AddWeighted(2, 2)
+
+	expected := []byte{
+		0x09, 0, 0, 0, 0, 0, 0, 0x59, 0x40, // compression = 100
+		0x10, 0x03, // count = 3
+		0x29, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, // min = 1
+		0x31, 0, 0, 0, 0, 0, 0, 0, 0x40, // max = 2
+		0x1a, 0x10, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0, 0, 0, 0, 0, 0, 0, 0x40, // means = [1, 2]
+		0x22, 0x02, 0x01, 0x02, // counts = [1, 2]
+	}
+
+	payload, err := digest.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(payload, expected) {
+		t.Errorf("Unexpected encoding. Got %x, wanted %x", payload, expected)
+	}
+
+	// Same message, but with unpacked repeated fields and an
+	// unknown field (number 15, varint) in the middle.
+	unpacked := []byte{
+		0x19, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f,
+		0x20, 0x01,
+		0x78, 0x2a,
+		0x19, 0, 0, 0, 0, 0, 0, 0, 0x40,
+		0x20, 0x02,
+		0x09, 0, 0, 0, 0, 0, 0, 0x59, 0x40,
+	}
+
+	var other TDigest
+	err = other.UnmarshalProto(unpacked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSerialization(t, digest, &other)
+}
+
+func TestProtoEmpty(t *testing.T) {
+	var digest TDigest
+	err := digest.UnmarshalProto(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if digest.Compression() != 100 || digest.Count() != 0 {
+		t.Errorf("Expected an empty digest with default compression")
+	}
+}
+
+func TestProtoInvalid(t *testing.T) {
+	inputs := [][]byte{
+		{0x09, 0, 0},       // truncated compression
+		{0x10},             // truncated count
+		{0x10, 0x05},       // count doesn't match the (empty) centroids
+		{0x1a, 0x03, 0, 0}, // truncated means
+		{0x1a, 0x01, 0},    // means not multiple of 8 bytes
+		{0x22, 0x01, 0x01}, // counts without means
+		{0x0b},             // unsupported wire type
+	}
+
+	for _, input := range inputs {
+		var digest TDigest
+		if digest.UnmarshalProto(input) == nil {
+			t.Errorf("Expected error decoding %x", input)
+		}
+	}
+}
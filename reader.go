@@ -0,0 +1,46 @@
+package tdigest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// QuantileFromReader estimates the q-th quantile of the numbers read
+// from r, one per line, with a digest of the given compression.
+//
+// Samples go to the digest as they are read and it compresses itself
+// as it grows, so memory stays bounded however much data r holds.
+// Surrounding whitespace and blank lines are ignored, anything else
+// that isn't a finite number (see strconv.ParseFloat) is an error
+// mentioning its line number. Like Quantile, this returns NaN if r has
+// no numbers at all.
+func QuantileFromReader(r io.Reader, compression float64, q float64) (float64, error) {
+	t, err := New(Compression(compression))
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %q is not a number", line, text)
+		}
+		if err := t.Add(value); err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return t.Quantile(q), nil
+}
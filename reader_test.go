@@ -0,0 +1,72 @@
+package tdigest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestQuantileFromReader(t *testing.T) {
+	rng := rand.New(rand.NewSource(0xF10A7))
+	var buf bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&buf, "%g\n", rng.Float64())
+		if i%1000 == 0 {
+			buf.WriteString("\n  \t\n")
+		}
+	}
+
+	p99, err := QuantileFromReader(&buf, 100, 0.99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(p99-0.99) > 0.001 {
+		t.Errorf("Expected p99 to be about 0.99, got %f", p99)
+	}
+
+	median, err := QuantileFromReader(strings.NewReader(" 3\n1\r\n2"), 100, 0.5)
+	if err != nil || median != 2 {
+		t.Errorf("Expected a median of 2, got %f (%v)", median, err)
+	}
+
+	empty, err := QuantileFromReader(strings.NewReader("\n\n"), 100, 0.5)
+	if err != nil || !math.IsNaN(empty) {
+		t.Errorf("Expected NaN without numbers, got %f (%v)", empty, err)
+	}
+}
+
+func TestQuantileFromReaderErrors(t *testing.T) {
+	inputs := []struct {
+		data    string
+		message string
+	}{
+		{"1\n2\nthree\n4\n", "line 3: \"three\" is not a number"},
+		{"1\n\n1e999\n", "line 3:"},
+		{"NaN\n", "line 1: illegal datapoint"},
+		{"1 2\n", "line 1:"},
+	}
+	for _, input := range inputs {
+		_, err := QuantileFromReader(strings.NewReader(input.data), 100, 0.5)
+		if err == nil || !strings.Contains(err.Error(), input.message) {
+			t.Errorf("Expected an error about %q for %q, got %v", input.message, input.data, err)
+		}
+	}
+
+	if _, err := QuantileFromReader(strings.NewReader("1\n"), 0, 0.5); err == nil {
+		t.Errorf("Expected an invalid compression to be rejected")
+	}
+
+	if _, err := QuantileFromReader(failingReader{}, 100, 0.5); err == nil || err.Error() != "read failed" {
+		t.Errorf("Expected read errors to be returned, got %v", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
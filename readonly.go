@@ -0,0 +1,56 @@
+package tdigest
+
+// Reader is the read-only subset of the methods of a digest, for code
+// that reports on digests owned by someone else. *TDigest implements
+// it, and ReadOnly returns an implementation that can't be converted
+// back into the digest.
+type Reader interface {
+	Quantile(q float64) float64
+	CDF(value float64) float64
+	Count() uint64
+	Min() float64
+	Max() float64
+	ForEachCentroid(f func(mean float64, count uint64) bool)
+}
+
+// readOnly restricts a digest to the Reader methods.
+type readOnly struct {
+	digest *TDigest
+}
+
+// ReadOnly returns a view of the digest that only exposes the Reader
+// methods, so it can be handed to code that must not modify it. The
+// view doesn't copy anything: it reflects the current state of the
+// digest, which must not be modified while the view is in use.
+//
+// Queries don't write to the digest, so the view may be used by
+// several goroutines at once as long as nobody modifies the digest
+// meanwhile. Share a Clone or a Concurrent.Snapshot instead when the
+// digest keeps changing.
+func (t *TDigest) ReadOnly() Reader {
+	return readOnly{digest: t}
+}
+
+func (r readOnly) Quantile(q float64) float64 {
+	return r.digest.Quantile(q)
+}
+
+func (r readOnly) CDF(value float64) float64 {
+	return r.digest.CDF(value)
+}
+
+func (r readOnly) Count() uint64 {
+	return r.digest.Count()
+}
+
+func (r readOnly) Min() float64 {
+	return r.digest.Min()
+}
+
+func (r readOnly) Max() float64 {
+	return r.digest.Max()
+}
+
+func (r readOnly) ForEachCentroid(f func(mean float64, count uint64) bool) {
+	r.digest.ForEachCentroid(f)
+}
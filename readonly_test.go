@@ -0,0 +1,41 @@
+package tdigest
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	var _ Reader = &TDigest{}
+
+	td := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rand.NormFloat64())
+	}
+
+	view := td.ReadOnly()
+	if _, ok := view.(*TDigest); ok {
+		t.Errorf("Expected the view not to be convertible into the digest")
+	}
+
+	check := func() {
+		if view.Quantile(0.9) != td.Quantile(0.9) || view.CDF(0.5) != td.CDF(0.5) || view.Count() != td.Count() || view.Min() != td.Min() || view.Max() != td.Max() {
+			t.Errorf("Expected the view to answer like the digest")
+		}
+		var count uint64
+		view.ForEachCentroid(func(mean float64, c uint64) bool {
+			count += c
+			return true
+		})
+		if count != td.Count() {
+			t.Errorf("Expected the view to iterate over the centroids of the digest, got %d samples", count)
+		}
+	}
+	check()
+
+	// It isn't a copy
+	for i := 0; i < 1000; i++ {
+		_ = td.Add(10 + rand.Float64())
+	}
+	check()
+}
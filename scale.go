@@ -0,0 +1,157 @@
+package tdigest
+
+import "math"
+
+// ScaleFunction maps quantiles to an abstract "k" scale that rules
+// how big centroids can get: a centroid may only span one unit of k.
+// Scale functions that grow steeply near the tails keep centroids
+// there small, which is what makes extreme quantiles accurate.
+//
+// K returns the k value for the quantile q in a digest with the given
+// compression holding n samples and Q is its inverse.
+type ScaleFunction interface {
+	K(q, compression, n float64) float64
+	Q(k, compression, n float64) float64
+}
+
+// centroidSizer is implemented by scale functions that can compute
+// the maximum centroid size directly, instead of relying on K and Q.
+type centroidSizer interface {
+	maxSize(q, compression, n float64) float64
+}
+
+var (
+	// DefaultScale is the scale function used unless told otherwise:
+	// k(q) = δ/4·log(q/(1-q)), which caps centroids at 4nq(1-q)/δ
+	// samples.
+	DefaultScale ScaleFunction = scaleDefault{}
+
+	// ScaleK0 is the linear scale function, k(q) = δq/2. All
+	// centroids have the same maximum size, so tails are no more
+	// accurate than the middle of the distribution.
+	ScaleK0 ScaleFunction = scaleK0{}
+
+	// ScaleK1 is the arcsine scale function from the t-digest paper,
+	// k(q) = δ/(2π)·asin(2q-1).
+	ScaleK1 ScaleFunction = scaleK1{}
+
+	// ScaleK2 is the logistic scale function, k(q) = δ/Z·log(q/(1-q))
+	// with Z = 4·log(n/δ)+24.
+	ScaleK2 ScaleFunction = scaleK2{}
+
+	// ScaleK3 is the logarithmic scale function, k(q) = δ/Z·log(2q)
+	// for q <= 0.5 (mirrored above it), with Z as in ScaleK2. It is
+	// the most accurate at the extreme tails.
+	ScaleK3 ScaleFunction = scaleK3{}
+)
+
+// maxCentroidSize returns how many samples a centroid at quantile q
+// may hold. A nil scale means DefaultScale.
+func maxCentroidSize(scale ScaleFunction, q, compression, n float64) float64 {
+	if scale == nil {
+		scale = DefaultScale
+	}
+	if sizer, ok := scale.(centroidSizer); ok {
+		return sizer.maxSize(q, compression, n)
+	}
+
+	// The samples within half a unit of k on either side
+	k := scale.K(q, compression, n)
+	return n * (scale.Q(k+0.5, compression, n) - scale.Q(k-0.5, compression, n))
+}
+
+// MaxCentroidCount returns how many samples a centroid at quantile q
+// may hold in the digest, as allowed by its scale function and
+// compression for its current Count(): samples only join a centroid
+// that stays within that bound. Bounds are loosest around the median
+// and tighten towards the tails, and they grow with Count(). Out of
+// range quantiles are clamped into [0, 1].
+func (t *TDigest) MaxCentroidCount(q float64) float64 {
+	if math.IsNaN(q) {
+		return math.NaN()
+	}
+	return maxCentroidSize(t.scale, clampQuantile(q), t.compression, float64(t.count))
+}
+
+type scaleDefault struct{}
+
+func (scaleDefault) K(q, compression, n float64) float64 {
+	return compression / 4 * math.Log(q/(1-q))
+}
+
+func (scaleDefault) Q(k, compression, n float64) float64 {
+	return 1 / (1 + math.Exp(-4*k/compression))
+}
+
+func (scaleDefault) maxSize(q, compression, n float64) float64 {
+	return 4 * n * q * (1 - q) / compression
+}
+
+type scaleK0 struct{}
+
+func (scaleK0) K(q, compression, n float64) float64 {
+	return compression * q / 2
+}
+
+func (scaleK0) Q(k, compression, n float64) float64 {
+	return 2 * k / compression
+}
+
+func (scaleK0) maxSize(q, compression, n float64) float64 {
+	return 2 * n / compression
+}
+
+type scaleK1 struct{}
+
+func (scaleK1) K(q, compression, n float64) float64 {
+	return compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (scaleK1) Q(k, compression, n float64) float64 {
+	return (math.Sin(2*math.Pi*k/compression) + 1) / 2
+}
+
+func (scaleK1) maxSize(q, compression, n float64) float64 {
+	return 2 * math.Pi * n * math.Sqrt(q*(1-q)) / compression
+}
+
+// scaleNormalizer is the Z term of ScaleK2 and ScaleK3.
+func scaleNormalizer(compression, n float64) float64 {
+	return 4*math.Log(math.Max(n/compression, 1)) + 24
+}
+
+type scaleK2 struct{}
+
+func (scaleK2) K(q, compression, n float64) float64 {
+	return compression / scaleNormalizer(compression, n) * math.Log(q/(1-q))
+}
+
+func (scaleK2) Q(k, compression, n float64) float64 {
+	return 1 / (1 + math.Exp(-k*scaleNormalizer(compression, n)/compression))
+}
+
+func (scaleK2) maxSize(q, compression, n float64) float64 {
+	return n * scaleNormalizer(compression, n) * q * (1 - q) / compression
+}
+
+type scaleK3 struct{}
+
+func (scaleK3) K(q, compression, n float64) float64 {
+	z := scaleNormalizer(compression, n)
+	if q <= 0.5 {
+		return compression / z * math.Log(2*q)
+	}
+	return -compression / z * math.Log(2*(1-q))
+}
+
+func (scaleK3) Q(k, compression, n float64) float64 {
+	z := scaleNormalizer(compression, n)
+	if k <= 0 {
+		return math.Exp(k*z/compression) / 2
+	}
+	return 1 - math.Exp(-k*z/compression)/2
+}
+
+func (scaleK3) maxSize(q, compression, n float64) float64 {
+	return n * scaleNormalizer(compression, n) * math.Min(q, 1-q) / compression
+}
@@ -0,0 +1,117 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+var scaleFunctions = map[string]ScaleFunction{
+	"default": DefaultScale,
+	"k0":      ScaleK0,
+	"k1":      ScaleK1,
+	"k2":      ScaleK2,
+	"k3":      ScaleK3,
+}
+
+// customScale hides the maxSize shortcut of the builtin functions.
+type customScale struct {
+	ScaleFunction
+}
+
+func TestScaleInverse(t *testing.T) {
+	for name, scale := range scaleFunctions {
+		for _, q := range []float64{0.001, 0.1, 0.25, 0.5, 0.75, 0.9, 0.999} {
+			k := scale.K(q, 100, 1e6)
+			if x := scale.Q(k, 100, 1e6); math.Abs(x-q) > 1e-12 {
+				t.Errorf("Expected %s Q(K(%g)) to be %g, got %g", name, q, q, x)
+			}
+		}
+	}
+}
+
+func TestScaleMaxSize(t *testing.T) {
+	for name, scale := range scaleFunctions {
+		for _, q := range []float64{0.01, 0.2, 0.4, 0.7} {
+			exact := maxCentroidSize(scale, q, 1000, 1e6)
+			approx := maxCentroidSize(customScale{scale}, q, 1000, 1e6)
+			if math.Abs(exact-approx) > 0.01*exact {
+				t.Errorf("Expected %s centroid size at %g to be close to %f, got %f", name, q, exact, approx)
+			}
+		}
+	}
+
+	if maxCentroidSize(nil, 0.3, 100, 1000) != 4*1000*0.3*0.7/100 {
+		t.Errorf("Expected a nil scale to behave like the default one")
+	}
+}
+
+func TestScaleAccuracy(t *testing.T) {
+	for name, scale := range scaleFunctions {
+		for _, s := range []ScaleFunction{scale, customScale{scale}} {
+			td := uncheckedNew(Scale(s))
+			for i := 0; i < 100000; i++ {
+				_ = td.Add(rand.Float64())
+			}
+
+			for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+				if math.Abs(td.Quantile(q)-q) > 0.01 {
+					t.Errorf("Expected %s Quantile(%g) to be close to %g, got %f", name, q, q, td.Quantile(q))
+				}
+			}
+
+			if td.summary.Len() > int(20*td.Compression()) {
+				t.Errorf("Expected %s to keep the digest compressed, got %d centroids", name, td.summary.Len())
+			}
+		}
+	}
+}
+
+func TestScaleTails(t *testing.T) {
+	// Tail-heavy scales keep the smallest centroids at the edges
+	edge := func(scale ScaleFunction) uint64 {
+		td := uncheckedNew(Scale(scale), LocalRandomNumberGenerator(7))
+		r := rand.New(rand.NewSource(7))
+		for i := 0; i < 100000; i++ {
+			_ = td.Add(r.Float64())
+		}
+		_ = td.Compress()
+		return td.summary.Count(0) + td.summary.Count(1) + td.summary.Count(2)
+	}
+
+	if edge(ScaleK0) <= edge(ScaleK3) {
+		t.Errorf("Expected k0 to have bigger centroids in the tails than k3")
+	}
+}
+
+func TestMaxCentroidCount(t *testing.T) {
+	for name, scale := range scaleFunctions {
+		td := uncheckedNew(Scale(scale), Compression(50))
+		for i := 0; i < 100000; i++ {
+			_ = td.Add(rand.Float64())
+		}
+
+		median, tail := td.MaxCentroidCount(0.5), td.MaxCentroidCount(0.99)
+		if median != maxCentroidSize(scale, 0.5, 50, 100000) {
+			t.Errorf("Expected %s bound to follow the scale function, got %f", name, median)
+		}
+		// ScaleK0 bounds are the same everywhere
+		if tail > median || (name != "k0" && tail >= median) {
+			t.Errorf("Expected %s bound at 0.99 (%f) to be tighter than at 0.5 (%f)", name, tail, median)
+		}
+		if td.MaxCentroidCount(-1) != td.MaxCentroidCount(0) || td.MaxCentroidCount(2) != td.MaxCentroidCount(1) {
+			t.Errorf("Expected %s out of range quantiles to be clamped", name)
+		}
+
+		// Compressing more loosens the bounds
+		coarse := uncheckedNew(Scale(scale), Compression(10))
+		_ = coarse.Merge(td)
+		if coarse.MaxCentroidCount(0.5) <= median {
+			t.Errorf("Expected %s bound to grow with a lower compression, got %f and %f", name, coarse.MaxCentroidCount(0.5), median)
+		}
+	}
+
+	if !math.IsNaN(uncheckedNew().MaxCentroidCount(math.NaN())) {
+		t.Errorf("Expected NaN for a NaN quantile")
+	}
+}
@@ -5,43 +5,89 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 )
 
-const smallEncoding int32 = 2
+const (
+	verboseEncoding int32 = 1
+	smallEncoding   int32 = 2
+)
 
 var endianess = binary.BigEndian
 
+// binaryMagic prefixes the payloads produced by AsBytes and is
+// followed by a single format version byte. Its first byte is
+// never zero, which tells it apart from unversioned payloads.
+var binaryMagic = []byte{'t', 'd', 'g'}
+
+const (
+	// unversioned payloads, as written by AsBytes before the
+	// version header was introduced. This is the same layout as
+	// the "small encoding" of the reference Java implementation.
+	legacyVersion byte = 0
+	// legacyVersion prefixed by the version header
+	binaryVersion1 byte = 1
+	// binaryVersion1 with the exact min and max (float64) of the
+	// digest between the header and the rest of the payload
+	binaryVersion2 byte = 2
+
+	binaryVersion = binaryVersion2
+	headerSize    = 4
+	extremesSize  = 16
+)
+
 // AsBytes serializes the digest into a byte array so it can be
 // saved to disk or sent over the wire.
+//
+// The payload starts with a magic prefix and a version byte, so
+// that future format changes can be detected by FromBytes, followed
+// by the exact min and max of the digest. Past those, the layout is
+// the same as the one used by the reference Java implementation (see
+// FromDunningBytes).
 func (t TDigest) AsBytes() ([]byte, error) {
 	// TODO get rid of the (now) useless error
-	return t.ToBytes(make([]byte, t.requiredSize())), nil
+	return t.AppendBytes(nil), nil
 }
 
 func (t *TDigest) requiredSize() int {
-	return 16 + (4 * len(t.summary.means)) + (len(t.summary.counts) * binary.MaxVarintLen64)
+	return headerSize + extremesSize + 16 + (4 * len(t.summary.means)) + (len(t.summary.counts) * binary.MaxVarintLen64)
 }
 
 // ToBytes serializes into the supplied slice, avoiding allocation if the slice
 // is large enough. The result slice is returned.
 func (t *TDigest) ToBytes(b []byte) []byte {
-	requiredSize := t.requiredSize()
-	if cap(b) < requiredSize {
-		b = make([]byte, requiredSize)
+	return t.AppendBytes(b[:0])
+}
+
+// AppendBytes appends the serialized digest (see AsBytes) to dst and
+// returns the extended buffer, like strconv.AppendInt. dst is only
+// reallocated when it lacks the capacity for the largest possible
+// encoding, so reusing the result, e.g. as buf[:0], avoids allocation
+// altogether.
+func (t *TDigest) AppendBytes(dst []byte) []byte {
+	start := len(dst)
+	if requiredSize := start + t.requiredSize(); cap(dst) < requiredSize {
+		dst = append(dst, make([]byte, requiredSize-start)...)
 	}
 
 	// The binary.Put* functions helpfully don't extend the slice for you, they
 	// just panic if it's not already long enough. So pre-set the slice length;
 	// we'll return it with the actual encoded length.
-	b = b[:cap(b)]
+	b := dst[start:cap(dst)]
+
+	copy(b, binaryMagic)
+	b[3] = binaryVersion
+	endianess.PutUint64(b[headerSize:], math.Float64bits(t.min))
+	endianess.PutUint64(b[headerSize+8:], math.Float64bits(t.max))
 
-	endianess.PutUint32(b[0:4], uint32(smallEncoding))
-	endianess.PutUint64(b[4:12], math.Float64bits(t.compression))
-	endianess.PutUint32(b[12:16], uint32(t.summary.Len()))
+	idx := headerSize + extremesSize
+	endianess.PutUint32(b[idx:], uint32(smallEncoding))
+	endianess.PutUint64(b[idx+4:], math.Float64bits(t.compression))
+	endianess.PutUint32(b[idx+12:], uint32(t.summary.Len()))
 
 	var x float64
-	idx := 16
+	idx += 16
 	for _, mean := range t.summary.means {
 		delta := mean - x
 		x = mean
@@ -52,7 +98,7 @@ func (t *TDigest) ToBytes(b []byte) []byte {
 	for _, count := range t.summary.counts {
 		idx += binary.PutUvarint(b[idx:], count)
 	}
-	return b[:idx]
+	return dst[:start+idx]
 }
 
 // FromBytes reads a byte buffer with a serialized digest (from AsBytes)
@@ -61,9 +107,27 @@ func (t *TDigest) ToBytes(b []byte) []byte {
 // This function creates a new tdigest instance with the provided options,
 // but ignores the compression setting since the correct value comes
 // from the buffer.
+//
+// Payloads written before AsBytes started emitting a version header
+// are still accepted. Since those lack the exact min and max of the
+// digest, they are then estimated from the extreme centroid means.
+// Payloads whose centroids fail the checks of Validate are rejected.
 func FromBytes(buf *bytes.Reader, options ...tdigestOption) (*TDigest, error) {
+	version, err := readBinaryVersion(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	extremes := [2]float64{math.NaN(), math.NaN()}
+	if version >= binaryVersion2 {
+		err = binary.Read(buf, endianess, &extremes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var encoding int32
-	err := binary.Read(buf, endianess, &encoding)
+	err = binary.Read(buf, endianess, &encoding)
 	if err != nil {
 		return nil, err
 	}
@@ -117,9 +181,13 @@ func FromBytes(buf *bytes.Reader, options ...tdigestOption) (*TDigest, error) {
 			return nil, err
 		}
 		t.summary.counts[i] = count
-		t.count += count
 	}
 
+	t.count, err = validateCentroids(t.summary.means, t.summary.counts)
+	if err != nil {
+		return nil, err
+	}
+	t.setExtremes(extremes[0], extremes[1])
 	return t, nil
 }
 
@@ -127,37 +195,136 @@ func FromBytes(buf *bytes.Reader, options ...tdigestOption) (*TDigest, error) {
 // and overwriting any existing buffers.
 //
 // This method reinitializes the digest from the provided buffer
-// discarding any previously collected data. Notice that in case
-// of errors this may leave the digest in a unusable state.
+// discarding any previously collected data. Like the FromBytes
+// function, it rejects payloads with invalid centroids. Notice that
+// in case of errors this may leave the digest in a unusable state.
 func (t *TDigest) FromBytes(buf []byte) error {
+	var means []float64
+	var counts []uint64
+	if t.summary != nil {
+		means, counts = t.summary.means, t.summary.counts
+	}
+
+	header, means, counts, err := decodeBytes(buf, means, counts)
+	if err != nil {
+		return err
+	}
+
+	if t.summary == nil {
+		t.summary = &summary{}
+	}
+	t.summary.means = means
+	t.summary.counts = counts
+	t.summary.invalidate()
+	t.count = t.summary.GetTotalCount()
+	t.compression = header.compression
+	t.setExtremes(header.min, header.max)
+	if t.rng == nil {
+		t.rng = newLocalRNG(1)
+	}
+	return nil
+}
+
+// MergeBytes joins a digest serialized with AsBytes into itself.
+//
+// It is equivalent to merging with the result of FromBytes, but
+// the centroids are decoded straight from the buffer instead of
+// building an intermediate digest. The whole buffer is decoded and
+// validated before any sample is added, so the digest is left
+// untouched if the payload is corrupt. As with Merge, the result
+// keeps the receiver's compression and is compressed again if the
+// payload's one differs.
+func (t *TDigest) MergeBytes(buf []byte) error {
+	header, means, counts, err := decodeBytes(buf, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	total := t.count
+	for _, count := range counts {
+		err = checkCountOverflow(total, count)
+		if err != nil {
+			return err
+		}
+		total += count
+	}
+
+	if len(means) > 0 {
+		// Payloads that predate binaryVersion2 don't know their
+		// extremes, the means are the best guess then
+		min, max := header.min, header.max
+		if math.IsNaN(min) {
+			min, max = means[0], means[len(means)-1]
+		}
+		t.breakConstant(min, max)
+	}
+
+	shuffle(means, counts, t.rng)
+	for i, mean := range means {
+		err = t.insert(mean, counts[i])
+		if err != nil {
+			return err
+		}
+	}
+	if len(means) == 0 {
+		return nil
+	}
+	return t.finishMerge(header.min, header.max, header.compression)
+}
+
+// binaryHeader holds the digest-wide fields of a binary payload.
+type binaryHeader struct {
+	compression float64
+	// NaN for payloads that predate binaryVersion2
+	min, max float64
+}
+
+// decodeBytes decodes a payload in any of the formats accepted by
+// FromBytes, storing the centroids in the supplied slices (which are
+// reallocated if too small) and returning them with the header. The
+// centroids are checked like Validate does.
+func decodeBytes(buf []byte, means []float64, counts []uint64) (binaryHeader, []float64, []uint64, error) {
+	header := binaryHeader{min: math.NaN(), max: math.NaN()}
+
+	version, buf, err := splitBinaryVersion(buf)
+	if err != nil {
+		return header, nil, nil, err
+	}
+
+	if version >= binaryVersion2 {
+		if len(buf) < extremesSize {
+			return header, nil, nil, errors.New("buffer too small for deserialization")
+		}
+		header.min = math.Float64frombits(endianess.Uint64(buf))
+		header.max = math.Float64frombits(endianess.Uint64(buf[8:]))
+		buf = buf[extremesSize:]
+	}
+
 	if len(buf) < 16 {
-		return errors.New("buffer too small for deserialization")
+		return header, nil, nil, errors.New("buffer too small for deserialization")
 	}
 
 	encoding := int32(endianess.Uint32(buf))
 	if encoding != smallEncoding {
-		return fmt.Errorf("unsupported encoding version: %d", encoding)
+		return header, nil, nil, fmt.Errorf("unsupported encoding version: %d", encoding)
 	}
 
-	compression := math.Float64frombits(endianess.Uint64(buf[4:12]))
+	header.compression = math.Float64frombits(endianess.Uint64(buf[4:12]))
 	numCentroids := int(endianess.Uint32(buf[12:16]))
 	if numCentroids < 0 || numCentroids > 1<<22 {
-		return errors.New("bad number of centroids in serialization")
+		return header, nil, nil, errors.New("bad number of centroids in serialization")
 	}
 
 	if len(buf) < 16+(4*numCentroids) {
-		return errors.New("buffer too small for deserialization")
+		return header, nil, nil, errors.New("buffer too small for deserialization")
 	}
 
-	t.count = 0
-	t.compression = compression
-	if t.summary == nil ||
-		cap(t.summary.means) < numCentroids ||
-		cap(t.summary.counts) < numCentroids {
-		t.summary = newSummary(numCentroids)
+	if cap(means) < numCentroids || cap(counts) < numCentroids {
+		means = make([]float64, 0, numCentroids)
+		counts = make([]uint64, 0, numCentroids)
 	}
-	t.summary.means = t.summary.means[:numCentroids]
-	t.summary.counts = t.summary.counts[:numCentroids]
+	means = means[:numCentroids]
+	counts = counts[:numCentroids]
 
 	idx := 16
 	var x float64
@@ -165,24 +332,407 @@ func (t *TDigest) FromBytes(buf []byte) error {
 		delta := math.Float32frombits(endianess.Uint32(buf[idx:]))
 		idx += 4
 		x += float64(delta)
-		t.summary.means[i] = x
+		means[i] = x
 	}
 
 	for i := 0; i < numCentroids; i++ {
 		count, read := binary.Uvarint(buf[idx:])
 		if read < 1 {
-			return errors.New("error decoding varint, this TDigest is now invalid")
+			return header, nil, nil, errors.New("error decoding varint")
 		}
 
 		idx += read
-
-		t.summary.counts[i] = count
-		t.count += count
+		counts[i] = count
 	}
 
 	if idx != len(buf) {
-		return errors.New("buffer has unread data")
+		return header, nil, nil, errors.New("buffer has unread data")
+	}
+	_, err = validateCentroids(means, counts)
+	if err != nil {
+		return header, nil, nil, err
+	}
+	return header, means, counts, nil
+}
+
+// FromDunningBytes deserializes a digest serialized by the reference
+// Java implementation (https://github.com/tdunning/t-digest) with
+// either `AVLTreeDigest.asBytes` or `AVLTreeDigest.asSmallBytes`.
+//
+// Both layouts are big-endian (the ByteBuffer default) and start
+// with an int32 encoding tag, the compression as a double and the
+// number of centroids as an int32. The verbose layout follows with
+// every mean as a double and then every count as an int32, while
+// the small one stores float32 deltas between consecutive means and
+// varint-encoded counts. Versions 3.2 and later of the Java library,
+// which also serialize min and max, are not supported.
+//
+// Like FromBytes, the compression option is ignored since the
+// correct value comes from the buffer.
+func FromDunningBytes(buf []byte, options ...tdigestOption) (*TDigest, error) {
+	if len(buf) < 16 {
+		return nil, errors.New("buffer too small for deserialization")
+	}
+
+	t, err := newWithoutSummary(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding := int32(endianess.Uint32(buf))
+	switch encoding {
+	case smallEncoding:
+		err = t.FromBytes(buf)
+	case verboseEncoding:
+		err = t.fromVerboseBytes(buf)
+	default:
+		err = fmt.Errorf("unsupported encoding version: %d", encoding)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TDigest) fromVerboseBytes(buf []byte) error {
+	compression := math.Float64frombits(endianess.Uint64(buf[4:12]))
+	numCentroids := int(int32(endianess.Uint32(buf[12:16])))
+	if numCentroids < 0 || numCentroids > 1<<22 {
+		return errors.New("bad number of centroids in serialization")
+	}
+
+	buf = buf[16:]
+	if len(buf) != 12*numCentroids {
+		return errors.New("unexpected buffer size for deserialization")
+	}
+
+	means := make([]float64, numCentroids)
+	counts := make([]uint64, numCentroids)
+	for i := range means {
+		means[i] = math.Float64frombits(endianess.Uint64(buf[8*i:]))
+	}
+
+	buf = buf[8*numCentroids:]
+	for i := range counts {
+		count := int32(endianess.Uint32(buf[4*i:]))
+		if count <= 0 {
+			return fmt.Errorf("bad centroid count in serialization: %d", count)
+		}
+		counts[i] = uint64(count)
+	}
+
+	return t.loadCentroids(compression, means, counts)
+}
+
+// WriteTo implements io.WriterTo.
+//
+// It writes the digest to w in the same format as AsBytes, but
+// without building the whole payload in memory first.
+func (t *TDigest) WriteTo(w io.Writer) (int64, error) {
+	sw := streamWriter{w: w, buf: make([]byte, 0, 512)}
+
+	header := sw.reserve(headerSize + extremesSize + 16)
+	copy(header, binaryMagic)
+	header[3] = binaryVersion
+	endianess.PutUint64(header[4:], math.Float64bits(t.min))
+	endianess.PutUint64(header[12:], math.Float64bits(t.max))
+	endianess.PutUint32(header[20:], uint32(smallEncoding))
+	endianess.PutUint64(header[24:], math.Float64bits(t.compression))
+	endianess.PutUint32(header[32:], uint32(t.summary.Len()))
+
+	var x float64
+	for _, mean := range t.summary.means {
+		delta := mean - x
+		x = mean
+		endianess.PutUint32(sw.reserve(4), math.Float32bits(float32(delta)))
+	}
+
+	for _, count := range t.summary.counts {
+		sw.putUvarint(count)
+	}
+
+	sw.flush()
+	return sw.n, sw.err
+}
+
+// ReadFrom implements io.ReaderFrom.
+//
+// It reinitializes the digest with a single digest read from r, in
+// any of the formats accepted by FromBytes. Unlike most ReaderFrom
+// implementations, it stops reading right after the digest, so it
+// can be called repeatedly to read a sequence of digests from a
+// stream. Passing an io.ByteReader (a bufio.Reader, for example)
+// avoids issuing one Read call per byte when decoding counts.
+//
+// When r has no data at all the error is io.EOF; a stream that is
+// truncated mid-digest yields io.ErrUnexpectedEOF. The digest is
+// only modified if the whole digest is read successfully.
+func (t *TDigest) ReadFrom(r io.Reader) (int64, error) {
+	cr := countingReader{r: r}
+	err := t.readFrom(&cr)
+	return cr.n, err
+}
+
+func (t *TDigest) readFrom(r *countingReader) error {
+	var header [headerSize + 16]byte
+	_, err := io.ReadFull(r, header[:headerSize])
+	if err != nil {
+		return err
+	}
+
+	extremes := [2]float64{math.NaN(), math.NaN()}
+	body := header[headerSize:]
+	if bytes.Equal(header[:len(binaryMagic)], binaryMagic) {
+		var version byte
+		version, err = checkBinaryVersion(header[len(binaryMagic)])
+		if err != nil {
+			return err
+		}
+
+		if version >= binaryVersion2 {
+			err = binary.Read(r, endianess, &extremes)
+			if err != nil {
+				return noEOF(err)
+			}
+		}
+		_, err = io.ReadFull(r, body)
+	} else {
+		// unversioned payload, what we just read is the encoding
+		body = header[:16]
+		_, err = io.ReadFull(r, body[headerSize:])
+	}
+	if err != nil {
+		return noEOF(err)
+	}
+
+	encoding := int32(endianess.Uint32(body))
+	if encoding != smallEncoding {
+		return fmt.Errorf("unsupported encoding version: %d", encoding)
+	}
+
+	compression := math.Float64frombits(endianess.Uint64(body[4:12]))
+	numCentroids := int(endianess.Uint32(body[12:16]))
+	if numCentroids < 0 || numCentroids > 1<<22 {
+		return errors.New("bad number of centroids in serialization")
+	}
+
+	means := make([]float64, numCentroids)
+	counts := make([]uint64, numCentroids)
+
+	var delta [4]byte
+	var x float64
+	for i := range means {
+		_, err = io.ReadFull(r, delta[:])
+		if err != nil {
+			return noEOF(err)
+		}
+		x += float64(math.Float32frombits(endianess.Uint32(delta[:])))
+		means[i] = x
+	}
+
+	for i := range counts {
+		counts[i], err = binary.ReadUvarint(r)
+		if err != nil {
+			return noEOF(err)
+		}
+	}
+
+	err = t.loadCentroids(compression, means, counts)
+	if err != nil {
+		return err
+	}
+	t.setExtremes(extremes[0], extremes[1])
+	return nil
+}
+
+// setExtremes sets the exact min and max of a decoded digest, falling
+// back to resetExtremes when the payload didn't carry them (NaN).
+//
+// The decoded means may be slightly off (e.g.: float32 deltas), so
+// they are deliberately not taken into account.
+func (t *TDigest) setExtremes(min, max float64) {
+	if math.IsNaN(min) || math.IsNaN(max) {
+		t.resetExtremes()
+		return
+	}
+	t.min, t.max = min, max
+}
+
+// streamWriter buffers small writes to an io.Writer, keeping track
+// of how many bytes were written and of the first error found.
+type streamWriter struct {
+	w   io.Writer
+	buf []byte
+	n   int64
+	err error
+}
+
+// reserve returns a slice of size bytes at the end of the buffer,
+// flushing it first if there isn't enough room.
+func (s *streamWriter) reserve(size int) []byte {
+	if cap(s.buf)-len(s.buf) < size {
+		s.flush()
+	}
+	s.buf = s.buf[:len(s.buf)+size]
+	return s.buf[len(s.buf)-size:]
+}
+
+func (s *streamWriter) putUvarint(n uint64) {
+	l := binary.PutUvarint(s.reserve(binary.MaxVarintLen64), n)
+	s.buf = s.buf[:len(s.buf)-binary.MaxVarintLen64+l]
+}
+
+func (s *streamWriter) flush() {
+	if s.err == nil && len(s.buf) > 0 {
+		var n int
+		n, s.err = s.w.Write(s.buf)
+		s.n += int64(n)
+	}
+	s.buf = s.buf[:0]
+}
+
+// countingReader counts the bytes read from an io.Reader, also
+// implementing io.ByteReader on top of it.
+type countingReader struct {
+	r       io.Reader
+	n       int64
+	scratch [1]byte
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	if br, ok := c.r.(io.ByteReader); ok {
+		b, err := br.ReadByte()
+		if err == nil {
+			c.n++
+		}
+		return b, err
+	}
+
+	_, err := io.ReadFull(c, c.scratch[:])
+	return c.scratch[0], err
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for when reaching the
+// end of the stream means it was truncated.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// GobEncode implements gob.GobEncoder using the AsBytes format.
+func (t TDigest) GobEncode() ([]byte, error) {
+	return t.AsBytes()
+}
+
+// GobDecode implements gob.GobDecoder, accepting any payload that
+// the FromBytes method does.
+func (t *TDigest) GobDecode(buf []byte) error {
+	return t.FromBytes(buf)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using the
+// AsBytes format.
+func (t TDigest) MarshalBinary() ([]byte, error) {
+	return t.AsBytes()
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, accepting
+// any payload that the FromBytes method does. Like it, this discards
+// any previously collected data.
+func (t *TDigest) UnmarshalBinary(buf []byte) error {
+	return t.FromBytes(buf)
+}
+
+// readBinaryVersion consumes the version header from buf, if there
+// is one, returning the format version of the payload.
+func readBinaryVersion(buf *bytes.Reader) (byte, error) {
+	var header [headerSize]byte
+	n, _ := buf.Read(header[:])
+	if n < headerSize || !bytes.Equal(header[:len(binaryMagic)], binaryMagic) {
+		_, err := buf.Seek(int64(-n), io.SeekCurrent)
+		return legacyVersion, err
+	}
+	return checkBinaryVersion(header[len(binaryMagic)])
+}
+
+// splitBinaryVersion is like readBinaryVersion, but for byte slices:
+// it returns the version and the payload past the header.
+func splitBinaryVersion(buf []byte) (byte, []byte, error) {
+	if len(buf) < headerSize || !bytes.HasPrefix(buf, binaryMagic) {
+		return legacyVersion, buf, nil
+	}
+	version, err := checkBinaryVersion(buf[len(binaryMagic)])
+	return version, buf[headerSize:], err
+}
+
+func checkBinaryVersion(version byte) (byte, error) {
+	if version == legacyVersion || version > binaryVersion {
+		return 0, fmt.Errorf("unsupported format version: %d", version)
+	}
+	return version, nil
+}
+
+// loadCentroids replaces the contents of the digest with the given
+// centroids. A zero compression means the default one. The digest
+// keeps its random number generator, scale function, interpolation
+// and tie-breaking.
+//
+// The centroids are checked like Validate does (finite means sorted
+// in increasing order, positive counts that don't overflow), and the
+// digest is left untouched if they are invalid.
+//
+// Min and max are estimated from the extreme centroid means, callers
+// that know the exact values should update them afterwards.
+func (t *TDigest) loadCentroids(compression float64, means []float64, counts []uint64) error {
+	if len(means) != len(counts) {
+		return fmt.Errorf("mismatched centroid data: %d means but %d counts", len(means), len(counts))
+	}
+	total, err := validateCentroids(means, counts)
+	if err != nil {
+		return err
+	}
+
+	options := []tdigestOption{}
+	if compression != 0 {
+		options = append(options, Compression(compression))
+	}
+	if t.rng != nil {
+		options = append(options, RandomNumberGenerator(t.rng))
+	}
+	if t.scale != nil {
+		options = append(options, Scale(t.scale))
+	}
+	options = append(options, QuantileInterpolation(t.interpolation), QuantileTies(t.ties))
+	if t.bufferFactor != 0 {
+		options = append(options, BufferFactor(t.bufferFactor))
+	}
+
+	digest, err := newWithoutSummary(options...)
+	if err != nil {
+		return err
+	}
+
+	capacity := estimateCapacity(digest.compression)
+	if len(means) > capacity {
+		capacity = len(means)
 	}
+	digest.summary = newSummary(capacity)
+	digest.summary.means = append(digest.summary.means, means...)
+	digest.summary.counts = append(digest.summary.counts, counts...)
+	digest.count = total
+	digest.summary.cachePrefixSums()
+	digest.resetExtremes()
+
+	*t = *digest
 	return nil
 }
 
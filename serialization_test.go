@@ -2,11 +2,16 @@ package tdigest
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/base64"
+	"encoding/gob"
+	"io"
 	"math"
 	"math/rand"
 	"reflect"
+	"sort"
 	"testing"
+	"testing/iotest"
 )
 
 func TestEncodeDecode(t *testing.T) {
@@ -187,6 +192,9 @@ func TestLargeSerializaton(t *testing.T) {
 	assertSerialization(t, t1, t3)
 }
 
+// See TestJavaSmallBytesCompat for how this was generated.
+const serializedJavaTDigestB64 = "AAAAAkBZAAAAAAAAAAAEOzZpD1w24ySbN288eDfDHOI3jwpPN7jIyze1xXM2BzmuNc6x9DdUUcs2o1QFNvb5tzeNwTo2l0VYNgD89jaAiB83GxMBNTdLZzVjwOk3oKiDNxhS4jZ2blc2zTiiN8rlKDc7gN01HN5jNgF8bDYhIGo3BsH5NlbMcDdtCKQ3eJMUNzzuazQuLpY2y0lcNqNDdDcNDr03zOJ1N3ESMjcqxd42omxHNdA+mDbJmlo3KrIGN5i5/DegwGw10QY2NRuEmjdARF42g8qeN8L4yjajFVs1oIo9NvoNwDdrnuk2LeJGNwFHnTgGqu82TzfHN41Syzbd4xU2XjMVN1GPQjbMZOI2l91oNnY8CDdCy7U1wCuMNwLfyjfGDDo3FWWBNiEsSTiE9ZQ3rY03N6fEbDULhxU3i9qZNxuifjbeoMQ3vJ9mNpxU6jbvhEE3qOmYNrG09jcions3F6YRN5Ny1DUG5+E3P2m7NxXWSzd9PD03GBO9N+INZjczo844exOsNxmKIjgnk242m3GdNxrymzcJGSI1MVGaN6OzizblJ+43D9D/NvxA1Df2mZw339fFOB/KWzdN4WM4MhJoNpShjDfafXk3uSflN/uHhDeIUvI3ZOFqNqUkCDgokRU4VWp2Nzz1UjfigVQ4PHzkN8bWhzc21Kc3vOyQN8SJPjhEt344cC6EOAc/ZjfA9D04NZB9OAx8mzgsvD83oqOINzpg9jg9CWo4Y2qdN/r4XjbiH544DQY6OMvJSThcl+g4mnOyOKqdIzd91to4K72fODbsgjiPb2o4AmM6OIXueDhuDMs4PW1yN3ci2jhZGWY4aM5oOCDGwjiBKsk4FLcON7gbNTgr/zQ4e9V2N7qMkjiRTE04OiCKOA+kqDhK2u83jJvIN/P+6Tgw7v04voUSOExQKTgt8OU4ND0lN9CbPzhIfws4UJvSOBqgKzhe1TM4yVlsOLqRxjhsUw03lttXOEGkjTiTqns4kcOmOG2D5DgFx7847tKPONixTDhm8a84mAD1OFCXQzif2W84eVdkOPgJ+jjQy0g4a1HVOHLm7zjKP0k40bH4ODTQizj5Vn448ubuOQbg9TkIbEw4nuqfONUhyTktbsc48dTQOWSR7TkfJfU47iIfOQDP3jkN52Y5OibNOR1tRTk4XgM5JS+XODkp1DjNnOo4zOE/OTcKaDkfd4c5HTjLOTfMtzk1Tng5HH8aOTdpejlQok44yYMwN68whzgmY3o4kGHlOIRTqTkd2Jg45Dd0OHlnWzkEqtA5PENgOT6ckzlmuTQ5LPhpOL2F3zmPFVg5sPneOWfCETkZWu85KkV9ONN2zzlVKg85k3xqOYMdETkujEg5FZlSOYv3FznTwq05w571OXYNQDlfBkQ5NaiZOK74YzjPWAY5BSnsOUOhdTmCIsM5aphbOTm7cjmYQPw5WyLLOV8xQznRMgU5zm+AOb5MBDmEpF45lqbbOW3LNzlc5LI5ny6QObux3zmCqUY5JJyxOXAibjm8mJA5zUCAOeW3Tznyf3w59LruOceUBzn0Gx05vTtsOfquPDoaISI58SiPOdEPpznD/cw5yU1bObG+/zm6Urs5vqXbOcfLwDmrd4s51P3sOhMXXTogDTA51iYXObgArDnGgzQ5/T2FOfi0RjndrFQ5y0IuOhXqcDorpag6RHR1Oixgxjnpq5Y5svRMOdkKbzmou5k5xefuOdiV6DooArU6SnueOkSo6ToPT2o6BvjmOgtxUjoXlSw6G2tQOfUe9jnksDw52dLDOi/y0TpDLTg6NmYNOgqIbTmzGkE52tMyOoJqNzqnDaQ6q5T1Opv6UTqQdX06g9A3OnfuGzqFI246hlrhOmJtZjpf25k6FCyPOhAMgDo1nyI6TLhWOoVgwzqXc746gJc8OlnKVjo/gk86iR5UOpq7PTqdzGY6fspZOp6HRjqEU7w6So02OiKgNToiGkg6aR5oOpHAEDpRg+M6TXTPOnXxkjq5Ct069YXFOvA6NDry/wY65ooNOtzuzDq+ECw6mx8DOpM6qzrBq7E6wn5oOsrlYDsOlM87DKunOw2+iDrzrio6xuE4OrWjPDqoohQ60tC2OvuLODrrWeE63cvKOtKc2jq/DwE6t3QKOrLbvDqrGOI6vpYpOv+cezslrTw7Gp54OxOm8zsWlYM7H8mYOz5/qzs1fHE7MGNuOzCnFDs1TVs7P/9NOx9ocTr+Wzs6+KXkOxOgZjrNhNA6gXVdOmH0LzqUolA6zwgZOw9UyTsD9I46/6KVOwVc4zsa2pc7CwuyOsUzETqLuas6mdYmOwWSnTswT4o7JX7qOwqBMzr5UBY66uyWOvW5NTsKjMk7JL4oOyJEiTsuq1Y7QQhEOzLQBjsjYeg7BRP5OvfqBTsPYUI7Lhs+O1NqIzuFBsU7eMaTOzuwvDsVjz47FheUOzc2FTtf4y87eSLlO4FCMDuE1iI7jx8lO6CXezuLCc87SkkEOw9XGzrUN/o60S9OOwRbLjs1xu87d3xMO32c8zuL04A7kPoQO4I88jtgMhk7PfEaOxILhDrxJ/g6+S+dOxZK4js70sU7ZAatO41myjuP8FU7iNOzO5IsQzuUZZ47anfmOzKbiDssSQo7RbdFOzZGbzsijbg7EdwqOzAoGzs/cx87c6CdO6fSjju/2mE7s2PuO7BVFDuvFvU7uGxCO6KcTzuFdpY7gW0tO1MZejs+0u87bhNOO5hzHDuuqfU7puR+O27/RjsnXA87FRP2OyNyRTtbJ4A7oHBjO6aMVTu2P3I7xGZWO8iz2TvO9Ns7xOtWO6PXxjt9d/47cPPYO31G+Ds3erY6yE0aOk8xCDpGySk6qq7zOvjgZTsgTBs7NM8GOx3z6Tsq29w7NmsfO0Hreztu3xY7dk9WO3TTGDtiz0s7ZOMLO46IeDuO1vk7bpo/O25jnDt3Vek7lJ5YO5mNajtsaXA7Fv+0Ou/dCTsJbAs7PTjsO22GJzt2eTk7XRjBO340CzuCQOw7clTLO19aJDs0gkk7EHVbOx2iqTsiMhI7I3XXOxQtAjsXZlM7JfrQOzPyIjtHLgk7fNvUO4nBdDuOYZI7hCk6O2l7ITtjevg7WwaEO1/S6TtFPiY7MW19O2bjLzt03jI7gsFbO4PWBDuGU9U7noVhO7Hg3zufXSU7gVMiO1o9xztFxDo7OaUcO2D1wztT9/87XyIcO0mFPzszGc47Kht5Oz23WjtmjYg7gKOVO3IZfDtIzFg7GVHmOuB6KDrOLOQ7CF6POyzH1TsuH3Q7OM/DO0xskTtuJHQ7cMB/O4bPzzuLdOU7h2SsO2f2xDs8IKw7JR0+Oyvwhjsae7E7DcaqOvnPADrXxC063tLlOvY0zTsTxUI7IkbcOzkVzzs/RpM7M1ZDOzBmnjs87aU7VcmTO0DL/zsbCFE69oQyOtABijrpNtM69c8UOu225DqbxxA6azZrOlKXRDp7vwE6p0qUOqxh8zqs7JE6rdnqOtzxNzsOlb47FRw2OxtFIDr6nlQ6yv8ROqncETqkc4I6m2kEOmU4oTp3bec6roWNOtkwujq4hkw6iT+5OnlU+DpkEhQ6aw67Opyl9DqM79c6S3J2Ofz8rDn30cA6HOhuOgXIsToEZQQ5znUNOgH78zoTKKU6YLyIOnWfAjqSDVk6hWPrOnGUwDpqn3c6eY3AOlo1SDqC9kU6bS35OoHBLzp8WgI6So6gOgZ8fzo4Ibw6elzBOo5ZVTp5wSU6d0e+OnCgezpxp1M6NoEzOiXlxzpUG4o6ZLCKOmLp9Tot5oU6Ja0OOhfxAzo4qNI6O9+0OjMq5zorV7w6Gv+gOhnd8zn7P1o6IRscOhLPqDngEEg5uIZJOdmxAToNmYA6Gm3GOmg3sjpCPz06WyRCOmGz3zovg7050RuqOfX3WDol3yg6ZUH8OjrgyzoIwlI6H9qmOhtrGTovTtc6SJ3rOkDdRzoYcX46D3P0OhFudToCa2A6BWyTOaegSzlmUn05X3MqOY5bPjnGv7Q55MBkOil2NDo4lt86Ro6YOlW4mjob5ig5wtjpOZheyTmLg/c5iuH1OYyCVjk+Om85JLQMOZCxJjmP6ro5kcX3OfVvATnGgWE5haCUOP8UPDk8C6Q5iKLHOUrz4zk0mMw5WFZuOUwQ6jl2t2A5qF4BOZp7xzmMEhU5yBgqOdWqmDnmxrg5e4YkOUTKvzkklbs42a5MOTN8WTkWOKU5YfgsOUAgnjmPd1g5h/cCOWbI1TmTGvQ5c2+oOYGlXTlz5jU5WuZmOUBj6Tka3hs5kuGEOUJ64DlaTDI5Qx6wOWLktTk6UT44uJu4OSVojjlryTM5HOuzOKzKFjkzpaA5IKMzOU6a+TkZ+fo4/z9xOJ4zlDlRXMw5JFNkOZ/S5Dm+nbg5mNQ2OTYfzjkIhDY5BF12OWhzpzl1yzU5L8odOUxnIDmfni05O9aXOM5YXzkHdR85Z1vyOVD4LDknGEU5AO+mOUFl9jj6flw4qTKoOMJxbDkZ23s45egCOSXNVzlR/6A5YzwWOIiTmzhDuiM4ckLKOGlfETiwlGw4nTLiOQarEzkghTg435iYOTcOYTk6mxE417BqOShVoTjZ/vA5EbZqOMiXfDj1EMo4qezxOG1Ozjixiu04dG/sOCBpCzihxbA4yQo4OK0e0jizeBg5NRWpOPpimziANrc4EZ7jOIeAXziW4aY5BGPgOOxqLzifzCM4JEU7OMG5kjht8D44Jl+qODrHFzgVIbg4mPQ2OCIORjb5Cp84e6X0OADpBDibM2E3YKiFNuQmfTiYFC04i3bKOL4ELjigoew4oYQDOJAK0Th/KW04Zp6VONEgiTjUZOo4jJV6OBFkKzeaXUc4GJisOBQsOjgCZYc39MHDOBTM6DiVqi84KANtOEaOoTiK1ic4DO70N+rSvDhFJ9Q3gn3TOHXRdTiQZXk4CJwPN8TvgzfSFxo4Gw8UN4leLTepicc39wbUOHg9JzgW8tY4bOD7OJ9hjzhJIeE4G7+IOCht/zhuOXM3EV0eOFMPMzcGRI84uDUbN458SjXUYcg3hQD/N6go1jezTCs3jAi9OA1kFDcSnxM3CklMN3sxdjbrFtQ31mLFN/TNLjdi2XI3qtLMOBHGRDgWdfk3wzlgN0BOqzc4DU43H7m6NpuDhzUjc3g3tgLNNwsZ2ja8xdE3cqBUNXhSZjgJ3V44SLYWN6ywljbIXyo4ALH1N4FO5Tdk/u032vrrNpsb/jb7F3k2lZaBN0W5CTdzvwo4K1P2NmooDzhI1os4IJJZN/xf4DddXcM3adDqN/JMMjgE5Ww3CbgmNzxbkzMyJWI3Jmn+NomgODatgGs3skvFNuHb1ze65og2929+NrFZrjcCh5c2wlG+NqssVDgEloc3RZefN1no3DatxX03KevuNrzoSzgIf/UyKB8LNvfYhjeIRBY3FDw7NkHG1zbsOyw3QEX0N3PYhDa2y0Q2Ew3jNrJhZDhi3UE1jsnzNALBbzbCKuU20kNGNxgSUDW1cus29u8qNvHROjbGJ+U2d2R4NqmGPDh5qFE2kj5gNWP33zZqkM43sf31NzEY+DZsWkQ2qJYDNqUvJDYwDfQ2le0fNvwp2TZtVbk3V1A4NT3PtDd6xmY4FhDEN3OfxjfwGV4238DDNoB/qzaIS3E3Jz+iNmZ4nDeLlU43qQX/N6VXuzU+6Bk2N4WXNeQWsTcpydI3j8D1NrSMsjZRwxU23KKANyvmiTaKHrQ3zzqsNf/SMTchLt411j5sN1t3rDWBMKw21n5rOBeltQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQECAQEBAgEBAQEBAQEBAgICAgEBAgIBAwMBAgIBAQIDAQICAQIBAQEBAwIBAgEBAgMDAwIFAQIDAgIBBAQDAgICAQIDBAMEBAIFAgICAwUHAgIEBgYGAggDBgYCBgQEAQUDBgQDAwoCAgQEAwUCAQgIBQIKBQgEBwQNCQIGBwkFBA4MCQUFBwIICAYHBA0FBQkPEQsLDAkQEA4OCxMRDhMECggIFBMQGhQUExIECQYIChELDA4TERYMDSEbEhEKDhQbEQ8PLSobGBkQCBEPFB4RFCYbIjIcHxwhFhUjHQ8UGCckJSkmIjEmOCsiMScsHy0hHxspODcmKi4/MxcvR1RHMyQoMBotOkpXPiw4OkA/KyE3SlE3JyAygQGUAX+CAU1tYGZpXzYvQUpWd3tKPltvdGF+ckxKOUZ5T1BMap4ByAGuAa4BsgGjAYsBbHufAXOxAeUB2gHpAaUBkQGHAaYBygHJAb0BrwGgAZkBoAF6iwGdAeQB+wHfAdMB3AGfArwChQL7AZ8CpgKYArwB1QG2Ac8BhAFSXnirAeMBwQGmAeAB8wGkAW9ojQH4AbwCgQLPAZoBrAGzAfgBgwL7AZkCqgL8AdEBwAHHAeMBgALiArID1gLrAdkB+gG7AoQDiQOgA60D1QP+A/8CggKzAY0BrAHhAd8C4wKaA8YDnAP1AtkCjQK9AaUBzQGDAtwClwO5A5IDmAOHBKoDygLxAb8CugKSAtQB9gGIArMCvQOeBN0ErgSIBJ8EsQSxA/UChAOdAtICpwOZBJgE1AOhAtsB5gGWApsD8wOFBKgEggWFBfEEmQTLA/ICgQPqAswBWj5kuAHiAaUC/AHfAb8CrALSAvgChAPRAswCgAPGA4MD2QLSAp4DgATQA44CtgGfAfgBzwLiAswC6gKLA4sD5wLEAucB7gHrAfcB9AHiAegB+QGMAuAChgOxA5AD0QLiArEC3wK7AoYCpgL7ApMDnwOpA6sDggSdBKQD+gLIAqgCxgLPAtoCvgKWAvUBhgLHAoYD2wLEAvcBxAGdAbsB7QGCApQCmALJAsUCiQOpA68D/AKSAvwB9wGHAukBugGpAaUBngG6AfwBiwKUApsClQKmArECsAKZAuEBkgGsAccBxAGLAVNFWm6PAYoBe5cBwQHhAe0BzgHLAYYBggGbAVhThAGaAaEBhQFJW1p5iQFhOic2NS0mHjJAYGpsYVZcR2VsWF5JOTBKa3hUWGdSSFJXS1NAL0VRQz83LTQ2QDYjFSs+VEpabVQzJjNAWkM1LT5MPVBDKyw5IxcUFyEgPkNNTUUxKRwfHh4PGBkZKSUZEwwZHRcXDxUeGhgdKiYaHhEQCxISEh0REyAdGhoYDxMWFhIWHhEIChQNEA0TDBMMCQ8QEx8mGwsQERcWERcRDQ8TFg4REhILBxMJCQ4UEQQDCAQFDg0EERQLFhIHDA4NBgcKAwQLCQMMEQYDBwcIEAwKBgkFAwQHCAIBCAUDCAEJCwcLBwoFBgYGBQIEBQMCAgMJAwkCAwUBAwMGAwMDAgUFAgEDBgYHBAYBAwcBBQIBBgMCAgYBAQQCAwMBAgMEAgMDAQEBAQEDAQEDAgIBAgECAwECAQMDAwECAwICAQMCAQEBAQEBAgICAQIBAQICAQEBAQEBAQICAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="
+
 func TestJavaSmallBytesCompat(t *testing.T) {
 	// Base64 string generated via (<3 clojure):
 	// (def t (com.tdunning.math.stats.AVLTreeDigest. 100))
@@ -204,8 +212,6 @@ func TestJavaSmallBytesCompat(t *testing.T) {
 	//
 	// (println serialized-tdigest)
 
-	serializedJavaTDigestB64 := "AAAAAkBZAAAAAAAAAAAEOzZpD1w24ySbN288eDfDHOI3jwpPN7jIyze1xXM2BzmuNc6x9DdUUcs2o1QFNvb5tzeNwTo2l0VYNgD89jaAiB83GxMBNTdLZzVjwOk3oKiDNxhS4jZ2blc2zTiiN8rlKDc7gN01HN5jNgF8bDYhIGo3BsH5NlbMcDdtCKQ3eJMUNzzuazQuLpY2y0lcNqNDdDcNDr03zOJ1N3ESMjcqxd42omxHNdA+mDbJmlo3KrIGN5i5/DegwGw10QY2NRuEmjdARF42g8qeN8L4yjajFVs1oIo9NvoNwDdrnuk2LeJGNwFHnTgGqu82TzfHN41Syzbd4xU2XjMVN1GPQjbMZOI2l91oNnY8CDdCy7U1wCuMNwLfyjfGDDo3FWWBNiEsSTiE9ZQ3rY03N6fEbDULhxU3i9qZNxuifjbeoMQ3vJ9mNpxU6jbvhEE3qOmYNrG09jcions3F6YRN5Ny1DUG5+E3P2m7NxXWSzd9PD03GBO9N+INZjczo844exOsNxmKIjgnk242m3GdNxrymzcJGSI1MVGaN6OzizblJ+43D9D/NvxA1Df2mZw339fFOB/KWzdN4WM4MhJoNpShjDfafXk3uSflN/uHhDeIUvI3ZOFqNqUkCDgokRU4VWp2Nzz1UjfigVQ4PHzkN8bWhzc21Kc3vOyQN8SJPjhEt344cC6EOAc/ZjfA9D04NZB9OAx8mzgsvD83oqOINzpg9jg9CWo4Y2qdN/r4XjbiH544DQY6OMvJSThcl+g4mnOyOKqdIzd91to4K72fODbsgjiPb2o4AmM6OIXueDhuDMs4PW1yN3ci2jhZGWY4aM5oOCDGwjiBKsk4FLcON7gbNTgr/zQ4e9V2N7qMkjiRTE04OiCKOA+kqDhK2u83jJvIN/P+6Tgw7v04voUSOExQKTgt8OU4ND0lN9CbPzhIfws4UJvSOBqgKzhe1TM4yVlsOLqRxjhsUw03lttXOEGkjTiTqns4kcOmOG2D5DgFx7847tKPONixTDhm8a84mAD1OFCXQzif2W84eVdkOPgJ+jjQy0g4a1HVOHLm7zjKP0k40bH4ODTQizj5Vn448ubuOQbg9TkIbEw4nuqfONUhyTktbsc48dTQOWSR7TkfJfU47iIfOQDP3jkN52Y5OibNOR1tRTk4XgM5JS+XODkp1DjNnOo4zOE/OTcKaDkfd4c5HTjLOTfMtzk1Tng5HH8aOTdpejlQok44yYMwN68whzgmY3o4kGHlOIRTqTkd2Jg45Dd0OHlnWzkEqtA5PENgOT6ckzlmuTQ5LPhpOL2F3zmPFVg5sPneOWfCETkZWu85KkV9ONN2zzlVKg85k3xqOYMdETkujEg5FZlSOYv3FznTwq05w571OXYNQDlfBkQ5NaiZOK74YzjPWAY5BSnsOUOhdTmCIsM5aphbOTm7cjmYQPw5WyLLOV8xQznRMgU5zm+AOb5MBDmEpF45lqbbOW3LNzlc5LI5ny6QObux3zmCqUY5JJyxOXAibjm8mJA5zUCAOeW3Tznyf3w59LruOceUBzn0Gx05vTtsOfquPDoaISI58SiPOdEPpznD/cw5yU1bObG+/zm6Urs5vqXbOcfLwDmrd4s51P3sOhMXXTogDTA51iYXObgArDnGgzQ5/T2FOfi0RjndrFQ5y0IuOhXqcDorpag6RHR1Oixgxjnpq5Y5svRMOdkKbzmou5k5xefuOdiV6DooArU6SnueOkSo6ToPT2o6BvjmOgtxUjoXlSw6G2tQOfUe9jnksDw52dLDOi/y0TpDLTg6NmYNOgqIbTmzGkE52tMyOoJqNzqnDaQ6q5T1Opv6UTqQdX06g9A3OnfuGzqFI246hlrhOmJtZjpf25k6FCyPOhAMgDo1nyI6TLhWOoVgwzqXc746gJc8OlnKVjo/gk86iR5UOpq7PTqdzGY6fspZOp6HRjqEU7w6So02OiKgNToiGkg6aR5oOpHAEDpRg+M6TXTPOnXxkjq5Ct069YXFOvA6NDry/wY65ooNOtzuzDq+ECw6mx8DOpM6qzrBq7E6wn5oOsrlYDsOlM87DKunOw2+iDrzrio6xuE4OrWjPDqoohQ60tC2OvuLODrrWeE63cvKOtKc2jq/DwE6t3QKOrLbvDqrGOI6vpYpOv+cezslrTw7Gp54OxOm8zsWlYM7H8mYOz5/qzs1fHE7MGNuOzCnFDs1TVs7P/9NOx9ocTr+Wzs6+KXkOxOgZjrNhNA6gXVdOmH0LzqUolA6zwgZOw9UyTsD9I46/6KVOwVc4zsa2pc7CwuyOsUzETqLuas6mdYmOwWSnTswT4o7JX7qOwqBMzr5UBY66uyWOvW5NTsKjMk7JL4oOyJEiTsuq1Y7QQhEOzLQBjsjYeg7BRP5OvfqBTsPYUI7Lhs+O1NqIzuFBsU7eMaTOzuwvDsVjz47FheUOzc2FTtf4y87eSLlO4FCMDuE1iI7jx8lO6CXezuLCc87SkkEOw9XGzrUN/o60S9OOwRbLjs1xu87d3xMO32c8zuL04A7kPoQO4I88jtgMhk7PfEaOxILhDrxJ/g6+S+dOxZK4js70sU7ZAatO41myjuP8FU7iNOzO5IsQzuUZZ47anfmOzKbiDssSQo7RbdFOzZGbzsijbg7EdwqOzAoGzs/cx87c6CdO6fSjju/2mE7s2PuO7BVFDuvFvU7uGxCO6KcTzuFdpY7gW0tO1MZejs+0u87bhNOO5hzHDuuqfU7puR+O27/RjsnXA87FRP2OyNyRTtbJ4A7oHBjO6aMVTu2P3I7xGZWO8iz2TvO9Ns7xOtWO6PXxjt9d/47cPPYO31G+Ds3erY6yE0aOk8xCDpGySk6qq7zOvjgZTsgTBs7NM8GOx3z6Tsq29w7NmsfO0Hreztu3xY7dk9WO3TTGDtiz0s7ZOMLO46IeDuO1vk7bpo/O25jnDt3Vek7lJ5YO5mNajtsaXA7Fv+0Ou/dCTsJbAs7PTjsO22GJzt2eTk7XRjBO340CzuCQOw7clTLO19aJDs0gkk7EHVbOx2iqTsiMhI7I3XXOxQtAjsXZlM7JfrQOzPyIjtHLgk7fNvUO4nBdDuOYZI7hCk6O2l7ITtjevg7WwaEO1/S6TtFPiY7MW19O2bjLzt03jI7gsFbO4PWBDuGU9U7noVhO7Hg3zufXSU7gVMiO1o9xztFxDo7OaUcO2D1wztT9/87XyIcO0mFPzszGc47Kht5Oz23WjtmjYg7gKOVO3IZfDtIzFg7GVHmOuB6KDrOLOQ7CF6POyzH1TsuH3Q7OM/DO0xskTtuJHQ7cMB/O4bPzzuLdOU7h2SsO2f2xDs8IKw7JR0+Oyvwhjsae7E7DcaqOvnPADrXxC063tLlOvY0zTsTxUI7IkbcOzkVzzs/RpM7M1ZDOzBmnjs87aU7VcmTO0DL/zsbCFE69oQyOtABijrpNtM69c8UOu225DqbxxA6azZrOlKXRDp7vwE6p0qUOqxh8zqs7JE6rdnqOtzxNzsOlb47FRw2OxtFIDr6nlQ6yv8ROqncETqkc4I6m2kEOmU4oTp3bec6roWNOtkwujq4hkw6iT+5OnlU+DpkEhQ6aw67Opyl9DqM79c6S3J2Ofz8rDn30cA6HOhuOgXIsToEZQQ5znUNOgH78zoTKKU6YLyIOnWfAjqSDVk6hWPrOnGUwDpqn3c6eY3AOlo1SDqC9kU6bS35OoHBLzp8WgI6So6gOgZ8fzo4Ibw6elzBOo5ZVTp5wSU6d0e+OnCgezpxp1M6NoEzOiXlxzpUG4o6ZLCKOmLp9Tot5oU6Ja0OOhfxAzo4qNI6O9+0OjMq5zorV7w6Gv+gOhnd8zn7P1o6IRscOhLPqDngEEg5uIZJOdmxAToNmYA6Gm3GOmg3sjpCPz06WyRCOmGz3zovg7050RuqOfX3WDol3yg6ZUH8OjrgyzoIwlI6H9qmOhtrGTovTtc6SJ3rOkDdRzoYcX46D3P0OhFudToCa2A6BWyTOaegSzlmUn05X3MqOY5bPjnGv7Q55MBkOil2NDo4lt86Ro6YOlW4mjob5ig5wtjpOZheyTmLg/c5iuH1OYyCVjk+Om85JLQMOZCxJjmP6ro5kcX3OfVvATnGgWE5haCUOP8UPDk8C6Q5iKLHOUrz4zk0mMw5WFZuOUwQ6jl2t2A5qF4BOZp7xzmMEhU5yBgqOdWqmDnmxrg5e4YkOUTKvzkklbs42a5MOTN8WTkWOKU5YfgsOUAgnjmPd1g5h/cCOWbI1TmTGvQ5c2+oOYGlXTlz5jU5WuZmOUBj6Tka3hs5kuGEOUJ64DlaTDI5Qx6wOWLktTk6UT44uJu4OSVojjlryTM5HOuzOKzKFjkzpaA5IKMzOU6a+TkZ+fo4/z9xOJ4zlDlRXMw5JFNkOZ/S5Dm+nbg5mNQ2OTYfzjkIhDY5BF12OWhzpzl1yzU5L8odOUxnIDmfni05O9aXOM5YXzkHdR85Z1vyOVD4LDknGEU5AO+mOUFl9jj6flw4qTKoOMJxbDkZ23s45egCOSXNVzlR/6A5YzwWOIiTmzhDuiM4ckLKOGlfETiwlGw4nTLiOQarEzkghTg435iYOTcOYTk6mxE417BqOShVoTjZ/vA5EbZqOMiXfDj1EMo4qezxOG1Ozjixiu04dG/sOCBpCzihxbA4yQo4OK0e0jizeBg5NRWpOPpimziANrc4EZ7jOIeAXziW4aY5BGPgOOxqLzifzCM4JEU7OMG5kjht8D44Jl+qODrHFzgVIbg4mPQ2OCIORjb5Cp84e6X0OADpBDibM2E3YKiFNuQmfTiYFC04i3bKOL4ELjigoew4oYQDOJAK0Th/KW04Zp6VONEgiTjUZOo4jJV6OBFkKzeaXUc4GJisOBQsOjgCZYc39MHDOBTM6DiVqi84KANtOEaOoTiK1ic4DO70N+rSvDhFJ9Q3gn3TOHXRdTiQZXk4CJwPN8TvgzfSFxo4Gw8UN4leLTepicc39wbUOHg9JzgW8tY4bOD7OJ9hjzhJIeE4G7+IOCht/zhuOXM3EV0eOFMPMzcGRI84uDUbN458SjXUYcg3hQD/N6go1jezTCs3jAi9OA1kFDcSnxM3CklMN3sxdjbrFtQ31mLFN/TNLjdi2XI3qtLMOBHGRDgWdfk3wzlgN0BOqzc4DU43H7m6NpuDhzUjc3g3tgLNNwsZ2ja8xdE3cqBUNXhSZjgJ3V44SLYWN6ywljbIXyo4ALH1N4FO5Tdk/u032vrrNpsb/jb7F3k2lZaBN0W5CTdzvwo4K1P2NmooDzhI1os4IJJZN/xf4DddXcM3adDqN/JMMjgE5Ww3CbgmNzxbkzMyJWI3Jmn+NomgODatgGs3skvFNuHb1ze65og2929+NrFZrjcCh5c2wlG+NqssVDgEloc3RZefN1no3DatxX03KevuNrzoSzgIf/UyKB8LNvfYhjeIRBY3FDw7NkHG1zbsOyw3QEX0N3PYhDa2y0Q2Ew3jNrJhZDhi3UE1jsnzNALBbzbCKuU20kNGNxgSUDW1cus29u8qNvHROjbGJ+U2d2R4NqmGPDh5qFE2kj5gNWP33zZqkM43sf31NzEY+DZsWkQ2qJYDNqUvJDYwDfQ2le0fNvwp2TZtVbk3V1A4NT3PtDd6xmY4FhDEN3OfxjfwGV4238DDNoB/qzaIS3E3Jz+iNmZ4nDeLlU43qQX/N6VXuzU+6Bk2N4WXNeQWsTcpydI3j8D1NrSMsjZRwxU23KKANyvmiTaKHrQ3zzqsNf/SMTchLt411j5sN1t3rDWBMKw21n5rOBeltQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQECAQEBAgEBAQEBAQEBAgICAgEBAgIBAwMBAgIBAQIDAQICAQIBAQEBAwIBAgEBAgMDAwIFAQIDAgIBBAQDAgICAQIDBAMEBAIFAgICAwUHAgIEBgYGAggDBgYCBgQEAQUDBgQDAwoCAgQEAwUCAQgIBQIKBQgEBwQNCQIGBwkFBA4MCQUFBwIICAYHBA0FBQkPEQsLDAkQEA4OCxMRDhMECggIFBMQGhQUExIECQYIChELDA4TERYMDSEbEhEKDhQbEQ8PLSobGBkQCBEPFB4RFCYbIjIcHxwhFhUjHQ8UGCckJSkmIjEmOCsiMScsHy0hHxspODcmKi4/MxcvR1RHMyQoMBotOkpXPiw4OkA/KyE3SlE3JyAygQGUAX+CAU1tYGZpXzYvQUpWd3tKPltvdGF+ckxKOUZ5T1BMap4ByAGuAa4BsgGjAYsBbHufAXOxAeUB2gHpAaUBkQGHAaYBygHJAb0BrwGgAZkBoAF6iwGdAeQB+wHfAdMB3AGfArwChQL7AZ8CpgKYArwB1QG2Ac8BhAFSXnirAeMBwQGmAeAB8wGkAW9ojQH4AbwCgQLPAZoBrAGzAfgBgwL7AZkCqgL8AdEBwAHHAeMBgALiArID1gLrAdkB+gG7AoQDiQOgA60D1QP+A/8CggKzAY0BrAHhAd8C4wKaA8YDnAP1AtkCjQK9AaUBzQGDAtwClwO5A5IDmAOHBKoDygLxAb8CugKSAtQB9gGIArMCvQOeBN0ErgSIBJ8EsQSxA/UChAOdAtICpwOZBJgE1AOhAtsB5gGWApsD8wOFBKgEggWFBfEEmQTLA/ICgQPqAswBWj5kuAHiAaUC/AHfAb8CrALSAvgChAPRAswCgAPGA4MD2QLSAp4DgATQA44CtgGfAfgBzwLiAswC6gKLA4sD5wLEAucB7gHrAfcB9AHiAegB+QGMAuAChgOxA5AD0QLiArEC3wK7AoYCpgL7ApMDnwOpA6sDggSdBKQD+gLIAqgCxgLPAtoCvgKWAvUBhgLHAoYD2wLEAvcBxAGdAbsB7QGCApQCmALJAsUCiQOpA68D/AKSAvwB9wGHAukBugGpAaUBngG6AfwBiwKUApsClQKmArECsAKZAuEBkgGsAccBxAGLAVNFWm6PAYoBe5cBwQHhAe0BzgHLAYYBggGbAVhThAGaAaEBhQFJW1p5iQFhOic2NS0mHjJAYGpsYVZcR2VsWF5JOTBKa3hUWGdSSFJXS1NAL0VRQz83LTQ2QDYjFSs+VEpabVQzJjNAWkM1LT5MPVBDKyw5IxcUFyEgPkNNTUUxKRwfHh4PGBkZKSUZEwwZHRcXDxUeGhgdKiYaHhEQCxISEh0REyAdGhoYDxMWFhIWHhEIChQNEA0TDBMMCQ8QEx8mGwsQERcWERcRDQ8TFg4REhILBxMJCQ4UEQQDCAQFDg0EERQLFhIHDA4NBgcKAwQLCQMMEQYDBwcIEAwKBgkFAwQHCAIBCAUDCAEJCwcLBwoFBgYGBQIEBQMCAgMJAwkCAwUBAwMGAwMDAgUFAgEDBgYHBAYBAwcBBQIBBgMCAgYBAQQCAwMBAgMEAgMDAQEBAQEDAQEDAgIBAgECAwECAQMDAwECAwICAQMCAQEBAQEBAgICAQIBAQICAQEBAQEBAQICAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="
-
 	tdigestAsBytes, err := base64.StdEncoding.DecodeString(serializedJavaTDigestB64)
 
 	if err != nil {
@@ -231,6 +237,632 @@ func TestJavaSmallBytesCompat(t *testing.T) {
 	assertDifferenceSmallerThan(tdigest, 0.999, 0.001, t)
 }
 
+// Serialized with AsBytes before it started emitting a version header:
+//
+//	d, _ := New(Compression(50))
+//	for i, x := range []float64{0.5, 1, 2.25, 3, 100} {
+//		d.AddWeighted(x, uint64(i+1))
+//	}
+var legacyFixture = []byte{
+	0x0, 0x0, 0x0, 0x2, // encoding
+	0x40, 0x49, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // compression
+	0x0, 0x0, 0x0, 0x5, // number of centroids
+	0x3f, 0x0, 0x0, 0x0, 0x3f, 0x0, 0x0, 0x0, 0x3f, 0xa0, 0x0, 0x0, 0x3f, 0x40, 0x0, 0x0, 0x42, 0xc2, 0x0, 0x0, // mean deltas
+	0x1, 0x2, 0x3, 0x4, 0x5, // counts
+}
+
+func TestVersionedFormatFixtures(t *testing.T) {
+	v1Fixture := append([]byte{'t', 'd', 'g', 1}, legacyFixture...)
+	v2Fixture := append([]byte{'t', 'd', 'g', 2,
+		0x3f, 0xe0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // min
+		0x40, 0x59, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // max
+	}, legacyFixture...)
+
+	for _, fixture := range [][]byte{legacyFixture, v1Fixture, v2Fixture} {
+		t1, err := FromBytes(bytes.NewReader(fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var t2 TDigest
+		err = t2.FromBytes(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, digest := range []*TDigest{t1, &t2} {
+			if digest.Compression() != 50 || digest.Count() != 15 {
+				t.Errorf("Unexpected digest decoded from %x", fixture)
+			}
+
+			if !reflect.DeepEqual(digest.summary.means, []float64{0.5, 1, 2.25, 3, 100}) ||
+				!reflect.DeepEqual(digest.summary.counts, []uint64{1, 2, 3, 4, 5}) {
+				t.Errorf("Unexpected centroids decoded from %x: %v %v", fixture, digest.summary.means, digest.summary.counts)
+			}
+
+			if digest.Quantile(0.5) != 2.892857142857143 {
+				t.Errorf("Unexpected median decoded from %x: %v", fixture, digest.Quantile(0.5))
+			}
+
+			if digest.Min() != 0.5 || digest.Max() != 100 {
+				t.Errorf("Unexpected extremes decoded from %x: %v %v", fixture, digest.Min(), digest.Max())
+			}
+
+			payload, _ := digest.AsBytes()
+			if !bytes.Equal(payload, v2Fixture) {
+				t.Errorf("Expected AsBytes to produce %x, got %x", v2Fixture, payload)
+			}
+		}
+	}
+}
+
+func TestLegacyExtremesBackfill(t *testing.T) {
+	// Exact extremes beyond the outermost means: 0.25 and 150
+	v2Fixture := append([]byte{'t', 'd', 'g', 2,
+		0x3f, 0xd0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // min
+		0x40, 0x62, 0xc0, 0x0, 0x0, 0x0, 0x0, 0x0, // max
+	}, legacyFixture...)
+	v1Fixture := append([]byte{'t', 'd', 'g', 1}, legacyFixture...)
+
+	inputs := []struct {
+		fixture  []byte
+		min, max float64
+	}{
+		// Payloads without extremes fall back to the outermost means
+		{legacyFixture, 0.5, 100},
+		{v1Fixture, 0.5, 100},
+		{v2Fixture, 0.25, 150},
+	}
+	for _, input := range inputs {
+		var digest TDigest
+		if err := digest.FromBytes(input.fixture); err != nil {
+			t.Fatal(err)
+		}
+		if digest.Min() != input.min || digest.Max() != input.max ||
+			digest.Quantile(0) != input.min || digest.Quantile(1) != input.max {
+			t.Errorf("Expected extremes %f and %f decoding %x, got %f and %f", input.min, input.max, input.fixture, digest.Quantile(0), digest.Quantile(1))
+		}
+
+		// Merging the payload backfills the same way
+		merged := uncheckedNew()
+		if err := merged.MergeBytes(input.fixture); err != nil {
+			t.Fatal(err)
+		}
+		if merged.Min() != input.min || merged.Max() != input.max {
+			t.Errorf("Expected MergeBytes to find extremes %f and %f in %x, got %f and %f", input.min, input.max, input.fixture, merged.Min(), merged.Max())
+		}
+	}
+}
+
+func TestSerializationKeepsExtremes(t *testing.T) {
+	r := rand.New(rand.NewSource(0xDEAD))
+	digest := uncheckedNew(Compression(1), LocalRandomNumberGenerator(1))
+	for i := 0; i < 10000; i++ {
+		_ = digest.Add(r.NormFloat64())
+	}
+	// Such a low compression merges even the tails into centroids
+	if digest.summary.Mean(0) == digest.Min() {
+		t.Fatalf("Expected the smallest centroid to hold more than the min")
+	}
+
+	payload, _ := digest.AsBytes()
+
+	t1, err := FromBytes(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var t2 TDigest
+	err = t2.FromBytes(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var t3 TDigest
+	_, err = t3.ReadFrom(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, other := range []*TDigest{t1, &t2, &t3} {
+		if other.Min() != digest.Min() || other.Max() != digest.Max() {
+			t.Errorf("Expected extremes %v %v, got %v %v", digest.Min(), digest.Max(), other.Min(), other.Max())
+		}
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	for _, version := range []byte{0, binaryVersion + 1, 0xff} {
+		payload := append([]byte{'t', 'd', 'g', version}, legacyFixture...)
+
+		_, err := FromBytes(bytes.NewReader(payload))
+		if err == nil {
+			t.Errorf("Expected FromBytes to reject version %d", version)
+		}
+
+		var digest TDigest
+		if digest.FromBytes(payload) == nil {
+			t.Errorf("Expected FromBytes method to reject version %d", version)
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	var _ io.WriterTo = &TDigest{}
+	var _ io.ReaderFrom = &TDigest{}
+
+	digests := make([]*TDigest, 5)
+	for i := range digests {
+		digests[i] = uncheckedNew(Compression(float64(10 * (i + 1))))
+		for j := 0; j < 1000*i; j++ {
+			_ = digests[i].Add(rand.Float64())
+		}
+	}
+
+	var stream bytes.Buffer
+	for _, digest := range digests {
+		n, err := digest.WriteTo(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload, _ := digest.AsBytes()
+		if n != int64(len(payload)) {
+			t.Errorf("WriteTo reported %d bytes written, expected %d", n, len(payload))
+		}
+	}
+	stream.Write(legacyFixture)
+
+	legacy, _ := FromBytes(bytes.NewReader(legacyFixture))
+	digests = append(digests, legacy)
+
+	// A reader without ReadByte, returning a single byte per Read
+	r := iotest.OneByteReader(bytes.NewReader(stream.Bytes()))
+
+	for _, digest := range digests {
+		var other TDigest
+		_, err := other.ReadFrom(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b1, _ := digest.AsBytes()
+		b2, _ := other.AsBytes()
+		if !bytes.Equal(b1, b2) {
+			t.Errorf("Read something different. b1=%q b2=%q", b1, b2)
+		}
+	}
+
+	var other TDigest
+	_, err := other.ReadFrom(r)
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestReadFromTruncated(t *testing.T) {
+	digest := uncheckedNew()
+	for i := 0; i < 100; i++ {
+		_ = digest.Add(rand.Float64())
+	}
+
+	payload, _ := digest.AsBytes()
+	for i := 1; i < len(payload); i++ {
+		other := uncheckedNew()
+		_ = other.Add(42)
+
+		n, err := other.ReadFrom(bytes.NewReader(payload[:i]))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("Expected io.ErrUnexpectedEOF reading %d bytes, got %v", i, err)
+		}
+		if n != int64(i) {
+			t.Errorf("Expected ReadFrom to report %d bytes read, got %d", i, n)
+		}
+		if other.Count() != 1 {
+			t.Fatalf("Expected a failed ReadFrom to leave the digest untouched")
+		}
+	}
+}
+
+func TestGob(t *testing.T) {
+	type message struct {
+		Name   string
+		Digest *TDigest
+	}
+
+	digest := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = digest.Add(rand.Float64())
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(message{Name: "sensor", Digest: digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded message
+	err = gob.NewDecoder(&buf).Decode(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Name != "sensor" {
+		t.Errorf("Unexpected name: %q", decoded.Name)
+	}
+
+	// The binary format stores means with float32 precision, so
+	// compare against a digest that went through it as well
+	payload, _ := digest.AsBytes()
+	expected, _ := FromBytes(bytes.NewReader(payload))
+
+	for _, x := range []float64{0, 0.01, 0.25, 0.5, 0.75, 0.99, 1} {
+		if decoded.Digest.CDF(x) != expected.CDF(x) {
+			t.Errorf("CDF(%.2f) changed: %v != %v", x, decoded.Digest.CDF(x), expected.CDF(x))
+		}
+		if math.Abs(decoded.Digest.CDF(x)-digest.CDF(x)) > 1e-6 {
+			t.Errorf("CDF(%.2f) changed too much: %v != %v", x, decoded.Digest.CDF(x), digest.CDF(x))
+		}
+	}
+
+	// The decoded digest is fully functional
+	err = decoded.Digest.Add(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBinaryMarshaler(t *testing.T) {
+	var _ encoding.BinaryMarshaler = TDigest{}
+	var _ encoding.BinaryUnmarshaler = &TDigest{}
+
+	digest := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = digest.Add(rand.Float64())
+	}
+
+	payload, err := digest.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := digest.AsBytes()
+	if !bytes.Equal(payload, expected) {
+		t.Errorf("Expected MarshalBinary() to use the AsBytes format")
+	}
+
+	var decoded TDigest
+	err = decoded.UnmarshalBinary(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSerialization(t, digest, &decoded)
+
+	if err := decoded.UnmarshalBinary(payload[:len(payload)/2]); err == nil {
+		t.Errorf("Expected a truncated payload to be rejected")
+	}
+}
+
+func TestFromDunningBytes(t *testing.T) {
+	small, err := base64.StdEncoding.DecodeString(serializedJavaTDigestB64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t1, err := FromDunningBytes(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if t1.Count() != 100000 || t1.Compression() != 100 {
+		t.Fatalf("Unexpected digest: count=%d compression=%f", t1.Count(), t1.Compression())
+	}
+
+	// The digest was built from 100k uniformly distributed samples
+	assertDifferenceSmallerThan(t1, 0.5, 0.02, t)
+	assertDifferenceSmallerThan(t1, 0.99, 0.005, t)
+
+	// Same centroids, now laid out like AVLTreeDigest.asBytes does
+	verbose := make([]byte, 16+12*t1.summary.Len())
+	copy(verbose, small[:16])
+	endianess.PutUint32(verbose, uint32(verboseEncoding))
+	for i, mean := range t1.summary.means {
+		endianess.PutUint64(verbose[16+8*i:], math.Float64bits(mean))
+		endianess.PutUint32(verbose[16+8*t1.summary.Len()+4*i:], uint32(t1.summary.counts[i]))
+	}
+
+	t2, err := FromDunningBytes(verbose)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		if t1.Quantile(q) != t2.Quantile(q) {
+			t.Errorf("Quantile(%.2f) differs between encodings: %v != %v", q, t1.Quantile(q), t2.Quantile(q))
+		}
+	}
+
+	for _, bad := range [][]byte{small[:10], verbose[:len(verbose)-1], {0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}} {
+		_, err = FromDunningBytes(bad)
+		if err == nil {
+			t.Errorf("Expected error decoding %x", bad)
+		}
+	}
+}
+
+func TestMergeBytes(t *testing.T) {
+	data := make([]float64, 0, 50000)
+	merged := uncheckedNew()
+	expected := uncheckedNew()
+
+	for i := 0; i < 5; i++ {
+		part := uncheckedNew()
+		for j := 0; j < 10000; j++ {
+			x := rand.Float64()
+			data = append(data, x)
+			_ = part.Add(x)
+		}
+
+		payload, _ := part.AsBytes()
+		err := merged.MergeBytes(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, _ := FromBytes(bytes.NewReader(payload))
+		_ = expected.Merge(decoded)
+	}
+
+	if merged.Count() != expected.Count() || merged.Count() != uint64(len(data)) {
+		t.Fatalf("Unexpected count after MergeBytes: %d", merged.Count())
+	}
+
+	sort.Float64s(data)
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+		assertDifferenceFromQuantile(data, merged, q, 0.01, t)
+	}
+}
+
+func TestMergeBytesIntoConstant(t *testing.T) {
+	constant := func() *TDigest {
+		td := uncheckedNew(LocalRandomNumberGenerator(0xC5))
+		_ = td.AddWeighted(5, 100000)
+		return td
+	}
+	other := uncheckedNew(LocalRandomNumberGenerator(0xC6))
+	for i := 0; i < 1000; i++ {
+		_ = other.Add(float64(i))
+	}
+	payload, _ := other.AsBytes()
+
+	merged := constant()
+	if err := merged.MergeBytes(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	// The constant centroid is split as with Merge, so it doesn't
+	// swallow the quantiles around it
+	n := float64(merged.Count())
+	merged.ForEachCentroid(func(mean float64, count uint64) bool {
+		if mean == 5 && float64(count) > n/10 {
+			t.Errorf("Expected the constant centroid to be split, got a centroid of %d samples", count)
+			return false
+		}
+		return true
+	})
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		if merged.Quantile(q) != 5 {
+			t.Errorf("Expected Quantile(%g) to be 5, got %f", q, merged.Quantile(q))
+		}
+	}
+}
+
+func TestMergeBytesRejectsCorruptInput(t *testing.T) {
+	digest := uncheckedNew()
+	for i := 0; i < 100; i++ {
+		_ = digest.Add(rand.Float64())
+	}
+	before, _ := digest.AsBytes()
+
+	other := uncheckedNew()
+	for i := 0; i < 100; i++ {
+		_ = other.Add(rand.Float64())
+	}
+	payload, _ := other.AsBytes()
+
+	// NaN delta for the last mean
+	nanMean := append([]byte{}, payload...)
+	endianess.PutUint32(nanMean[headerSize+16+4*(other.summary.Len()-1):], math.Float32bits(float32(math.NaN())))
+
+	// Zero count for the last centroid
+	zeroCount := append([]byte{}, payload...)
+	zeroCount[len(zeroCount)-1] = 0
+
+	for _, corrupt := range [][]byte{payload[:len(payload)-1], append(payload, 0), nanMean, zeroCount} {
+		err := digest.MergeBytes(corrupt)
+		if err == nil {
+			t.Errorf("Expected MergeBytes to reject corrupt input")
+		}
+
+		after, _ := digest.AsBytes()
+		if !bytes.Equal(before, after) {
+			t.Fatalf("MergeBytes modified the digest on error")
+		}
+	}
+}
+
+func TestDecodingRejectsCountOverflow(t *testing.T) {
+	// Neither count overflows on its own, only their sum does
+	digest := uncheckedNew()
+	digest.summary.means = append(digest.summary.means, 1, 2)
+	digest.summary.counts = append(digest.summary.counts, 1<<63, 1<<63)
+	digest.count, digest.min, digest.max = math.MaxUint64, 1, 2
+
+	binary, _ := digest.AsBytes()
+	compact := digest.AsCompactBytes()
+	text, _ := digest.MarshalText()
+	jsonData, _ := digest.MarshalJSON()
+	proto, _ := digest.MarshalProto()
+	msgpack, _ := digest.MarshalMsgpack()
+	var stream bytes.Buffer
+	_, _ = digest.WriteTo(&stream)
+
+	decoders := map[string]func(*TDigest) error{
+		"FromBytes": func(*TDigest) error {
+			_, err := FromBytes(bytes.NewReader(binary))
+			return err
+		},
+		"FromCompactBytes": func(*TDigest) error {
+			_, err := FromCompactBytes(compact)
+			return err
+		},
+		"TDigest.FromBytes": func(t *TDigest) error { return t.FromBytes(binary) },
+		"MergeBytes":        func(t *TDigest) error { return t.MergeBytes(binary) },
+		"UnmarshalText":     func(t *TDigest) error { return t.UnmarshalText(text) },
+		"UnmarshalJSON":     func(t *TDigest) error { return t.UnmarshalJSON(jsonData) },
+		"UnmarshalProto":    func(t *TDigest) error { return t.UnmarshalProto(proto) },
+		"UnmarshalMsgpack":  func(t *TDigest) error { return t.UnmarshalMsgpack(msgpack) },
+		"ReadFrom": func(t *TDigest) error {
+			_, err := t.ReadFrom(bytes.NewReader(stream.Bytes()))
+			return err
+		},
+	}
+	for name, decode := range decoders {
+		target := uncheckedNew()
+		_ = target.Add(42)
+		if decode(target) == nil {
+			t.Errorf("Expected %s to reject counts adding up past the limit", name)
+		}
+		// TDigest.FromBytes decodes into the buffers of the digest
+		if name != "TDigest.FromBytes" && (target.Count() != 1 || target.Quantile(0.5) != 42) {
+			t.Errorf("Expected %s to leave the digest untouched", name)
+		}
+	}
+}
+
+func TestDecodingRejectsInvalidCentroids(t *testing.T) {
+	inputs := []struct {
+		name   string
+		means  []float64
+		counts []uint64
+	}{
+		{"NaN mean", []float64{1, math.NaN(), 3}, []uint64{1, 1, 1}},
+		{"infinite mean", []float64{1, 2, math.Inf(1)}, []uint64{1, 1, 1}},
+		{"zero count", []float64{1, 2, 3}, []uint64{1, 0, 1}},
+		{"unsorted means", []float64{1, 3, 2}, []uint64{1, 1, 1}},
+	}
+
+	// These decode into the buffers of the digest
+	reusesBuffers := map[string]bool{"TDigest.FromBytes": true, "UnmarshalBinary": true, "GobDecode": true}
+
+	for _, input := range inputs {
+		digest := uncheckedNew()
+		digest.summary.means = append(digest.summary.means, input.means...)
+		digest.summary.counts = append(digest.summary.counts, input.counts...)
+		digest.count, digest.min, digest.max = 3, 1, 3
+
+		// The verbose layout of the Java library
+		verbose := make([]byte, 16+12*len(input.means))
+		endianess.PutUint32(verbose, uint32(verboseEncoding))
+		endianess.PutUint64(verbose[4:], math.Float64bits(100))
+		endianess.PutUint32(verbose[12:], uint32(len(input.means)))
+		for i, mean := range input.means {
+			endianess.PutUint64(verbose[16+8*i:], math.Float64bits(mean))
+			endianess.PutUint32(verbose[16+8*len(input.means)+4*i:], uint32(input.counts[i]))
+		}
+
+		payloads := map[string]func() ([]byte, error){
+			"FromBytes":         digest.AsBytes,
+			"TDigest.FromBytes": digest.AsBytes,
+			"UnmarshalBinary":   digest.AsBytes,
+			"GobDecode":         digest.AsBytes,
+			"MergeBytes":        digest.AsBytes,
+			"FromCompactBytes":  func() ([]byte, error) { return digest.AsCompactBytes(), nil },
+			"UnmarshalText":     digest.MarshalText,
+			"UnmarshalJSON":     digest.MarshalJSON,
+			"UnmarshalProto":    digest.MarshalProto,
+			"UnmarshalMsgpack":  digest.MarshalMsgpack,
+			"ReadFrom": func() ([]byte, error) {
+				var buf bytes.Buffer
+				_, err := digest.WriteTo(&buf)
+				return buf.Bytes(), err
+			},
+			"FromDunningBytes": func() ([]byte, error) { return verbose, nil },
+		}
+		decoders := map[string]func(*TDigest, []byte) error{
+			"FromBytes": func(_ *TDigest, buf []byte) error {
+				_, err := FromBytes(bytes.NewReader(buf))
+				return err
+			},
+			"TDigest.FromBytes": (*TDigest).FromBytes,
+			"UnmarshalBinary":   (*TDigest).UnmarshalBinary,
+			"GobDecode":         (*TDigest).GobDecode,
+			"MergeBytes":        (*TDigest).MergeBytes,
+			"FromCompactBytes": func(_ *TDigest, buf []byte) error {
+				_, err := FromCompactBytes(buf)
+				return err
+			},
+			"UnmarshalText":    (*TDigest).UnmarshalText,
+			"UnmarshalJSON":    (*TDigest).UnmarshalJSON,
+			"UnmarshalProto":   (*TDigest).UnmarshalProto,
+			"UnmarshalMsgpack": (*TDigest).UnmarshalMsgpack,
+			"ReadFrom": func(t *TDigest, buf []byte) error {
+				_, err := t.ReadFrom(bytes.NewReader(buf))
+				return err
+			},
+			"FromDunningBytes": (*TDigest).fromVerboseBytes,
+		}
+
+		for name, decode := range decoders {
+			payload, err := payloads[name]()
+			if err != nil {
+				// e.g. JSON has no NaN
+				continue
+			}
+			target := uncheckedNew()
+			_ = target.Add(42)
+			if decode(target, payload) == nil {
+				t.Errorf("%s: expected %s to reject the centroids", input.name, name)
+			}
+			if reusesBuffers[name] {
+				continue
+			}
+			if target.Count() != 1 || target.Quantile(0.5) != 42 {
+				t.Errorf("%s: expected %s to leave the digest untouched", input.name, name)
+			}
+		}
+	}
+}
+
+func TestAppendBytes(t *testing.T) {
+	digest := uncheckedNew(LocalRandomNumberGenerator(1))
+	for i := 0; i < 1000; i++ {
+		_ = digest.Add(rand.Float64())
+	}
+	expected, _ := digest.AsBytes()
+
+	// The payload goes after what's already in the buffer
+	buf := digest.AppendBytes([]byte("prefix"))
+	if !bytes.HasPrefix(buf, []byte("prefix")) || !bytes.Equal(buf[len("prefix"):], expected) {
+		t.Fatalf("Expected the payload to be appended to the prefix")
+	}
+
+	// Reusing the buffer doesn't reallocate it
+	for i := 0; i < 3; i++ {
+		reused := digest.AppendBytes(buf[:0])
+		if &reused[0] != &buf[0] || !bytes.Equal(reused, expected) {
+			t.Fatalf("Expected the buffer to be reused")
+		}
+		_ = digest.Add(rand.Float64())
+		expected, _ = digest.AsBytes()
+	}
+
+	decoded, err := FromBytes(bytes.NewReader(digest.AppendBytes(nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSerialization(t, digest, decoded)
+}
+
 func BenchmarkAsBytes(b *testing.B) {
 	b.ReportAllocs()
 
@@ -261,6 +893,21 @@ func BenchmarkToBytes(b *testing.B) {
 	}
 }
 
+func BenchmarkAppendBytes(b *testing.B) {
+	b.ReportAllocs()
+
+	t1, _ := New(Compression(100))
+	for i := 0; i < 100; i++ {
+		t1.Add(rand.Float64())
+	}
+
+	b.ResetTimer()
+	var buf []byte
+	for n := 0; n < b.N; n++ {
+		buf = t1.AppendBytes(buf[:0])
+	}
+}
+
 func BenchmarkFromBytes(b *testing.B) {
 	b.ReportAllocs()
 
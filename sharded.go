@@ -0,0 +1,137 @@
+package tdigest
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Sharded is a digest split into independent shards, so that many
+// goroutines can add samples with little lock contention. It is safe
+// for concurrent use.
+//
+// Samples go to a single shard, picked either round-robin (Add) or by
+// a caller-provided hash (AddToShard). Queries merge all the shards,
+// and the merged digest is cached until the next sample is added.
+type Sharded struct {
+	// round-robin counter, accessed atomically. It must stay the first
+	// field: 64-bit atomic operations need 64-bit alignment on 32-bit
+	// platforms, which only the first word of an allocated struct has.
+	next    uint64
+	shards  []shard
+	dirty   uint32 // set when the cache is stale, accessed atomically
+	options []tdigestOption
+
+	mu     sync.Mutex
+	merged *TDigest
+}
+
+type shard struct {
+	mu     sync.Mutex
+	digest *TDigest
+}
+
+// NewSharded creates a digest split into n shards, each of them
+// created with the given options (see New).
+//
+// Every shard gets its own local random number generator, so the
+// RandomNumberGenerator option (or its local variant) only applies
+// to the merged digest queries are answered from.
+func NewSharded(n int, options ...tdigestOption) (*Sharded, error) {
+	if n < 1 {
+		return nil, errors.New("number of shards should be >= 1")
+	}
+
+	// Validate the options before creating the shards
+	_, err := newWithoutSummary(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sharded{
+		shards:  make([]shard, n),
+		dirty:   1,
+		options: options,
+	}
+	for i := range s.shards {
+		s.shards[i].digest, err = New(append(options[:len(options):len(options)], LocalRandomNumberGenerator(int64(i)))...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Add registers a new sample in the next shard, round-robin.
+func (s *Sharded) Add(value float64) error {
+	i := atomic.AddUint64(&s.next, 1)
+	return s.addToShard(int(i%uint64(len(s.shards))), value)
+}
+
+// AddToShard registers a new sample in the shard picked by hash, e.g.
+// the id of the calling goroutine or worker, which keeps each shard
+// mostly used by the same caller.
+func (s *Sharded) AddToShard(hash uint64, value float64) error {
+	return s.addToShard(int(hash%uint64(len(s.shards))), value)
+}
+
+func (s *Sharded) addToShard(i int, value float64) error {
+	shard := &s.shards[i]
+	shard.mu.Lock()
+	err := shard.digest.Add(value)
+	shard.mu.Unlock()
+
+	// Avoid writing to the shared flag when it's already set
+	if atomic.LoadUint32(&s.dirty) == 0 {
+		atomic.StoreUint32(&s.dirty, 1)
+	}
+	return err
+}
+
+// Quantile returns the desired percentile estimation over all the
+// shards, see TDigest.Quantile.
+func (s *Sharded) Quantile(q float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mergedDigest().Quantile(q)
+}
+
+// CDF computes the fraction in which all samples (of all shards) are
+// less than or equal to the given value, see TDigest.CDF.
+func (s *Sharded) CDF(value float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mergedDigest().CDF(value)
+}
+
+// Count returns the total number of samples in all the shards.
+func (s *Sharded) Count() uint64 {
+	var count uint64
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		count += shard.digest.Count()
+		shard.mu.Unlock()
+	}
+	return count
+}
+
+// mergedDigest returns the merged digest, rebuilding it if samples
+// were added since it was last built. Must be called with s.mu held.
+func (s *Sharded) mergedDigest() *TDigest {
+	// Samples added while merging set the flag again
+	if atomic.SwapUint32(&s.dirty, 0) == 0 {
+		return s.merged
+	}
+
+	// The options were validated on creation
+	merged, _ := New(s.options...)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		_ = merged.Merge(shard.digest)
+		shard.mu.Unlock()
+	}
+	s.merged = merged
+	return merged
+}
@@ -0,0 +1,102 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestSharded(t *testing.T) {
+	digest, err := NewSharded(4, Compression(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !math.IsNaN(digest.Quantile(0.5)) {
+		t.Errorf("Expected an empty sharded digest to have a NaN median")
+	}
+
+	const workers, samples = 8, 10000
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(worker)))
+			for j := 0; j < samples; j++ {
+				var err error
+				if worker%2 == 0 {
+					err = digest.Add(r.Float64())
+				} else {
+					err = digest.AddToShard(uint64(worker), r.Float64())
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if j%1000 == 0 {
+					_ = digest.Quantile(0.5)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if digest.Count() != workers*samples {
+		t.Errorf("Expected %d samples, got %d", workers*samples, digest.Count())
+	}
+
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		if math.Abs(digest.Quantile(q)-q) > 0.01 {
+			t.Errorf("Expected Quantile(%g) to be close to %g, got %f", q, q, digest.Quantile(q))
+		}
+	}
+
+	merged := digest.merged
+	_ = digest.CDF(0.5)
+	if digest.merged != merged {
+		t.Errorf("Expected the merged digest to be cached")
+	}
+
+	_ = digest.Add(2)
+	if digest.CDF(1) == 1 || digest.merged == merged {
+		t.Errorf("Expected adding a sample to invalidate the cache")
+	}
+}
+
+func TestNewShardedInvalid(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if _, err := NewSharded(n); err == nil {
+			t.Errorf("Expected %d shards to be rejected", n)
+		}
+	}
+
+	if _, err := NewSharded(2, Compression(0)); err == nil {
+		t.Errorf("Expected an error for a bad compression")
+	}
+}
+
+// Run with -cpu to compare both under contention
+func BenchmarkContention(b *testing.B) {
+	b.Run("Concurrent", func(b *testing.B) {
+		digest, _ := NewConcurrent()
+		b.RunParallel(func(pb *testing.PB) {
+			r := rand.New(rand.NewSource(rand.Int63()))
+			for pb.Next() {
+				_ = digest.Add(r.Float64())
+			}
+		})
+	})
+
+	b.Run("Sharded", func(b *testing.B) {
+		digest, _ := NewSharded(8)
+		b.RunParallel(func(pb *testing.PB) {
+			r := rand.New(rand.NewSource(rand.Int63()))
+			for pb.Next() {
+				_ = digest.Add(r.Float64())
+			}
+		})
+	})
+}
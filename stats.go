@@ -0,0 +1,38 @@
+package tdigest
+
+// Stats describes how much a digest compressed itself, to help tuning
+// its compression: many centroids merged away by frequent compressions
+// mean samples get merged aggressively, at the expense of accuracy.
+type Stats struct {
+	// Number of compressions since the digest was created (or last
+	// reset), be they automatic or explicit calls to Compress
+	Compressions uint64
+	// Total number of centroids those compressions merged away
+	MergedCentroids uint64
+
+	// Current number of centroids, see CentroidCount
+	Centroids int
+	// Highest number of centroids the digest held at once since it
+	// was created (or last reset)
+	MaxCentroids int
+}
+
+// Stats returns the compression statistics of the digest. They are
+// copied by Clone but not serialized: decoding a digest starts them
+// over.
+func (t *TDigest) Stats() Stats {
+	stats := t.stats
+	stats.Centroids = t.summary.Len()
+	if stats.Centroids > stats.MaxCentroids {
+		stats.MaxCentroids = stats.Centroids
+	}
+	return stats
+}
+
+// recordPeak keeps track of the highest number of centroids, to be
+// called before they get fewer.
+func (t *TDigest) recordPeak() {
+	if n := t.summary.Len(); n > t.stats.MaxCentroids {
+		t.stats.MaxCentroids = n
+	}
+}
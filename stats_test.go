@@ -0,0 +1,50 @@
+package tdigest
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	td := uncheckedNew(Compression(10))
+	if stats := td.Stats(); stats != (Stats{}) {
+		t.Errorf("Expected empty stats for a new digest, got %+v", stats)
+	}
+
+	// Ordered samples keep adding centroids, so compressions kick in
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(float64(i))
+	}
+	stats := td.Stats()
+	if stats.Compressions == 0 || stats.MergedCentroids == 0 {
+		t.Errorf("Expected automatic compressions, got %+v", stats)
+	}
+	if stats.Centroids != td.CentroidCount() || stats.MaxCentroids != int(20*td.Compression())+1 {
+		t.Errorf("Expected %d centroids and a peak of %d, got %+v", td.CentroidCount(), int(20*td.Compression())+1, stats)
+	}
+
+	before := td.CentroidCount()
+	_ = td.Compress()
+	after := td.Stats()
+	if after.Compressions != stats.Compressions+1 || after.MergedCentroids != stats.MergedCentroids+uint64(before-td.CentroidCount()) {
+		t.Errorf("Expected Compress() to be accounted for, got %+v then %+v", stats, after)
+	}
+
+	// Removals can't hide the peak
+	td = uncheckedNew()
+	for i := 0; i < 1000; i++ {
+		_ = td.AddCentroid(rand.Float64(), 1)
+	}
+	_ = td.Remove(0.5, 900)
+	if stats := td.Stats(); stats.Compressions != 0 || stats.Centroids != 100 || stats.MaxCentroids != 1000 {
+		t.Errorf("Expected 100 centroids and a peak of 1000, got %+v", stats)
+	}
+
+	if td.Clone().Stats() != td.Stats() {
+		t.Errorf("Expected Clone() to copy the stats")
+	}
+	_, _ = td.Reset()
+	if stats := td.Stats(); stats != (Stats{}) {
+		t.Errorf("Expected Reset() to clear the stats, got %+v", stats)
+	}
+}
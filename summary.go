@@ -4,11 +4,49 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"sync"
 )
 
+// BinarySearchThreshold is the number of centroids from which
+// lookups in a digest switch from a linear scan to a binary search.
+// The best value depends on the hardware; run BenchmarkSearchThreshold
+// to pick one. It is not safe to change it while digests are in use.
+var BinarySearchThreshold = 250
+
 type summary struct {
 	means  []float64
 	counts []uint64
+
+	// Fenwick tree (binary indexed tree) over counts, 1-based, that
+	// makes HeadSum O(log n). It's kept up to date by count updates
+	// until the next insertion or removal invalidates it, and only
+	// rebuilt once HeadSum has scanned as many counts as a rebuild
+	// would take, so insertion-heavy workloads don't pay for it. Code
+	// writing to counts directly must call invalidate.
+	tree    []uint64
+	indexed bool
+	scanned int
+
+	// Cumulative counts, cumulative[i] being the sum of the counts
+	// before centroid i. Built by the writes that walk every centroid
+	// anyway (compressions, merges, decoding) and dropped by any change
+	// to the counts. Queries never build them, they sum the counts
+	// themselves instead, so that a digest can be queried concurrently
+	// as long as nobody writes to it.
+	cumulative []uint64
+	cached     bool
+
+	// Sum of the counts, kept up to date by every change made through
+	// the methods of the summary so GetTotalCount is O(1). invalidate
+	// drops it, to be summed again on the next call.
+	total   uint64
+	totaled bool
+
+	// Set once TDigest.Compress (ForceCompress for settled) is done
+	// and cleared by any change to the centroids, so compressing an
+	// unchanged digest again is a no-op.
+	compressed bool
+	settled    bool
 }
 
 func newSummary(initialCapacity int) *summary {
@@ -22,8 +60,12 @@ func newSummary(initialCapacity int) *summary {
 func (s *summary) Reset() {
 	s.means = s.means[:0]
 	s.counts = s.counts[:0]
+	s.reindex()
+	s.total, s.totaled = 0, true
 }
 
+// GetDataCopy copies the means and counts. It takes no lock, see
+// TDigest.ExportCentroids.
 func (s *summary) GetDataCopy() ([]float64, []uint64) {
 	meansCopy := make([]float64, len(s.means))
 	countsCopy := make([]uint64, len(s.counts))
@@ -37,8 +79,8 @@ func (s *summary) Len() int {
 }
 
 func (s *summary) Add(key float64, value uint64) error {
-	if math.IsNaN(key) {
-		return fmt.Errorf("key must not be NaN")
+	if math.IsNaN(key) || math.IsInf(key, 0) {
+		return fmt.Errorf("key must be a finite number")
 	}
 	if value == 0 {
 		return fmt.Errorf("Count must be >0")
@@ -54,14 +96,21 @@ func (s *summary) Add(key float64, value uint64) error {
 
 	s.means[idx] = key
 	s.counts[idx] = value
+	s.total += value
+	s.reindex()
 
 	return nil
 }
 
-// Always insert to the right
+// Always insert to the right: a new key goes after every mean equal
+// to it, so runs of identical means are kept in insertion order. Since
+// adjustLeft and adjustRight only swap means that are strictly out of
+// order, updating a centroid never reorders it among equal ones
+// either, which keeps the layout (and thus the serialized output) of
+// a digest fed the same samples reproducible.
 func (s *summary) findInsertionIndex(x float64) int {
 	// Binary search is only worthwhile if we have a lot of keys.
-	if len(s.means) < 250 {
+	if len(s.means) < BinarySearchThreshold {
 		for i, mean := range s.means {
 			if mean > x {
 				return i
@@ -78,7 +127,105 @@ func (s *summary) findInsertionIndex(x float64) int {
 // This method is the hotspot when calling Add(), which in turn is called by
 // Compress() and Merge().
 func (s *summary) HeadSum(idx int) (sum float64) {
-	return float64(sumUntilIndex(s.counts, idx))
+	if s.cached {
+		return float64(s.cumulative[idx])
+	}
+	if !s.indexed {
+		s.scanned += idx
+		if s.scanned < 4*len(s.counts) {
+			return float64(sumUntilIndex(s.counts, idx))
+		}
+		s.buildTree()
+	}
+
+	var cumSum uint64
+	for i := idx; i > 0; i -= i & -i {
+		cumSum += s.tree[i]
+	}
+	return float64(cumSum)
+}
+
+// buildTree (re)builds the Fenwick tree over counts in linear time.
+func (s *summary) buildTree() {
+	n := len(s.counts)
+	if cap(s.tree) < n+1 {
+		s.tree = make([]uint64, n+1, cap(s.counts)+1)
+	}
+	s.tree = s.tree[:n+1]
+	s.tree[0] = 0
+	copy(s.tree[1:], s.counts)
+	for i := 1; i <= n; i++ {
+		if j := i + i&-i; j <= n {
+			s.tree[j] += s.tree[i]
+		}
+	}
+	s.indexed = true
+}
+
+// invalidate drops everything derived from the counts, for code that
+// writes to them directly.
+func (s *summary) invalidate() {
+	s.reindex()
+	s.totaled = false
+}
+
+// reindex drops the tree and cumulative counts after centroids were
+// inserted, removed or moved around, which leaves the total as is.
+func (s *summary) reindex() {
+	s.indexed = false
+	s.scanned = 0
+	s.cached = false
+	s.compressed = false
+	s.settled = false
+}
+
+// prefixSums returns the cumulative counts (see summary.cumulative),
+// or nil if they aren't up to date. The result is only valid until
+// the next change to the summary.
+func (s *summary) prefixSums() []uint64 {
+	if !s.cached {
+		return nil
+	}
+	return s.cumulative
+}
+
+// cachePrefixSums builds the cumulative counts if needed.
+func (s *summary) cachePrefixSums() {
+	if s.cached {
+		return
+	}
+	s.cumulative = append(s.cumulative[:0], 0)
+	var sum uint64
+	for _, count := range s.counts {
+		sum += count
+		s.cumulative = append(s.cumulative, sum)
+	}
+	s.cached = true
+}
+
+// countBefore returns the sum of the counts before the given index,
+// like HeadSum but without writing to the summary.
+func (s *summary) countBefore(index int) uint64 {
+	if s.cached {
+		return s.cumulative[index]
+	}
+	return sumUntilIndex(s.counts, index)
+}
+
+// setCount updates the count at index, keeping the tree up to date.
+func (s *summary) setCount(index int, count uint64) {
+	if s.indexed {
+		// Unsigned overflow takes care of negative deltas
+		delta := count - s.counts[index]
+		for i := index + 1; i < len(s.tree); i += i & -i {
+			s.tree[i] += delta
+		}
+	}
+	s.total += count - s.counts[index]
+	s.counts[index] = count
+	s.cached = false
+	s.compressed = false
+	s.settled = false
 }
 
 func (s *summary) Floor(x float64) int {
@@ -87,7 +234,7 @@ func (s *summary) Floor(x float64) int {
 
 func (s *summary) findIndex(x float64) int {
 	// Binary search is only worthwhile if we have a lot of keys.
-	if len(s.means) < 250 {
+	if len(s.means) < BinarySearchThreshold {
 		for i, mean := range s.means {
 			if mean >= x {
 				return i
@@ -110,11 +257,14 @@ func (s *summary) Count(uncheckedIndex int) uint64 {
 }
 
 func (s *summary) GetTotalCount() uint64 {
-	var totalCount uint64
-	for _, count := range s.counts {
-		totalCount += count
+	if !s.totaled {
+		s.total = 0
+		for _, count := range s.counts {
+			s.total += count
+		}
+		s.totaled = true
 	}
-	return totalCount
+	return s.total
 }
 
 // return the index of the last item which the sum of counts
@@ -123,24 +273,32 @@ func (s *summary) GetTotalCount() uint64 {
 // Since it's cheap, this also returns the `HeadSum` until
 // the found index (i.e. cumSum = HeadSum(FloorSum(x)))
 func (s *summary) FloorSum(sum float64) (index int, cumSum float64) {
-	index = -1
-	for i, count := range s.counts {
-		if cumSum <= sum {
-			index = i
-		} else {
-			break
+	cumulative := s.prefixSums()
+	if cumulative == nil {
+		var total uint64
+		index = -1
+		for i, count := range s.counts {
+			if float64(total) > sum {
+				break
+			}
+			index, cumSum = i, float64(total)
+			total += count
 		}
-		cumSum += float64(count)
+		return index, cumSum
 	}
+
+	index = sort.Search(s.Len(), func(i int) bool {
+		return float64(cumulative[i]) > sum
+	}) - 1
 	if index != -1 {
-		cumSum -= float64(s.counts[index])
+		cumSum = float64(cumulative[index])
 	}
 	return index, cumSum
 }
 
 func (s *summary) setAt(index int, mean float64, count uint64) {
 	s.means[index] = mean
-	s.counts[index] = count
+	s.setCount(index, count)
 	s.adjustRight(index)
 	s.adjustLeft(index)
 }
@@ -148,17 +306,41 @@ func (s *summary) setAt(index int, mean float64, count uint64) {
 func (s *summary) adjustRight(index int) {
 	for i := index + 1; i < len(s.means) && s.means[i-1] > s.means[i]; i++ {
 		s.means[i-1], s.means[i] = s.means[i], s.means[i-1]
-		s.counts[i-1], s.counts[i] = s.counts[i], s.counts[i-1]
+		s.swapCounts(i-1, i)
 	}
 }
 
 func (s *summary) adjustLeft(index int) {
 	for i := index - 1; i >= 0 && s.means[i] > s.means[i+1]; i-- {
 		s.means[i], s.means[i+1] = s.means[i+1], s.means[i]
-		s.counts[i], s.counts[i+1] = s.counts[i+1], s.counts[i]
+		s.swapCounts(i, i+1)
 	}
 }
 
+func (s *summary) swapCounts(i, j int) {
+	ci, cj := s.counts[i], s.counts[j]
+	s.setCount(i, cj)
+	s.setCount(j, ci)
+}
+
+// nearest returns the index of the centroid whose mean is the closest
+// to x, preferring the upper one on ties. The summary must not be
+// empty.
+func (s *summary) nearest(x float64) int {
+	idx := s.findIndex(x)
+	if idx == len(s.means) || (idx > 0 && x-s.means[idx-1] < s.means[idx]-x) {
+		idx--
+	}
+	return idx
+}
+
+func (s *summary) removeAt(index int) {
+	s.total -= s.counts[index]
+	s.means = append(s.means[:index], s.means[index+1:]...)
+	s.counts = append(s.counts[:index], s.counts[index+1:]...)
+	s.reindex()
+}
+
 func (s *summary) ForEach(f func(float64, uint64) bool) {
 	for i, mean := range s.means {
 		if !f(mean, s.counts[i]) {
@@ -168,7 +350,11 @@ func (s *summary) ForEach(f func(float64, uint64) bool) {
 }
 
 func (s *summary) Perm(rng RNG, f func(float64, uint64) bool) {
-	for _, i := range perm(rng, s.Len()) {
+	buf := scratchPool.Get().(*scratch)
+	defer scratchPool.Put(buf)
+
+	buf.perm = permInto(rng, buf.perm, s.Len())
+	for _, i := range buf.perm {
 		if !f(s.means[i], s.counts[i]) {
 			break
 		}
@@ -176,16 +362,26 @@ func (s *summary) Perm(rng RNG, f func(float64, uint64) bool) {
 }
 
 func (s *summary) Clone() *summary {
-	return &summary{
-		means:  append([]float64{}, s.means...),
-		counts: append([]uint64{}, s.counts...),
+	clone := &summary{
+		means:      append([]float64{}, s.means...),
+		counts:     append([]uint64{}, s.counts...),
+		total:      s.total,
+		totaled:    s.totaled,
+		compressed: s.compressed,
+		settled:    s.settled,
 	}
+	if s.cached {
+		clone.cumulative = append([]uint64{}, s.cumulative...)
+		clone.cached = true
+	}
+	return clone
 }
 
 // Randomly shuffles summary contents, so they can be added to another summary
 // with being pathological. Renders summary invalid.
 func (s *summary) shuffle(rng RNG) {
 	shuffle(s.means, s.counts, rng)
+	s.reindex()
 }
 
 func shuffle(means []float64, counts []uint64, rng RNG) {
@@ -197,6 +393,7 @@ func shuffle(means []float64, counts []uint64, rng RNG) {
 // for sort.Interface
 func (s *summary) Swap(i, j int) {
 	Swap(s.means, s.counts, i, j)
+	s.reindex()
 }
 
 func Swap(means []float64, counts []uint64, i, j int) {
@@ -208,24 +405,43 @@ func (s *summary) Less(i, j int) bool {
 	return s.means[i] < s.means[j]
 }
 
-// A simple loop unroll saves a surprising amount of time.
+// sumUntilIndex sums the first idx counts.
+//
+// The loop is unrolled by 8 over independent accumulators: this breaks
+// the dependency chain between additions so the CPU can run several of
+// them per cycle, and the fixed-size chunks let the compiler drop the
+// bounds checks. Unsigned addition is associative, so the result is
+// the same as a plain loop's.
 func sumUntilIndex(s []uint64, idx int) uint64 {
-	var cumSum uint64
-	var i int
-	for i = idx - 1; i >= 3; i -= 4 {
-		cumSum += uint64(s[i])
-		cumSum += uint64(s[i-1])
-		cumSum += uint64(s[i-2])
-		cumSum += uint64(s[i-3])
+	s = s[:idx]
+	var s0, s1, s2, s3 uint64
+	for len(s) >= 8 {
+		c := s[:8:8]
+		s0 += c[0] + c[4]
+		s1 += c[1] + c[5]
+		s2 += c[2] + c[6]
+		s3 += c[3] + c[7]
+		s = s[8:]
 	}
-	for ; i >= 0; i-- {
-		cumSum += uint64(s[i])
+	for _, count := range s {
+		s0 += count
 	}
-	return cumSum
+	return s0 + s1 + s2 + s3
 }
 
 func perm(rng RNG, n int) []int {
-	m := make([]int, n)
+	return permInto(rng, nil, n)
+}
+
+// permInto is like perm, but reuses m if it's big enough.
+func permInto(rng RNG, m []int, n int) []int {
+	if cap(m) < n {
+		m = make([]int, n)
+	}
+	m = m[:n]
+	if n > 0 {
+		m[0] = 0
+	}
 	for i := 1; i < n; i++ {
 		j := rng.Intn(i + 1)
 		m[i] = m[j]
@@ -233,3 +449,15 @@ func perm(rng RNG, n int) []int {
 	}
 	return m
 }
+
+// scratch holds temporary buffers for compressing and merging digests.
+// They are pooled so that steady-state ingestion doesn't allocate.
+type scratch struct {
+	means  []float64
+	counts []uint64
+	perm   []int
+}
+
+var scratchPool = sync.Pool{
+	New: func() interface{} { return new(scratch) },
+}
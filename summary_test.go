@@ -1,8 +1,10 @@
 package tdigest
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
+	"reflect"
 	"sort"
 	"testing"
 )
@@ -20,6 +22,10 @@ func TestBasics(t *testing.T) {
 		t.Errorf("Adding math.NaN() shouldn't be allowed")
 	}
 
+	if s.Add(math.Inf(1), 1) == nil || s.Add(math.Inf(-1), 1) == nil {
+		t.Errorf("Adding infinities shouldn't be allowed")
+	}
+
 	if s.Add(1, 0) == nil {
 		t.Errorf("Adding count=0 shouldn't be allowed")
 	}
@@ -149,6 +155,61 @@ func TestFloorSum(t *testing.T) {
 	}
 }
 
+func TestFloorSumBounds(t *testing.T) {
+	s := newSummary(10)
+	for i := 0; i < 10; i++ {
+		_ = s.Add(float64(i), uint64(i+1))
+	}
+	total := float64(s.GetTotalCount())
+	last := s.Len() - 1
+
+	inputs := []struct {
+		sum   float64
+		index int
+	}{
+		{total + 1, last},
+		{total, last},
+		{total - 1, last},
+		// HeadSum(last) itself, and right before it
+		{total - 10, last},
+		{total - 10.5, last - 1},
+		{0, 0},
+		{-0.5, -1},
+	}
+	for _, input := range inputs {
+		index, cumSum := s.FloorSum(input.sum)
+		if index != input.index {
+			t.Errorf("Expected FloorSum(%f) to return index %d, got %d", input.sum, input.index, index)
+		}
+		if index >= 0 && cumSum != s.HeadSum(index) {
+			t.Errorf("Expected FloorSum(%f) to return HeadSum(%d)=%f, got %f", input.sum, index, s.HeadSum(index), cumSum)
+		}
+	}
+}
+
+func TestEqualMeansOrder(t *testing.T) {
+	s := newSummary(10)
+	_ = s.Add(0, 100)
+	for i := uint64(1); i <= 5; i++ {
+		_ = s.Add(1, i)
+	}
+	_ = s.Add(2, 100)
+
+	// Equal means keep their insertion order, whatever their counts
+	expected := []uint64{100, 1, 2, 3, 4, 5, 100}
+	if !reflect.DeepEqual(s.counts, expected) {
+		t.Fatalf("Expected counts %v, got %v", expected, s.counts)
+	}
+
+	// Updating one of them doesn't move it around
+	s.setAt(2, 1, 20)
+	s.setAt(4, 1, 40)
+	expected = []uint64{100, 1, 20, 3, 40, 5, 100}
+	if !reflect.DeepEqual(s.counts, expected) {
+		t.Errorf("Expected counts %v, got %v", expected, s.counts)
+	}
+}
+
 func TestFloor(t *testing.T) {
 	s := newSummary(200)
 	for i := float64(0); i < 101; i++ {
@@ -191,3 +252,229 @@ func TestAdjustLeftRight(t *testing.T) {
 		t.Errorf("adjustLeft should have fixed the keys/counts state. %v %v", s.means, s.counts)
 	}
 }
+
+func TestNearestAndRemoveAt(t *testing.T) {
+	s := newSummary(5)
+	for i, x := range []float64{1, 2, 4, 8} {
+		_ = s.Add(x, uint64(i+1))
+	}
+
+	for x, expected := range map[float64]int{-10: 0, 1: 0, 1.4: 0, 1.5: 1, 3: 2, 5.9: 2, 6.1: 3, 100: 3} {
+		if s.nearest(x) != expected {
+			t.Errorf("Expected nearest(%g) to be %d, got %d", x, expected, s.nearest(x))
+		}
+	}
+
+	s.removeAt(1)
+	if !reflect.DeepEqual(s.means, []float64{1, 4, 8}) || !reflect.DeepEqual(s.counts, []uint64{1, 3, 4}) {
+		t.Errorf("Unexpected summary after removeAt(1): %v %v", s.means, s.counts)
+	}
+
+	s.removeAt(2)
+	s.removeAt(0)
+	if !reflect.DeepEqual(s.means, []float64{4}) || !reflect.DeepEqual(s.counts, []uint64{3}) {
+		t.Errorf("Unexpected summary after removing the edges: %v %v", s.means, s.counts)
+	}
+}
+
+func TestBinarySearchThreshold(t *testing.T) {
+	defer func(threshold int) { BinarySearchThreshold = threshold }(BinarySearchThreshold)
+
+	s := newSummary(500)
+	for i := 0; i < 500; i++ {
+		_ = s.Add(float64(i/2), 1)
+	}
+
+	for _, threshold := range []int{0, 250, 1000} {
+		BinarySearchThreshold = threshold
+		for _, x := range []float64{-1, 0, 0.5, 10, 124, 249, 1000} {
+			linear := sort.Search(s.Len(), func(i int) bool { return s.means[i] >= x })
+			if s.findIndex(x) != linear {
+				t.Errorf("threshold=%d: findIndex(%g) = %d, wanted %d", threshold, x, s.findIndex(x), linear)
+			}
+
+			linear = sort.Search(s.Len(), func(i int) bool { return s.means[i] > x })
+			if s.findInsertionIndex(x) != linear {
+				t.Errorf("threshold=%d: findInsertionIndex(%g) = %d, wanted %d", threshold, x, s.findInsertionIndex(x), linear)
+			}
+		}
+	}
+}
+
+// Sweeps BinarySearchThreshold over summaries of varying sizes: for
+// each size, the fastest threshold below it means binary search wins.
+func BenchmarkSearchThreshold(b *testing.B) {
+	defer func(threshold int) { BinarySearchThreshold = threshold }(BinarySearchThreshold)
+
+	for _, size := range []int{16, 64, 256, 1024, 4096} {
+		s := newSummary(size)
+		for i := 0; i < size; i++ {
+			_ = s.Add(rand.Float64(), 1)
+		}
+		xs := make([]float64, 1024)
+		for i := range xs {
+			xs[i] = rand.Float64()
+		}
+
+		for _, threshold := range []int{0, 32, 64, 128, 250, 500, 1000, math.MaxInt32} {
+			if threshold > 4*size && threshold != math.MaxInt32 {
+				continue
+			}
+			b.Run(fmt.Sprintf("size=%d/threshold=%d", size, threshold), func(b *testing.B) {
+				BinarySearchThreshold = threshold
+				for n := 0; n < b.N; n++ {
+					s.findIndex(xs[n%len(xs)])
+				}
+			})
+		}
+	}
+}
+
+func TestHeadSumIndex(t *testing.T) {
+	r := rand.New(rand.NewSource(0xB17))
+	s := newSummary(0)
+
+	for i := 0; i < 20000; i++ {
+		switch op := r.Intn(10); {
+		case op == 0 || s.Len() < 2:
+			_ = s.Add(r.Float64(), uint64(1+r.Intn(100)))
+		case op == 1:
+			s.removeAt(r.Intn(s.Len()))
+		default:
+			// Moves centroids around, swapping counts
+			idx := r.Intn(s.Len())
+			s.setAt(idx, r.Float64(), uint64(1+r.Intn(100)))
+		}
+
+		idx := r.Intn(s.Len() + 1)
+		if s.HeadSum(idx) != float64(sumUntilIndex(s.counts, idx)) {
+			t.Fatalf("step %d: HeadSum(%d) = %f, wanted %d", i, idx, s.HeadSum(idx), sumUntilIndex(s.counts, idx))
+		}
+	}
+
+	// Repeated lookups without insertions end up building the index
+	for i := 0; i < 10; i++ {
+		s.HeadSum(s.Len())
+	}
+	if !s.indexed {
+		t.Errorf("Expected the index to be in use")
+	}
+}
+
+func TestTotalCount(t *testing.T) {
+	r := rand.New(rand.NewSource(0x7074))
+	td := uncheckedNew(Compression(20), LocalRandomNumberGenerator(0x7074))
+
+	sum := func() uint64 {
+		return sumUntilIndex(td.summary.counts, td.summary.Len())
+	}
+	for i := 0; i < 2000; i++ {
+		switch r.Intn(6) {
+		case 0:
+			_ = td.AddWeighted(r.Float64(), uint64(1+r.Intn(100)))
+		case 1:
+			_ = td.AddBatch([]float64{r.Float64(), r.Float64(), r.Float64()})
+		case 2:
+			other := uncheckedNew(Compression(10))
+			for j := 0; j < 50; j++ {
+				_ = other.Add(r.Float64())
+			}
+			_ = td.Merge(other)
+		case 3:
+			if td.Count() > 0 {
+				_ = td.Remove(r.Float64(), 1)
+			}
+		case 4:
+			_ = td.Compress()
+		default:
+			_ = td.AddCentroid(r.Float64(), uint64(1+r.Intn(10)))
+		}
+
+		if td.summary.GetTotalCount() != sum() || td.Count() != sum() {
+			t.Fatalf("step %d: expected a total of %d, got %d and Count() %d", i, sum(), td.summary.GetTotalCount(), td.Count())
+		}
+	}
+
+	// Direct writes go through invalidate
+	td.summary.counts[0] += 10
+	td.summary.invalidate()
+	if td.summary.GetTotalCount() != sum() {
+		t.Errorf("Expected the total to be summed again after invalidate()")
+	}
+}
+
+func TestCumulativeCache(t *testing.T) {
+	r := rand.New(rand.NewSource(0xCAC4E))
+	s := newSummary(0)
+	for i := 0; i < 100; i++ {
+		_ = s.Add(r.Float64(), uint64(1+r.Intn(100)))
+	}
+
+	floorSum := func(sum float64) (int, float64) {
+		index, cumSum := -1, 0.0
+		for i := 0; i < s.Len() && float64(sumUntilIndex(s.counts, i)) <= sum; i++ {
+			index, cumSum = i, float64(sumUntilIndex(s.counts, i))
+		}
+		return index, cumSum
+	}
+
+	for i := 0; i < 5000; i++ {
+		switch r.Intn(3) {
+		case 0:
+			_ = s.Add(r.Float64(), uint64(1+r.Intn(100)))
+		case 1:
+			// Moving a centroid far away swaps counts all along
+			s.setAt(r.Intn(s.Len()), r.Float64(), uint64(1+r.Intn(100)))
+		}
+
+		total := float64(s.GetTotalCount())
+		for j := 0; j < 3; j++ {
+			sum := r.Float64()*(total+2) - 1
+			index, cumSum := s.FloorSum(sum)
+			expectedIndex, expectedSum := floorSum(sum)
+			if index != expectedIndex || cumSum != expectedSum {
+				t.Fatalf("step %d: FloorSum(%f) = %d, %f, wanted %d, %f", i, sum, index, cumSum, expectedIndex, expectedSum)
+			}
+
+			idx := r.Intn(s.Len() + 1)
+			if s.HeadSum(idx) != float64(sumUntilIndex(s.counts, idx)) {
+				t.Fatalf("step %d: HeadSum(%d) = %f, wanted %d", i, idx, s.HeadSum(idx), sumUntilIndex(s.counts, idx))
+			}
+		}
+	}
+}
+
+func TestSumUntilIndex(t *testing.T) {
+	counts := make([]uint64, 100)
+	for i := range counts {
+		counts[i] = uint64(rand.Int63())
+	}
+	// Wrapping around must give the same result too
+	counts[7] = math.MaxUint64
+
+	var expected uint64
+	for idx := 0; idx <= len(counts); idx++ {
+		if sum := sumUntilIndex(counts, idx); sum != expected {
+			t.Errorf("sumUntilIndex(counts, %d) = %d, wanted %d", idx, sum, expected)
+		}
+		if idx < len(counts) {
+			expected += counts[idx]
+		}
+	}
+}
+
+// 10k counts, half the maximum size of a digest with compression 1000
+func BenchmarkSumUntilIndex(b *testing.B) {
+	counts := make([]uint64, 10000)
+	for i := range counts {
+		counts[i] = uint64(1 + rand.Intn(1000))
+	}
+
+	var sum uint64
+	for n := 0; n < b.N; n++ {
+		sum += sumUntilIndex(counts, len(counts))
+	}
+	if sum == 0 {
+		b.Fatal("unexpected zero sum")
+	}
+}
@@ -27,16 +27,37 @@ package tdigest
 import (
 	"fmt"
 	"math"
+	"sort"
+	"unsafe"
 )
 
 // TDigest is a quantile approximation data structure.
+//
+// A TDigest is not safe for concurrent use while it is modified.
+// Queries don't write to it though, so any number of goroutines may
+// query a digest nobody modifies meanwhile, e.g. under the read lock
+// of a sync.RWMutex guarding its writers. See Concurrent for a
+// thread-safe digest.
 type TDigest struct {
 	summary     *summary
 	compression float64
 	count       uint64
+	min         float64
+	max         float64
 	rng         RNG
+	// nil means DefaultScale
+	scale         ScaleFunction
+	interpolation Interpolation
+	ties          Ties
+	// 0 means defaultBufferFactor
+	bufferFactor float64
+	stats        Stats
 }
 
+// defaultBufferFactor is how many centroids per unit of compression a
+// digest holds, by default, before it compresses itself.
+const defaultBufferFactor = 20
+
 // New creates a new digest.
 //
 // By default the digest is constructed with a configuration that
@@ -50,12 +71,26 @@ func New(options ...tdigestOption) (*TDigest, error) {
 		return nil, err
 	}
 
-	tdigest.summary = newSummary(estimateCapacity(tdigest.compression))
+	if tdigest.summary == nil {
+		tdigest.summary = newSummary(estimateCapacity(tdigest.compression))
+	}
 	return tdigest, nil
 }
 
+// Reset empties the digest so it can be refilled, keeping its
+// buffers to avoid allocating new ones. The given options (see New)
+// are then applied, on top of the current settings.
+//
+// A digest that is reset behaves exactly like a new one with the
+// same settings, except for the state of its random number generator:
+// pass LocalRandomNumberGenerator again to make it reproducible.
+//
+// Returns the digest itself and the error of the first option that
+// fails, if any.
 func (t *TDigest) Reset(opts ...tdigestOption) (*TDigest, error) {
+	t.stats = Stats{}
 	t.count = 0
+	t.min, t.max = math.Inf(1), math.Inf(-1)
 	t.summary.Reset()
 	for _, option := range opts {
 		err := option(t)
@@ -71,6 +106,8 @@ func newWithoutSummary(options ...tdigestOption) (*TDigest, error) {
 	tdigest := &TDigest{
 		compression: 100,
 		count:       0,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
 	}
 
 	for _, option := range options {
@@ -87,11 +124,49 @@ func newWithoutSummary(options ...tdigestOption) (*TDigest, error) {
 	return tdigest, nil
 }
 
+// _quantile interpolates linearly between previousMean, at
+// previousIndex, and nextMean, at nextIndex. The index must lie in
+// between.
+//
+// The result moves from previousMean towards nextMean, rather than
+// weighing both, and is kept between them: rounding can then neither
+// make it decrease as the index grows nor overshoot where the next
+// interpolation starts, so estimates are monotone across centroids.
 func _quantile(index float64, previousIndex float64, nextIndex float64, previousMean float64, nextMean float64) float64 {
 	delta := nextIndex - previousIndex
-	previousWeight := (nextIndex - index) / delta
 	nextWeight := (index - previousIndex) / delta
-	return previousMean*previousWeight + nextMean*nextWeight
+	result := previousMean + (nextMean-previousMean)*nextWeight
+	if !isFinite(result) {
+		// The difference overflowed
+		result = previousMean*(1-nextWeight) + nextMean*nextWeight
+	}
+	return math.Max(math.Min(previousMean, nextMean), math.Min(result, math.Max(previousMean, nextMean)))
+}
+
+// SizeBytes returns the approximate heap footprint of the digest, in
+// bytes: its structures plus the capacity (not just the length) of the
+// buffers holding the centroids and the caches built from them, since
+// those are allocated ahead of time and grow by doubling.
+//
+// This leaves out the random number generator, which may be shared
+// with other digests (see RandomNumberGenerator, Clone). The default
+// one, a math/rand source of its own, adds about 5KB: digests held by
+// the millions should rather share one.
+func (t *TDigest) SizeBytes() int {
+	s := t.summary
+	size := int(unsafe.Sizeof(*t)) + int(unsafe.Sizeof(*s))
+	size += (cap(s.means) + cap(s.counts) + cap(s.tree) + cap(s.cumulative)) * 8
+	return size
+}
+
+// needsCompression tells whether the digest grew past the number of
+// centroids its buffer factor allows, see BufferFactor.
+func (t *TDigest) needsCompression() bool {
+	factor := t.bufferFactor
+	if factor == 0 {
+		factor = defaultBufferFactor
+	}
+	return float64(t.summary.Len()) > factor*t.compression
 }
 
 // Compression returns the TDigest compression.
@@ -99,87 +174,373 @@ func (t *TDigest) Compression() float64 {
 	return t.compression
 }
 
+// Min returns the smallest sample registered in the digest, or NaN
+// if the digest is empty.
+//
+// Unlike the centroid means, which are averages, this is the exact
+// value of the sample.
+func (t *TDigest) Min() float64 {
+	if t.count == 0 {
+		return math.NaN()
+	}
+	return t.min
+}
+
+// Max returns the largest sample registered in the digest, or NaN
+// if the digest is empty.
+//
+// Unlike the centroid means, which are averages, this is the exact
+// value of the sample.
+func (t *TDigest) Max() float64 {
+	if t.count == 0 {
+		return math.NaN()
+	}
+	return t.max
+}
+
+// updateExtremes widens the [min, max] range of the digest so that
+// it includes the given range.
+func (t *TDigest) updateExtremes(min, max float64) {
+	if min < t.min {
+		t.min = min
+	}
+	if max > t.max {
+		t.max = max
+	}
+}
+
+// resetExtremes sets min and max to the extreme centroid means, the
+// best guess available when the exact values are unknown.
+func (t *TDigest) resetExtremes() {
+	t.min, t.max = math.Inf(1), math.Inf(-1)
+	if t.summary.Len() > 0 {
+		t.updateExtremes(t.summary.Mean(0), t.summary.Mean(t.summary.Len()-1))
+	}
+}
+
+// breakConstant prepares a constant digest, whose samples may all
+// be in a single oversized centroid (see AddWeighted), for samples
+// between min and max that aren't all equal to its value: the
+// centroid is split into centroids of the same mean, as big as the
+// scale function allows around their quantile.
+func (t *TDigest) breakConstant(min, max float64) {
+	if t.count < 2 || t.min != t.max || (min == t.min && max == t.max) {
+		return
+	}
+
+	// The lower half, mirrored into the upper one: centroids only
+	// grow towards the median, so the bound at the start of each one
+	// holds over all of it
+	n := float64(t.count)
+	half := t.count / 2
+	t.summary.Reset()
+	for sum := uint64(0); sum < half; {
+		size := uint64(maxCentroidSize(t.scale, float64(sum)/(n-1), t.compression, n))
+		if size < 1 {
+			size = 1
+		} else if size > half-sum {
+			size = half - sum
+		}
+		t.summary.means = append(t.summary.means, t.min)
+		t.summary.counts = append(t.summary.counts, size)
+		sum += size
+	}
+	lower := len(t.summary.counts)
+	for i := lower - 1; i >= 0; i-- {
+		t.summary.means = append(t.summary.means, t.min)
+		t.summary.counts = append(t.summary.counts, t.summary.counts[i])
+	}
+	if t.count%2 == 1 {
+		t.summary.counts[lower-1]++
+	}
+	t.summary.invalidate()
+}
+
 // Quantile returns the desired percentile estimation.
 //
-// Values of p must be between 0 and 1 (inclusive), will panic otherwise.
+// Quantile(0) and Quantile(1) are the exact smallest and largest
+// samples (see Min and Max) and every estimate lies between them.
+// An empty digest has no quantiles: the result is always NaN, which
+// callers should check for (e.g. with math.IsNaN) before using it.
+//
+// Values of q outside of [0, 1] are clamped to it, so Quantile(1.5)
+// is Quantile(1) and Quantile(-0.1) is Quantile(0): a slightly off
+// computation on the caller's side yields the extreme samples rather
+// than a crash. A NaN q gives NaN.
 func (t *TDigest) Quantile(q float64) float64 {
-	if q < 0 || q > 1 {
-		panic("q must be between 0 and 1 (inclusive)")
+	if math.IsNaN(q) {
+		return math.NaN()
+	}
+	return t.estimateQuantile(clampQuantile(q), &quantileWalker{})
+}
+
+// clampQuantile restricts q to [0, 1].
+func clampQuantile(q float64) float64 {
+	return math.Max(0, math.Min(q, 1))
+}
+
+// Quantiles returns the estimations of all the given percentiles, in
+// the same order, walking the centroids only once. The results are
+// the same as calling Quantile for each of them, so they are all NaN
+// for an empty digest, and values of q outside of [0, 1] are clamped
+// the same way.
+//
+// Passing them in increasing order saves sorting them: only the
+// result is allocated then.
+func (t *TDigest) Quantiles(qs ...float64) []float64 {
+	results := make([]float64, len(qs))
+	sorted := true
+	previous := math.Inf(-1)
+	for i, q := range qs {
+		if math.IsNaN(q) {
+			results[i] = math.NaN()
+			continue
+		}
+		sorted = sorted && q >= previous
+		previous = q
+	}
+
+	walker := &quantileWalker{}
+	if sorted {
+		// The common case, which needs no reordering
+		for i, q := range qs {
+			if !math.IsNaN(q) {
+				results[i] = t.estimateQuantile(clampQuantile(q), walker)
+			}
+		}
+		return results
 	}
 
+	order := make([]int, 0, len(qs))
+	for i, q := range qs {
+		if !math.IsNaN(q) {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return qs[order[i]] < qs[order[j]] })
+	for _, i := range order {
+		results[i] = t.estimateQuantile(clampQuantile(qs[i]), walker)
+	}
+	return results
+}
+
+// estimateQuantile computes Quantile(q), resuming the walk over the
+// centroids where the walker left it. Successive calls sharing a
+// walker must have non-decreasing values of q.
+func (t *TDigest) estimateQuantile(q float64, walker *quantileWalker) float64 {
 	if t.summary.Len() == 0 {
 		return math.NaN()
+	} else if q == 0 {
+		return t.min
+	} else if q == 1 {
+		return t.max
 	} else if t.summary.Len() == 1 {
 		return t.summary.Mean(0)
+	} else if t.min == t.max {
+		return t.min
 	}
 
-	index := q * float64(t.count-1)
-	previousMean := math.NaN()
-	previousIndex := float64(0)
-	next, total := t.summary.FloorSum(index)
+	if t.ties != InterpolateTies {
+		if value, ok := tieQuantile(t.summary, q*float64(t.count-1), t.ties); ok {
+			return math.Max(t.min, math.Min(value, t.max))
+		}
+	}
 
-	if next > 0 {
-		previousMean = t.summary.Mean(next - 1)
-		previousIndex = total - float64(t.summary.Count(next-1)+1)/2
+	if walker.summary == nil {
+		walker.summary = t.summary
+		walker.count = t.count
+		walker.min, walker.max = t.min, t.max
+		walker.piecewise = t.interpolation == PiecewiseInterpolation
+		walker.previousMean = math.NaN()
+	}
+	return math.Max(t.min, math.Min(walker.quantile(q*float64(t.count-1)), t.max))
+}
+
+// Median is a shortcut for Quantile(0.5).
+func (t *TDigest) Median() float64 {
+	return t.Quantile(0.5)
+}
+
+// Percentile is Quantile for a percentile p between 0 and 100, e.g.
+// Percentile(99) is Quantile(0.99). Unlike Quantile, it doesn't clamp
+// its input: a p outside of [0, 100], most likely a quantile passed
+// by mistake, or NaN yields NaN.
+func (t *TDigest) Percentile(p float64) float64 {
+	if !(p >= 0 && p <= 100) {
+		return math.NaN()
+	}
+	return t.Quantile(p / 100)
+}
+
+// IQR returns the interquartile range, Quantile(0.75)-Quantile(0.25).
+// Returns NaN for an empty digest and 0 if it only holds one value.
+func (t *TDigest) IQR() float64 {
+	return t.Quantile(0.75) - t.Quantile(0.25)
+}
+
+// quantileWalker estimates quantiles from the centroids alone, moving
+// forward through the digest as the requested index grows.
+type quantileWalker struct {
+	summary       *summary
+	count         uint64
+	min, max      float64
+	piecewise     bool
+	next          int
+	total         float64
+	previousMean  float64
+	previousIndex float64
+}
+
+// quantile returns the estimated value at the given index, which must
+// not be smaller than the one of the previous call. The digest must
+// have at least two centroids.
+func (w *quantileWalker) quantile(index float64) float64 {
+	s := w.summary
+
+	// Skip to the last centroid starting at or before the index, like
+	// FloorSum does, or walk there below otherwise
+	if cumulative := s.prefixSums(); cumulative != nil {
+		next := w.next + sort.Search(s.Len()-w.next, func(i int) bool {
+			return float64(cumulative[w.next+i]) > index
+		}) - 1
+		if next > w.next {
+			total := float64(cumulative[next])
+			w.next, w.total = next, total
+			w.previousMean = s.Mean(next - 1)
+			w.previousIndex = total - float64(s.Count(next-1)+1)/2
+		}
 	}
 
 	for {
-		nextIndex := total + float64(t.summary.Count(next)-1)/2
+		nextIndex := w.total + float64(s.Count(w.next)-1)/2
 		if nextIndex >= index {
+			previousMean := w.previousMean
 			if math.IsNaN(previousMean) {
 				// the index is before the 1st centroid
-				if nextIndex == previousIndex {
-					return t.summary.Mean(next)
+				if w.piecewise {
+					return tailQuantile(index, nextIndex, s.Mean(w.next), s.Mean(w.next+1), w.min)
+				}
+				if nextIndex == w.previousIndex {
+					return s.Mean(w.next)
 				}
 				// assume linear growth
-				nextIndex2 := total + float64(t.summary.Count(next)) + float64(t.summary.Count(next+1)-1)/2
-				previousMean = (nextIndex2*t.summary.Mean(next) - nextIndex*t.summary.Mean(next+1)) / (nextIndex2 - nextIndex)
+				nextIndex2 := w.total + float64(s.Count(w.next)) + float64(s.Count(w.next+1)-1)/2
+				previousMean = extrapolate(s.Mean(w.next), s.Mean(w.next+1), nextIndex, nextIndex2-nextIndex)
 			}
 			// common case: two centroids found, the result in in between
-			return _quantile(index, previousIndex, nextIndex, previousMean, t.summary.Mean(next))
-		} else if next+1 == t.summary.Len() {
+			return _quantile(index, w.previousIndex, nextIndex, previousMean, s.Mean(w.next))
+		} else if w.next+1 == s.Len() {
 			// the index is after the last centroid
-			nextIndex2 := float64(t.count - 1)
-			nextMean2 := (t.summary.Mean(next)*(nextIndex2-previousIndex) - previousMean*(nextIndex2-nextIndex)) / (nextIndex - previousIndex)
-			return _quantile(index, nextIndex, nextIndex2, t.summary.Mean(next), nextMean2)
+			nextIndex2 := float64(w.count - 1)
+			if w.piecewise {
+				// the first tail, upside down
+				return -tailQuantile(nextIndex2-index, nextIndex2-nextIndex, -s.Mean(w.next), -w.previousMean, -w.max)
+			}
+			nextMean2 := extrapolate(s.Mean(w.next), w.previousMean, nextIndex2-nextIndex, nextIndex-w.previousIndex)
+			return _quantile(index, nextIndex, nextIndex2, s.Mean(w.next), nextMean2)
 		}
-		total += float64(t.summary.Count(next))
-		previousMean = t.summary.Mean(next)
-		previousIndex = nextIndex
-		next++
+		w.total += float64(s.Count(w.next))
+		w.previousMean = s.Mean(w.next)
+		w.previousIndex = nextIndex
+		w.next++
 	}
 	// unreachable
 }
 
+// extrapolate returns the value at distance d from the one at x,
+// following the line from y at distance dy on the other side. It is
+// written so that it doesn't overflow for values close to the limits
+// of float64, like x·(d+dy)/dy-y·d/dy would.
+func extrapolate(x, y, d, dy float64) float64 {
+	return x + (x-y)*(d/dy)
+}
+
 // boundedWeightedAverage computes the weighted average of two
 // centroids guaranteeing that the result will be between x1 and x2,
 // inclusive.
 //
+// It moves x1 towards x2 by the share of w2 rather than summing the
+// weighted means: with large weights the products round off far more
+// than the (small) difference between the means, making the mean of
+// a heavy centroid drift as it absorbs samples.
+//
 // Refer to https://github.com/caio/go-tdigest/pull/19 for more details
 func boundedWeightedAverage(x1 float64, w1 float64, x2 float64, w2 float64) float64 {
 	if x1 > x2 {
 		x1, x2, w1, w2 = x2, x1, w2, w1
 	}
-	result := (x1*w1 + x2*w2) / (w1 + w2)
+	w := w1 + w2
+	result := x1 + (x2-x1)*(w2/w)
+	if !isFinite(result) {
+		// The difference overflowed (the means are close to
+		// ±math.MaxFloat64), weigh the means by their share instead
+		result = x1*(w1/w) + x2*(w2/w)
+	}
 	return math.Max(x1, math.Min(result, x2))
 }
 
+func isFinite(x float64) bool {
+	return !math.IsNaN(x) && !math.IsInf(x, 0)
+}
+
 // AddWeighted registers a new sample in the digest.
 //
 // It's the main entry point for the digest and very likely the only
 // method to be used for collecting samples. The count parameter is for
 // when you are registering a sample that occurred multiple times - the
-// most common value for this is 1.
+// most common value for this is 1. All of them are registered at once,
+// which is much cheaper than calling Add() `count` times and yields
+// about the same quantiles.
 //
-// This will emit an error if `value` is NaN or if `count` is zero.
-func (t *TDigest) AddWeighted(value float64, count uint64) (err error) {
-	if count == 0 {
+// A digest whose samples all have the same value, e.g. that of an
+// idle metric, keeps them in a single centroid: repeating the value
+// is then just a matter of adding to its count, and every quantile is
+// that value. The centroid is split (as if the samples had been added
+// one by one) as soon as another value comes in.
+//
+// This will emit an error if `value` is NaN or infinite, if `count`
+// is zero or if the total count of the digest would overflow.
+// Infinities are rejected rather than stored since merging one into a
+// centroid would make its mean infinite, or NaN.
+func (t *TDigest) AddWeighted(value float64, count uint64) error {
+	if !isFinite(value) || count == 0 {
 		return fmt.Errorf("illegal datapoint <value: %.4f, count: %d>", value, count)
 	}
+	err := checkCountOverflow(t.count, count)
+	if err != nil {
+		return err
+	}
+
+	if t.count > 0 && t.min == t.max && value == t.min {
+		last := t.summary.Len() - 1
+		t.summary.setAt(last, value, t.summary.Count(last)+count)
+		t.count += count
+		return nil
+	}
+
+	t.breakConstant(value, value)
+	return t.insert(value, count)
+}
+
+// insert adds a sample (or centroid) to the digest, merging it with
+// one of its neighbors if any can take it. Unlike AddWeighted, it
+// treats constant digests like any other.
+func (t *TDigest) insert(value float64, count uint64) (err error) {
+	if !isFinite(value) || count == 0 {
+		return fmt.Errorf("illegal datapoint <value: %.4f, count: %d>", value, count)
+	}
+	// Centroids never hold more than the total, so this covers them too
+	err = checkCountOverflow(t.count, count)
+	if err != nil {
+		return err
+	}
 
 	if t.summary.Len() == 0 {
 		err = t.summary.Add(value, count)
-		t.count = uint64(count)
+		if err == nil {
+			t.count = uint64(count)
+			t.min, t.max = value, value
+		}
 		return err
 	}
 
@@ -198,13 +559,14 @@ func (t *TDigest) AddWeighted(value float64, count uint64) (err error) {
 			return err
 		}
 	} else {
-		c := float64(t.summary.Count(closest))
-		newMean := boundedWeightedAverage(t.summary.Mean(closest), c, value, float64(count))
-		t.summary.setAt(closest, newMean, uint64(c)+count)
+		c := t.summary.Count(closest)
+		newMean := boundedWeightedAverage(t.summary.Mean(closest), float64(c), value, float64(count))
+		t.summary.setAt(closest, newMean, c+count)
 	}
 	t.count += uint64(count)
+	t.updateExtremes(value, value)
 
-	if float64(t.summary.Len()) > 20*t.compression {
+	if t.needsCompression() {
 		err = t.Compress()
 	}
 
@@ -231,12 +593,417 @@ func (t TDigest) Count() uint64 {
 	return t.count
 }
 
+// CentroidCount returns the number of centroids the digest holds.
+//
+// It grows with the number of distinct samples until the digest
+// compresses itself, which happens once it exceeds the compression
+// times the buffer factor (see BufferFactor): a compressed digest
+// holds a small multiple of its compression, so a count that keeps
+// growing past that points to a misconfiguration.
+func (t *TDigest) CentroidCount() int {
+	return t.summary.Len()
+}
+
+// AddCentroid inserts a precomputed centroid (the mean of `count`
+// samples) into the digest as is, without merging it with its
+// neighbors. This is meant for bulk-loading clusters computed by
+// another system; the digest compresses itself as usual when it
+// grows too big.
+//
+// Since the centroid holds no information about its spread, the
+// mean is what Min() and Max() account for.
+//
+// This will emit an error if `mean` is NaN or infinite, if `count` is
+// zero or if the total count of the digest would overflow.
+func (t *TDigest) AddCentroid(mean float64, count uint64) error {
+	if !isFinite(mean) || count == 0 {
+		return fmt.Errorf("illegal centroid <mean: %.4f, count: %d>", mean, count)
+	}
+	err := checkCountOverflow(t.count, count)
+	if err != nil {
+		return err
+	}
+
+	err = t.summary.Add(mean, count)
+	if err != nil {
+		return err
+	}
+	t.count += count
+	t.updateExtremes(mean, mean)
+
+	if t.needsCompression() {
+		err = t.Compress()
+	}
+	return err
+}
+
 // Add is an alias for AddWeighted(x,1)
 // Read the documentation for AddWeighted for more details.
 func (t *TDigest) Add(value float64) error {
 	return t.AddWeighted(value, 1)
 }
 
+// AddBatch registers all the given samples (with a count of one
+// each) at once.
+//
+// The samples are sorted and merged with the existing centroids in a
+// single pass, so large batches are much cheaper than calling Add()
+// for each value and the digest doesn't need compressing along the
+// way. The caller's slice is left untouched: it is copied before
+// sorting.
+//
+// This will emit an error, without registering anything, if any of
+// the values is NaN or infinite or if the total count of the digest
+// would overflow.
+func (t *TDigest) AddBatch(values []float64) error {
+	for _, value := range values {
+		if !isFinite(value) {
+			return fmt.Errorf("illegal datapoint <value: %.4f, count: 1>", value)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	err := checkCountOverflow(t.count, uint64(len(values)))
+	if err != nil {
+		return err
+	}
+
+	sorted := scratchPool.Get().(*scratch)
+	defer scratchPool.Put(sorted)
+
+	sorted.means = append(sorted.means[:0], values...)
+	sort.Float64s(sorted.means)
+	return t.addSorted(sorted.means, nil, uint64(len(values)))
+}
+
+// AddBatchWeighted registers all the given samples at once, each with
+// the count at the same index of weights, like AddBatch does for
+// samples with a count of one: they are sorted and merged with the
+// existing centroids in a single pass, and the digest is compressed
+// once at the end if it grew too big. The caller's slices are left
+// untouched.
+//
+// This will emit an error, without registering anything, if the slices
+// have different lengths, if any of the values is NaN or infinite, if
+// any of the weights is zero or if the total count of the digest would
+// overflow.
+func (t *TDigest) AddBatchWeighted(values []float64, weights []uint64) error {
+	if len(values) != len(weights) {
+		return fmt.Errorf("mismatched batch: %d values but %d weights", len(values), len(weights))
+	}
+	total := uint64(0)
+	for i, value := range values {
+		if !isFinite(value) || weights[i] == 0 {
+			return fmt.Errorf("illegal datapoint <value: %.4f, count: %d>", value, weights[i])
+		}
+		err := checkCountOverflow(total, weights[i])
+		if err != nil {
+			return err
+		}
+		total += weights[i]
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	err := checkCountOverflow(t.count, total)
+	if err != nil {
+		return err
+	}
+
+	sorted := scratchPool.Get().(*scratch)
+	defer scratchPool.Put(sorted)
+
+	sorted.means = append(sorted.means[:0], values...)
+	sorted.counts = append(sorted.counts[:0], weights...)
+	sort.Sort(&summary{means: sorted.means, counts: sorted.counts})
+	return t.addSorted(sorted.means, sorted.counts, total)
+}
+
+// FromSortedValues builds a digest with the given compression out of
+// samples already sorted in increasing order, e.g. the output of a
+// batch job.
+//
+// Centroids are formed in a single pass over the values, each growing
+// as long as the scale function allows, so this is much cheaper than
+// calling Add() for each value. The result is the same as that of
+// AddBatch, minus the copy and sort it needs. The order is checked
+// along the way: unsorted values are rejected, like NaN or infinite
+// ones.
+func FromSortedValues(values []float64, compression float64) (*TDigest, error) {
+	for i, value := range values {
+		if !isFinite(value) {
+			return nil, fmt.Errorf("illegal datapoint <value: %.4f, count: 1>", value)
+		}
+		if i > 0 && value < values[i-1] {
+			return nil, fmt.Errorf("values must be sorted in increasing order, got %f after %f", value, values[i-1])
+		}
+	}
+
+	t, err := New(Compression(compression))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return t, nil
+	}
+	return t, t.addSorted(values, nil, uint64(len(values)))
+}
+
+// NewFromCentroids builds a digest with the given compression out of
+// centroids, given as parallel slices of means and counts like the
+// ones listed by ForEachCentroid, e.g. to restore a digest from
+// external storage.
+//
+// The centroids are taken as they are, without going through the
+// insertion logic, and are sorted by mean first if they aren't already.
+// Since they don't tell how their samples were spread, Min() and Max()
+// are estimated from the extreme means. The slices are copied and can
+// be reused.
+//
+// This will emit an error if the slices differ in length, if any mean
+// is NaN or infinite, if any count is zero or if the total count
+// would overflow.
+func NewFromCentroids(means []float64, counts []uint64, compression float64) (*TDigest, error) {
+	if len(means) != len(counts) {
+		return nil, fmt.Errorf("mismatched centroid data: %d means but %d counts", len(means), len(counts))
+	}
+	var total uint64
+	sorted := true
+	for i, mean := range means {
+		if !isFinite(mean) || counts[i] == 0 {
+			return nil, fmt.Errorf("illegal centroid <mean: %.4f, count: %d>", mean, counts[i])
+		}
+		err := checkCountOverflow(total, counts[i])
+		if err != nil {
+			return nil, err
+		}
+		total += counts[i]
+		sorted = sorted && (i == 0 || mean >= means[i-1])
+	}
+
+	t, err := New(Compression(compression))
+	if err != nil {
+		return nil, err
+	}
+	if !sorted {
+		// Sort copies, loadCentroids copies the sorted ones anyway
+		means, counts = append([]float64{}, means...), append([]uint64{}, counts...)
+		sort.Stable(&summary{means: means, counts: counts})
+	}
+	return t, t.loadCentroids(compression, means, counts)
+}
+
+// FromReservoir builds a digest with the given compression out of a
+// weighted sample, such as a reservoir, where weights[i] is how many
+// samples samples[i] stands for.
+//
+// Counts are integers, so the weights are rounded like MergeScaled
+// rounds scaled counts: walking the samples in order, the running
+// total of the weights is rounded to the nearest integer and each
+// sample gets the difference with the previous one. Count() is thus
+// the sum of the weights, rounded, and no sample is off by one or
+// more. Samples whose count is rounded down to zero are skipped; see
+// WeightedTDigest to keep fractional weights instead.
+//
+// The samples are then added in a random order: reservoirs are often
+// sorted, or grouped by weight, and adding samples in order makes for
+// a less accurate digest. The random number generator is the default
+// one, so the result only depends on the inputs. The slices are left
+// untouched.
+//
+// This will emit an error if the slices differ in length, if any
+// sample is NaN or infinite, if any weight is not a positive finite
+// number or if the total count would overflow.
+func FromReservoir(samples []float64, weights []float64, compression float64) (*TDigest, error) {
+	if len(samples) != len(weights) {
+		return nil, fmt.Errorf("mismatched reservoir: %d samples but %d weights", len(samples), len(weights))
+	}
+	for i, value := range samples {
+		if !isFinite(value) || !(weights[i] > 0) || math.IsInf(weights[i], 1) {
+			return nil, fmt.Errorf("illegal datapoint <value: %.4f, weight: %f>", value, weights[i])
+		}
+	}
+
+	t, err := New(Compression(compression))
+	if err != nil {
+		return nil, err
+	}
+
+	means := make([]float64, 0, len(samples))
+	counts := make([]uint64, 0, len(samples))
+	var sum, previous float64
+	for i, weight := range weights {
+		sum += weight
+		rounded := math.Round(sum)
+		if rounded >= math.MaxUint64 {
+			return nil, fmt.Errorf("reservoir weights add up to more than %d samples", uint64(math.MaxUint64))
+		}
+		if rounded > previous {
+			means = append(means, samples[i])
+			counts = append(counts, uint64(rounded-previous))
+		}
+		previous = rounded
+	}
+
+	shuffle(means, counts, t.rng)
+	for i, mean := range means {
+		err = t.AddWeighted(mean, counts[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// addSorted merges the given non-empty, sorted and finite samples
+// with the centroids of the digest. Their counts are the given
+// weights, or one each if nil, adding up to total. The count of the
+// digest must not overflow.
+func (t *TDigest) addSorted(values []float64, weights []uint64, total uint64) error {
+	merged := scratchPool.Get().(*scratch)
+	defer scratchPool.Put(merged)
+
+	t.recordPeak()
+	t.breakConstant(values[0], values[len(values)-1])
+	t.count += total
+	t.updateExtremes(values[0], values[len(values)-1])
+
+	// Walk the centroids and the samples in order, folding each one
+	// into the last centroid as long as it stays under the size bound
+	means, counts := merged.means[:0], merged.counts[:0]
+	n := float64(t.count)
+	var sum float64
+	for i, j := 0, 0; i < t.summary.Len() || j < len(values); {
+		var mean float64
+		var count uint64
+		if j == len(values) || (i < t.summary.Len() && t.summary.Mean(i) <= values[j]) {
+			mean, count = t.summary.Mean(i), t.summary.Count(i)
+			i++
+		} else {
+			mean, count = values[j], 1
+			if weights != nil {
+				count = weights[j]
+			}
+			j++
+		}
+
+		if last := len(means) - 1; last >= 0 {
+			c := float64(counts[last])
+			q := 0.5
+			if n > 1 {
+				q = (sum + (c+float64(count)-1)/2) / (n - 1)
+			}
+			if c+float64(count) <= maxCentroidSize(t.scale, q, t.compression, n) {
+				means[last] = boundedWeightedAverage(means[last], c, mean, float64(count))
+				counts[last] += count
+				continue
+			}
+			sum += c
+		}
+		means = append(means, mean)
+		counts = append(counts, count)
+	}
+	merged.means, merged.counts = means, counts
+
+	t.summary.Reset()
+	t.summary.means = append(t.summary.means, means...)
+	t.summary.counts = append(t.summary.counts, counts...)
+	t.summary.invalidate()
+
+	if t.needsCompression() {
+		return t.Compress()
+	}
+	return nil
+}
+
+// Remove unregisters `count` samples of `value` from the digest, in
+// order to support sliding windows and similar use cases.
+//
+// Digests don't keep individual samples, so this is an approximation:
+// the count of the centroid closest to `value` is decremented (moving
+// on to the next closest ones if it holds fewer samples) and emptied
+// centroids are deleted. Centroid means are left untouched and so are
+// Min() and Max(), unless the digest becomes empty. Accuracy degrades
+// the more the samples removed differ from the ones that built the
+// affected centroids.
+//
+// This will emit an error if `value` is NaN, if `count` is zero or if
+// it exceeds Count().
+func (t *TDigest) Remove(value float64, count uint64) error {
+	if math.IsNaN(value) || count == 0 {
+		return fmt.Errorf("illegal datapoint <value: %.4f, count: %d>", value, count)
+	}
+	if count > t.count {
+		return fmt.Errorf("can't remove %d samples from a digest with %d", count, t.count)
+	}
+
+	t.recordPeak()
+	t.count -= count
+	for count > 0 {
+		closest := t.summary.nearest(value)
+		c := t.summary.Count(closest)
+		if c > count {
+			t.summary.setCount(closest, c-count)
+			break
+		}
+		t.summary.removeAt(closest)
+		count -= c
+	}
+
+	if t.count == 0 {
+		t.min, t.max = math.Inf(1), math.Inf(-1)
+	}
+	return nil
+}
+
+// Trim removes the centroids holding fewer than minCount samples, such
+// as the ones left in the tails by sparse noise, and recompresses the
+// digest if any was removed.
+//
+// The samples of removed centroids are dropped, not redistributed to
+// the remaining ones, which would drag their means towards the noise:
+// Count() decreases accordingly and quantiles are then relative to the
+// samples left. Min() and Max() move to the means of the new extreme
+// centroids when the old ones are removed. Beware that DefaultScale
+// keeps a few small centroids at either tail, so a high enough
+// threshold trims genuine tails too.
+func (t *TDigest) Trim(minCount uint64) error {
+	s := t.summary
+	if s.Len() == 0 {
+		return nil
+	}
+	t.recordPeak()
+	trimFirst, trimLast := s.counts[0] < minCount, s.counts[s.Len()-1] < minCount
+
+	n := 0
+	for i, count := range s.counts {
+		if count >= minCount {
+			s.means[n], s.counts[n] = s.means[i], count
+			n++
+		} else {
+			t.count -= count
+		}
+	}
+	if n == s.Len() {
+		return nil
+	}
+	s.means, s.counts = s.means[:n], s.counts[:n]
+	s.invalidate()
+
+	if n == 0 {
+		t.min, t.max = math.Inf(1), math.Inf(-1)
+		return nil
+	}
+	if trimFirst {
+		t.min = s.means[0]
+	}
+	if trimLast {
+		t.max = s.means[n-1]
+	}
+	return t.Compress()
+}
+
 // Compress tries to reduce the number of individual centroids stored
 // in the digest.
 //
@@ -248,25 +1015,91 @@ func (t *TDigest) Add(value float64) error {
 // may completely ignore this and it will compress itself automatically
 // after it grows too much. If you are minimizing network traffic
 // it might be a good idea to compress before serializing.
-func (t *TDigest) Compress() (err error) {
+//
+// Calling it recompresses the digest whatever its size: the centroids
+// are shuffled and added again to an empty digest, which merges them
+// up to the bounds set by the compression. Compressing again a digest
+// that didn't change since is a cheap no-op, see ForceCompress.
+func (t *TDigest) Compress() error {
+	if t.summary.compressed {
+		return nil
+	}
+	return t.compress()
+}
+
+// ForceCompress recompresses the digest down to its compression,
+// whatever its size and even if it is already compressed, e.g. right
+// before serializing it to minimize its size.
+//
+// Pulling in centroids from other digests (with Merge, say) tends to
+// leave more of them than necessary, which a single pass of Compress
+// only partly fixes. ForceCompress repeats the passes until one of
+// them no longer shrinks the digest, by which point every centroid
+// that could join a neighbor has done so. Calling it again on a
+// digest that didn't change since is a cheap no-op, as is calling
+// Compress.
+func (t *TDigest) ForceCompress() error {
+	if t.summary.settled {
+		return nil
+	}
+	for {
+		before := t.summary.Len()
+		err := t.compress()
+		if err != nil {
+			return err
+		}
+		if t.summary.Len() >= before {
+			t.summary.settled = true
+			return nil
+		}
+	}
+}
+
+// compress shuffles the centroids and adds them again to an empty
+// digest, a single pass of Compress.
+func (t *TDigest) compress() (err error) {
 	if t.summary.Len() <= 1 {
 		return nil
 	}
 
-	oldMeans, oldCounts := t.summary.GetDataCopy()
-	shuffle(oldMeans, oldCounts, t.rng)
-	return t.resetApplyTransaction(oldMeans, oldCounts)
+	buf := scratchPool.Get().(*scratch)
+	defer scratchPool.Put(buf)
+
+	buf.means = append(buf.means[:0], t.summary.means...)
+	buf.counts = append(buf.counts[:0], t.summary.counts...)
+	shuffle(buf.means, buf.counts, t.rng)
+
+	t.recordPeak()
+	stats := t.stats
+	err = t.resetApplyTransaction(buf.means, buf.counts)
+	t.stats = stats
+	if err == nil {
+		t.stats.Compressions++
+		t.stats.MergedCentroids += uint64(len(buf.means) - t.summary.Len())
+		t.summary.compressed = true
+		t.summary.cachePrefixSums()
+	}
+	return err
 }
 
+// resetApplyTransaction replaces the contents of the digest with the
+// given centroids, restoring them if that fails. The slices are not
+// retained.
 func (t *TDigest) resetApplyTransaction(oldMeans []float64, oldCounts []uint64) (err error) {
+	// The centroid means can't tell the exact extremes
+	min, max := t.min, t.max
+	defer t.updateExtremes(min, max)
+
 	t.Reset()
 	revert := func() {
-		t.summary.means = oldMeans
-		t.summary.counts = oldCounts
+		t.summary.means = append(t.summary.means[:0], oldMeans...)
+		t.summary.counts = append(t.summary.counts[:0], oldCounts...)
+		t.summary.invalidate()
+		sort.Sort(t.summary)
 		t.count = t.summary.GetTotalCount()
 	}
 	for idx, m := range oldMeans {
-		err = t.AddWeighted(m, oldCounts[idx])
+		err = t.insert(m, oldCounts[idx])
 		if err != nil {
 			revert()
 			return err
@@ -281,22 +1114,239 @@ func (t *TDigest) resetApplyTransaction(oldMeans []float64, oldCounts []uint64)
 // in separate threads and you want to compute quantiles over all the
 // samples. This is particularly important on a scatter-gather/map-reduce
 // scenario.
+//
+// Merging an empty digest does nothing, and merging into an empty
+// digest copies the other one's centroids.
+//
+// The digests may have different compressions: the result always uses
+// the receiver's one. When they differ, the combined centroids are
+// compressed again once merged, so that the result is laid out as if
+// it had been built with the receiver's compression (centroids of the
+// other digest are never split, though).
 func (t *TDigest) Merge(other *TDigest) (err error) {
+	err = t.merge(other)
+	if err != nil || other.summary.Len() == 0 {
+		return err
+	}
+	return t.finishMerge(other.min, other.max, other.compression)
+}
+
+// MergeKeepFinest works as Merge, but the result keeps the larger
+// (finer) of both compressions instead of the receiver's one, so
+// merging a more accurate digest into a coarser one doesn't lose the
+// accuracy of the former.
+//
+// When the receiver adopts the other digest's compression, the
+// centroids it already had are kept as is, since centroids can't be
+// split: accuracy only improves for the samples merged (or added)
+// from then on. A larger compression means more centroids, thus more
+// memory, a bigger serialization and slower additions, see
+// Compression. The compression is left as is if the merge fails.
+func (t *TDigest) MergeKeepFinest(other *TDigest) error {
+	compression := t.compression
+	if other.summary.Len() > 0 && other.compression > t.compression {
+		t.compression = other.compression
+	}
+	err := t.Merge(other)
+	if err != nil {
+		t.compression = compression
+	}
+	return err
+}
+
+// merge is Merge without the final steps of finishMerge, which are
+// left to the caller.
+func (t *TDigest) merge(other *TDigest) (err error) {
 	if other.summary.Len() == 0 {
 		return nil
 	}
 
+	err = checkCountOverflow(t.count, other.count)
+	if err != nil {
+		return err
+	}
+
+	if t.summary.Len() == 0 {
+		// Nothing to merge with, the centroids can be taken as is
+		t.summary.means = append(t.summary.means[:0], other.summary.means...)
+		t.summary.counts = append(t.summary.counts[:0], other.summary.counts...)
+		t.summary.invalidate()
+		t.count = other.count
+		t.min, t.max = other.min, other.max
+		return nil
+	}
+
+	t.breakConstant(other.min, other.max)
 	other.summary.Perm(t.rng, func(mean float64, count uint64) bool {
-		err = t.AddWeighted(mean, count)
+		err = t.insert(mean, count)
 		return err == nil
 	})
 	return err
 }
 
+// finishMerge completes merging the centroids of a digest with the
+// given extremes and compression: the range is widened to include
+// the extremes and, when the compressions differ, the centroids are
+// compressed again so that the result is laid out as if it had been
+// built with the receiver's compression. The cumulative counts are
+// built for the queries that usually follow.
+func (t *TDigest) finishMerge(min, max, compression float64) error {
+	t.updateExtremes(min, max)
+	if compression != t.compression {
+		return t.Compress()
+	}
+	t.summary.cachePrefixSums()
+	return nil
+}
+
+// MergeScaled joins a given digest into itself like Merge, but with
+// every centroid count of the other digest multiplied by weight, e.g.
+// to combine digests of samples taken at different rates. The other
+// digest is left untouched.
+//
+// Counts are integers, so the scaled ones are rounded, in a way that
+// preserves the total mass: walking the centroids in order, the
+// running total of the scaled counts is rounded to the nearest integer
+// and each centroid gets the difference with the previous one. Every
+// count is thus off by less than one and the merged digest gains
+// exactly round(weight*other.Count()) samples. Centroids whose count
+// is rounded down to zero are skipped. A weight of 1 is the same as
+// Merge.
+//
+// This will emit an error if `weight` is not a positive number or if
+// the total count of the digest would overflow.
+func (t *TDigest) MergeScaled(other *TDigest, weight float64) (err error) {
+	if !(weight > 0) || math.IsInf(weight, 1) {
+		return fmt.Errorf("illegal merge weight: %f", weight)
+	}
+	if other.summary.Len() == 0 {
+		return nil
+	}
+
+	total := math.Round(float64(other.count) * weight)
+	if total >= math.MaxUint64 {
+		return fmt.Errorf("scaling %d samples by %f overflows", other.count, weight)
+	}
+	err = checkCountOverflow(t.count, uint64(total))
+	if err != nil || total == 0 {
+		return err
+	}
+
+	buf := scratchPool.Get().(*scratch)
+	defer scratchPool.Put(buf)
+
+	var sum, previous float64
+	buf.counts = buf.counts[:0]
+	for _, count := range other.summary.counts {
+		sum += float64(count) * weight
+		rounded := math.Round(sum)
+		buf.counts = append(buf.counts, uint64(rounded-previous))
+		previous = rounded
+	}
+
+	// Same insertion order as merge
+	t.breakConstant(other.min, other.max)
+	buf.perm = permInto(t.rng, buf.perm, other.summary.Len())
+	for _, i := range buf.perm {
+		if buf.counts[i] == 0 {
+			continue
+		}
+		err = t.insert(other.summary.means[i], buf.counts[i])
+		if err != nil {
+			return err
+		}
+	}
+	return t.finishMerge(other.min, other.max, other.compression)
+}
+
+// MergeMany joins all the given digests into itself, skipping nil
+// ones. See Merge.
+//
+// The total count is checked upfront, so overflowing it doesn't merge
+// anything. When some digests have a different compression, the
+// result is only compressed again once all of them are merged.
+func (t *TDigest) MergeMany(digests ...*TDigest) (err error) {
+	err = checkTotalCount(t.count, digests)
+	if err != nil {
+		return err
+	}
+
+	recompress := false
+	for _, other := range digests {
+		if other == nil {
+			continue
+		}
+		err = t.merge(other)
+		if err != nil {
+			return err
+		}
+		t.updateExtremes(other.min, other.max)
+		recompress = recompress || (other.summary.Len() > 0 && other.compression != t.compression)
+	}
+
+	if recompress {
+		return t.Compress()
+	}
+	t.summary.cachePrefixSums()
+	return nil
+}
+
+// checkTotalCount returns an error if merging the given digests,
+// except nil ones, into a digest of the given count would overflow.
+func checkTotalCount(count uint64, digests []*TDigest) error {
+	for _, other := range digests {
+		if other == nil {
+			continue
+		}
+		err := checkCountOverflow(count, other.count)
+		if err != nil {
+			return err
+		}
+		count += other.count
+	}
+	return nil
+}
+
+// MergeAll creates a new digest with the given options (see New) and
+// merges all the given digests into it, see MergeMany.
+func MergeAll(digests []*TDigest, options ...tdigestOption) (*TDigest, error) {
+	t, err := New(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.MergeMany(digests...)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// MergeDeterministic works as Merge, but always yields the same result
+// when merging the same digests, which is convenient for tests and
+// golden files.
+//
+// Merge relies on the digest's random number generator to pick the
+// order in which centroids are inserted (sorted insertion is
+// pathological) and which centroids they join. Here, those decisions
+// come from a generator with a fixed seed instead, so the result only
+// depends on the contents of both digests. The accuracy is the same
+// as Merge's on average, but since the same "random" decisions are
+// made on every call, repeatedly merging similar digests won't
+// average out an unlucky one.
+func (t *TDigest) MergeDeterministic(other *TDigest) error {
+	rng := t.rng
+	t.rng = newLocalRNG(deterministicMergeSeed)
+	defer func() { t.rng = rng }()
+
+	return t.Merge(other)
+}
+
 // MergeDestructive joins a given digest into itself rendering
 // the other digest invalid.
 //
-// This works as Merge above but its faster. Using this method
+// This works as Merge above (including merging digests of different
+// compressions) but its faster. Using this method
 // requires caution as it makes 'other' useless - you must make
 // sure you discard it without making further uses of it.
 func (t *TDigest) MergeDestructive(other *TDigest) (err error) {
@@ -304,71 +1354,334 @@ func (t *TDigest) MergeDestructive(other *TDigest) (err error) {
 		return nil
 	}
 
+	err = checkCountOverflow(t.count, other.count)
+	if err != nil {
+		return err
+	}
+
+	t.breakConstant(other.min, other.max)
 	other.summary.shuffle(t.rng)
 	other.summary.ForEach(func(mean float64, count uint64) bool {
-		err = t.AddWeighted(mean, count)
+		err = t.insert(mean, count)
 		return err == nil
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	return t.finishMerge(other.min, other.max, other.compression)
 }
 
 // CDF computes the fraction in which all samples are less than
-// or equal to the given value.
+// or equal to the given value: 0 below Min(), 1 from Max() on.
+//
+// Like Quantile, it returns NaN for an empty digest since there is no
+// fraction of zero samples. Use Rank for a count that is 0 then.
 func (t *TDigest) CDF(value float64) float64 {
+	return t.estimateCDF(value, &cdfWalker{})
+}
+
+// CDFWithError computes CDF(value) along with an error band around
+// it, derived from the centroid straddling the value: the samples of
+// a centroid might lie anywhere within it, so the actual fraction of
+// samples less than or equal to the value may be anything from the
+// fraction before that centroid (lower) to the one after it (upper).
+// The band is as wide as the centroid's count over Count(), so it is
+// narrow where centroids are small (in the tails, or with a higher
+// compression) and vanishes below Min() and from Max() on, where the
+// CDF is exact.
+//
+// The bounds assume centroids don't overlap, which merges of digests
+// built from different data may break, so they are a measure of the
+// uncertainty rather than a guarantee. All three results are NaN for
+// an empty digest.
+func (t *TDigest) CDFWithError(value float64) (estimate, lower, upper float64) {
+	estimate = t.CDF(value)
+	if t.summary.Len() == 0 || value < t.min || value >= t.max {
+		return estimate, estimate, estimate
+	}
+
+	i := t.summary.nearest(value)
+	before := t.summary.countBefore(i)
+	n := float64(t.count)
+	lower = math.Min(float64(before)/n, estimate)
+	upper = math.Max(float64(before+t.summary.Count(i))/n, estimate)
+	return estimate, lower, upper
+}
+
+// InterpolatedRank is the inverse of Quantile: it returns the
+// fraction of the way, between 0 and 1, through the sorted samples
+// at which the given value would be, interpolated linearly so that it
+// grows smoothly with the value, unlike CDF which counts the samples
+// up to the value.
+//
+// It follows the midpoint convention of Quantile: a centroid sits at
+// the middle of the ranks of its samples, HeadSum+(count-1)/2 out of
+// 0 to Count()-1, with the smallest sample at rank 0 (Min()) and the
+// largest one at Count()-1 (Max()). Values are interpolated between
+// the means of the neighboring centroids, or between Min() (Max())
+// and the first (last) mean, and the rank is divided by Count()-1.
+// Thus InterpolatedRank(Quantile(q)) is q, give or take rounding, for
+// q whose estimate lies between the means of two centroids. Values
+// below Min() are at 0 and those from Max() on at 1.
+//
+// Returns NaN for an empty digest.
+func (t *TDigest) InterpolatedRank(value float64) float64 {
+	s := t.summary
+	if s.Len() == 0 {
+		return math.NaN()
+	} else if value < t.min {
+		return 0
+	} else if value >= t.max {
+		return 1
+	}
+
+	center := func(i int) float64 {
+		return float64(s.countBefore(i)) + float64(s.Count(i)-1)/2
+	}
+	last := float64(t.count - 1)
+
+	var rank float64
+	switch next := s.findInsertionIndex(value); next {
+	case 0:
+		rank = _quantile(value, t.min, s.Mean(0), 0, center(0))
+	case s.Len():
+		rank = _quantile(value, s.Mean(next-1), t.max, center(next-1), last)
+	default:
+		rank = _quantile(value, s.Mean(next-1), s.Mean(next), center(next-1), center(next))
+	}
+	return math.Max(0, math.Min(rank/last, 1))
+}
+
+// Rank returns the estimated number of samples less than or equal to
+// the given value: 0 below Min(), Count() from Max() on and CDF(value)
+// times Count() in between.
+func (t *TDigest) Rank(value float64) float64 {
+	return t.estimateRank(value, &cdfWalker{})
+}
+
+// CountBetween returns the estimated number of samples greater than
+// lo and less than or equal to hi, i.e. (CDF(hi)-CDF(lo))*Count(),
+// e.g. to count the requests of an SLO window. It is 0 if lo isn't
+// less than hi (or either of them is NaN) and for an empty digest.
+func (t *TDigest) CountBetween(lo, hi float64) float64 {
+	if !(lo < hi) {
+		return 0
+	}
+	walker := &cdfWalker{}
+	below := t.estimateRank(lo, walker)
+	return t.estimateRank(hi, walker) - below
+}
+
+// CDFs returns the CDF of all the given values, in the same order,
+// walking the centroids only once. The results are the same as
+// calling CDF for each of them. Like with Quantiles, values given in
+// increasing order don't need sorting.
+func (t *TDigest) CDFs(values ...float64) []float64 {
+	results := make([]float64, len(values))
+	walker := &cdfWalker{}
+
+	sorted := true
+	for i := 1; i < len(values) && sorted; i++ {
+		sorted = values[i] >= values[i-1]
+	}
+	if sorted {
+		for i, value := range values {
+			results[i] = t.estimateCDF(value, walker)
+		}
+		return results
+	}
+
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return values[order[i]] < values[order[j]] })
+	for _, i := range order {
+		results[i] = t.estimateCDF(values[i], walker)
+	}
+	return results
+}
+
+// estimateCDF computes CDF(value), resuming the walk over the
+// centroids where the walker left it. Successive calls sharing a
+// walker must have non-decreasing values.
+func (t *TDigest) estimateCDF(value float64, walker *cdfWalker) float64 {
 	if t.summary.Len() == 0 {
 		return math.NaN()
+	}
+	return t.estimateRank(value, walker) / float64(t.count)
+}
+
+// estimateRank computes Rank(value), with the same requirements as
+// estimateCDF.
+func (t *TDigest) estimateRank(value float64, walker *cdfWalker) float64 {
+	if t.summary.Len() == 0 || value < t.min {
+		return 0
+	} else if value >= t.max {
+		return float64(t.count)
 	} else if t.summary.Len() == 1 {
 		if value < t.summary.Mean(0) {
 			return 0
 		}
-		return 1
+		return float64(t.count)
 	}
 
 	// We have at least 2 centroids
-	left := (t.summary.Mean(1) - t.summary.Mean(0)) / 2
-	right := left
-	tot := 0.0
-
-	for i := 1; i < t.summary.Len()-1; i++ {
-		prevMean := t.summary.Mean(i - 1)
-		if value < prevMean+right {
-			v := (tot + float64(t.summary.Count(i-1))*interpolate(value, prevMean-left, prevMean+right)) / float64(t.Count())
+	if walker.summary == nil {
+		walker.summary = t.summary
+		walker.next = 1
+		walker.left = (t.summary.Mean(1) - t.summary.Mean(0)) / 2
+		walker.right = walker.left
+	}
+	return walker.rank(value)
+}
+
+// cdfWalker computes ranks from the centroids, moving forward through
+// the digest as the requested value grows.
+type cdfWalker struct {
+	summary     *summary
+	next        int
+	left, right float64
+	tot         float64
+}
+
+// rank returns the rank of the given value, which must not be smaller
+// than the one of the previous call. The digest must have at least
+// two centroids.
+func (w *cdfWalker) rank(value float64) float64 {
+	s := w.summary
+
+	// Skip the centroids lying entirely below the value, i.e. those
+	// whose upper bound (halfway to the next one) is not above it
+	if skip := sort.Search(s.Len()-1-w.next, func(i int) bool {
+		j := w.next + i
+		return value < s.Mean(j-1)+(s.Mean(j)-s.Mean(j-1))/2
+	}); skip > 0 {
+		if cumulative := s.prefixSums(); cumulative != nil {
+			w.tot = float64(cumulative[w.next+skip-1])
+		} else {
+			w.tot += float64(sumUntilIndex(s.counts[w.next-1:], skip))
+		}
+		w.next += skip
+		w.left = (s.Mean(w.next-1) - s.Mean(w.next-2)) / 2
+		w.right = (s.Mean(w.next) - s.Mean(w.next-1)) / 2
+	}
+
+	for ; w.next < s.Len()-1; w.next++ {
+		prevMean := s.Mean(w.next - 1)
+		if value < prevMean+w.right {
+			v := w.tot + float64(s.Count(w.next-1))*interpolate(value, prevMean-w.left, prevMean+w.right)
 			if v > 0 {
 				return v
 			}
 			return 0
 		}
 
-		tot += float64(t.summary.Count(i - 1))
-		left = right
-		right = (t.summary.Mean(i+1) - t.summary.Mean(i)) / 2
+		w.tot += float64(s.Count(w.next - 1))
+		w.left = w.right
+		w.right = (s.Mean(w.next+1) - s.Mean(w.next)) / 2
 	}
 
 	// last centroid, the summary length is at least two
-	aIdx := t.summary.Len() - 2
-	aMean := t.summary.Mean(aIdx)
-	if value < aMean+right {
-		aCount := float64(t.summary.Count(aIdx))
-		return (tot + aCount*interpolate(value, aMean-left, aMean+right)) / float64(t.Count())
+	aIdx := s.Len() - 2
+	aMean := s.Mean(aIdx)
+	if value < aMean+w.right {
+		aCount := float64(s.Count(aIdx))
+		return w.tot + aCount*interpolate(value, aMean-w.left, aMean+w.right)
 	}
-	return 1
+	return w.tot + float64(s.Count(aIdx)+s.Count(aIdx+1))
 }
 
-// Clone returns a deep copy of a TDigest.
+// Clone returns a deep copy of a TDigest, which can be modified
+// independently of the original, e.g. to snapshot a digest before a
+// merge. The random number generator is shared with the original
+// though, so using both copies concurrently isn't safe unless it is.
 func (t *TDigest) Clone() *TDigest {
 	return &TDigest{
-		summary:     t.summary.Clone(),
-		compression: t.compression,
-		count:       t.count,
-		rng:         t.rng,
+		summary:       t.summary.Clone(),
+		compression:   t.compression,
+		count:         t.count,
+		min:           t.min,
+		max:           t.max,
+		rng:           t.rng,
+		scale:         t.scale,
+		interpolation: t.interpolation,
+		ties:          t.ties,
+		bufferFactor:  t.bufferFactor,
+		stats:         t.stats,
 	}
 }
 
+// String returns a short, human-readable description of the digest,
+// such as
+//
+//	tdigest(compression=100, centroids=37, count=10234, min=0.01, max=99.8, p50=49.6, p99=98.9)
+//
+// Its length doesn't depend on the size of the digest. The statistics
+// are left out when the digest is empty.
+func (t *TDigest) String() string {
+	if t.count == 0 {
+		return fmt.Sprintf("tdigest(compression=%g, centroids=0, count=0)", t.compression)
+	}
+	return fmt.Sprintf("tdigest(compression=%g, centroids=%d, count=%d, min=%.6g, max=%.6g, p50=%.6g, p99=%.6g)",
+		t.compression, t.summary.Len(), t.count, t.min, t.max, t.Quantile(0.5), t.Quantile(0.99))
+}
+
+// Equals reports whether both digests hold the same centroids: the
+// same number of them, with identical counts and means that differ
+// by no more than tolerance, which makes their total counts equal
+// too. Digests with a different number of centroids are never equal.
+//
+// Settings such as the compression and the (exact) Min() and Max()
+// are not compared, so a digest and its deserialized copy are equal
+// as long as the tolerance covers any precision lost by the
+// encoding.
+func (t *TDigest) Equals(other *TDigest, tolerance float64) bool {
+	if other == nil || t.count != other.count || t.summary.Len() != other.summary.Len() {
+		return false
+	}
+	for i, mean := range t.summary.means {
+		if t.summary.counts[i] != other.summary.counts[i] || !(math.Abs(mean-other.summary.means[i]) <= tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff returns how much the estimations of the given quantiles moved
+// from those of baseline: each quantile maps to t.Quantile(q) minus
+// baseline.Quantile(q), so positive deltas mean higher values.
+//
+// Quantiles are relative to the count of each digest, so digests of
+// different sizes compare fine. Deltas are NaN when either digest is
+// empty, or baseline is nil, and NaN quantiles are left out since they
+// can't be looked up in a map.
+func (t *TDigest) Diff(baseline *TDigest, quantiles []float64) map[float64]float64 {
+	deltas := make(map[float64]float64, len(quantiles))
+	if baseline == nil {
+		for _, q := range quantiles {
+			if !math.IsNaN(q) {
+				deltas[q] = math.NaN()
+			}
+		}
+		return deltas
+	}
+
+	current, previous := t.Quantiles(quantiles...), baseline.Quantiles(quantiles...)
+	for i, q := range quantiles {
+		if !math.IsNaN(q) {
+			deltas[q] = current[i] - previous[i]
+		}
+	}
+	return deltas
+}
+
 func interpolate(x, x0, x1 float64) float64 {
 	return (x - x0) / (x1 - x0)
 }
 
-// ForEachCentroid calls the specified function for each centroid.
+// ForEachCentroid calls the specified function for each centroid, in
+// increasing order of their means.
 //
 // Iteration stops when the supplied function returns false, or when all
 // centroids have been iterated.
@@ -376,6 +1689,19 @@ func (t *TDigest) ForEachCentroid(f func(mean float64, count uint64) bool) {
 	t.summary.ForEach(f)
 }
 
+// ExportCentroids returns copies of the means and counts of the
+// centroids, in increasing order of their means, which NewFromCentroids
+// turns back into a digest.
+//
+// Like every method of TDigest, this isn't synchronized: a digest
+// modified while its centroids are copied yields a torn copy, mixing
+// centroids from before and after the change. Callers sharing a digest
+// between goroutines must hold the lock guarding its writers, or use
+// Concurrent.ExportCentroids.
+func (t *TDigest) ExportCentroids() (means []float64, counts []uint64) {
+	return t.summary.GetDataCopy()
+}
+
 func (t TDigest) findNeighbors(start int, value float64) (int, int) {
 	minDistance := math.MaxFloat64
 	lastNeighbor := t.summary.Len()
@@ -405,7 +1731,7 @@ func (t TDigest) chooseMergeCandidate(begin, end int, count uint64) int {
 		} else {
 			q = (sum + (c-1)/2) / float64(t.count-1)
 		}
-		k := 4 * float64(t.count) * q * (1 - q) / t.compression
+		k := maxCentroidSize(t.scale, q, t.compression, float64(t.count))
 
 		if c+float64(count) <= k {
 			n++
@@ -421,25 +1747,35 @@ func (t TDigest) chooseMergeCandidate(begin, end int, count uint64) int {
 // TrimmedMean returns the mean of the distribution between the two
 // percentiles p1 and p2.
 //
-// Values of p1 and p2 must be beetween 0 and 1 (inclusive) and p1
-// must be less than p2. Will panic otherwise.
+// Only the samples ranked between p1*Count() and p2*Count() are
+// taken into account. Within a centroid, samples are assumed to be
+// evenly spread over its ranks, so the centroids straddling either
+// boundary contribute their mean weighted by the portion of their
+// count that falls inside the range. Thus TrimmedMean(0, 1) is the
+// mean of all samples.
+//
+// Values of p1 and p2 outside of [0, 1] are clamped, as Quantile
+// does. Returns NaN if p1 is not lower than p2 once clamped (or either
+// of them is NaN), and 0 for an empty digest.
 func (t *TDigest) TrimmedMean(p1, p2 float64) float64 {
-	if p1 < 0 || p1 > 1 {
-		panic("p1 must be between 0 and 1 (inclusive)")
-	}
-	if p2 < 0 || p2 > 1 {
-		panic("p2 must be between 0 and 1 (inclusive)")
-	}
-	if p1 >= p2 {
-		panic("p1 must be lower than p2")
+	p1, p2 = clampQuantile(p1), clampQuantile(p2)
+	if !(p1 < p2) {
+		return math.NaN()
 	}
 
 	minCount := p1 * float64(t.count)
 	maxCount := p2 * float64(t.count)
 
-	var trimmedSum, trimmedCount, currCount float64
-	for i, mean := range t.summary.means {
-		count := float64(t.summary.counts[i])
+	// Skip straight to the centroid holding the sample at minCount
+	start, currCount := t.summary.FloorSum(minCount)
+	if start < 0 {
+		start = 0
+	}
+
+	var trimmedSum, trimmedCount float64
+	for i := start; i < t.summary.Len(); i++ {
+		mean := t.summary.Mean(i)
+		count := float64(t.summary.Count(i))
 
 		nextCount := currCount + count
 		if nextCount <= minCount {
@@ -469,6 +1805,116 @@ func (t *TDigest) TrimmedMean(p1, p2 float64) float64 {
 	return trimmedSum / trimmedCount
 }
 
+// Sum returns an estimate of the sum of all samples in the digest.
+//
+// Each centroid mean is the average of the samples it absorbed, so
+// the sum of mean*count over all centroids closely approximates the
+// sum of the samples themselves. Returns 0 for an empty digest, and
+// ±Inf if the sum is beyond the range of a float64.
+func (t *TDigest) Sum() float64 {
+	var sum float64
+	for i, mean := range t.summary.means {
+		sum += mean * float64(t.summary.counts[i])
+	}
+	return sum
+}
+
+// Variance returns an estimate of the (population) variance of the
+// samples in the digest, computed from the centroid means and counts
+// around the overall mean, Sum()/Count(). Returns 0 for an empty
+// digest.
+//
+// The spread of samples within each centroid is lost, so this
+// underestimates the true variance. The error is small for large
+// digests since most centroids are narrow compared to the whole
+// distribution, but grows as the compression decreases.
+func (t *TDigest) Variance() float64 {
+	if t.count == 0 {
+		return 0
+	}
+
+	// Work on means scaled down to [-1, 1], so that neither the sum
+	// of the samples nor the squares overflow unless the variance does
+	scale := math.Max(math.Abs(t.min), math.Abs(t.max))
+	if scale == 0 {
+		return 0
+	}
+	var mean, total float64
+	for i, m := range t.summary.means {
+		count := float64(t.summary.counts[i])
+		total += count
+		mean += (m/scale - mean) * (count / total)
+	}
+
+	var sum float64
+	for i, m := range t.summary.means {
+		d := m/scale - mean
+		sum += d * d * float64(t.summary.counts[i])
+	}
+	return sum / float64(t.count) * scale * scale
+}
+
+// StdDev returns an estimate of the standard deviation of the samples
+// in the digest, the square root of Variance (see its caveats).
+func (t *TDigest) StdDev() float64 {
+	return math.Sqrt(t.Variance())
+}
+
+// Mode returns an estimate of the most frequent value in the digest:
+// the mean of the centroid with the highest density, that is, count
+// per unit of width. A centroid's width is approximated by half the
+// distance between its neighboring means (or the distance to its
+// only neighbor, at the edges). Ties resolve to the lower mean.
+// Returns NaN for an empty digest.
+//
+// This is a heuristic: centroids are deliberately small near the
+// tails and large near the median, so densities are only comparable
+// between nearby centroids. It works well for clearly peaked
+// distributions, but on flat or multi-modal ones the result may be
+// any of the (local) modes, or simply noise.
+func (t *TDigest) Mode() float64 {
+	n := t.summary.Len()
+	if n == 0 {
+		return math.NaN()
+	} else if n == 1 {
+		return t.summary.Mean(0)
+	}
+
+	means := t.summary.means
+	mode, density := 0, -1.0
+	for i := 0; i < n; i++ {
+		var width float64
+		switch i {
+		case 0:
+			width = means[1] - means[0]
+		case n - 1:
+			width = means[n-1] - means[n-2]
+		default:
+			width = (means[i+1] - means[i-1]) / 2
+		}
+
+		d := float64(t.summary.counts[i]) / width
+		if d > density {
+			mode, density = i, d
+		}
+	}
+	return means[mode]
+}
+
+// deterministicMergeSeed seeds the generator used by
+// MergeDeterministic. Changing it changes the results of every
+// deterministic merge.
+const deterministicMergeSeed = 0x7d16e57
+
+// checkCountOverflow errors if adding count samples to a digest (or
+// centroid) holding total would overflow.
+func checkCountOverflow(total, count uint64) error {
+	if total+count < total {
+		return fmt.Errorf("count overflow: can't add %d samples to %d", count, total)
+	}
+	return nil
+}
+
 func estimateCapacity(compression float64) int {
 	return int(compression) * 10
 }
@@ -1,10 +1,13 @@
 package tdigest
 
 import (
+	"bytes"
 	"fmt"
 	"math"
 	"math/rand"
+	"reflect"
 	"sort"
+	"sync"
 	"testing"
 
 	rng "github.com/leesper/go_rng"
@@ -75,6 +78,125 @@ func assertDifferenceSmallerThan(tdigest *TDigest, p float64, m float64, t *test
 	}
 }
 
+func TestSmallDigests(t *testing.T) {
+	empty := uncheckedNew()
+	single := uncheckedNew()
+	_ = single.AddWeighted(2, 3)
+	pair := uncheckedNew()
+	_ = pair.Add(1)
+	_ = pair.Add(3)
+
+	inputs := []struct {
+		name      string
+		digest    *TDigest
+		quantiles []float64
+		// CDFs below Min(), at Min(), at Max() and above it
+		cdfs []float64
+	}{
+		{"empty", empty, []float64{math.NaN(), math.NaN(), math.NaN()}, []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN()}},
+		{"single centroid", single, []float64{2, 2, 2}, []float64{0, 1, 1, 1}},
+		{"two centroids", pair, []float64{1, 2, 3}, []float64{0, 0.25, 1, 1}},
+	}
+	same := func(a, b float64) bool {
+		return a == b || (math.IsNaN(a) && math.IsNaN(b))
+	}
+	for _, input := range inputs {
+		td := input.digest
+		for i, q := range []float64{0, 0.5, 1} {
+			if x := td.Quantile(q); !same(x, input.quantiles[i]) {
+				t.Errorf("%s: expected Quantile(%g) to be %f, got %f", input.name, q, input.quantiles[i], x)
+			}
+		}
+
+		lo, hi := td.Min(), td.Max()
+		if td.Count() == 0 {
+			lo, hi = 0, 0
+		}
+		for i, value := range []float64{lo - 1, lo, hi, hi + 1} {
+			if x := td.CDF(value); !same(x, input.cdfs[i]) {
+				t.Errorf("%s: expected CDF(%f) to be %f, got %f", input.name, value, input.cdfs[i], x)
+			}
+		}
+	}
+
+	if empty.Rank(1) != 0 {
+		t.Errorf("Expected the rank of any value to be 0 in an empty digest, got %f", empty.Rank(1))
+	}
+}
+
+func TestGetters(t *testing.T) {
+	td := uncheckedNew()
+	if td.Compression() != 100 || td.Count() != 0 {
+		t.Errorf("Expected a new digest to have compression 100 and no samples, got %f and %d", td.Compression(), td.Count())
+	}
+
+	_ = td.Add(1)
+	_ = td.AddWeighted(2, 10)
+	other := uncheckedNew(Compression(42))
+	_ = other.AddWeighted(3, 5)
+	_ = td.Merge(other)
+
+	// Merging doesn't change the compression, only the count
+	if td.Compression() != 100 || other.Compression() != 42 || td.Count() != 16 {
+		t.Errorf("Expected compression 100 and 16 samples, got %f and %d", td.Compression(), td.Count())
+	}
+	if td.Count() != td.summary.GetTotalCount() {
+		t.Errorf("Expected Count() to match the centroids, got %d and %d", td.Count(), td.summary.GetTotalCount())
+	}
+}
+
+func TestSizeBytes(t *testing.T) {
+	empty := uncheckedNew(InitialCapacity(0))
+	base := empty.SizeBytes()
+	if base <= 0 {
+		t.Fatalf("Expected a positive footprint, got %d", base)
+	}
+
+	// Capacity counts, used or not
+	td := uncheckedNew(InitialCapacity(1000))
+	if td.SizeBytes() != base+1000*16 {
+		t.Errorf("Expected %d bytes, got %d", base+1000*16, td.SizeBytes())
+	}
+	_ = td.Add(1)
+	if td.SizeBytes() != base+1000*16 {
+		t.Errorf("Expected a sample to fit in the preallocated buffers, got %d bytes", td.SizeBytes())
+	}
+
+	// and so do the caches built by compressions
+	for i := 0; i < 500; i++ {
+		_ = td.Add(float64(i))
+	}
+	before := td.SizeBytes()
+	_ = td.Compress()
+	if td.SizeBytes() <= before {
+		t.Errorf("Expected the cumulative counts to be accounted for")
+	}
+}
+
+func TestCentroidCount(t *testing.T) {
+	td := uncheckedNew(Compression(10))
+	if td.CentroidCount() != 0 {
+		t.Errorf("Expected a new digest to have no centroids, got %d", td.CentroidCount())
+	}
+
+	// Distinct samples far apart from each other get a centroid each
+	// at first
+	for i := 0; i < 3; i++ {
+		_ = td.Add(float64(i * 1000))
+	}
+	if td.CentroidCount() != 3 || td.CentroidCount() != td.summary.Len() {
+		t.Errorf("Expected 3 centroids, got %d", td.CentroidCount())
+	}
+
+	// and never more than the threshold triggering a compression
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rand.Float64())
+		if td.CentroidCount() > int(20*td.Compression()) || td.CentroidCount() != td.summary.Len() {
+			t.Fatalf("Expected at most %d centroids, got %d", int(20*td.Compression()), td.CentroidCount())
+		}
+	}
+}
+
 func TestUniformDistribution(t *testing.T) {
 	tdigest := uncheckedNew()
 
@@ -236,393 +358,2284 @@ func TestWeights(t *testing.T) {
 	assertDifferenceFromQuantile(data, tdigest, 0.999, 1.0+0.001*100.0, t)
 }
 
-func TestIntegers(t *testing.T) {
-	tdigest := uncheckedNew()
-
-	_ = tdigest.Add(1)
-	_ = tdigest.Add(2)
-	_ = tdigest.Add(3)
-
-	if tdigest.Quantile(0.5) != 2 {
-		t.Errorf("Expected p(0.5) = 2, Got %.2f instead", tdigest.Quantile(0.5))
+func TestWeightedRepeats(t *testing.T) {
+	r := rand.New(rand.NewSource(0x5EE5))
+	weighted := uncheckedNew(LocalRandomNumberGenerator(1))
+	repeated := uncheckedNew(LocalRandomNumberGenerator(1))
+	for i := 0; i < 20000; i++ {
+		x := math.Round(r.NormFloat64() * 100)
+		before := weighted.summary.Len()
+		_ = weighted.AddWeighted(x, 5)
+		if before > 1 && weighted.summary.Len() > before+1 {
+			t.Fatalf("Expected a weighted sample to add a single centroid at most, got %d more", weighted.summary.Len()-before)
+		}
+		for j := 0; j < 5; j++ {
+			_ = repeated.Add(x)
+		}
 	}
 
-	tdigest = uncheckedNew()
-
-	for _, i := range []float64{1, 2, 2, 2, 2, 2, 2, 2, 3} {
-		_ = tdigest.Add(i)
+	if weighted.Count() != repeated.Count() || weighted.Min() != repeated.Min() || weighted.Max() != repeated.Max() {
+		t.Errorf("Expected the same count and extremes, got %d %f %f and %d %f %f", weighted.Count(), weighted.Min(), weighted.Max(), repeated.Count(), repeated.Min(), repeated.Max())
+	}
+	if float64(weighted.summary.Len()) > 20*weighted.Compression() {
+		t.Errorf("Expected the digest to stay compressed, got %d centroids", weighted.summary.Len())
+	}
+	for _, q := range []float64{0.001, 0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+		if math.Abs(weighted.Quantile(q)-repeated.Quantile(q)) > 2 {
+			t.Errorf("Quantile(%g): expected %f, got %f", q, repeated.Quantile(q), weighted.Quantile(q))
+		}
 	}
+}
 
-	if tdigest.Quantile(0.5) != 2 {
-		t.Errorf("Expected p(0.5) = 2, Got %.2f instead", tdigest.Quantile(0.5))
+func TestAddCentroid(t *testing.T) {
+	source := uncheckedNew(Compression(50))
+	for i := 0; i < 100000; i++ {
+		_ = source.Add(rand.ExpFloat64())
+	}
+	if source.summary.Len() < 500 {
+		t.Fatalf("Expected at least 500 centroids, got %d", source.summary.Len())
 	}
 
-	var tot uint64
-	tdigest.ForEachCentroid(func(mean float64, count uint64) bool {
-		tot += count
+	td := uncheckedNew(Compression(50))
+	source.ForEachCentroid(func(mean float64, count uint64) bool {
+		err := td.AddCentroid(mean, count)
+		if err != nil {
+			t.Fatal(err)
+		}
 		return true
 	})
 
-	if tot != 9 {
-		t.Errorf("Expected the centroid count to be 9, Got %d instead", tot)
+	if td.summary.Len() != source.summary.Len() || td.Count() != source.Count() {
+		t.Errorf("Expected the centroids to be inserted as is, got %d centroids and count %d", td.summary.Len(), td.Count())
 	}
-}
 
-func cdf(x float64, data []float64) float64 {
-	var n1, n2 int
-	for i := 0; i < len(data); i++ {
-		if data[i] < x {
-			n1++
-		}
-		if data[i] <= x {
-			n2++
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+		if math.Abs(td.Quantile(q)-source.Quantile(q)) > 1e-9 {
+			t.Errorf("Expected Quantile(%g) to be %f, got %f", q, source.Quantile(q), td.Quantile(q))
 		}
 	}
-	return float64(n1+n2) / 2.0 / float64(len(data))
-}
 
-func quantile(q float64, data []float64) float64 {
-	if len(data) == 0 {
-		return math.NaN()
+	if td.AddCentroid(math.NaN(), 1) == nil || td.AddCentroid(1, 0) == nil {
+		t.Errorf("Expected illegal centroids to be rejected")
 	}
 
-	if q == 1 || len(data) == 1 {
-		return data[len(data)-1]
+	// Growing too big triggers a compression
+	td = uncheckedNew(Compression(5))
+	for i := 0; i < 1000; i++ {
+		_ = td.AddCentroid(float64(i), 1)
+	}
+	if td.summary.Len() > 100 || td.Count() != 1000 {
+		t.Errorf("Expected a compressed digest of 1000 samples, got %d centroids and count %d", td.summary.Len(), td.Count())
 	}
-
-	index := q * (float64(len(data)) - 1)
-	return data[int(index)+1]*(index-float64(int(index))) + data[int(index)]*(float64(int(index)+1)-index)
-}
-
-func TestMergeNormal(t *testing.T) {
-	testMerge(t, false)
-}
-
-func TestMergeDescructive(t *testing.T) {
-	testMerge(t, true)
 }
 
-func testMerge(t *testing.T, destructive bool) {
-	if testing.Short() {
-		t.Skipf("Skipping merge test. Short flag is on")
+func TestAddBatch(t *testing.T) {
+	data := make([]float64, 100000)
+	for i := range data {
+		data[i] = rand.Float64()
 	}
+	original := append([]float64(nil), data...)
 
-	const numItems = 100000
+	tdigest := uncheckedNew()
+	// In a few batches, so later ones merge with existing centroids
+	for i := 0; i < len(data); i += 30000 {
+		end := i + 30000
+		if end > len(data) {
+			end = len(data)
+		}
+		err := tdigest.AddBatch(data[i:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	for _, numSubs := range []int{2, 5, 10, 20, 50, 100} {
-		data := make([]float64, numItems)
+	if !reflect.DeepEqual(data, original) {
+		t.Errorf("AddBatch shouldn't modify its input")
+	}
 
-		subs := make([]*TDigest, numSubs)
-		for i := 0; i < numSubs; i++ {
-			subs[i] = uncheckedNew()
-		}
+	sort.Float64s(original)
+	if tdigest.Count() != uint64(len(data)) || tdigest.Min() != original[0] || tdigest.Max() != original[len(original)-1] {
+		t.Errorf("Unexpected count or extremes: %d %v %v", tdigest.Count(), tdigest.Min(), tdigest.Max())
+	}
 
-		dist := uncheckedNew()
-		for i := 0; i < numItems; i++ {
-			num := rand.Float64()
+	if float64(tdigest.summary.Len()) > 20*tdigest.Compression() {
+		t.Errorf("Expected the digest to stay compressed, got %d centroids", tdigest.summary.Len())
+	}
 
-			data[i] = num
-			_ = dist.Add(num)
-			_ = subs[i%numSubs].Add(num)
-		}
+	assertDifferenceSmallerThan(tdigest, 0.5, 0.02, t)
+	assertDifferenceSmallerThan(tdigest, 0.1, 0.01, t)
+	assertDifferenceSmallerThan(tdigest, 0.9, 0.01, t)
+	assertDifferenceSmallerThan(tdigest, 0.01, 0.005, t)
+	assertDifferenceSmallerThan(tdigest, 0.99, 0.005, t)
+	assertDifferenceSmallerThan(tdigest, 0.001, 0.001, t)
+	assertDifferenceSmallerThan(tdigest, 0.999, 0.001, t)
 
-		_ = dist.Compress()
+	if tdigest.AddBatch([]float64{1, math.NaN()}) == nil || tdigest.Count() != uint64(len(data)) {
+		t.Errorf("Expected a batch containing NaN to be rejected as a whole")
+	}
 
-		dist2 := uncheckedNew()
-		for i := 0; i < numSubs; i++ {
-			if destructive {
-				_ = dist2.MergeDestructive(subs[i])
-			} else {
-				_ = dist2.Merge(subs[i])
-			}
+	if tdigest.AddBatch(nil) != nil || tdigest.Count() != uint64(len(data)) {
+		t.Errorf("Expected an empty batch to be a no-op")
+	}
+}
 
+func TestAddBatchWeighted(t *testing.T) {
+	r := rand.New(rand.NewSource(0xBA7C))
+	values := make([]float64, 20000)
+	weights := make([]uint64, len(values))
+	for i := range values {
+		values[i] = r.NormFloat64()
+		weights[i] = uint64(1 + r.Intn(10))
+	}
+	originalValues := append([]float64(nil), values...)
+	originalWeights := append([]uint64(nil), weights...)
+
+	batch := uncheckedNew()
+	single := uncheckedNew()
+	// In a few batches, so later ones merge with existing centroids
+	for i := 0; i < len(values); i += 5000 {
+		err := batch.AddBatchWeighted(values[i:i+5000], weights[i:i+5000])
+		if err != nil {
+			t.Fatal(err)
 		}
+	}
+	for i, value := range values {
+		_ = single.AddWeighted(value, weights[i])
+	}
 
-		if dist.Count() != dist2.Count() {
-			t.Errorf("Expected the number of centroids to be the same. %d != %d", dist.Count(), dist2.Count())
+	if !reflect.DeepEqual(values, originalValues) || !reflect.DeepEqual(weights, originalWeights) {
+		t.Errorf("AddBatchWeighted shouldn't modify its input")
+	}
+	if err := batch.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Count() != single.Count() || batch.Min() != single.Min() || batch.Max() != single.Max() {
+		t.Errorf("Expected the same count and extremes as weighted adds, got %d %f %f and %d %f %f", batch.Count(), batch.Min(), batch.Max(), single.Count(), single.Min(), single.Max())
+	}
+	if float64(batch.summary.Len()) > 20*batch.Compression() {
+		t.Errorf("Expected the digest to stay compressed, got %d centroids", batch.summary.Len())
+	}
+	for _, q := range []float64{0.001, 0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+		if math.Abs(batch.Quantile(q)-single.Quantile(q)) > 0.02 {
+			t.Errorf("Quantile(%g): expected about %f, got %f", q, single.Quantile(q), batch.Quantile(q))
 		}
+	}
 
-		if dist2.Count() != numItems {
-			t.Errorf("Items shouldn't have disappeared. %d != %d", dist2.Count(), numItems)
+	count := batch.Count()
+	inputs := []struct {
+		values  []float64
+		weights []uint64
+	}{
+		{[]float64{1, 2}, []uint64{1}},
+		{[]float64{1, math.NaN()}, []uint64{1, 1}},
+		{[]float64{1, 2}, []uint64{1, 0}},
+		{[]float64{1, 2}, []uint64{1, math.MaxUint64}},
+	}
+	for _, input := range inputs {
+		if batch.AddBatchWeighted(input.values, input.weights) == nil || batch.Count() != count {
+			t.Errorf("Expected %v with weights %v to be rejected as a whole", input.values, input.weights)
 		}
+	}
+	if batch.AddBatchWeighted(nil, nil) != nil || batch.Count() != count {
+		t.Errorf("Expected an empty batch to be a no-op")
+	}
+}
 
-		sort.Float64s(data)
-
-		for _, q := range []float64{0.001, 0.01, 0.1, 0.2, 0.3, 0.5} {
-			z := quantile(q, data)
-			p1 := dist.Quantile(q)
-			p2 := dist2.Quantile(q)
+func TestFromSortedValues(t *testing.T) {
+	data := make([]float64, 100000)
+	for i := range data {
+		data[i] = rand.Float64()
+	}
+	sort.Float64s(data)
 
-			e1 := p1 - z
-			e2 := p2 - z
+	tdigest, err := FromSortedValues(data, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tdigest.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if tdigest.Compression() != 100 || tdigest.Count() != uint64(len(data)) || tdigest.Min() != data[0] || tdigest.Max() != data[len(data)-1] {
+		t.Errorf("Unexpected compression, count or extremes: %f %d %v %v", tdigest.Compression(), tdigest.Count(), tdigest.Min(), tdigest.Max())
+	}
+	if float64(tdigest.summary.Len()) > 20*tdigest.Compression() {
+		t.Errorf("Expected the digest to be compressed, got %d centroids", tdigest.summary.Len())
+	}
 
-			if math.Abs(e2)/q >= 0.3 {
-				t.Errorf("rel >= 0.3: parts=%3d q=%.3f e1=%.4f e2=%.4f rel=%.3f real=%.3f",
-					numSubs, q, e1, e2, math.Abs(e2)/q, z-q)
-			}
-			if math.Abs(e2) >= 0.015 {
-				t.Errorf("e2 >= 0.015: parts=%3d q=%.3f e1=%.4f e2=%.4f rel=%.3f real=%.3f",
-					numSubs, q, e1, e2, math.Abs(e2)/q, z-q)
-			}
+	assertDifferenceSmallerThan(tdigest, 0.5, 0.02, t)
+	assertDifferenceSmallerThan(tdigest, 0.1, 0.01, t)
+	assertDifferenceSmallerThan(tdigest, 0.9, 0.01, t)
+	assertDifferenceSmallerThan(tdigest, 0.01, 0.005, t)
+	assertDifferenceSmallerThan(tdigest, 0.99, 0.005, t)
+	assertDifferenceSmallerThan(tdigest, 0.001, 0.001, t)
+	assertDifferenceSmallerThan(tdigest, 0.999, 0.001, t)
 
-			z = cdf(q, data)
-			e1 = dist.CDF(q) - z
-			e2 = dist2.CDF(q) - z
+	batch := uncheckedNew()
+	_ = batch.AddBatch(data)
+	if !reflect.DeepEqual(tdigest.summary.means, batch.summary.means) || !reflect.DeepEqual(tdigest.summary.counts, batch.summary.counts) {
+		t.Errorf("Expected the same centroids as AddBatch")
+	}
 
-			if math.Abs(e2)/q > 0.3 {
-				t.Errorf("CDF e2 < 0.015: parts=%3d q=%.3f e1=%.4f e2=%.4f rel=%.3f",
-					numSubs, q, e1, e2, math.Abs(e2)/q)
-			}
+	empty, err := FromSortedValues(nil, 100)
+	if err != nil || empty.Count() != 0 {
+		t.Errorf("Expected an empty digest, got %d samples (%v)", empty.Count(), err)
+	}
 
-			if math.Abs(e2) >= 0.015 {
-				t.Errorf("CDF e2 < 0.015: parts=%3d q=%.3f e1=%.4f e2=%.4f rel=%.3f",
-					numSubs, q, e1, e2, math.Abs(e2)/q)
-			}
+	inputs := [][]float64{
+		{1, 3, 2},
+		{1, math.NaN(), 2},
+		{1, 2, math.Inf(1)},
+	}
+	for _, input := range inputs {
+		if _, err := FromSortedValues(input, 100); err == nil {
+			t.Errorf("Expected %v to be rejected", input)
 		}
 	}
+	if _, err := FromSortedValues(data, 0); err == nil {
+		t.Errorf("Expected an invalid compression to be rejected")
+	}
 }
 
-func TestCompressDoesntChangeCount(t *testing.T) {
-	tdigest := uncheckedNew()
+func TestNewFromCentroids(t *testing.T) {
+	r := rand.New(rand.NewSource(0xCE27))
+	original := uncheckedNew(Compression(50), LocalRandomNumberGenerator(1))
+	for i := 0; i < 100000; i++ {
+		_ = original.Add(r.NormFloat64())
+	}
 
-	for i := 0; i < 1000; i++ {
-		_ = tdigest.Add(rand.Float64())
+	// Round trip through external storage
+	means, counts := original.summary.GetDataCopy()
+	restored, err := NewFromCentroids(means, counts, original.Compression())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Equals(original, 0) || restored.Compression() != 50 {
+		t.Fatalf("Expected the same centroids and compression")
+	}
+	for _, q := range []float64{0.001, 0.1, 0.5, 0.9, 0.999} {
+		if restored.Quantile(q) != original.Quantile(q) {
+			t.Errorf("Expected the same estimate for q=%f, got %f instead of %f", q, restored.Quantile(q), original.Quantile(q))
+		}
 	}
 
-	initialCount := tdigest.Count()
+	// The slices are copied
+	means[0] = 42
+	if restored.summary.Mean(0) == 42 {
+		t.Errorf("Expected the digest not to share the given slices")
+	}
 
-	err := tdigest.Compress()
+	// Unsorted centroids are sorted, the counts following their means
+	shuffled, err := NewFromCentroids([]float64{3, 1, 2}, []uint64{30, 10, 20}, 100)
 	if err != nil {
-		t.Errorf("Compress() triggered an unexpected error: %s", err)
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(shuffled.summary.means, []float64{1, 2, 3}) || !reflect.DeepEqual(shuffled.summary.counts, []uint64{10, 20, 30}) {
+		t.Errorf("Expected sorted centroids, got %v %v", shuffled.summary.means, shuffled.summary.counts)
+	}
+	if shuffled.Count() != 60 || shuffled.Min() != 1 || shuffled.Max() != 3 {
+		t.Errorf("Unexpected count or extremes: %d %f %f", shuffled.Count(), shuffled.Min(), shuffled.Max())
 	}
 
-	if tdigest.Count() != initialCount {
-		t.Errorf("Compress() should not change count. Wanted %d, got %d", initialCount, tdigest.Count())
+	empty, err := NewFromCentroids(nil, nil, 100)
+	if err != nil || empty.Count() != 0 {
+		t.Errorf("Expected an empty digest, got %d samples (%v)", empty.Count(), err)
 	}
-}
 
-func TestGammaDistribution(t *testing.T) {
-	const numItems = 100000
+	inputs := []struct {
+		means       []float64
+		counts      []uint64
+		compression float64
+	}{
+		{[]float64{1, 2}, []uint64{1}, 100},
+		{[]float64{1, 2}, []uint64{1, 0}, 100},
+		{[]float64{1, math.NaN()}, []uint64{1, 1}, 100},
+		{[]float64{math.Inf(-1), 2}, []uint64{1, 1}, 100},
+		{[]float64{1, 2}, []uint64{math.MaxUint64, 1}, 100},
+		{[]float64{1, 2}, []uint64{1, 1}, 0},
+	}
+	for _, input := range inputs {
+		if _, err := NewFromCentroids(input.means, input.counts, input.compression); err == nil {
+			t.Errorf("Expected %v %v (compression %f) to be rejected", input.means, input.counts, input.compression)
+		}
+	}
+}
 
-	digest := uncheckedNew()
-	gammaRNG := rng.NewGammaGenerator(0xDEADBEE)
+func TestExportCentroids(t *testing.T) {
+	td := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rand.Float64())
+	}
 
-	data := make([]float64, numItems)
-	for i := 0; i < numItems; i++ {
-		data[i] = gammaRNG.Gamma(0.1, 0.1)
-		_ = digest.Add(data[i])
+	means, counts := td.ExportCentroids()
+	if !reflect.DeepEqual(means, td.summary.means) || !reflect.DeepEqual(counts, td.summary.counts) {
+		t.Fatalf("Expected the centroids of the digest")
 	}
 
-	sort.Float64s(data)
+	// The copies are independent of the digest
+	means[0], counts[0] = -1, 42
+	if td.summary.Mean(0) == -1 || td.summary.Count(0) == 42 {
+		t.Errorf("Expected ExportCentroids() to return copies")
+	}
+}
 
-	softErrors := 0
-	for _, q := range []float64{0.001, 0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+func TestFromReservoir(t *testing.T) {
+	r := rand.New(rand.NewSource(0x5E5))
 
-		ix := float64(len(data))*q - 0.5
-		index := int(math.Floor(ix))
-		p := ix - float64(index)
-		realQuantile := data[index]*(1-p) + data[index+1]*p
+	// A sorted reservoir, each sample standing for 10 to 20 others
+	samples := make([]float64, 10000)
+	weights := make([]float64, len(samples))
+	var total float64
+	for i := range samples {
+		samples[i] = r.Float64()
+		weights[i] = 10 + 10*r.Float64()
+		total += weights[i]
+	}
+	sort.Float64s(samples)
+	original := append([]float64{}, samples...)
 
-		// estimated cdf of real quantile(x)
-		if math.Abs(digest.CDF(realQuantile)-q) > 0.005 {
-			t.Errorf("Error in estimated CDF too high")
+	td, err := FromReservoir(samples, weights, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(samples, original) {
+		t.Errorf("Expected the samples to be left untouched")
+	}
+	if err := td.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if float64(td.Count()) != math.Round(total) {
+		t.Errorf("Expected a count of %.0f, got %d", math.Round(total), td.Count())
+	}
+	assertDifferenceSmallerThan(td, 0.5, 0.02, t)
+	assertDifferenceSmallerThan(td, 0.1, 0.01, t)
+	assertDifferenceSmallerThan(td, 0.9, 0.01, t)
+	assertDifferenceSmallerThan(td, 0.01, 0.005, t)
+	assertDifferenceSmallerThan(td, 0.99, 0.005, t)
+
+	// Same inputs, same digest
+	again, _ := FromReservoir(samples, weights, 100)
+	if !again.Equals(td, 0) {
+		t.Errorf("Expected FromReservoir() to be reproducible")
+	}
+
+	// Weights below one may round down to nothing, but still add up
+	light, err := FromReservoir([]float64{1, 2, 3}, []float64{0.4, 0.4, 0.4}, 100)
+	if err != nil || light.Count() != 1 || light.Min() != 2 || light.Max() != 2 {
+		t.Errorf("Expected a single sample at 2, got %d samples from %f to %f (%v)", light.Count(), light.Min(), light.Max(), err)
+	}
+	light, err = FromReservoir([]float64{1, 2, 3}, []float64{1e-9, 1e-9, 1}, 100)
+	if err != nil || light.Count() != 1 || light.Min() != 3 {
+		t.Errorf("Expected only the last sample, got %d samples from %f (%v)", light.Count(), light.Min(), err)
+	}
+
+	inputs := []struct {
+		samples []float64
+		weights []float64
+	}{
+		{[]float64{1, 2}, []float64{1}},
+		{[]float64{1, math.NaN()}, []float64{1, 1}},
+		{[]float64{1, 2}, []float64{1, 0}},
+		{[]float64{1, 2}, []float64{1, -1}},
+		{[]float64{1, 2}, []float64{1, math.NaN()}},
+		{[]float64{1, 2}, []float64{1, math.Inf(1)}},
+		{[]float64{1, 2}, []float64{1e19, 1e19}},
+	}
+	for _, input := range inputs {
+		if _, err := FromReservoir(input.samples, input.weights, 100); err == nil {
+			t.Errorf("Expected %v with weights %v to be rejected", input.samples, input.weights)
+		}
+	}
+	if _, err := FromReservoir(samples, weights, 0); err == nil {
+		t.Errorf("Expected an invalid compression to be rejected")
+	}
+}
+
+func TestInfinities(t *testing.T) {
+	td := uncheckedNew(Compression(100), LocalRandomNumberGenerator(0xF1))
+	for i := 1; i <= 1000; i++ {
+		_ = td.Add(float64(i))
+	}
+	before := td.Clone()
+
+	for _, inf := range []float64{math.Inf(1), math.Inf(-1)} {
+		errs := []error{
+			td.Add(inf),
+			td.AddWeighted(inf, 10),
+			td.AddCentroid(inf, 1),
+			td.AddBatch([]float64{1, inf}),
+		}
+		for i, err := range errs {
+			if err == nil {
+				t.Errorf("Expected %f to be rejected by call %d", inf, i)
+			}
+		}
+	}
+
+	// Nothing got in: quantiles stay finite and the extremes untouched
+	if !td.Equals(before, 0) || td.Min() != 1 || td.Max() != 1000 {
+		t.Errorf("Expected infinities to leave the digest untouched")
+	}
+	for _, q := range []float64{0, 0.5, 1} {
+		if x := td.Quantile(q); math.IsInf(x, 0) || math.IsNaN(x) {
+			t.Errorf("Expected a finite Quantile(%g), got %f", q, x)
+		}
+	}
+
+	// Nor can they sneak in through serialized centroids
+	other := uncheckedNew()
+	_ = other.Add(1)
+	other.summary.means[0] = math.Inf(-1)
+	buf, _ := other.AsBytes()
+	if td.MergeBytes(buf) == nil || td.Count() != 1000 {
+		t.Errorf("Expected infinite centroids to be rejected by MergeBytes")
+	}
+}
+
+func TestIdenticalValues(t *testing.T) {
+	build := func() *TDigest {
+		td := uncheckedNew(Compression(100), LocalRandomNumberGenerator(0x1D))
+		for i := 0; i < 100000; i++ {
+			_ = td.Add(42)
+		}
+		_ = td.Compress()
+		return td
+	}
+	td := build()
+
+	// A constant stream collapses into a single centroid
+	if td.summary.Len() != 1 || td.Count() != 100000 {
+		t.Errorf("Expected a single centroid of 100000 samples, got %d centroids and %d samples", td.summary.Len(), td.Count())
+	}
+	td.ForEachCentroid(func(mean float64, count uint64) bool {
+		if mean != 42 {
+			t.Errorf("Expected every mean to be exactly 42, got %f", mean)
+		}
+		return true
+	})
+	for _, q := range []float64{0, 0.001, 0.5, 0.999, 1} {
+		if td.Quantile(q) != 42 {
+			t.Errorf("Expected Quantile(%g) to be 42, got %f", q, td.Quantile(q))
+		}
+	}
+
+	// And the layout is the same every time
+	a, _ := td.AsBytes()
+	b, _ := build().AsBytes()
+	if !bytes.Equal(a, b) {
+		t.Errorf("Expected identical digests to serialize identically")
+	}
+}
+
+func TestConstantStream(t *testing.T) {
+	td := uncheckedNew(LocalRandomNumberGenerator(0xC0))
+	for i := 0; i < 1000000; i++ {
+		_ = td.Add(0)
+	}
+	_ = td.AddWeighted(0, 1000000)
+	if td.summary.Len() != 1 || td.Count() != 2000000 {
+		t.Fatalf("Expected a single centroid of 2000000 samples, got %d centroids and %d samples", td.summary.Len(), td.Count())
+	}
+	for _, q := range []float64{0, 1e-9, 0.001, 0.5, 0.999, 1} {
+		if td.Quantile(q) != 0 {
+			t.Errorf("Expected Quantile(%g) to be 0, got %f", q, td.Quantile(q))
+		}
+	}
+
+	// Other values split the centroid, so quantiles stay accurate on
+	// both sides of the constant samples
+	r := rand.New(rand.NewSource(0xC1))
+	for i := 0; i < 2000000; i++ {
+		_ = td.Add(1 + r.Float64())
+	}
+	if err := td.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if float64(td.summary.Len()) > 20*td.Compression() {
+		t.Errorf("Expected the digest to stay compressed, got %d centroids", td.summary.Len())
+	}
+	for _, q := range []float64{0.001, 0.1, 0.4, 0.495} {
+		if td.Quantile(q) != 0 {
+			t.Errorf("Expected Quantile(%g) to be 0, got %f", q, td.Quantile(q))
+		}
+	}
+	for _, q := range []float64{0.505, 0.6, 0.75, 0.9, 0.999} {
+		expected := 1 + (q-0.5)*2
+		if math.Abs(td.Quantile(q)-expected) > 0.01 {
+			t.Errorf("Expected Quantile(%g) to be about %f, got %f", q, expected, td.Quantile(q))
+		}
+	}
+
+	// Batches and merges split it too
+	build := func() *TDigest {
+		td := uncheckedNew()
+		_ = td.AddWeighted(0, 1000000)
+		return td
+	}
+	other := uncheckedNew()
+	_ = other.Add(1)
+	for name, split := range map[string]func(td *TDigest) error{
+		"AddBatch":         func(td *TDigest) error { return td.AddBatch([]float64{1}) },
+		"Merge":            func(td *TDigest) error { return td.Merge(other) },
+		"MergeScaled":      func(td *TDigest) error { return td.MergeScaled(other, 2) },
+		"MergeDestructive": func(td *TDigest) error { return td.MergeDestructive(other.Clone()) },
+	} {
+		td := build()
+		if err := split(td); err != nil {
+			t.Fatal(err)
+		}
+		if td.summary.Len() < 10 || td.Quantile(0.99) != 0 {
+			t.Errorf("%s: expected the constant centroid to be split, got %d centroids and Quantile(0.99)=%f", name, td.summary.Len(), td.Quantile(0.99))
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	td := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rand.Float64())
+	}
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(10 + rand.Float64())
+	}
+
+	// Slide the window away from the first batch
+	for i := 0; i < 9000; i++ {
+		err := td.Remove(rand.Float64(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if td.Count() != 11000 || td.summary.GetTotalCount() != td.Count() {
+		t.Errorf("Expected a count of 11000, got %d (summary says %d)", td.Count(), td.summary.GetTotalCount())
+	}
+
+	if q := td.Quantile(0.5); q < 10 || q > 11 {
+		t.Errorf("Expected the median to move to the second batch, got %f", q)
+	}
+
+	if td.Remove(1, td.Count()+1) == nil {
+		t.Errorf("Expected removing more than Count() samples to fail")
+	}
+	if td.Remove(math.NaN(), 1) == nil || td.Remove(1, 0) == nil {
+		t.Errorf("Expected illegal datapoints to be rejected")
+	}
+
+	// Removing spills onto the neighboring centroids
+	err := td.Remove(5, td.Count())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if td.Count() != 0 || td.summary.Len() != 0 || !math.IsNaN(td.Min()) {
+		t.Errorf("Expected an empty digest after removing everything")
+	}
+
+	_ = td.Add(3)
+	if td.Min() != 3 || td.Max() != 3 {
+		t.Errorf("Expected the emptied digest to be usable, got min=%f max=%f", td.Min(), td.Max())
+	}
+}
+
+func TestCountOverflow(t *testing.T) {
+	td := uncheckedNew()
+	_ = td.AddWeighted(1, math.MaxUint64-10)
+
+	err := td.AddWeighted(1, 10)
+	if err != nil {
+		t.Fatalf("Expected adding up to MaxUint64 to work, got %v", err)
+	}
+	if td.Count() != math.MaxUint64 || td.summary.GetTotalCount() != math.MaxUint64 {
+		t.Errorf("Expected a count of MaxUint64, got %d", td.Count())
+	}
+	centroids := td.summary.Len()
+
+	if td.AddWeighted(1, 1) == nil || td.AddWeighted(100, 1) == nil {
+		t.Errorf("Expected adding past MaxUint64 to fail")
+	}
+	if td.Count() != math.MaxUint64 || td.summary.Len() != centroids {
+		t.Errorf("Expected the digest to be untouched after an overflow")
+	}
+
+	other := uncheckedNew()
+	_ = other.Add(2)
+	payload, _ := other.AsBytes()
+
+	if td.Merge(other) == nil || td.MergeDestructive(other.Clone()) == nil || td.MergeBytes(payload) == nil {
+		t.Errorf("Expected merging past MaxUint64 to fail")
+	}
+	if td.Count() != math.MaxUint64 || td.summary.Len() != centroids {
+		t.Errorf("Expected the digest to be untouched after a failed merge")
+	}
+}
+
+func TestIntegers(t *testing.T) {
+	tdigest := uncheckedNew()
+
+	_ = tdigest.Add(1)
+	_ = tdigest.Add(2)
+	_ = tdigest.Add(3)
+
+	if tdigest.Quantile(0.5) != 2 {
+		t.Errorf("Expected p(0.5) = 2, Got %.2f instead", tdigest.Quantile(0.5))
+	}
+
+	tdigest = uncheckedNew()
+
+	for _, i := range []float64{1, 2, 2, 2, 2, 2, 2, 2, 3} {
+		_ = tdigest.Add(i)
+	}
+
+	if tdigest.Quantile(0.5) != 2 {
+		t.Errorf("Expected p(0.5) = 2, Got %.2f instead", tdigest.Quantile(0.5))
+	}
+
+	var tot uint64
+	tdigest.ForEachCentroid(func(mean float64, count uint64) bool {
+		tot += count
+		return true
+	})
+
+	if tot != 9 {
+		t.Errorf("Expected the centroid count to be 9, Got %d instead", tot)
+	}
+}
+
+func cdf(x float64, data []float64) float64 {
+	var n1, n2 int
+	for i := 0; i < len(data); i++ {
+		if data[i] < x {
+			n1++
+		}
+		if data[i] <= x {
+			n2++
+		}
+	}
+	return float64(n1+n2) / 2.0 / float64(len(data))
+}
+
+func quantile(q float64, data []float64) float64 {
+	if len(data) == 0 {
+		return math.NaN()
+	}
+
+	if q == 1 || len(data) == 1 {
+		return data[len(data)-1]
+	}
+
+	index := q * (float64(len(data)) - 1)
+	return data[int(index)+1]*(index-float64(int(index))) + data[int(index)]*(float64(int(index)+1)-index)
+}
+
+func TestMergeNormal(t *testing.T) {
+	testMerge(t, false)
+}
+
+func TestMergeDescructive(t *testing.T) {
+	testMerge(t, true)
+}
+
+func testMerge(t *testing.T, destructive bool) {
+	if testing.Short() {
+		t.Skipf("Skipping merge test. Short flag is on")
+	}
+
+	const numItems = 100000
+
+	for _, numSubs := range []int{2, 5, 10, 20, 50, 100} {
+		data := make([]float64, numItems)
+
+		subs := make([]*TDigest, numSubs)
+		for i := 0; i < numSubs; i++ {
+			subs[i] = uncheckedNew()
+		}
+
+		dist := uncheckedNew()
+		for i := 0; i < numItems; i++ {
+			num := rand.Float64()
+
+			data[i] = num
+			_ = dist.Add(num)
+			_ = subs[i%numSubs].Add(num)
+		}
+
+		_ = dist.Compress()
+
+		dist2 := uncheckedNew()
+		for i := 0; i < numSubs; i++ {
+			if destructive {
+				_ = dist2.MergeDestructive(subs[i])
+			} else {
+				_ = dist2.Merge(subs[i])
+			}
+
+		}
+
+		if dist.Count() != dist2.Count() {
+			t.Errorf("Expected the number of centroids to be the same. %d != %d", dist.Count(), dist2.Count())
+		}
+
+		if dist2.Count() != numItems {
+			t.Errorf("Items shouldn't have disappeared. %d != %d", dist2.Count(), numItems)
+		}
+
+		sort.Float64s(data)
+
+		for _, q := range []float64{0.001, 0.01, 0.1, 0.2, 0.3, 0.5} {
+			z := quantile(q, data)
+			p1 := dist.Quantile(q)
+			p2 := dist2.Quantile(q)
+
+			e1 := p1 - z
+			e2 := p2 - z
+
+			if math.Abs(e2)/q >= 0.3 {
+				t.Errorf("rel >= 0.3: parts=%3d q=%.3f e1=%.4f e2=%.4f rel=%.3f real=%.3f",
+					numSubs, q, e1, e2, math.Abs(e2)/q, z-q)
+			}
+			if math.Abs(e2) >= 0.015 {
+				t.Errorf("e2 >= 0.015: parts=%3d q=%.3f e1=%.4f e2=%.4f rel=%.3f real=%.3f",
+					numSubs, q, e1, e2, math.Abs(e2)/q, z-q)
+			}
+
+			z = cdf(q, data)
+			e1 = dist.CDF(q) - z
+			e2 = dist2.CDF(q) - z
+
+			if math.Abs(e2)/q > 0.3 {
+				t.Errorf("CDF e2 < 0.015: parts=%3d q=%.3f e1=%.4f e2=%.4f rel=%.3f",
+					numSubs, q, e1, e2, math.Abs(e2)/q)
+			}
+
+			if math.Abs(e2) >= 0.015 {
+				t.Errorf("CDF e2 < 0.015: parts=%3d q=%.3f e1=%.4f e2=%.4f rel=%.3f",
+					numSubs, q, e1, e2, math.Abs(e2)/q)
+			}
+		}
+	}
+}
+
+func TestMergeDifferentCompressions(t *testing.T) {
+	build := func(compression float64) *TDigest {
+		td := uncheckedNew(Compression(compression))
+		for i := 0; i < 50000; i++ {
+			_ = td.Add(rand.Float64())
+		}
+		return td
+	}
+
+	for _, compressions := range [][2]float64{{50, 200}, {200, 50}} {
+		for _, mode := range []string{"Merge", "MergeDestructive", "MergeBytes"} {
+			td, other := build(compressions[0]), build(compressions[1])
+
+			var err error
+			switch mode {
+			case "Merge":
+				err = td.Merge(other)
+			case "MergeDestructive":
+				err = td.MergeDestructive(other)
+			case "MergeBytes":
+				payload, _ := other.AsBytes()
+				err = td.MergeBytes(payload)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if td.Compression() != compressions[0] || td.Count() != 100000 || td.summary.GetTotalCount() != td.Count() {
+				t.Errorf("Unexpected digest after merging %v: compression=%f count=%d", compressions, td.Compression(), td.Count())
+			}
+
+			if !td.summary.compressed || td.summary.Len() > int(20*td.Compression()) {
+				t.Errorf("Expected %s to compress the digest after merging %v, got %d centroids", mode, compressions, td.summary.Len())
+			}
+
+			for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+				if math.Abs(td.Quantile(q)-q) > 0.01 {
+					t.Errorf("Expected Quantile(%g) after merging %v to be close to %g, got %f", q, compressions, q, td.Quantile(q))
+				}
+			}
+		}
+	}
+}
+
+func TestMergeKeepFinest(t *testing.T) {
+	r := rand.New(rand.NewSource(0xF1E))
+	build := func(compression float64) *TDigest {
+		td := uncheckedNew(Compression(compression), LocalRandomNumberGenerator(1))
+		for i := 0; i < 50000; i++ {
+			_ = td.Add(r.Float64())
+		}
+		return td
+	}
+
+	for _, compressions := range [][2]float64{{50, 100}, {100, 50}} {
+		td, other := build(compressions[0]), build(compressions[1])
+		coarse := td.Clone()
+		_ = coarse.Merge(other)
+
+		if err := td.MergeKeepFinest(other); err != nil {
+			t.Fatal(err)
+		}
+		if td.Compression() != 100 || other.Compression() != compressions[1] || td.Count() != 100000 {
+			t.Errorf("Expected merging %v to yield a compression of 100, got %f and count %d", compressions, td.Compression(), td.Count())
+		}
+
+		// The finer centroids are kept, so there are more than with
+		// the coarser compression
+		if compressions[0] < compressions[1] && td.summary.Len() <= coarse.summary.Len() {
+			t.Errorf("Expected more centroids than the %d of a plain merge, got %d", coarse.summary.Len(), td.summary.Len())
+		}
+		for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+			if math.Abs(td.Quantile(q)-q) > 0.01 {
+				t.Errorf("Expected Quantile(%g) after merging %v to be close to %g, got %f", q, compressions, q, td.Quantile(q))
+			}
+		}
+	}
+
+	// Empty digests don't count
+	td := uncheckedNew(Compression(50))
+	_ = td.MergeKeepFinest(uncheckedNew(Compression(100)))
+	if td.Compression() != 50 {
+		t.Errorf("Expected merging an empty digest to keep the compression, got %f", td.Compression())
+	}
+
+	// Nor do failed merges
+	_ = td.AddWeighted(1, math.MaxUint64-10)
+	finer := uncheckedNew(Compression(200))
+	_ = finer.AddWeighted(2, 100)
+	if td.MergeKeepFinest(finer) == nil {
+		t.Fatalf("Expected an overflowing merge to fail")
+	}
+	if td.Compression() != 50 || td.Count() != math.MaxUint64-10 {
+		t.Errorf("Expected a failed merge to leave the digest as is, got a compression of %f and count %d", td.Compression(), td.Count())
+	}
+}
+
+func TestMergeEmpty(t *testing.T) {
+	td := uncheckedNew(LocalRandomNumberGenerator(0xE))
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rand.NormFloat64())
+	}
+	before, _ := td.AsBytes()
+
+	// Merging an empty digest is a no-op, whichever way it's done
+	empty := uncheckedNew()
+	merges := []func(*TDigest) error{td.Merge, td.MergeDestructive, td.MergeDeterministic, td.MergeKeepFinest}
+	for _, merge := range merges {
+		if err := merge(empty); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := td.MergeMany(empty, nil, uncheckedNew()); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := td.AsBytes()
+	if !bytes.Equal(before, after) {
+		t.Errorf("Expected merging empty digests to leave the digest untouched")
+	}
+
+	// Merging into an empty digest copies the other one
+	for _, merge := range []func(*TDigest, *TDigest) error{(*TDigest).Merge, (*TDigest).MergeDeterministic} {
+		empty = uncheckedNew()
+		if err := merge(empty, td); err != nil {
+			t.Fatal(err)
+		}
+		if !empty.Equals(td, 0) || empty.Min() != td.Min() || empty.Max() != td.Max() {
+			t.Errorf("Expected merging into an empty digest to copy the other one")
+		}
+		_ = empty.Add(100)
+		if td.Max() == 100 || td.Count() != 10000 {
+			t.Errorf("Expected the copy to be independent")
+		}
+	}
+
+	// Unless the compressions differ
+	empty = uncheckedNew(Compression(10))
+	_ = empty.Merge(td)
+	if empty.Compression() != 10 || empty.Count() != 10000 || empty.summary.Len() >= td.summary.Len() {
+		t.Errorf("Expected the copy to be compressed again, got %d centroids", empty.summary.Len())
+	}
+
+	empty = uncheckedNew()
+	if err := empty.Merge(uncheckedNew()); err != nil || empty.Count() != 0 || !math.IsNaN(empty.Quantile(0.5)) {
+		t.Errorf("Expected merging empty digests together to leave an empty digest")
+	}
+}
+
+func TestMergeMany(t *testing.T) {
+	data := make([]float64, 100000)
+	for i := range data {
+		data[i] = rand.ExpFloat64()
+	}
+
+	full := uncheckedNew()
+	partials := []*TDigest{nil}
+	for i := 0; i < 100; i++ {
+		// Some of them with a different compression
+		partial := uncheckedNew(Compression(float64(50 + 50*(i%3))))
+		for _, x := range data[i*1000 : (i+1)*1000] {
+			_ = partial.Add(x)
+			_ = full.Add(x)
+		}
+		partials = append(partials, partial, nil)
+	}
+
+	merged, err := MergeAll(partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged.Count() != full.Count() || merged.Min() != full.Min() || merged.Max() != full.Max() {
+		t.Errorf("Expected the same count and extremes as the full digest, got %d %f %f", merged.Count(), merged.Min(), merged.Max())
+	}
+	if merged.summary.Len() > int(20*merged.Compression()) {
+		t.Errorf("Expected a compressed digest, got %d centroids", merged.summary.Len())
+	}
+
+	sort.Float64s(data)
+	for _, q := range []float64{0.001, 0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+		expected := quantile(q, data)
+		if math.Abs(merged.Quantile(q)-expected) > 0.01*expected+0.001 || math.Abs(merged.Quantile(q)-full.Quantile(q)) > 0.02*expected+0.001 {
+			t.Errorf("Quantile(%g): merged %f, full %f, actual %f", q, merged.Quantile(q), full.Quantile(q), expected)
+		}
+	}
+
+	// Overflowing digests aren't merged at all
+	huge := uncheckedNew()
+	_ = huge.AddWeighted(0, math.MaxUint64-10)
+	before := merged.Count()
+	if merged.MergeMany(partials[1], huge) == nil || merged.Count() != before {
+		t.Errorf("Expected MergeMany to check for overflows upfront")
+	}
+
+	if _, err := MergeAll(partials, Compression(0)); err == nil {
+		t.Errorf("Expected invalid options to be rejected")
+	}
+}
+
+func TestMergeScaled(t *testing.T) {
+	r := rand.New(rand.NewSource(0x5CA1E))
+	build := func(offset float64, seed int64) *TDigest {
+		td := uncheckedNew(LocalRandomNumberGenerator(seed))
+		for i := 0; i < 10000; i++ {
+			_ = td.Add(offset + r.Float64())
+		}
+		return td
+	}
+	low, high := build(0, 1), build(1, 2)
+
+	// A weight of 1 is a plain merge, down to the serialization
+	merged := low.Clone()
+	merged.rng = newLocalRNG(3)
+	_ = merged.Merge(high)
+	scaled := low.Clone()
+	scaled.rng = newLocalRNG(3)
+	_ = scaled.MergeScaled(high, 1)
+	a, _ := merged.AsBytes()
+	b, _ := scaled.AsBytes()
+	if !bytes.Equal(a, b) {
+		t.Errorf("Expected MergeScaled(other, 1) to be the same as Merge(other)")
+	}
+
+	// Upweighted samples take the larger share of the distribution
+	scaled = low.Clone()
+	_ = scaled.MergeScaled(high, 3)
+	if scaled.Count() != 40000 || math.Abs(scaled.CDF(1)-0.25) > 0.01 || scaled.Max() != high.Max() {
+		t.Errorf("Expected a quarter of 40000 samples to be below 1, got %d samples and CDF(1) = %f", scaled.Count(), scaled.CDF(1))
+	}
+	if high.Count() != 10000 {
+		t.Errorf("Expected the other digest to be left untouched")
+	}
+
+	// Rounding preserves the total mass, even when centroids get lost
+	for _, weight := range []float64{0.001, 0.3333, 1.5, 2.71828} {
+		scaled = low.Clone()
+		_ = scaled.MergeScaled(high, weight)
+		if expected := 10000 + uint64(math.Round(10000*weight)); scaled.Count() != expected || scaled.summary.GetTotalCount() != expected {
+			t.Errorf("Expected a weight of %f to add %d samples, got %d", weight, expected-10000, scaled.Count()-10000)
+		}
+	}
+
+	for _, weight := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		if low.MergeScaled(high, weight) == nil {
+			t.Errorf("Expected weight %f to be rejected", weight)
+		}
+	}
+	if low.MergeScaled(high, 1e20) == nil || low.Count() != 10000 {
+		t.Errorf("Expected an overflowing weight to be rejected")
+	}
+	if low.MergeScaled(uncheckedNew(), 2) != nil || low.Count() != 10000 {
+		t.Errorf("Expected merging an empty digest to be a no-op")
+	}
+}
+
+func TestMergeDeterministic(t *testing.T) {
+	other := uncheckedNew()
+	for i := 0; i < 20000; i++ {
+		_ = other.Add(rand.NormFloat64())
+	}
+
+	var payload []byte
+	for i := 0; i < 5; i++ {
+		// Same contents, unrelated random number generators
+		td := uncheckedNew(LocalRandomNumberGenerator(int64(i)))
+		for j := 0; j < 1000; j++ {
+			_ = td.Add(float64(j) / 1000)
+		}
+
+		own := td.rng
+		err := td.MergeDeterministic(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if td.rng != own {
+			t.Errorf("Expected the digest to keep its own random number generator")
+		}
+
+		b, _ := td.AsBytes()
+		if payload == nil {
+			payload = b
+		} else if !bytes.Equal(b, payload) {
+			t.Fatalf("Expected every deterministic merge to yield the same digest")
+		}
+
+		if td.Count() != 21000 || math.Abs(td.Quantile(0.5)-0.05) > 0.05 {
+			t.Errorf("Unexpected digest after merging: count=%d median=%f", td.Count(), td.Quantile(0.5))
+		}
+	}
+}
+
+func TestCompressReusesBuffers(t *testing.T) {
+	td := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rand.Float64())
+	}
+	other := td.Clone()
+
+	// Buffers come from a sync.Pool, which may be emptied by the GC
+	// at any time, hence the average
+	if allocs := testing.AllocsPerRun(100, func() { _ = td.Compress() }); allocs >= 1 {
+		t.Errorf("Expected Compress() not to allocate, got %f allocs per run", allocs)
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { _ = td.Merge(other) }); allocs >= 1 {
+		t.Errorf("Expected Merge() not to allocate, got %f allocs per run", allocs)
+	}
+}
+
+func TestCompressAfterMerges(t *testing.T) {
+	r := rand.New(rand.NewSource(0xC0))
+	td := uncheckedNew(LocalRandomNumberGenerator(0xC0))
+	direct := uncheckedNew(LocalRandomNumberGenerator(0xC1))
+	for i := 0; i < 200; i++ {
+		other := uncheckedNew(LocalRandomNumberGenerator(int64(i)))
+		for j := 0; j < 500; j++ {
+			x := r.NormFloat64()
+			_ = other.Add(x)
+			_ = direct.Add(x)
+		}
+		_ = td.Merge(other)
+	}
+	_ = direct.ForceCompress()
+
+	// Compressing doesn't wait for the digest to grow too big
+	before := td.summary.Len()
+	_ = td.Compress()
+	if td.summary.Len() >= before {
+		t.Errorf("Expected fewer than %d centroids, got %d", before, td.summary.Len())
+	}
+
+	// and forcing it shrinks the digest further, down to about as
+	// many centroids as the samples added directly end up in
+	before = td.summary.Len()
+	_ = td.ForceCompress()
+	if td.summary.Len() >= before || float64(td.summary.Len()) > 1.05*float64(direct.summary.Len()) {
+		t.Errorf("Expected ForceCompress to go from %d to about %d centroids, got %d", before, direct.summary.Len(), td.summary.Len())
+	}
+
+	// past which more passes barely help
+	again := td.Clone()
+	for i := 0; i < 5; i++ {
+		_ = again.compress()
+	}
+	if float64(again.summary.Len()) < 0.99*float64(td.summary.Len()) {
+		t.Errorf("Expected ForceCompress to leave little to compress, got %d centroids down to %d", td.summary.Len(), again.summary.Len())
+	}
+
+	// and leaves centroids within their size bound
+	n := float64(td.Count())
+	var sum float64
+	td.ForEachCentroid(func(mean float64, count uint64) bool {
+		c := float64(count)
+		q := (sum + (c-1)/2) / (n - 1)
+		if count > 1 && c > maxCentroidSize(td.scale, q, td.Compression(), n) {
+			t.Errorf("Expected a centroid at q=%f to hold at most %f samples, got %d", q, maxCentroidSize(td.scale, q, td.Compression(), n), count)
+		}
+		sum += c
+		return true
+	})
+}
+
+func TestCompressTwice(t *testing.T) {
+	td := uncheckedNew(LocalRandomNumberGenerator(0xC2))
+	for i := 0; i < 100000; i++ {
+		_ = td.Add(rand.NormFloat64())
+	}
+	_ = td.Compress()
+	compressed, _ := td.AsBytes()
+	stats := td.Stats()
+
+	// Nothing changed, so there is nothing to do
+	_ = td.Compress()
+	again, _ := td.AsBytes()
+	if !bytes.Equal(compressed, again) || td.Stats() != stats {
+		t.Errorf("Expected compressing twice in a row to be a no-op, got %+v then %+v", stats, td.Stats())
+	}
+
+	// unless forced to
+	_ = td.ForceCompress()
+	if td.Stats().Compressions <= stats.Compressions {
+		t.Errorf("Expected ForceCompress to compress again, got %+v", td.Stats())
+	}
+
+	// which once done leaves nothing to do either
+	compressed, _ = td.AsBytes()
+	stats = td.Stats()
+	_ = td.ForceCompress()
+	_ = td.Compress()
+	again, _ = td.AsBytes()
+	if !bytes.Equal(compressed, again) || td.Stats() != stats {
+		t.Errorf("Expected ForceCompress twice in a row to be a no-op, got %+v then %+v", stats, td.Stats())
+	}
+
+	// and any change calls for a new compression
+	changes := map[string]func(td *TDigest){
+		"Add":         func(td *TDigest) { _ = td.Add(0.5) },
+		"AddCentroid": func(td *TDigest) { _ = td.AddCentroid(0.5, 2) },
+		"Remove":      func(td *TDigest) { _ = td.Remove(0.5, 2) },
+		"Merge":       func(td *TDigest) { _ = td.Merge(td.Clone()) },
+	}
+	for name, change := range changes {
+		td := td.Clone()
+		_ = td.Compress()
+		compressions := td.Stats().Compressions
+		change(td)
+		_ = td.Compress()
+		if td.Stats().Compressions != compressions+1 {
+			t.Errorf("%s: expected the digest to be compressed again", name)
+		}
+
+		_ = td.ForceCompress()
+		compressions = td.Stats().Compressions
+		change(td)
+		_ = td.ForceCompress()
+		if td.Stats().Compressions <= compressions {
+			t.Errorf("%s: expected the digest to be force compressed again", name)
+		}
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	td := uncheckedNew(LocalRandomNumberGenerator(0xC0C))
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rand.NormFloat64())
+	}
+
+	query := func() []float64 {
+		estimate, lower, upper := td.CDFWithError(0.3)
+		results := append(td.Quantiles(0.001, 0.25, 0.5, 0.99), td.CDFs(-1, 0, 2)...)
+		return append(results, td.Quantile(0.7), td.CDF(0.1), td.Rank(-0.5), td.InterpolatedRank(1),
+			td.TrimmedMean(0.1, 0.9), td.CountBetween(-1, 1), estimate, lower, upper)
+	}
+
+	// Queries give the same results whether the cumulative counts are
+	// cached or not, and never write to the digest on either case, so
+	// they can run concurrently (see go test -race)
+	for _, cached := range []bool{false, true} {
+		if cached {
+			_ = td.Compress()
+		} else {
+			_ = td.Add(0)
+		}
+		expected := query()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if results := query(); !reflect.DeepEqual(results, expected) {
+						t.Errorf("Expected concurrent queries (cached: %t) to return %v, got %v", cached, expected, results)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if td.summary.cached != cached {
+			t.Errorf("Expected queries to leave the cache alone")
+		}
+	}
+
+	// And both ways agree
+	uncached := td.Clone()
+	uncached.summary.cached = false
+	cachedResults := query()
+	td = uncached
+	if results := query(); !reflect.DeepEqual(results, cachedResults) {
+		t.Errorf("Expected the same results without the cache, got %v instead of %v", results, cachedResults)
+	}
+}
+
+func TestQueriesDontAllocate(t *testing.T) {
+	td := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rand.Float64())
+	}
+	c, _ := NewConcurrent()
+	_ = c.Merge(td)
+
+	queries := map[string]func(){
+		"Quantile":            func() { td.Quantile(0.99) },
+		"Median":              func() { td.Median() },
+		"CDF":                 func() { td.CDF(0.5) },
+		"Rank":                func() { td.Rank(0.5) },
+		"CDFWithError":        func() { td.CDFWithError(0.5) },
+		"InterpolatedRank":    func() { td.InterpolatedRank(0.5) },
+		"TrimmedMean":         func() { td.TrimmedMean(0.1, 0.9) },
+		"Concurrent.Quantile": func() { c.Quantile(0.99) },
+	}
+	// Whether the cumulative counts are cached or not
+	for _, cached := range []bool{false, true} {
+		if cached {
+			td.summary.cachePrefixSums()
+		}
+		for name, query := range queries {
+			if allocs := testing.AllocsPerRun(100, query); allocs != 0 {
+				t.Errorf("Expected %s not to allocate (cached: %t), got %f allocs per run", name, cached, allocs)
+			}
+		}
+	}
+
+	// Sorted inputs only need the result
+	if allocs := testing.AllocsPerRun(100, func() { td.Quantiles(0.5, 0.9, 0.99) }); allocs != 1 {
+		t.Errorf("Expected Quantiles to allocate once, got %f allocs per run", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { td.CDFs(0.1, 0.5, 0.9) }); allocs != 1 {
+		t.Errorf("Expected CDFs to allocate once, got %f allocs per run", allocs)
+	}
+}
+
+func TestCompressDoesntChangeCount(t *testing.T) {
+	tdigest := uncheckedNew()
+
+	for i := 0; i < 1000; i++ {
+		_ = tdigest.Add(rand.Float64())
+	}
+
+	initialCount := tdigest.Count()
+
+	err := tdigest.Compress()
+	if err != nil {
+		t.Errorf("Compress() triggered an unexpected error: %s", err)
+	}
+
+	if tdigest.Count() != initialCount {
+		t.Errorf("Compress() should not change count. Wanted %d, got %d", initialCount, tdigest.Count())
+	}
+}
+
+func TestGammaDistribution(t *testing.T) {
+	const numItems = 100000
+
+	digest := uncheckedNew()
+	gammaRNG := rng.NewGammaGenerator(0xDEADBEE)
+
+	data := make([]float64, numItems)
+	for i := 0; i < numItems; i++ {
+		data[i] = gammaRNG.Gamma(0.1, 0.1)
+		_ = digest.Add(data[i])
+	}
+
+	sort.Float64s(data)
+
+	softErrors := 0
+	for _, q := range []float64{0.001, 0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+
+		ix := float64(len(data))*q - 0.5
+		index := int(math.Floor(ix))
+		p := ix - float64(index)
+		realQuantile := data[index]*(1-p) + data[index+1]*p
+
+		// estimated cdf of real quantile(x)
+		if math.Abs(digest.CDF(realQuantile)-q) > 0.005 {
+			t.Errorf("Error in estimated CDF too high")
+		}
+
+		// real cdf of estimated quantile(x)
+		error := math.Abs(q - cdf(digest.Quantile(q), data))
+		if error > 0.005 {
+			softErrors++
+		}
+
+		if error > 0.012 {
+			t.Errorf("Error in estimated Quantile too high")
+		}
+	}
+
+	if softErrors >= 3 {
+		t.Errorf("Too many soft errors")
+	}
+
+	// Issue #17, verify that we are hitting the extreme CDF case
+	// XXX Maybe test this properly instead of having a hardcoded value
+	extreme := digest.CDF(0.71875)
+	if !closeEnough(extreme, 1) {
+		t.Errorf("Expected something close to 1 but got %.4f instead", extreme)
+	}
+}
+
+func shouldPanic(f func(), t *testing.T, message string) {
+	defer func() {
+		tryRecover := recover()
+		if tryRecover == nil {
+			t.Errorf(message)
+		}
+	}()
+	f()
+}
+
+func TestPercentile(t *testing.T) {
+	tdigest := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = tdigest.Add(rand.Float64())
+	}
+
+	for _, p := range []float64{0, 0.1, 1, 25, 50, 99, 99.9, 100} {
+		if tdigest.Percentile(p) != tdigest.Quantile(p/100) {
+			t.Errorf("Expected Percentile(%g) to be Quantile(%g) = %f, got %f", p, p/100, tdigest.Quantile(p/100), tdigest.Percentile(p))
+		}
+	}
+	for _, p := range []float64{-1, -0.001, 100.001, 1000, math.NaN(), math.Inf(1)} {
+		if !math.IsNaN(tdigest.Percentile(p)) {
+			t.Errorf("Expected Percentile(%g) to be NaN, got %f", p, tdigest.Percentile(p))
+		}
+	}
+}
+
+func TestQuantileClamping(t *testing.T) {
+	tdigest := uncheckedNew()
+	if !math.IsNaN(tdigest.Quantile(-42)) || !math.IsNaN(tdigest.Quantile(42)) {
+		t.Errorf("Expected out of range quantiles of an empty digest to be NaN")
+	}
+
+	for i := 1; i <= 100; i++ {
+		_ = tdigest.Add(float64(i))
+	}
+
+	inputs := map[float64]float64{
+		-42:  1,
+		-0.1: 1,
+		0:    1,
+		1:    100,
+		1.1:  100,
+		42:   100,
+	}
+	for q, expected := range inputs {
+		if x := tdigest.Quantile(q); x != expected {
+			t.Errorf("Expected Quantile(%g) to be %f, got %f", q, expected, x)
+		}
+	}
+
+	qs := tdigest.Quantiles(1.1, math.NaN(), 0.5, -0.1)
+	if qs[0] != 100 || !math.IsNaN(qs[1]) || qs[2] != tdigest.Quantile(0.5) || qs[3] != 1 {
+		t.Errorf("Expected Quantiles to clamp like Quantile, got %v", qs)
+	}
+	if !math.IsNaN(tdigest.Quantile(math.NaN())) {
+		t.Errorf("Expected Quantile(NaN) to be NaN, got %f", tdigest.Quantile(math.NaN()))
+	}
+}
+
+func TestForEachCentroid(t *testing.T) {
+	tdigest := uncheckedNew(Compression(10))
+
+	for i := 0; i < 100; i++ {
+		_ = tdigest.Add(float64(i))
+	}
+
+	// Iterate limited number.
+	means := []float64{}
+	tdigest.ForEachCentroid(func(mean float64, count uint64) bool {
+		means = append(means, mean)
+		return len(means) != 3
+	})
+	if len(means) != 3 {
+		t.Errorf("ForEachCentroid handled incorrect number of data items")
+	}
+
+	// Iterate all datapoints.
+	means = []float64{}
+	tdigest.ForEachCentroid(func(mean float64, count uint64) bool {
+		means = append(means, mean)
+		return true
+	})
+	if len(means) != tdigest.summary.Len() {
+		t.Errorf("ForEachCentroid did not handle all data")
+	}
+
+	// In order, adding up to the whole digest.
+	tdigest = uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = tdigest.Add(rand.NormFloat64())
+	}
+	means = []float64{}
+	var total uint64
+	tdigest.ForEachCentroid(func(mean float64, count uint64) bool {
+		means = append(means, mean)
+		total += count
+		return true
+	})
+	if !sort.Float64sAreSorted(means) || total != tdigest.Count() {
+		t.Errorf("ForEachCentroid should visit all the centroids sorted by mean")
+	}
+}
+
+func TestQuantilesDontOverflow(t *testing.T) {
+	tdigest := uncheckedNew(Compression(100))
+	// Add slightly more than math.MaxUint32 samples uniformly in the range
+	// [0, 1). This would overflow a uint32-based implementation.
+	tdigest.Add(1)
+	for i := 0; i < 1024; i++ {
+		tdigest.AddWeighted(float64(i)/1024, 4194304)
+	}
+	assertDifferenceSmallerThan(tdigest, 0.5, .02, t)
+}
+
+func TestCDFInsideLastCentroid(t *testing.T) {
+	// values pulled from a live digest. sorry it's a lot!
+	td := &TDigest{
+		summary: &summary{
+			means:  []float64{2120.75048828125, 2260.3844299316406, 3900.490264892578, 3937.495807647705, 5390.479816436768, 10450.335285186768, 14152.897296905518, 16442.676349639893, 24303.143146514893, 56961.87361526489, 63891.24959182739, 73982.55232620239, 86477.50447463989, 110746.62556838989, 175479.7388496399, 300492.3404121399, 440452.5279121399, 515611.7700996399, 535827.0025215149, 546241.6822090149, 556965.3648262024, 569791.2124824524, 587320.6870918274, 603969.4175605774, 613751.6177558899, 624708.7593574524, 635060.0718574524, 641924.2007637024, 650656.4302558899, 660653.1714668274, 671380.9009590149, 687094.3667793274, 716595.8824043274, 740870.9800605774, 760276.2437324524, 768857.5786933899, 775021.0025215149, 787686.0337715149, 801473.4624824524, 815225.1255683899, 832358.6997871399, 852438.4751777649, 866134.2935371399, 1.10661549666214e+06, 1.1212118980293274e+06, 1.2230108433418274e+06, 1.5446490620918274e+06, 4.306712312091827e+06, 5.487582562091827e+06, 6.306383562091827e+06, 7.089308312091827e+06, 7.520797593341827e+06},
+			counts: []uint64{0x1, 0x1, 0x1, 0x1, 0x1, 0x2, 0x1, 0x4, 0x5, 0x6, 0x3, 0x3, 0x4, 0x11, 0x23, 0x2f, 0x1e, 0x1b, 0x36, 0x31, 0x33, 0x4e, 0x5f, 0x61, 0x48, 0x2e, 0x26, 0x28, 0x2a, 0x31, 0x39, 0x51, 0x32, 0x2b, 0x12, 0x8, 0xb, 0xa, 0x11, 0xa, 0x11, 0x9, 0x7, 0x1, 0x1, 0x1, 0x3, 0x2, 0x1, 0x1, 0x1, 0x1},
+		},
+		compression: 5,
+		count:       1250,
+		min:         2120.75048828125,
+		max:         7.520797593341827e+06,
+		rng:         globalRNG{},
+	}
+
+	if cdf := td.CDF(7.144560976650238e+06); cdf > 1 {
+		t.Fatalf("invalid: %v", cdf)
+	}
+}
+
+func TestCDFs(t *testing.T) {
+	td := uncheckedNew()
+
+	for _, x := range td.CDFs(0, 1) {
+		if !math.IsNaN(x) {
+			t.Errorf("Expected NaN CDFs for an empty digest, got %f", x)
+		}
+	}
+
+	for i := 0; i < 100000; i++ {
+		_ = td.Add(rand.NormFloat64())
+	}
+
+	xs := []float64{2, -1, 0, -100, 0.5, 100, 0, -2.5, td.Min(), td.Max()}
+	results := td.CDFs(xs...)
+
+	if len(results) != len(xs) {
+		t.Fatalf("Expected %d results, got %d", len(xs), len(results))
+	}
+
+	for i, x := range xs {
+		if results[i] != td.CDF(x) {
+			t.Errorf("Expected CDFs()[%d] to be CDF(%g) = %f, got %f", i, x, td.CDF(x), results[i])
+		}
+	}
+
+	if results[2] != results[6] {
+		t.Errorf("Expected duplicate values to have the same CDF: %f != %f", results[2], results[6])
+	}
+}
+
+func TestCDFWithError(t *testing.T) {
+	r := rand.New(rand.NewSource(0xE44))
+	data := make([]float64, 100000)
+	td := uncheckedNew(Compression(1000), LocalRandomNumberGenerator(0xE44))
+	for i := range data {
+		data[i] = r.NormFloat64()
+		_ = td.Add(data[i])
+	}
+	sort.Float64s(data)
+
+	within := 0
+	for i := 0; i < 1000; i++ {
+		x := data[i*100]
+		estimate, lower, upper := td.CDFWithError(x)
+		if estimate != td.CDF(x) || lower > estimate || upper < estimate {
+			t.Fatalf("Expected CDF(%f) = %f within [%f, %f]", x, td.CDF(x), lower, upper)
+		}
+		// A dense digest has tight bounds, tighter in the tails
+		if upper-lower > 0.001 || (i < 10 && upper-lower > 0.0001) {
+			t.Errorf("Expected a narrow band at %f, got [%f, %f]", x, lower, upper)
+		}
+
+		exact := float64(sort.SearchFloat64s(data, x)+1) / float64(len(data))
+		if lower <= exact && exact <= upper {
+			within++
+		}
+	}
+	// Centroids may overlap a bit, so the bounds can be off
+	if within < 900 {
+		t.Errorf("Expected the exact CDF to be within the bounds most of the time, got %d out of 1000", within)
+	}
+
+	// Exact outside of the range
+	for _, x := range []float64{td.Min() - 1, td.Max()} {
+		estimate, lower, upper := td.CDFWithError(x)
+		if lower != estimate || upper != estimate {
+			t.Errorf("Expected no error band at %f, got [%f, %f]", x, lower, upper)
+		}
+	}
+
+	estimate, lower, upper := uncheckedNew().CDFWithError(1)
+	if !math.IsNaN(estimate) || !math.IsNaN(lower) || !math.IsNaN(upper) {
+		t.Errorf("Expected NaN results for an empty digest, got %f [%f, %f]", estimate, lower, upper)
+	}
+}
+
+func TestInterpolatedRank(t *testing.T) {
+	r := rand.New(rand.NewSource(0x1AB))
+	for _, compression := range []float64{20, 100, 500} {
+		td := uncheckedNew(Compression(compression), LocalRandomNumberGenerator(1))
+		for i := 0; i < 100000; i++ {
+			_ = td.Add(r.NormFloat64())
+		}
+
+		previous := 0.0
+		for q := 0.0; q <= 1; q += 0.0005 {
+			x := td.Quantile(q)
+			rank := td.InterpolatedRank(x)
+			if math.Abs(rank-q) > 1e-9 {
+				t.Errorf("compression %f: expected InterpolatedRank(Quantile(%f)) to round-trip, got %f", compression, q, rank)
+			}
+			if rank < previous {
+				t.Errorf("compression %f: expected ranks to grow with the values, got %f after %f", compression, rank, previous)
+			}
+			previous = rank
+		}
+
+		if td.InterpolatedRank(td.Min()-1) != 0 || td.InterpolatedRank(td.Min()) != 0 || td.InterpolatedRank(td.Max()) != 1 {
+			t.Errorf("compression %f: expected the extremes to be at 0 and 1", compression)
 		}
+	}
 
-		// real cdf of estimated quantile(x)
-		error := math.Abs(q - cdf(digest.Quantile(q), data))
-		if error > 0.005 {
-			softErrors++
+	// Ranks are placed at the middle of centroids
+	td := uncheckedNew()
+	_ = td.AddCentroid(0, 1)
+	_ = td.AddCentroid(10, 9)
+	_ = td.AddCentroid(20, 1)
+	inputs := map[float64]float64{
+		-1: 0,
+		0:  0,
+		5:  2.5 / 10,
+		10: 5.0 / 10,
+		15: 7.5 / 10,
+		20: 1,
+	}
+	for value, expected := range inputs {
+		if rank := td.InterpolatedRank(value); math.Abs(rank-expected) > 1e-12 {
+			t.Errorf("Expected InterpolatedRank(%f) to be %f, got %f", value, expected, rank)
+		}
+	}
+
+	if !math.IsNaN(uncheckedNew().InterpolatedRank(1)) {
+		t.Errorf("Expected NaN for an empty digest")
+	}
+}
+
+func TestRank(t *testing.T) {
+	td := uncheckedNew()
+
+	if td.Rank(1) != 0 {
+		t.Errorf("Expected the rank in an empty digest to be 0, got %f", td.Rank(1))
+	}
+
+	for i := 0; i < 1000; i++ {
+		_ = td.AddWeighted(float64(i%100), uint64(1+i%7))
+	}
+
+	if td.Rank(-1) != 0 || td.Rank(td.Max()) != float64(td.Count()) || td.Rank(1000) != float64(td.Count()) {
+		t.Errorf("Expected ranks of 0 below Min() and Count() from Max() on")
+	}
+
+	previous := 0.0
+	for x := -0.5; x < 100; x += 0.25 {
+		rank := td.Rank(x)
+		if rank < previous {
+			t.Errorf("Expected Rank() to be monotonic, but Rank(%g) = %f < %f", x, rank, previous)
+		}
+		previous = rank
+
+		if expected := td.CDF(x) * float64(td.Count()); math.Abs(rank-expected) > 1e-9*expected {
+			t.Errorf("Expected Rank(%g) to be CDF(%g)*Count() = %f, got %f", x, x, expected, rank)
+		}
+	}
+}
+
+func TestTrim(t *testing.T) {
+	r := rand.New(rand.NewSource(0x7819))
+	td := uncheckedNew(LocalRandomNumberGenerator(1))
+	for i := 0; i < 100000; i++ {
+		_ = td.Add(r.NormFloat64())
+	}
+	// Sparse noise far in the upper tail, a centroid per sample
+	for i := 0; i < 50; i++ {
+		_ = td.Add(100 + 900*r.Float64())
+	}
+
+	quantiles := []float64{0.1, 0.25, 0.5, 0.75, 0.9}
+	before := td.Quantiles(quantiles...)
+	var dropped uint64
+	td.ForEachCentroid(func(mean float64, count uint64) bool {
+		if count < 2 {
+			dropped += count
+		}
+		return true
+	})
+
+	// Singletons only, the noise and the outermost genuine samples
+	err := td.Trim(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if td.Count() != 100050-dropped {
+		t.Errorf("Expected %d samples left, got %d", 100050-dropped, td.Count())
+	}
+	if err := td.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	td.ForEachCentroid(func(mean float64, count uint64) bool {
+		if count < 2 {
+			t.Errorf("Expected no centroid below 2 samples, got %d of %f", count, mean)
+		}
+		return true
+	})
+	if td.Max() > 10 || td.Min() < -10 || td.Max() != td.summary.Mean(td.summary.Len()-1) {
+		t.Errorf("Expected the extremes to move to the remaining centroids, got %f and %f", td.Min(), td.Max())
+	}
+
+	// The dense body barely moves
+	for i, q := range td.Quantiles(quantiles...) {
+		if math.Abs(q-before[i]) > 0.01 {
+			t.Errorf("Expected Quantile(%f) to stay close to %f, got %f", quantiles[i], before[i], q)
+		}
+	}
+
+	// Nothing below the threshold, nothing to do
+	count, centroids := td.Count(), td.summary.Len()
+	if err := td.Trim(2); err != nil || td.Count() != count || td.summary.Len() != centroids {
+		t.Errorf("Expected trimming again to be a no-op")
+	}
+
+	if err := td.Trim(math.MaxUint64); err != nil || td.Count() != 0 || !math.IsNaN(td.Quantile(0.5)) {
+		t.Errorf("Expected an empty digest, got %d samples (%v)", td.Count(), err)
+	}
+	if err := td.Trim(10); err != nil {
+		t.Errorf("Expected trimming an empty digest to be fine, got %s", err)
+	}
+}
+
+func TestCountBetween(t *testing.T) {
+	td := uncheckedNew()
+	if td.CountBetween(0, 1) != 0 {
+		t.Errorf("Expected no samples in an empty digest, got %f", td.CountBetween(0, 1))
+	}
+
+	for i := 0; i < 100000; i++ {
+		_ = td.Add(rand.Float64())
+	}
+
+	if all := td.CountBetween(-1, 2); all != float64(td.Count()) {
+		t.Errorf("Expected all %d samples between -1 and 2, got %f", td.Count(), all)
+	}
+	if all := td.CountBetween(0, 1); math.Abs(all-float64(td.Count())) > 0.001*float64(td.Count()) {
+		t.Errorf("Expected about %d samples between 0 and 1, got %f", td.Count(), all)
+	}
+	for _, window := range [][2]float64{{0.1, 0.2}, {0.25, 0.75}, {0.9, 0.99}, {0.5, 0.5001}} {
+		count := td.CountBetween(window[0], window[1])
+		expected := (td.CDF(window[1]) - td.CDF(window[0])) * float64(td.Count())
+		if math.Abs(count-expected) > 1e-6*expected {
+			t.Errorf("Expected CountBetween(%g, %g) to be %f, got %f", window[0], window[1], expected, count)
+		}
+		if actual := (window[1] - window[0]) * 100000; math.Abs(count-actual) > 0.01*100000 {
+			t.Errorf("Expected about %f samples between %g and %g, got %f", actual, window[0], window[1], count)
+		}
+	}
+
+	for _, window := range [][2]float64{{0.5, 0.5}, {0.6, 0.4}, {math.NaN(), 1}, {0, math.NaN()}} {
+		if count := td.CountBetween(window[0], window[1]); count != 0 {
+			t.Errorf("Expected no samples between %g and %g, got %f", window[0], window[1], count)
+		}
+	}
+}
+
+func TestTrimmedMean(t *testing.T) {
+	tests := []struct {
+		p1, p2 float64
+	}{
+		{0, 1},
+		{0.1, 0.9},
+		{0.2, 0.8},
+		{0.25, 0.75},
+		{0, 0.5},
+		{0.5, 1},
+		{0.1, 0.7},
+		{0.3, 0.9},
+	}
+
+	for _, size := range []int{100, 1000, 10000} {
+		for _, test := range tests {
+			td := uncheckedNew(Compression(100))
+
+			data := make([]float64, 0, size)
+			for i := 0; i < size; i++ {
+				f := rand.Float64()
+				data = append(data, f)
+				err := td.Add(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := td.TrimmedMean(test.p1, test.p2)
+			wanted := trimmedMean(data, test.p1, test.p2)
+			if math.Abs(got-wanted) > 0.01 {
+				t.Fatalf("got %f, wanted %f (size=%d p1=%f p2=%f)",
+					got, wanted, size, test.p1, test.p2)
+			}
+
+			for i := 0; i < 10; i++ {
+				err := td.Add(float64(i * 100))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			mean := td.TrimmedMean(0.1, 0.999)
+			if mean < 0 {
+				t.Fatalf("mean < 0")
+			}
+		}
+	}
+}
+
+func TestTrimmedMeanCornerCases(t *testing.T) {
+	td := uncheckedNew(Compression(100))
+
+	mean := td.TrimmedMean(0, 1)
+	if mean != 0 {
+		t.Fatalf("got %f, wanted 0", mean)
+	}
+
+	x := 1.0
+	err := td.Add(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mean = td.TrimmedMean(0, 1)
+	if mean != 1 {
+		t.Fatalf("got %f, wanted %f", mean, x)
+	}
+
+	err = td.Add(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mean = td.TrimmedMean(0, 1)
+	wanted := 500.5
+	if !closeEnough(mean, wanted) {
+		t.Fatalf("got %f, wanted %f", mean, wanted)
+	}
+
+	// Each sample holds half of the mass, so the boundary
+	// centroids are only partially counted.
+	mean = td.TrimmedMean(0.25, 1)
+	wanted = (0.25*1 + 0.5*1000) / 0.75
+	if !closeEnough(mean, wanted) {
+		t.Fatalf("got %f, wanted %f", mean, wanted)
+	}
+
+	for _, p := range [][2]float64{{0.5, 0.5}, {0.9, 0.1}, {1, 0}, {2, 3}, {-2, -1}, {math.NaN(), 1}, {0, math.NaN()}} {
+		mean = td.TrimmedMean(p[0], p[1])
+		if !math.IsNaN(mean) {
+			t.Fatalf("TrimmedMean(%f, %f) = %f, wanted NaN", p[0], p[1], mean)
+		}
+	}
+
+	// Out of range percentiles are clamped like in Quantile
+	for _, p := range [][2]float64{{-1, 1}, {0, 2}, {-0.5, 1.5}} {
+		mean = td.TrimmedMean(p[0], p[1])
+		if mean != td.TrimmedMean(0, 1) {
+			t.Fatalf("TrimmedMean(%f, %f) = %f, wanted %f", p[0], p[1], mean, td.TrimmedMean(0, 1))
+		}
+	}
+	mean = td.TrimmedMean(0.25, 7)
+	if mean != td.TrimmedMean(0.25, 1) {
+		t.Fatalf("TrimmedMean(0.25, 7) = %f, wanted %f", mean, td.TrimmedMean(0.25, 1))
+	}
+}
+
+func TestTrimmedMeanWholeRange(t *testing.T) {
+	td := uncheckedNew(Compression(100))
+
+	var sum float64
+	for i := 0; i < 10000; i++ {
+		x := rand.ExpFloat64()
+		sum += x
+		_ = td.Add(x)
+	}
+
+	got := td.TrimmedMean(0, 1)
+	wanted := sum / float64(td.Count())
+	if math.Abs(got-wanted) > 1e-9*wanted {
+		t.Fatalf("got %f, wanted %f", got, wanted)
+	}
+}
+
+func trimmedMean(ff []float64, p1, p2 float64) float64 {
+	sort.Float64s(ff)
+	x1 := stat.Quantile(p1, stat.Empirical, ff, nil)
+	x2 := stat.Quantile(p2, stat.Empirical, ff, nil)
+
+	var sum float64
+	var count int
+	for _, f := range ff {
+		if f >= x1 && f <= x2 {
+			sum += f
+			count++
+		}
+	}
+	return sum / float64(count)
+}
+
+func TestSum(t *testing.T) {
+	td := uncheckedNew()
+
+	if td.Sum() != 0 {
+		t.Errorf("Expected the sum of an empty digest to be 0, got %f", td.Sum())
+	}
+
+	var sum float64
+	for i := 0; i < 100000; i++ {
+		x := 1 + rand.NormFloat64()
+		sum += x
+		_ = td.Add(x)
+	}
+
+	if math.Abs(td.Sum()-sum) > 1e-6*math.Abs(sum) {
+		t.Errorf("Expected Sum() to be close to %f, got %f", sum, td.Sum())
+	}
+
+	_ = td.Compress()
+	if math.Abs(td.Sum()-sum) > 1e-6*math.Abs(sum) {
+		t.Errorf("Expected Sum() to be close to %f after Compress(), got %f", sum, td.Sum())
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	td := uncheckedNew(Compression(10))
+
+	if !math.IsNaN(td.Min()) || !math.IsNaN(td.Max()) {
+		t.Errorf("Expected NaN extremes for an empty digest, got %f %f", td.Min(), td.Max())
+	}
+
+	min, max := math.Inf(1), math.Inf(-1)
+	for i := 0; i < 100000; i++ {
+		x := rand.NormFloat64()
+		min, max = math.Min(min, x), math.Max(max, x)
+		_ = td.Add(x)
+	}
+
+	_ = td.Compress()
+
+	if td.Min() != min || td.Max() != max {
+		t.Errorf("Expected extremes %f %f, got %f %f", min, max, td.Min(), td.Max())
+	}
+
+	if td.Quantile(0) != min || td.Quantile(1) != max {
+		t.Errorf("Expected Quantile(0) and Quantile(1) to be %f %f, got %f %f", min, max, td.Quantile(0), td.Quantile(1))
+	}
+
+	for _, q := range []float64{1e-9, 0.001, 0.5, 0.999, 1 - 1e-9} {
+		if x := td.Quantile(q); x < min || x > max {
+			t.Errorf("Quantile(%g) = %f is out of [%f, %f]", q, x, min, max)
+		}
+	}
+
+	if td.CDF(min-1) != 0 || td.CDF(max) != 1 {
+		t.Errorf("Expected CDF to be 0 below Min() and 1 at Max()")
+	}
+
+	other := uncheckedNew()
+	_ = other.Add(min - 1)
+	_ = other.Add(max + 1)
+	_ = td.Merge(other)
+
+	if td.Min() != min-1 || td.Max() != max+1 {
+		t.Errorf("Expected merged extremes %f %f, got %f %f", min-1, max+1, td.Min(), td.Max())
+	}
+
+	_, _ = td.Reset()
+	if !math.IsNaN(td.Min()) || !math.IsNaN(td.Max()) {
+		t.Errorf("Expected NaN extremes after Reset(), got %f %f", td.Min(), td.Max())
+	}
+}
+
+func TestMedian(t *testing.T) {
+	td := uncheckedNew()
+
+	if !math.IsNaN(td.Median()) {
+		t.Errorf("Expected the median of an empty digest to be NaN, got %f", td.Median())
+	}
+
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rand.ExpFloat64())
+	}
+
+	if td.Median() != td.Quantile(0.5) {
+		t.Errorf("Expected Median() to be Quantile(0.5): %f != %f", td.Median(), td.Quantile(0.5))
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	td := uncheckedNew()
+
+	if len(td.Quantiles()) != 0 {
+		t.Errorf("Expected no results when no quantiles are requested")
+	}
+
+	for _, x := range td.Quantiles(0, 0.5, 1) {
+		if !math.IsNaN(x) {
+			t.Errorf("Expected NaN quantiles for an empty digest, got %f", x)
+		}
+	}
+
+	for i := 0; i < 100000; i++ {
+		_ = td.Add(rand.NormFloat64())
+	}
+
+	qs := []float64{0.99, 0.5, 0, 0.999, 0.001, 1, 0.5, 0.9, 1e-9}
+	results := td.Quantiles(qs...)
+
+	if len(results) != len(qs) {
+		t.Fatalf("Expected %d results, got %d", len(qs), len(results))
+	}
+
+	for i, q := range qs {
+		if results[i] != td.Quantile(q) {
+			t.Errorf("Expected Quantiles()[%d] to be Quantile(%g) = %f, got %f", i, q, td.Quantile(q), results[i])
 		}
+	}
+}
+
+func TestIQR(t *testing.T) {
+	td := uncheckedNew()
+
+	if !math.IsNaN(td.IQR()) {
+		t.Errorf("Expected the IQR of an empty digest to be NaN, got %f", td.IQR())
+	}
+
+	_ = td.AddWeighted(7, 10)
+	if td.IQR() != 0 {
+		t.Errorf("Expected the IQR of a single value to be 0, got %f", td.IQR())
+	}
+
+	td = uncheckedNew()
+	for i := 0; i < 100000; i++ {
+		_ = td.Add(rand.Float64() * 100)
+	}
+
+	if math.Abs(td.IQR()-50) > 1 {
+		t.Errorf("Expected the IQR of U(0, 100) to be close to 50, got %f", td.IQR())
+	}
+}
+
+func TestVariance(t *testing.T) {
+	td := uncheckedNew()
+
+	if td.Variance() != 0 || td.StdDev() != 0 {
+		t.Errorf("Expected the variance of an empty digest to be 0, got %f", td.Variance())
+	}
 
-		if error > 0.012 {
-			t.Errorf("Error in estimated Quantile too high")
-		}
+	samples := make([]float64, 100000)
+	var mean float64
+	for i := range samples {
+		samples[i] = 5 + 3*rand.NormFloat64()
+		mean += samples[i]
+		_ = td.Add(samples[i])
 	}
+	mean /= float64(len(samples))
 
-	if softErrors >= 3 {
-		t.Errorf("Too many soft errors")
+	var variance float64
+	for _, x := range samples {
+		variance += (x - mean) * (x - mean)
 	}
+	variance /= float64(len(samples))
 
-	// Issue #17, verify that we are hitting the extreme CDF case
-	// XXX Maybe test this properly instead of having a hardcoded value
-	extreme := digest.CDF(0.71875)
-	if !closeEnough(extreme, 1) {
-		t.Errorf("Expected something close to 1 but got %.4f instead", extreme)
+	if math.Abs(td.Variance()-variance) > 0.01*variance {
+		t.Errorf("Expected Variance() to be close to %f, got %f", variance, td.Variance())
+	}
+
+	if math.Abs(td.StdDev()-3) > 0.05 {
+		t.Errorf("Expected StdDev() to be close to 3, got %f", td.StdDev())
 	}
 }
 
-func shouldPanic(f func(), t *testing.T, message string) {
-	defer func() {
-		tryRecover := recover()
-		if tryRecover == nil {
-			t.Errorf(message)
+func TestExtremeMagnitudes(t *testing.T) {
+	r := rand.New(rand.NewSource(0xB16))
+
+	inputs := []struct {
+		name   string
+		sample func() float64
+		median float64
+	}{
+		{"huge", func() float64 { return math.MaxFloat64 * (0.5 + 0.5*r.Float64()) }, 0.75 * math.MaxFloat64},
+		{"negative huge", func() float64 { return -math.MaxFloat64 * (0.5 + 0.5*r.Float64()) }, -0.75 * math.MaxFloat64},
+		{"subnormal", func() float64 { return math.SmallestNonzeroFloat64 * float64(1+r.Intn(1000000)) }, 500000 * math.SmallestNonzeroFloat64},
+	}
+	for _, input := range inputs {
+		td := uncheckedNew(LocalRandomNumberGenerator(1))
+		for i := 0; i < 100000; i++ {
+			_ = td.Add(input.sample())
 		}
-	}()
-	f()
-}
 
-func TestPanic(t *testing.T) {
-	tdigest := uncheckedNew()
+		previous := math.Inf(-1)
+		for q := 0.0; q <= 1; q += 0.001 {
+			value := td.Quantile(q)
+			if !isFinite(value) || value < td.Min() || value > td.Max() || value < previous {
+				t.Fatalf("%s: expected finite, increasing quantiles within [%g, %g], got %g after %g for q=%f", input.name, td.Min(), td.Max(), value, previous, q)
+			}
+			previous = value
+		}
+		if median := td.Quantile(0.5); math.Abs(median-input.median) > 0.01*math.Abs(input.median) {
+			t.Errorf("%s: expected a median close to %g, got %g", input.name, input.median, median)
+		}
+		for _, mean := range td.summary.means {
+			if !isFinite(mean) {
+				t.Fatalf("%s: expected finite centroid means, got %g", input.name, mean)
+			}
+		}
+	}
 
-	shouldPanic(func() {
-		tdigest.Quantile(-42)
-	}, t, "Quantile < 0 should panic!")
+	// The weighted average of the largest values doesn't overflow
+	if average := boundedWeightedAverage(math.MaxFloat64, 3, math.MaxFloat64/2, 5); !isFinite(average) || average < math.MaxFloat64/2 {
+		t.Errorf("Expected a finite average of huge means, got %g", average)
+	}
 
-	shouldPanic(func() {
-		tdigest.Quantile(42)
-	}, t, "Quantile > 1 should panic!")
+	// Nor does the variance, even when the sum does
+	td := uncheckedNew()
+	_ = td.AddWeighted(1e307, 100000)
+	if !math.IsInf(td.Sum(), 1) {
+		t.Errorf("Expected the sum to overflow, got %g", td.Sum())
+	}
+	if td.Variance() != 0 {
+		t.Errorf("Expected a variance of 0, got %g", td.Variance())
+	}
 }
 
-func TestForEachCentroid(t *testing.T) {
-	tdigest := uncheckedNew(Compression(10))
+func TestWeightedAverageLargeCounts(t *testing.T) {
+	r := rand.New(rand.NewSource(0xC0FFEE))
 
-	for i := 0; i < 100; i++ {
-		_ = tdigest.Add(float64(i))
+	// A heavy centroid absorbing samples spread evenly around its mean
+	// barely moves: summing the weighted means would round it off by
+	// about an ulp per merge
+	mean, count := 0.1, float64(1<<50)
+	for i := 0; i < 100000; i++ {
+		delta := r.Float64() * 1e-9
+		mean = boundedWeightedAverage(mean, count, 0.1-delta, 1)
+		mean = boundedWeightedAverage(mean, count+1, 0.1+delta, 1)
+		count += 2
+	}
+	if ulps := math.Abs(mean-0.1) / (math.Nextafter(0.1, 1) - 0.1); ulps > 2 {
+		t.Errorf("Expected the mean to stay within 2 ulps of 0.1, got %.17g (%.0f ulps away)", mean, ulps)
 	}
+}
 
-	// Iterate limited number.
-	means := []float64{}
-	tdigest.ForEachCentroid(func(mean float64, count uint64) bool {
-		means = append(means, mean)
-		return len(means) != 3
-	})
-	if len(means) != 3 {
-		t.Errorf("ForEachCentroid handled incorrect number of data items")
+func TestMode(t *testing.T) {
+	td := uncheckedNew()
+
+	if !math.IsNaN(td.Mode()) {
+		t.Errorf("Expected the mode of an empty digest to be NaN, got %f", td.Mode())
 	}
 
-	// Iterate all datapoints.
-	means = []float64{}
-	tdigest.ForEachCentroid(func(mean float64, count uint64) bool {
-		means = append(means, mean)
-		return true
-	})
-	if len(means) != tdigest.summary.Len() {
-		t.Errorf("ForEachCentroid did not handle all data")
+	_ = td.Add(42)
+	if td.Mode() != 42 {
+		t.Errorf("Expected the mode of a single sample to be itself, got %f", td.Mode())
 	}
-}
 
-func TestQuantilesDontOverflow(t *testing.T) {
-	tdigest := uncheckedNew(Compression(100))
-	// Add slightly more than math.MaxUint32 samples uniformly in the range
-	// [0, 1). This would overflow a uint32-based implementation.
-	tdigest.Add(1)
-	for i := 0; i < 1024; i++ {
-		tdigest.AddWeighted(float64(i)/1024, 4194304)
+	// Seeded, since a few unluckily close samples in the tails can
+	// look denser than the peak (see Mode)
+	r := rand.New(rand.NewSource(0xBEEF))
+	td = uncheckedNew(LocalRandomNumberGenerator(1))
+	for i := 0; i < 100000; i++ {
+		_ = td.Add(10 + r.NormFloat64())
 	}
-	assertDifferenceSmallerThan(tdigest, 0.5, .02, t)
-}
 
-func TestCDFInsideLastCentroid(t *testing.T) {
-	// values pulled from a live digest. sorry it's a lot!
-	td := &TDigest{
-		summary: &summary{
-			means:  []float64{2120.75048828125, 2260.3844299316406, 3900.490264892578, 3937.495807647705, 5390.479816436768, 10450.335285186768, 14152.897296905518, 16442.676349639893, 24303.143146514893, 56961.87361526489, 63891.24959182739, 73982.55232620239, 86477.50447463989, 110746.62556838989, 175479.7388496399, 300492.3404121399, 440452.5279121399, 515611.7700996399, 535827.0025215149, 546241.6822090149, 556965.3648262024, 569791.2124824524, 587320.6870918274, 603969.4175605774, 613751.6177558899, 624708.7593574524, 635060.0718574524, 641924.2007637024, 650656.4302558899, 660653.1714668274, 671380.9009590149, 687094.3667793274, 716595.8824043274, 740870.9800605774, 760276.2437324524, 768857.5786933899, 775021.0025215149, 787686.0337715149, 801473.4624824524, 815225.1255683899, 832358.6997871399, 852438.4751777649, 866134.2935371399, 1.10661549666214e+06, 1.1212118980293274e+06, 1.2230108433418274e+06, 1.5446490620918274e+06, 4.306712312091827e+06, 5.487582562091827e+06, 6.306383562091827e+06, 7.089308312091827e+06, 7.520797593341827e+06},
-			counts: []uint64{0x1, 0x1, 0x1, 0x1, 0x1, 0x2, 0x1, 0x4, 0x5, 0x6, 0x3, 0x3, 0x4, 0x11, 0x23, 0x2f, 0x1e, 0x1b, 0x36, 0x31, 0x33, 0x4e, 0x5f, 0x61, 0x48, 0x2e, 0x26, 0x28, 0x2a, 0x31, 0x39, 0x51, 0x32, 0x2b, 0x12, 0x8, 0xb, 0xa, 0x11, 0xa, 0x11, 0x9, 0x7, 0x1, 0x1, 0x1, 0x3, 0x2, 0x1, 0x1, 0x1, 0x1},
-		},
-		compression: 5,
-		count:       1250,
-		rng:         globalRNG{},
+	if math.Abs(td.Mode()-10) > 0.5 {
+		t.Errorf("Expected a mode close to 10, got %f", td.Mode())
 	}
 
-	if cdf := td.CDF(7.144560976650238e+06); cdf > 1 {
-		t.Fatalf("invalid: %v", cdf)
+	// Two equally dense centroids, the lower one wins
+	td = uncheckedNew()
+	for _, x := range []float64{1, 2, 3} {
+		_ = td.AddWeighted(x, 5)
+	}
+	if td.Mode() != 1 {
+		t.Errorf("Expected ties to resolve to the lower mean, got %f", td.Mode())
 	}
 }
 
-func TestTrimmedMean(t *testing.T) {
-	tests := []struct {
-		p1, p2 float64
-	}{
-		{0, 1},
-		{0.1, 0.9},
-		{0.2, 0.8},
-		{0.25, 0.75},
-		{0, 0.5},
-		{0.5, 1},
-		{0.1, 0.7},
-		{0.3, 0.9},
+func TestEquals(t *testing.T) {
+	td := uncheckedNew()
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rand.NormFloat64())
 	}
 
-	for _, size := range []int{100, 1000, 10000} {
-		for _, test := range tests {
-			td := uncheckedNew(Compression(100))
+	if !td.Equals(td.Clone(), 0) || !td.Equals(td, 0) {
+		t.Errorf("Expected a digest to equal its clone")
+	}
 
-			data := make([]float64, 0, size)
-			for i := 0; i < size; i++ {
-				f := rand.Float64()
-				data = append(data, f)
-				err := td.Add(f)
-				if err != nil {
-					t.Fatal(err)
-				}
-			}
+	// AsBytes loses precision
+	payload, _ := td.AsBytes()
+	decoded, _ := FromBytes(bytes.NewReader(payload))
+	if td.Equals(decoded, 0) || !td.Equals(decoded, 1e-5) || !decoded.Equals(td, 1e-5) {
+		t.Errorf("Expected a deserialized copy to only be equal within tolerance")
+	}
 
-			got := td.TrimmedMean(test.p1, test.p2)
-			wanted := trimmedMean(data, test.p1, test.p2)
-			if math.Abs(got-wanted) > 0.01 {
-				t.Fatalf("got %f, wanted %f (size=%d p1=%f p2=%f)",
-					got, wanted, size, test.p1, test.p2)
-			}
+	other := td.Clone()
+	other.summary.counts[3]++
+	other.count++
+	if td.Equals(other, 1) {
+		t.Errorf("Expected digests with different counts to differ")
+	}
 
-			for i := 0; i < 10; i++ {
-				err := td.Add(float64(i * 100))
-				if err != nil {
-					t.Fatal(err)
-				}
-			}
-			mean := td.TrimmedMean(0.1, 0.999)
-			if mean < 0 {
-				t.Fatalf("mean < 0")
-			}
-		}
+	other = td.Clone()
+	_ = other.AddCentroid(100, 1)
+	if td.Equals(other, math.Inf(1)) || other.Equals(td, math.Inf(1)) {
+		t.Errorf("Expected digests with a different number of centroids to differ")
+	}
+
+	if td.Equals(nil, 1) || !uncheckedNew().Equals(uncheckedNew(Compression(1)), 0) {
+		t.Errorf("Unexpected result comparing empty digests")
 	}
 }
 
-func TestTrimmedMeanCornerCases(t *testing.T) {
-	td := uncheckedNew(Compression(100))
+func TestDiff(t *testing.T) {
+	r := rand.New(rand.NewSource(0xD1FF))
+	quantiles := []float64{0, 0.5, 0.9, 0.99, 1}
 
-	mean := td.TrimmedMean(0, 1)
-	if mean != 0 {
-		t.Fatalf("got %f, wanted 0", mean)
+	baseline := uncheckedNew(LocalRandomNumberGenerator(1))
+	for i := 0; i < 10000; i++ {
+		_ = baseline.Add(r.Float64())
 	}
 
-	x := 1.0
-	err := td.Add(x)
-	if err != nil {
-		t.Fatal(err)
+	// Compared to itself, nothing moves
+	for q, delta := range baseline.Diff(baseline.Clone(), quantiles) {
+		if delta != 0 {
+			t.Errorf("Expected no change for q=%f, got %f", q, delta)
+		}
 	}
 
-	mean = td.TrimmedMean(0, 1)
-	if mean != 1 {
-		t.Fatalf("got %f, wanted %f", mean, x)
+	// Counts don't need to match: a slower run of a tenth the size
+	current := uncheckedNew(LocalRandomNumberGenerator(1))
+	for i := 0; i < 1000; i++ {
+		_ = current.Add(r.Float64() + 0.5)
+	}
+	deltas := current.Diff(baseline, quantiles)
+	if len(deltas) != len(quantiles) {
+		t.Fatalf("Expected %d deltas, got %v", len(quantiles), deltas)
+	}
+	for _, q := range quantiles {
+		if math.Abs(deltas[q]-0.5) > 0.05 {
+			t.Errorf("Expected a delta close to 0.5 for q=%f, got %f", q, deltas[q])
+		}
 	}
 
-	err = td.Add(1000)
-	if err != nil {
-		t.Fatal(err)
+	// Empty or missing digests have nothing to compare
+	for _, deltas := range []map[float64]float64{
+		uncheckedNew().Diff(baseline, quantiles),
+		baseline.Diff(uncheckedNew(), quantiles),
+		baseline.Diff(nil, quantiles),
+	} {
+		for q, delta := range deltas {
+			if !math.IsNaN(delta) {
+				t.Errorf("Expected NaN for q=%f, got %f", q, delta)
+			}
+		}
 	}
 
-	mean = td.TrimmedMean(0, 1)
-	wanted := 500.5
-	if !closeEnough(mean, wanted) {
-		t.Fatalf("got %f, wanted %f", mean, wanted)
+	if deltas := baseline.Diff(baseline, []float64{math.NaN(), 0.5}); len(deltas) != 1 {
+		t.Errorf("Expected NaN quantiles to be left out, got %v", deltas)
 	}
 }
 
-func trimmedMean(ff []float64, p1, p2 float64) float64 {
-	sort.Float64s(ff)
-	x1 := stat.Quantile(p1, stat.Empirical, ff, nil)
-	x2 := stat.Quantile(p2, stat.Empirical, ff, nil)
+func TestString(t *testing.T) {
+	td := uncheckedNew(Compression(50))
+	if td.String() != "tdigest(compression=50, centroids=0, count=0)" {
+		t.Errorf("Unexpected description of an empty digest: %s", td)
+	}
 
-	var sum float64
-	var count int
-	for _, f := range ff {
-		if f >= x1 && f <= x2 {
-			sum += f
-			count++
+	for _, x := range []float64{1, 2, 3, 4, 5} {
+		_ = td.Add(x)
+	}
+	expected := "tdigest(compression=50, centroids=5, count=5, min=1, max=5, p50=3, p99=4.96)"
+	if td.String() != expected || fmt.Sprintf("%v", td) != expected {
+		t.Errorf("Unexpected description: %s", td)
+	}
+}
+
+func TestReset(t *testing.T) {
+	fill := func(td *TDigest) {
+		r := rand.New(rand.NewSource(0x2E5E7))
+		for i := 0; i < 10000; i++ {
+			_ = td.Add(r.ExpFloat64())
 		}
 	}
-	return sum / float64(count)
+
+	td := uncheckedNew(Compression(20), LocalRandomNumberGenerator(1))
+	fill(td)
+	means := td.summary.means
+
+	reset, err := td.Reset(LocalRandomNumberGenerator(1))
+	if err != nil || reset != td {
+		t.Fatalf("Unexpected Reset() result: %v", err)
+	}
+	if td.Count() != 0 || td.summary.Len() != 0 || !math.IsNaN(td.Quantile(0.5)) || !math.IsNaN(td.Min()) {
+		t.Errorf("Expected an empty digest after Reset()")
+	}
+
+	fill(td)
+	fresh := uncheckedNew(Compression(20), LocalRandomNumberGenerator(1))
+	fill(fresh)
+
+	got, _ := td.AsBytes()
+	expected, _ := fresh.AsBytes()
+	if !bytes.Equal(got, expected) || td.Min() != fresh.Min() || td.Max() != fresh.Max() {
+		t.Errorf("Expected a Reset() digest to behave like a new one")
+	}
+	if &td.summary.means[:1][0] != &means[:1][0] {
+		t.Errorf("Expected Reset() to reuse the buffers")
+	}
+
+	if _, err = td.Reset(Compression(0)); err == nil {
+		t.Errorf("Expected invalid options to be rejected")
+	}
 }
 
 func TestClone(t *testing.T) {
@@ -676,6 +2689,26 @@ func TestClone(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	// td is not changed after the clone is changed.
+
+	means, counts := td.summary.GetDataCopy()
+	count, min, max := td.Count(), td.Min(), td.Max()
+
+	other := uncheckedNew()
+	_ = other.AddWeighted(-10, 5)
+	_ = other.AddWeighted(10, 5)
+	_ = clone.Merge(other)
+	_ = clone.Remove(0.5, 20)
+	_ = clone.Compress()
+
+	if td.Count() != count || td.Min() != min || td.Max() != max ||
+		!reflect.DeepEqual(td.summary.means, means) || !reflect.DeepEqual(td.summary.counts, counts) {
+		t.Fatalf("Changing the clone changed the original")
+	}
+	if clone.Min() != -10 || clone.Max() != 10 {
+		t.Fatalf("Expected the clone extremes to change, got %f %f", clone.Min(), clone.Max())
+	}
 }
 
 var compressions = []float64{1, 10, 20, 30, 50, 100}
@@ -708,6 +2741,56 @@ func benchmarkAddOnce(b *testing.B, compression float64) {
 	b.StopTimer()
 }
 
+func BenchmarkAddBatch(b *testing.B) {
+	for _, n := range []int{100, 10000, 1000000} {
+		data := make([]float64, n)
+		for i := range data {
+			data[i] = rand.Float64()
+		}
+
+		b.Run(fmt.Sprintf("n=%d/Add", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				t := uncheckedNew()
+				for _, x := range data {
+					_ = t.Add(x)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("n=%d/AddBatch", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				t := uncheckedNew()
+				_ = t.AddBatch(data)
+			}
+		})
+	}
+}
+
+func BenchmarkFromSortedValues(b *testing.B) {
+	for _, n := range []int{100, 10000, 1000000} {
+		data := make([]float64, n)
+		for i := range data {
+			data[i] = rand.Float64()
+		}
+		sort.Float64s(data)
+
+		b.Run(fmt.Sprintf("n=%d/Add", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				t := uncheckedNew()
+				for _, x := range data {
+					_ = t.Add(x)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("n=%d/FromSortedValues", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = FromSortedValues(data, 100)
+			}
+		})
+	}
+}
+
 func BenchmarkTDigestAddMulti(b *testing.B) {
 	for _, compression := range compressions {
 		compression := compression
@@ -790,6 +2873,87 @@ func randomTDigest(compression float64) *TDigest {
 	return t
 }
 
+func BenchmarkQuantiles(b *testing.B) {
+	t, _ := New(Compression(100))
+	for n := 0; n < 100000; n++ {
+		t.Add(rand.Float64())
+	}
+
+	qs := []float64{0.5, 0.9, 0.99, 0.999}
+
+	b.Run("Quantile", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for _, q := range qs {
+				t.Quantile(q)
+			}
+		}
+	})
+
+	b.Run("Quantiles", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			t.Quantiles(qs...)
+		}
+	})
+}
+
+func BenchmarkCDFs(b *testing.B) {
+	t, _ := New(Compression(100))
+	for n := 0; n < 100000; n++ {
+		t.Add(rand.Float64())
+	}
+
+	xs := []float64{0.1, 0.25, 0.5, 0.75, 0.9, 0.99}
+
+	b.Run("CDF", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for _, x := range xs {
+				t.CDF(x)
+			}
+		}
+	})
+
+	b.Run("CDFs", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			t.CDFs(xs...)
+		}
+	})
+}
+
+// Steady-state ingestion, which compresses the digest every now and
+// then and shouldn't allocate.
+func BenchmarkAddSteadyState(b *testing.B) {
+	b.ReportAllocs()
+
+	t, _ := New(Compression(10))
+	for n := 0; n < 10000; n++ {
+		t.Add(rand.Float64())
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		t.Add(rand.Float64())
+		if n%100 == 0 {
+			t.Compress()
+		}
+	}
+}
+
+func BenchmarkBufferFactor(b *testing.B) {
+	for _, factor := range []float64{12, 20, 50} {
+		b.Run(fmt.Sprintf("factor=%.0f", factor), func(b *testing.B) {
+			b.ReportAllocs()
+			t, _ := New(BufferFactor(factor))
+			for n := 0; n < b.N; n++ {
+				_ = t.Add(float64(n))
+			}
+		})
+	}
+}
+
 // Pathological ordered-input case.
 func BenchmarkAddOrdered(b *testing.B) {
 	t, _ := New(Compression(100))
@@ -802,6 +2966,26 @@ func BenchmarkAddOrdered(b *testing.B) {
 	}
 }
 
+// Compressing digests with many centroids, which is dominated by
+// the prefix sums over their counts.
+func BenchmarkCompress(b *testing.B) {
+	for _, size := range []int{200, 2000} {
+		source := uncheckedNew(Compression(float64(size / 20)))
+		for source.summary.Len() < size {
+			_ = source.AddCentroid(rand.Float64(), uint64(1+rand.Intn(100)))
+		}
+
+		b.Run(fmt.Sprintf("centroids=%d", size), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				t := source.Clone()
+				b.StartTimer()
+				_ = t.Compress()
+			}
+		})
+	}
+}
+
 func BenchmarkMerge(b *testing.B) {
 	b.ReportAllocs()
 
@@ -0,0 +1,124 @@
+// Package tdigestprom exposes t-digest quantiles as Prometheus
+// metrics.
+//
+// A Collector reads a digest on every scrape and reports a gauge per
+// target quantile, labelled with the quantile like the ones of a
+// Prometheus summary, plus a `_count` gauge with the number of samples
+// in the digest:
+//
+//	latency{quantile="0.5"} 0.012
+//	latency{quantile="0.99"} 0.250
+//	latency_count 10234
+//
+// The package is a module of its own, so that only programs using it
+// depend on the Prometheus client library.
+package tdigestprom
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/br-kearns/go-tdigest/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Source provides the digests a Collector reports on. Snapshot must
+// return a digest that isn't modified while the collector reads it,
+// such as a copy.
+//
+// *tdigest.Concurrent implements it.
+type Source interface {
+	Snapshot() *tdigest.TDigest
+}
+
+// Opts configures a Collector. Name is mandatory, the metric names
+// are built from Namespace, Subsystem and Name as usual.
+type Opts struct {
+	Namespace   string
+	Subsystem   string
+	Name        string
+	Help        string
+	ConstLabels prometheus.Labels
+
+	// Quantiles to report, between 0 and 1
+	Quantiles []float64
+}
+
+// Collector is a prometheus.Collector reporting quantiles of a digest.
+type Collector struct {
+	source    Source
+	quantiles []float64
+	labels    []string
+
+	quantileDesc *prometheus.Desc
+	countDesc    *prometheus.Desc
+}
+
+// New creates a collector reporting on the digests provided by
+// source, e.g. a *tdigest.Concurrent.
+func New(opts Opts, source Source) (*Collector, error) {
+	if opts.Name == "" {
+		return nil, errors.New("metric name should not be empty")
+	}
+	if source == nil {
+		return nil, errors.New("source should not be nil")
+	}
+
+	c := &Collector{
+		source:    source,
+		quantiles: append([]float64{}, opts.Quantiles...),
+		labels:    make([]string, len(opts.Quantiles)),
+	}
+	for i, q := range c.quantiles {
+		if !(q >= 0 && q <= 1) {
+			return nil, errors.New("quantiles should be between 0 and 1")
+		}
+		c.labels[i] = strconv.FormatFloat(q, 'g', -1, 64)
+	}
+
+	name := prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	c.quantileDesc = prometheus.NewDesc(name, opts.Help, []string{"quantile"}, opts.ConstLabels)
+	c.countDesc = prometheus.NewDesc(name+"_count", opts.Help, nil, opts.ConstLabels)
+	return c, nil
+}
+
+// NewLocked creates a collector reporting on a plain digest, guarded
+// by the given lock: every scrape copies the digest while holding it.
+// Writers must hold the same lock.
+func NewLocked(opts Opts, digest *tdigest.TDigest, lock sync.Locker) (*Collector, error) {
+	if digest == nil || lock == nil {
+		return nil, errors.New("digest and lock should not be nil")
+	}
+	return New(opts, &lockedSource{digest: digest, lock: lock})
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.quantileDesc
+	ch <- c.countDesc
+}
+
+// Collect implements prometheus.Collector. All the metrics of a
+// scrape come from the same snapshot, so they are consistent with
+// each other.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	digest := c.source.Snapshot()
+
+	// Like summaries, empty digests report NaN quantiles
+	for i, value := range digest.Quantiles(c.quantiles...) {
+		ch <- prometheus.MustNewConstMetric(c.quantileDesc, prometheus.GaugeValue, value, c.labels[i])
+	}
+	ch <- prometheus.MustNewConstMetric(c.countDesc, prometheus.GaugeValue, float64(digest.Count()))
+}
+
+type lockedSource struct {
+	digest *tdigest.TDigest
+	lock   sync.Locker
+}
+
+func (s *lockedSource) Snapshot() *tdigest.TDigest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.digest.Clone()
+}
@@ -0,0 +1,125 @@
+package tdigestprom
+
+import (
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/br-kearns/go-tdigest/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gather scrapes the registry, returning the value of every metric by
+// name and quantile label.
+func gather(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "quantile" {
+					name += "{" + label.GetValue() + "}"
+				}
+			}
+			values[name] = metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func TestCollector(t *testing.T) {
+	digest, _ := tdigest.NewConcurrent()
+	collector, err := New(Opts{
+		Namespace:   "app",
+		Name:        "latency",
+		Help:        "Request latency",
+		ConstLabels: prometheus.Labels{"service": "api"},
+		Quantiles:   []float64{0.5, 0.99, 0},
+	}, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	values := gather(t, registry)
+	if len(values) != 4 || values["app_latency_count"] != 0 || !math.IsNaN(values["app_latency{0.5}"]) {
+		t.Errorf("Unexpected metrics for an empty digest: %v", values)
+	}
+
+	for i := 1; i <= 1000; i++ {
+		_ = digest.Add(float64(i))
+	}
+
+	values = gather(t, registry)
+	if values["app_latency_count"] != 1000 || values["app_latency{0}"] != 1 {
+		t.Errorf("Unexpected metrics: %v", values)
+	}
+	for _, q := range []float64{0.5, 0.99} {
+		name := map[float64]string{0.5: "app_latency{0.5}", 0.99: "app_latency{0.99}"}[q]
+		if math.Abs(values[name]-1000*q) > 5 {
+			t.Errorf("Expected %s to be close to %f, got %f", name, 1000*q, values[name])
+		}
+	}
+}
+
+func TestNewLocked(t *testing.T) {
+	var mu sync.Mutex
+	digest, _ := tdigest.New()
+
+	collector, err := NewLocked(Opts{Name: "size", Quantiles: []float64{0.5}}, digest, &mu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			mu.Lock()
+			_ = digest.Add(1)
+			mu.Unlock()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		values := gather(t, registry)
+		if values["size_count"] > 0 && values["size{0.5}"] != 1 {
+			t.Errorf("Unexpected median: %v", values)
+		}
+	}
+	wg.Wait()
+
+	if values := gather(t, registry); values["size_count"] != 10000 {
+		t.Errorf("Unexpected count: %v", values)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	digest, _ := tdigest.NewConcurrent()
+	inputs := []Opts{
+		{},
+		{Name: "x", Quantiles: []float64{1.5}},
+		{Name: "x", Quantiles: []float64{math.NaN()}},
+	}
+	for _, opts := range inputs {
+		if _, err := New(opts, digest); err == nil {
+			t.Errorf("Expected %v to be rejected", opts)
+		}
+	}
+
+	if _, err := New(Opts{Name: "x"}, nil); err == nil {
+		t.Errorf("Expected a nil source to be rejected")
+	}
+	if _, err := NewLocked(Opts{Name: "x"}, nil, &sync.Mutex{}); err == nil {
+		t.Errorf("Expected a nil digest to be rejected")
+	}
+}
@@ -0,0 +1,47 @@
+package tdigestprom_test
+
+import (
+	"fmt"
+
+	"github.com/br-kearns/go-tdigest/v5"
+	"github.com/br-kearns/go-tdigest/v5/tdigestprom"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Example() {
+	digest, _ := tdigest.NewConcurrent()
+
+	collector, err := tdigestprom.New(tdigestprom.Opts{
+		Name:      "request_duration_seconds",
+		Help:      "Request durations.",
+		Quantiles: []float64{0.5, 0.9, 0.99},
+	}, digest)
+	if err != nil {
+		panic(err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	// Then serve the registry, e.g. with
+	// promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+	for i := 1; i <= 100; i++ {
+		_ = digest.Add(float64(i) / 100)
+	}
+
+	families, _ := registry.Gather()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := ""
+			for _, label := range metric.GetLabel() {
+				labels += fmt.Sprintf("{%s=%q}", label.GetName(), label.GetValue())
+			}
+			fmt.Printf("%s%s %.4g\n", family.GetName(), labels, metric.GetGauge().GetValue())
+		}
+	}
+	// Output:
+	// request_duration_seconds{quantile="0.5"} 0.505
+	// request_duration_seconds{quantile="0.9"} 0.901
+	// request_duration_seconds{quantile="0.99"} 0.9901
+	// request_duration_seconds_count 100
+}
@@ -0,0 +1,25 @@
+module github.com/br-kearns/go-tdigest/v5/tdigestprom
+
+go 1.18
+
+require (
+	github.com/br-kearns/go-tdigest/v5 v5.0.0-20261014073252-92210141bd69
+	github.com/prometheus/client_golang v1.14.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.37.0 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
+)
+
+// Builds against the parent directory when working in this repository.
+// Replace directives only apply to the main module, so programs using
+// tdigestprom get the version required above.
+replace github.com/br-kearns/go-tdigest/v5 => ../
@@ -0,0 +1,77 @@
+// Package tdigesttest provides helpers to test the accuracy of
+// t-digests, comparing their estimates to the exact quantiles of the
+// samples that built them:
+//
+//	func TestLatencies(t *testing.T) {
+//		digest, samples := buildDigest()
+//		sort.Float64s(samples)
+//		tdigesttest.AssertQuantileAccuracy(t, digest, samples, []float64{0.5, 0.99}, 0.01)
+//	}
+package tdigesttest
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+// Quantiler is what AssertQuantileAccuracy needs from a digest.
+// *tdigest.TDigest, *tdigest.Concurrent and tdigest.Reader all
+// implement it.
+type Quantiler interface {
+	Quantile(q float64) float64
+}
+
+// AssertQuantileAccuracy checks that the estimates of the digest for
+// the given quantiles are within relErr of the exact quantiles of
+// sortedTruth, the samples it was built from sorted in increasing
+// order: |estimate - exact| <= relErr·|exact|. It reports every
+// quantile that isn't, with the estimate and the relative error, and
+// returns whether all of them are.
+//
+// Exact quantiles are interpolated linearly between the samples at
+// index q·(len(sortedTruth)-1), like the digest does. Note that the
+// error is relative to the exact value, so quantiles at or around 0
+// need a (nearly) exact estimate.
+//
+// Empty or unsorted samples and quantiles outside of [0, 1] are
+// reported as fatal errors.
+func AssertQuantileAccuracy(t testing.TB, digest Quantiler, sortedTruth, quantiles []float64, relErr float64) bool {
+	t.Helper()
+	if len(sortedTruth) == 0 {
+		t.Fatalf("No samples to compare the digest to")
+		return false
+	}
+	if !sort.Float64sAreSorted(sortedTruth) {
+		t.Fatalf("The samples should be sorted in increasing order")
+		return false
+	}
+
+	ok := true
+	for _, q := range quantiles {
+		if !(q >= 0 && q <= 1) {
+			t.Fatalf("Quantiles should be between 0 and 1, got %v", q)
+			return false
+		}
+
+		exact := exactQuantile(sortedTruth, q)
+		estimate := digest.Quantile(q)
+		diff := math.Abs(estimate - exact)
+		if !(diff <= relErr*math.Abs(exact)) {
+			t.Errorf("Quantile(%v) = %v, expected %v within a relative error of %v, off by %v (relative error %.4g)",
+				q, estimate, exact, relErr, diff, diff/math.Abs(exact))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// exactQuantile interpolates the samples around index q·(n-1).
+func exactQuantile(sorted []float64, q float64) float64 {
+	index := q * float64(len(sorted)-1)
+	i := int(index)
+	if i >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (sorted[i+1]-sorted[i])*(index-float64(i))
+}
@@ -0,0 +1,89 @@
+package tdigesttest
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/br-kearns/go-tdigest/v5"
+)
+
+// recorder is a testing.TB keeping the failures it is told about
+// instead of failing the test.
+type recorder struct {
+	testing.TB
+	errors []string
+	fatal  bool
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+	r.fatal = true
+}
+
+func TestAssertQuantileAccuracy(t *testing.T) {
+	r := rand.New(rand.NewSource(0xACC))
+	digest, _ := tdigest.New(tdigest.LocalRandomNumberGenerator(1))
+	samples := make([]float64, 100000)
+	for i := range samples {
+		samples[i] = 1 + r.ExpFloat64()
+		_ = digest.Add(samples[i])
+	}
+	sort.Float64s(samples)
+
+	quantiles := []float64{0, 0.01, 0.5, 0.99, 1}
+	if !AssertQuantileAccuracy(t, digest, samples, quantiles, 0.01) {
+		t.Errorf("Expected the digest to be accurate")
+	}
+	if !AssertQuantileAccuracy(t, digest.ReadOnly(), samples, quantiles, 0.01) {
+		t.Errorf("Expected readers to be accepted")
+	}
+
+	// A shifted digest fails, reporting the quantiles that are off
+	shifted, _ := tdigest.New()
+	for _, x := range samples {
+		_ = shifted.Add(x + 0.1)
+	}
+	rec := &recorder{}
+	if AssertQuantileAccuracy(rec, shifted, samples, []float64{0.01, 0.99}, 0.05) {
+		t.Errorf("Expected the shifted digest to be inaccurate")
+	}
+	if len(rec.errors) != 1 || !strings.Contains(rec.errors[0], "Quantile(0.01)") {
+		t.Errorf("Expected the low quantile to be reported, got %q", rec.errors)
+	}
+
+	for _, input := range []struct {
+		truth     []float64
+		quantiles []float64
+	}{
+		{nil, []float64{0.5}},
+		{[]float64{3, 2, 1}, []float64{0.5}},
+		{samples, []float64{1.5}},
+	} {
+		rec := &recorder{}
+		if AssertQuantileAccuracy(rec, digest, input.truth, input.quantiles, 0.01) || !rec.fatal {
+			t.Errorf("Expected %v and %v to be a fatal error", input.truth, input.quantiles)
+		}
+	}
+}
+
+func TestExactQuantile(t *testing.T) {
+	sorted := []float64{1, 2, 4}
+	inputs := map[float64]float64{0: 1, 0.25: 1.5, 0.5: 2, 0.75: 3, 1: 4}
+	for q, expected := range inputs {
+		if actual := exactQuantile(sorted, q); actual != expected {
+			t.Errorf("Expected %f for q=%f, got %f", expected, q, actual)
+		}
+	}
+	if exactQuantile([]float64{7}, 0.5) != 7 {
+		t.Errorf("Expected the only sample")
+	}
+}
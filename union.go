@@ -0,0 +1,108 @@
+package tdigest
+
+import "math"
+
+// UnionQuantile estimates the q-th quantile of the union of the given
+// digests, skipping nil ones, as if they had been merged but without
+// building the merged digest: their centroids are walked in order of
+// mean, with a k-way merge, until the quantile is found.
+//
+// The estimate is interpolated between centroids like Quantile does
+// (linearly, whatever the QuantileInterpolation of the digests), so
+// it is at least as accurate as that of a merged digest: merging can
+// only make centroids bigger. Finding the next centroid takes time
+// proportional to the number of digests, so this is best suited to
+// ad-hoc queries over a few digests, e.g. shards. Merge them into one
+// instead when querying them repeatedly.
+//
+// Like Quantile, this returns NaN if all the digests are empty and
+// clamps q into [0, 1].
+func UnionQuantile(q float64, digests ...*TDigest) float64 {
+	var count float64
+	min, max := math.Inf(1), math.Inf(-1)
+	centroids := 0
+	for _, t := range digests {
+		if t == nil || t.count == 0 {
+			continue
+		}
+		count += float64(t.count)
+		min, max = math.Min(min, t.min), math.Max(max, t.max)
+		centroids += t.summary.Len()
+	}
+	if centroids == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+
+	q = clampQuantile(q)
+	if q == 0 {
+		return min
+	} else if q == 1 {
+		return max
+	}
+
+	u := unionWalker{digests: digests, next: make([]int, len(digests))}
+	mean, c, _ := u.pop()
+	if centroids == 1 {
+		return mean
+	}
+
+	index := q * (count - 1)
+	previousMean, previousIndex := math.NaN(), 0.0
+	var total float64
+	for {
+		nextIndex := total + (float64(c)-1)/2
+		if nextIndex >= index {
+			if math.IsNaN(previousMean) {
+				// the index is before the 1st centroid
+				if nextIndex == previousIndex {
+					return mean
+				}
+				// assume linear growth
+				mean2, c2, _ := u.pop()
+				nextIndex2 := total + float64(c) + (float64(c2)-1)/2
+				previousMean = extrapolate(mean, mean2, nextIndex, nextIndex2-nextIndex)
+			}
+			return math.Max(min, math.Min(_quantile(index, previousIndex, nextIndex, previousMean, mean), max))
+		}
+
+		nextMean, nextCount, ok := u.pop()
+		if !ok {
+			// the index is after the last centroid
+			nextIndex2 := count - 1
+			nextMean2 := extrapolate(mean, previousMean, nextIndex2-nextIndex, nextIndex-previousIndex)
+			return math.Max(min, math.Min(_quantile(index, nextIndex, nextIndex2, mean, nextMean2), max))
+		}
+		total += float64(c)
+		previousMean, previousIndex = mean, nextIndex
+		mean, c = nextMean, nextCount
+	}
+}
+
+// unionWalker walks the centroids of several digests in increasing
+// order of mean.
+type unionWalker struct {
+	digests []*TDigest
+	// index of the next centroid of each digest
+	next []int
+}
+
+// pop returns the next centroid of the union, if any.
+func (u *unionWalker) pop() (mean float64, count uint64, ok bool) {
+	lowest := -1
+	for i, t := range u.digests {
+		if t == nil || u.next[i] == t.summary.Len() {
+			continue
+		}
+		if lowest == -1 || t.summary.Mean(u.next[i]) < u.digests[lowest].summary.Mean(u.next[lowest]) {
+			lowest = i
+		}
+	}
+	if lowest == -1 {
+		return 0, 0, false
+	}
+
+	s := u.digests[lowest].summary
+	mean, count = s.Mean(u.next[lowest]), s.Count(u.next[lowest])
+	u.next[lowest]++
+	return mean, count, true
+}
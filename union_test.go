@@ -0,0 +1,69 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestUnionQuantile(t *testing.T) {
+	r := rand.New(rand.NewSource(0x0410))
+	var digests []*TDigest
+	for i := 0; i < 5; i++ {
+		td := uncheckedNew(LocalRandomNumberGenerator(int64(i)))
+		for j := 0; j < 10000; j++ {
+			// Shards with overlapping ranges
+			_ = td.Add(float64(i) + 3*r.ExpFloat64())
+		}
+		digests = append(digests, td)
+	}
+	digests = append(digests, nil, uncheckedNew())
+	merged, _ := MergeAll(digests)
+
+	quantiles := []float64{0, 0.0001, 0.001, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999, 0.9999, 1}
+	for _, q := range quantiles {
+		union := UnionQuantile(q, digests...)
+		expected := merged.Quantile(q)
+		if math.Abs(union-expected) > 0.01*expected+0.01 {
+			t.Errorf("Quantile(%g): expected about %f, got %f", q, expected, union)
+		}
+	}
+	if UnionQuantile(0, digests...) != merged.Min() || UnionQuantile(1, digests...) != merged.Max() {
+		t.Errorf("Expected the extremes of the union to be exact")
+	}
+
+	// A single digest is its own union
+	for _, q := range quantiles {
+		if union := UnionQuantile(q, digests[0]); math.Abs(union-digests[0].Quantile(q)) > 1e-9 {
+			t.Errorf("Quantile(%g): expected %f, got %f", q, digests[0].Quantile(q), union)
+		}
+	}
+
+	single := uncheckedNew()
+	_ = single.AddWeighted(3, 10)
+	if UnionQuantile(0.5, nil, single, uncheckedNew()) != 3 {
+		t.Errorf("Expected the mean of the only centroid, got %f", UnionQuantile(0.5, single))
+	}
+	if UnionQuantile(2, digests...) != merged.Max() || !math.IsNaN(UnionQuantile(math.NaN(), digests...)) {
+		t.Errorf("Expected out of range quantiles to be clamped and NaN ones to stay NaN")
+	}
+	if !math.IsNaN(UnionQuantile(0.5)) || !math.IsNaN(UnionQuantile(0.5, nil, uncheckedNew())) {
+		t.Errorf("Expected NaN without samples")
+	}
+}
+
+func BenchmarkUnionQuantile(b *testing.B) {
+	digests := make([]*TDigest, 8)
+	for i := range digests {
+		digests[i] = uncheckedNew()
+		for j := 0; j < 100000; j++ {
+			_ = digests[i].Add(rand.NormFloat64())
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		UnionQuantile(0.99, digests...)
+	}
+}
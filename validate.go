@@ -0,0 +1,129 @@
+package tdigest
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Validate checks the invariants of the digest the other methods rely
+// on, returning an error describing the first one violated, if any:
+//
+//   - centroid means are finite and sorted in increasing order
+//   - centroid counts are positive, and add up to Count() without
+//     overflowing
+//   - the compression is at least 1 and, unless the digest is empty,
+//     Min() and Max() are ordered numbers
+//
+// A healthy digest is always valid, so this is meant for debugging,
+// e.g. to check digests after merging or decoding them from untrusted
+// sources. It walks all centroids.
+func (t *TDigest) Validate() error {
+	if !(t.compression >= 1) {
+		return fmt.Errorf("compression should be >= 1, got %f", t.compression)
+	}
+
+	s := t.summary
+	if len(s.means) != len(s.counts) {
+		return fmt.Errorf("mismatched centroid data: %d means but %d counts", len(s.means), len(s.counts))
+	}
+
+	total, err := validateCentroids(s.means, s.counts)
+	if err != nil {
+		return err
+	}
+
+	if total != t.count {
+		return fmt.Errorf("centroid counts add up to %d but Count() is %d", total, t.count)
+	}
+	if s.totaled && s.total != total {
+		return fmt.Errorf("centroid counts add up to %d but the cached total is %d", total, s.total)
+	}
+	if t.count > 0 && !(t.min <= t.max) {
+		return fmt.Errorf("min (%f) should be a number not greater than max (%f)", t.min, t.max)
+	}
+	return nil
+}
+
+// validateCentroids checks the centroid invariants of Validate on
+// parallel slices of means and counts, returning the total count.
+func validateCentroids(means []float64, counts []uint64) (uint64, error) {
+	var total uint64
+	for i, mean := range means {
+		if !isFinite(mean) {
+			return 0, fmt.Errorf("centroid %d: mean should be a finite number, got %f", i, mean)
+		}
+		if i > 0 && mean < means[i-1] {
+			return 0, fmt.Errorf("centroid %d: mean %f is smaller than the previous one, %f", i, mean, means[i-1])
+		}
+		if counts[i] == 0 {
+			return 0, fmt.Errorf("centroid %d: count should be > 0", i)
+		}
+		if total+counts[i] < total {
+			return 0, fmt.Errorf("centroid %d: total count overflows", i)
+		}
+		total += counts[i]
+	}
+	return total, nil
+}
+
+// Repair salvages a digest that fails Validate because of its
+// centroids, e.g. one decoded from a buggy producer: centroids with a
+// NaN or infinite mean or a zero count are dropped, the rest is sorted
+// again by mean, centroids sharing the same mean are merged and
+// Count() is recomputed. Min() and Max() are widened to the remaining
+// means if needed, or reset from them if they aren't ordered numbers.
+//
+// This only restores the invariants: samples from dropped centroids
+// are lost and, if means got mixed up with the wrong counts, quantiles
+// stay off. Repairing a valid digest leaves it untouched, unless it
+// holds centroids with the same mean, which are merged. This will
+// emit an error, leaving the digest as is, if the counts overflow.
+func (t *TDigest) Repair() error {
+	t.recordPeak()
+	s := t.summary
+	means, counts := s.means, s.counts
+	if len(counts) < len(means) {
+		means = means[:len(counts)]
+	}
+	counts = counts[:len(means)]
+
+	var total uint64
+	for i, mean := range means {
+		if isFinite(mean) && counts[i] > 0 {
+			if total+counts[i] < total {
+				return fmt.Errorf("centroid %d: total count overflows", i)
+			}
+			total += counts[i]
+		}
+	}
+
+	n := 0
+	for i, mean := range means {
+		if isFinite(mean) && counts[i] > 0 {
+			means[n], counts[n] = mean, counts[i]
+			n++
+		}
+	}
+	s.means, s.counts = means[:n], counts[:n]
+	sort.Sort(s)
+
+	n = 0
+	for i, mean := range s.means {
+		if n > 0 && mean == s.means[n-1] {
+			s.counts[n-1] += s.counts[i]
+			continue
+		}
+		s.means[n], s.counts[n] = mean, s.counts[i]
+		n++
+	}
+	s.means, s.counts = s.means[:n], s.counts[:n]
+	s.invalidate()
+
+	t.count = total
+	if !(t.min <= t.max) {
+		t.resetExtremes()
+	} else if n > 0 {
+		t.updateExtremes(s.means[0], s.means[n-1])
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	build := func() *TDigest {
+		td := uncheckedNew(LocalRandomNumberGenerator(0xA1))
+		for i := 0; i < 1000; i++ {
+			_ = td.Add(rand.NormFloat64())
+		}
+		return td
+	}
+
+	if err := uncheckedNew().Validate(); err != nil {
+		t.Errorf("Expected an empty digest to be valid, got %v", err)
+	}
+	td := build()
+	other := build()
+	_ = td.Merge(other)
+	buf, _ := td.AsBytes()
+	var decoded TDigest
+	_ = decoded.FromBytes(buf)
+	for _, digest := range []*TDigest{td, other, &decoded} {
+		if err := digest.Validate(); err != nil {
+			t.Errorf("Expected a valid digest, got %v", err)
+		}
+	}
+
+	corruptions := []struct {
+		corrupt func(td *TDigest)
+		message string
+	}{
+		{func(td *TDigest) { td.summary.means[3] = math.NaN() }, "centroid 3: mean should be a finite number"},
+		{func(td *TDigest) { td.summary.means[5] = math.Inf(-1) }, "centroid 5: mean should be a finite number"},
+		{func(td *TDigest) { td.summary.means[7] = td.summary.means[0] }, "centroid 7: mean"},
+		{func(td *TDigest) { td.count -= td.summary.counts[2]; td.summary.counts[2] = 0 }, "centroid 2: count should be > 0"},
+		{func(td *TDigest) { td.summary.counts[1] = math.MaxUint64 }, "centroid 1: total count overflows"},
+		{func(td *TDigest) { td.count++ }, "add up to 1000 but Count() is 1001"},
+		{func(td *TDigest) { td.summary.GetTotalCount(); td.summary.total++ }, "add up to 1000 but the cached total is 1001"},
+		{func(td *TDigest) { td.summary.counts = td.summary.counts[1:] }, "mismatched centroid data"},
+		{func(td *TDigest) { td.min, td.max = td.max, td.min }, "should be a number not greater than max"},
+		{func(td *TDigest) { td.min = math.NaN() }, "should be a number not greater than max"},
+		{func(td *TDigest) { td.compression = 0 }, "compression should be >= 1"},
+	}
+	for _, corruption := range corruptions {
+		td := build()
+		corruption.corrupt(td)
+
+		err := td.Validate()
+		if err == nil || !strings.Contains(err.Error(), corruption.message) {
+			t.Errorf("Expected an error about %q, got %v", corruption.message, err)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	rng := rand.New(rand.NewSource(0x5EED))
+	td := uncheckedNew(LocalRandomNumberGenerator(0xA2))
+	for i := 0; i < 10000; i++ {
+		_ = td.Add(rng.ExpFloat64())
+	}
+	expected := td.Quantiles(0, 0.01, 0.25, 0.5, 0.75, 0.99, 1)
+
+	if err := td.Clone().Repair(); err != nil {
+		t.Errorf("Expected a valid digest to be repaired, got %v", err)
+	}
+
+	shuffle(td.summary.means, td.summary.counts, newLocalRNG(0xA3))
+	td.summary.invalidate()
+	if err := td.Validate(); err == nil {
+		t.Fatalf("Expected a shuffled digest to be invalid")
+	}
+	if err := td.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	if err := td.Validate(); err != nil {
+		t.Errorf("Expected a repaired digest to be valid, got %v", err)
+	}
+	for i, q := range td.Quantiles(0, 0.01, 0.25, 0.5, 0.75, 0.99, 1) {
+		if q != expected[i] {
+			t.Errorf("Expected quantile #%d to be recovered as %f, got %f", i, expected[i], q)
+		}
+	}
+
+	// Duplicates are merged, broken centroids dropped
+	td = uncheckedNew()
+	td.summary.means = []float64{3, 1, math.NaN(), 3, 2, math.Inf(1), 1}
+	td.summary.counts = []uint64{1, 2, 5, 3, 1, 5, 4}
+	td.summary.invalidate()
+	td.count, td.min, td.max = 100, math.NaN(), 2
+	if err := td.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	if err := td.Validate(); err != nil {
+		t.Errorf("Expected a repaired digest to be valid, got %v", err)
+	}
+	if td.CentroidCount() != 3 || td.Count() != 11 || td.Min() != 1 || td.Max() != 3 {
+		t.Errorf("Expected 11 samples in 3 centroids from 1 to 3, got %d in %d from %f to %f", td.Count(), td.CentroidCount(), td.Min(), td.Max())
+	}
+	for i, count := range []uint64{6, 1, 4} {
+		if td.summary.Mean(i) != float64(i+1) || td.summary.Count(i) != count {
+			t.Errorf("Expected centroid %d to be (%d, %d), got (%f, %d)", i, i+1, count, td.summary.Mean(i), td.summary.Count(i))
+		}
+	}
+
+	td.summary.counts[0] = math.MaxUint64
+	td.summary.invalidate()
+	if err := td.Repair(); err == nil {
+		t.Errorf("Expected overflowing counts to be reported")
+	}
+}
@@ -0,0 +1,202 @@
+package tdigest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Number of units a sample of weight one is stored as, which sets how
+// finely fractional weights are represented.
+const weightResolution = 1 << 16
+
+var weightedMagic = []byte{'t', 'd', 'w'}
+
+const weightedVersion byte = 1
+
+// WeightedTDigest is a digest of samples with fractional weights, such
+// as the inverse of a sampling rate.
+//
+// The weights are stored as fixed-point counts: every centroid count is
+// in units of 1/65536 of a sample, so a weight of 0.5 registers half a
+// sample and two of them add up to exactly one. What doesn't fit in a
+// whole unit is carried over to the next addition rather than dropped,
+// so Count() is the sum of the weights. Quantiles and CDFs only depend
+// on the relative weights, so they are the ones of the stored counts.
+// Snapshot converts it to a regular digest.
+//
+// Like TDigest, it is not safe for concurrent use.
+type WeightedTDigest struct {
+	digest *TDigest
+	// weight, in units, not registered in any centroid yet
+	residual float64
+}
+
+// NewWeighted creates a digest of weighted samples with the given
+// options (see New).
+func NewWeighted(options ...tdigestOption) (*WeightedTDigest, error) {
+	digest, err := New(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &WeightedTDigest{digest: digest}, nil
+}
+
+// checkWeighted checks that a weighted sample can be registered.
+func checkWeighted(value float64, weight float64) error {
+	if !isFinite(value) || !(weight > 0) || weight*weightResolution >= math.MaxUint64 {
+		return fmt.Errorf("illegal datapoint <value: %.4f, weight: %f>", value, weight)
+	}
+	return nil
+}
+
+// units returns the whole number of units to register for the given
+// weight, along with what is left to carry over.
+func (w *WeightedTDigest) units(weight float64) (uint64, float64) {
+	exact := weight*weightResolution + w.residual
+	units := math.Round(exact)
+	if units <= 0 {
+		return 0, exact
+	}
+	return uint64(units), exact - units
+}
+
+// Add registers a new sample with a weight of one.
+func (w *WeightedTDigest) Add(value float64) error {
+	return w.AddWeighted(value, 1)
+}
+
+// AddWeighted registers a new sample with the given weight, which may
+// be fractional. A weight too small to register a whole unit on its
+// own still adds up with the following ones.
+//
+// This will emit an error if `value` is NaN or infinite, if `weight`
+// is not a positive number below 2^48 or if the total weight would
+// overflow.
+func (w *WeightedTDigest) AddWeighted(value float64, weight float64) error {
+	err := checkWeighted(value, weight)
+	if err != nil {
+		return err
+	}
+
+	units, residual := w.units(weight)
+	if units > 0 {
+		err = w.digest.AddWeighted(value, units)
+		if err != nil {
+			return err
+		}
+	}
+	w.residual = residual
+	return nil
+}
+
+// Merge joins a given weighted digest into itself, see TDigest.Merge.
+// The other digest is left untouched.
+func (w *WeightedTDigest) Merge(other *WeightedTDigest) error {
+	err := w.digest.Merge(other.digest)
+	if err != nil {
+		return err
+	}
+	w.residual += other.residual
+	return nil
+}
+
+// MergeDigest joins a given digest of unweighted samples into itself,
+// each of its samples having a weight of one. The other digest is left
+// untouched.
+//
+// This will emit an error if the total weight would overflow.
+func (w *WeightedTDigest) MergeDigest(other *TDigest) error {
+	return w.digest.MergeScaled(other, weightResolution)
+}
+
+// Quantile returns the desired percentile estimation of the weighted
+// distribution, see TDigest.Quantile.
+func (w *WeightedTDigest) Quantile(q float64) float64 {
+	return w.digest.Quantile(q)
+}
+
+// Quantiles returns the estimations of several percentiles at once,
+// see TDigest.Quantiles.
+func (w *WeightedTDigest) Quantiles(qs ...float64) []float64 {
+	return w.digest.Quantiles(qs...)
+}
+
+// CDF computes the (weighted) fraction of samples less than or equal
+// to the given value, see TDigest.CDF.
+func (w *WeightedTDigest) CDF(value float64) float64 {
+	return w.digest.CDF(value)
+}
+
+// Compress tries to reduce the number of centroids, see
+// TDigest.Compress.
+func (w *WeightedTDigest) Compress() error {
+	return w.digest.Compress()
+}
+
+// Count returns the sum of the weights of the samples.
+func (w *WeightedTDigest) Count() float64 {
+	return (float64(w.digest.Count()) + w.residual) / weightResolution
+}
+
+// Min returns the smallest sample stored in the digest, see
+// TDigest.Min.
+func (w *WeightedTDigest) Min() float64 {
+	return w.digest.Min()
+}
+
+// Max returns the largest sample stored in the digest, see
+// TDigest.Max.
+func (w *WeightedTDigest) Max() float64 {
+	return w.digest.Max()
+}
+
+// Snapshot returns a regular digest with the samples of this one, for
+// code that takes a *TDigest. Its counts are rounded to whole samples
+// like MergeScaled rounds scaled counts, so its Count() is this one's,
+// rounded, and centroids lighter than half a sample may be dropped.
+// The snapshot is independent of this digest.
+func (w *WeightedTDigest) Snapshot() *TDigest {
+	snapshot := w.digest.Clone()
+	snapshot.scaleCounts(1.0 / weightResolution)
+	return snapshot
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The payload has a
+// header of its own followed by the stored counts in the AsBytes
+// format, so the FromBytes of TDigest rejects it rather than decoding
+// counts 65536 times too large.
+func (w *WeightedTDigest) MarshalBinary() ([]byte, error) {
+	b := make([]byte, len(weightedMagic)+1+8)
+	copy(b, weightedMagic)
+	b[len(weightedMagic)] = weightedVersion
+	endianess.PutUint64(b[len(weightedMagic)+1:], math.Float64bits(w.residual))
+	return w.digest.AppendBytes(b), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, accepting
+// payloads from MarshalBinary. It discards any previously collected
+// data, and leaves the digest untouched if the payload is invalid.
+// Like the FromBytes function, the decoded digest gets the default
+// options besides the compression, which comes from the payload.
+func (w *WeightedTDigest) UnmarshalBinary(buf []byte) error {
+	header := len(weightedMagic) + 1 + 8
+	if len(buf) < header || !bytes.HasPrefix(buf, weightedMagic) {
+		return errors.New("not a weighted tdigest encoding")
+	}
+	if version := buf[len(weightedMagic)]; version != weightedVersion {
+		return fmt.Errorf("unsupported format version: %d", version)
+	}
+	residual := math.Float64frombits(endianess.Uint64(buf[len(weightedMagic)+1:]))
+	if !isFinite(residual) {
+		return fmt.Errorf("illegal residual weight: %f", residual)
+	}
+
+	digest, err := FromBytes(bytes.NewReader(buf[header:]))
+	if err != nil {
+		return err
+	}
+	w.digest, w.residual = digest, residual
+	return nil
+}
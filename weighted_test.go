@@ -0,0 +1,175 @@
+package tdigest
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestWeightedAdd(t *testing.T) {
+	r := rand.New(rand.NewSource(0xBAD))
+	w, err := NewWeighted(LocalRandomNumberGenerator(0xBAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mass float64
+	for i := 0; i < 100000; i++ {
+		weight := 0.5 + r.Float64()*2
+		mass += weight
+		err := w.AddWeighted(r.NormFloat64(), weight)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if math.Abs(w.Count()-mass) > 1e-9*mass {
+		t.Errorf("Expected Count() to be the total weight %f, got %f", mass, w.Count())
+	}
+	if err := w.digest.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(w.Quantile(0.5)) > 0.05 {
+		t.Errorf("Expected a median close to 0, got %f", w.Quantile(0.5))
+	}
+
+	// Fractional weights are kept, whatever the order they come in
+	half, _ := NewWeighted()
+	_ = half.AddWeighted(1, 0.5)
+	_ = half.AddWeighted(2, 0.5)
+	_ = half.AddWeighted(3, 1.5)
+	if half.Count() != 2.5 || half.CDF(1.5) != 0.2 || half.Quantile(0.1) != 1 {
+		t.Errorf("Expected weights of 0.5, 0.5 and 1.5, got a count of %f and CDF(1.5)=%f", half.Count(), half.CDF(1.5))
+	}
+
+	// Weights below the resolution add up
+	tiny, _ := NewWeighted()
+	for i := 0; i < 1000; i++ {
+		_ = tiny.AddWeighted(float64(i), 1e-6)
+	}
+	if math.Abs(tiny.Count()-1e-3) > 1e-12 || tiny.digest.Count() == 0 {
+		t.Errorf("Expected tiny weights to add up to 0.001, got %f in %d units", tiny.Count(), tiny.digest.Count())
+	}
+
+	for _, weight := range []float64{0, -1, math.NaN(), math.Inf(1), 1e20} {
+		if half.AddWeighted(1, weight) == nil {
+			t.Errorf("Expected weight %f to be rejected", weight)
+		}
+	}
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if half.AddWeighted(value, 0.5) == nil {
+			t.Errorf("Expected %f to be rejected", value)
+		}
+	}
+	if half.Count() != 2.5 {
+		t.Errorf("Expected rejected samples to leave the digest untouched, got a count of %f", half.Count())
+	}
+}
+
+func TestWeightedMerge(t *testing.T) {
+	w, _ := NewWeighted()
+	_ = w.AddWeighted(1, 0.25)
+	other, _ := NewWeighted()
+	_ = other.AddWeighted(2, 0.5)
+	_ = other.AddWeighted(3, 1e-9)
+
+	err := w.Merge(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(w.Count()-(0.75+1e-9)) > 1e-15 || w.Max() != 2 {
+		t.Errorf("Unexpected digest after merging: count=%f max=%f", w.Count(), w.Max())
+	}
+	if other.Count() != 0.5+1e-9 {
+		t.Errorf("Expected the other digest to be left untouched, got a count of %f", other.Count())
+	}
+
+	// Regular digests merge with a weight of one per sample
+	digest := uncheckedNew()
+	_ = digest.AddWeighted(1000, 3)
+	err = w.MergeDigest(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(w.Count()-(3.75+1e-9)) > 1e-12 || w.Max() != 1000 {
+		t.Errorf("Unexpected digest after merging: count=%f max=%f", w.Count(), w.Max())
+	}
+	if digest.Count() != 3 {
+		t.Errorf("Expected the digest to be left untouched, got a count of %d", digest.Count())
+	}
+
+	huge := uncheckedNew()
+	_ = huge.AddWeighted(1, math.MaxUint64>>10)
+	if w.MergeDigest(huge) == nil {
+		t.Errorf("Expected an overflowing merge to be rejected")
+	}
+}
+
+func TestWeightedSnapshot(t *testing.T) {
+	w, _ := NewWeighted(LocalRandomNumberGenerator(0x5A))
+	for i := 0; i < 10000; i++ {
+		_ = w.AddWeighted(float64(i%100), 0.25+float64(i%4)/4)
+	}
+	err := w.Compress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := w.Snapshot()
+	if err := snapshot.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if float64(snapshot.Count()) != math.Round(w.Count()) {
+		t.Errorf("Expected a count of %.0f, got %d", math.Round(w.Count()), snapshot.Count())
+	}
+	qs := []float64{0.1, 0.5, 0.9}
+	for i, x := range w.Quantiles(qs...) {
+		if math.Abs(snapshot.Quantile(qs[i])-x) > 0.5 {
+			t.Errorf("Expected the snapshot to estimate Quantile(%g) like the digest, got %f and %f", qs[i], snapshot.Quantile(qs[i]), x)
+		}
+	}
+
+	// The snapshot is independent of the digest
+	_ = snapshot.Add(1000)
+	if w.Max() == 1000 {
+		t.Errorf("Expected the snapshot to be a copy")
+	}
+}
+
+func TestWeightedSerialization(t *testing.T) {
+	w, _ := NewWeighted()
+	for i := 0; i < 1000; i++ {
+		_ = w.AddWeighted(float64(i), 1.0/3)
+	}
+
+	payload, err := w.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded WeightedTDigest
+	err = decoded.UnmarshalBinary(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Count() != w.Count() || !decoded.digest.Equals(w.digest, 0) {
+		t.Errorf("Expected the digest to round-trip, got a count of %f instead of %f", decoded.Count(), w.Count())
+	}
+
+	// Regular decoders don't mistake the stored units for samples
+	if _, err := FromBytes(bytes.NewReader(payload)); err == nil {
+		t.Errorf("Expected FromBytes to reject a weighted payload")
+	}
+
+	regular, _ := w.digest.AsBytes()
+	corrupt := append([]byte{}, payload...)
+	corrupt[len(weightedMagic)] = 42
+	for _, buf := range [][]byte{nil, regular, payload[:len(weightedMagic)+4], corrupt} {
+		if decoded.UnmarshalBinary(buf) == nil {
+			t.Errorf("Expected %v to be rejected", buf)
+		}
+	}
+	if decoded.Count() != w.Count() {
+		t.Errorf("Expected rejected payloads to leave the digest untouched")
+	}
+}
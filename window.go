@@ -0,0 +1,161 @@
+package tdigest
+
+import (
+	"errors"
+	"time"
+)
+
+// WindowDigest is a digest over a sliding time window, e.g. for
+// reporting the p99 latency of the last five minutes.
+//
+// The window is split into a ring of buckets, each a TDigest covering
+// an equal slice of time. Samples go to the current bucket and, as the
+// clock advances, the oldest bucket is reset and reused for the new
+// time slice. Queries merge the live buckets.
+//
+// The number of buckets trades time accuracy for cost: the window
+// actually spans between n-1 and n buckets worth of time depending on
+// how far into the current bucket the clock is, so more buckets make
+// its edge sharper. But every bucket holds its own centroids (up to
+// the compression times the buffer factor, see BufferFactor) and
+// queries need to merge all of them, so memory and query time grow
+// linearly with the number of buckets. Quantile accuracy barely
+// depends on it. For most uses 5 to 60 buckets are a good fit.
+//
+// Like TDigest, it is not safe for concurrent use.
+type WindowDigest struct {
+	buckets []*TDigest
+	width   time.Duration
+	options []tdigestOption
+	current int
+	// start of the current bucket
+	start time.Time
+
+	merged *TDigest
+	dirty  bool
+}
+
+// NewWindow creates a digest over a sliding window of the given
+// length, split into the given number of buckets, each created with
+// the given options (see New).
+func NewWindow(window time.Duration, buckets int, options ...tdigestOption) (*WindowDigest, error) {
+	if buckets < 1 {
+		return nil, errors.New("number of buckets should be >= 1")
+	}
+	if window <= 0 || window/time.Duration(buckets) == 0 {
+		return nil, errors.New("window should be positive and span at least a nanosecond per bucket")
+	}
+
+	w := &WindowDigest{
+		buckets: make([]*TDigest, buckets),
+		width:   window / time.Duration(buckets),
+		options: options,
+		dirty:   true,
+	}
+	for i := range w.buckets {
+		var err error
+		w.buckets[i], err = New(options...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Advance moves the window forward to the given time, expiring the
+// buckets that fall out of it. Adding samples advances the window
+// too, so this only needs calling (on a clock tick, say) when samples
+// may stop flowing for a while but queries must go on reflecting the
+// current window. Times before the current bucket are ignored.
+func (w *WindowDigest) Advance(now time.Time) {
+	if w.start.IsZero() {
+		w.start = now.Truncate(w.width)
+		return
+	}
+
+	elapsed := now.Sub(w.start) / w.width
+	if elapsed <= 0 {
+		return
+	}
+
+	if elapsed >= time.Duration(len(w.buckets)) {
+		for _, bucket := range w.buckets {
+			_, _ = bucket.Reset()
+		}
+	} else {
+		for i := time.Duration(0); i < elapsed; i++ {
+			w.current = (w.current + 1) % len(w.buckets)
+			_, _ = w.buckets[w.current].Reset()
+		}
+	}
+	w.start = w.start.Add(elapsed * w.width)
+	w.dirty = true
+}
+
+// Add registers a new sample observed now, see AddAt.
+func (w *WindowDigest) Add(value float64) error {
+	return w.AddAt(value, time.Now())
+}
+
+// AddAt registers a new sample observed at the given time, advancing
+// the window if needed.
+//
+// Samples older than the current bucket go to the bucket covering
+// their time, while those that are too old for the window are
+// ignored.
+func (w *WindowDigest) AddAt(value float64, at time.Time) error {
+	w.Advance(at)
+
+	i := w.current
+	if at.Before(w.start) {
+		age := (w.start.Sub(at) + w.width - 1) / w.width
+		if age >= time.Duration(len(w.buckets)) {
+			return nil
+		}
+		i = (i - int(age) + len(w.buckets)) % len(w.buckets)
+	}
+
+	w.dirty = true
+	return w.buckets[i].Add(value)
+}
+
+// Quantile returns the desired percentile estimation over the
+// window, see TDigest.Quantile.
+func (w *WindowDigest) Quantile(q float64) float64 {
+	return w.mergedDigest().Quantile(q)
+}
+
+// CDF computes the fraction of the samples in the window that are
+// less than or equal to the given value, see TDigest.CDF.
+func (w *WindowDigest) CDF(value float64) float64 {
+	return w.mergedDigest().CDF(value)
+}
+
+// Count returns the number of samples in the window.
+func (w *WindowDigest) Count() uint64 {
+	var count uint64
+	for _, bucket := range w.buckets {
+		count += bucket.Count()
+	}
+	return count
+}
+
+// mergedDigest returns the union of the live buckets, rebuilding it
+// if the window changed since it was last built.
+func (w *WindowDigest) mergedDigest() *TDigest {
+	if !w.dirty {
+		return w.merged
+	}
+
+	if w.merged == nil {
+		// The options were validated on creation
+		w.merged, _ = New(w.options...)
+	} else {
+		_, _ = w.merged.Reset()
+	}
+	for _, bucket := range w.buckets {
+		_ = w.merged.Merge(bucket)
+	}
+	w.dirty = false
+	return w.merged
+}
@@ -0,0 +1,99 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	r := rand.New(rand.NewSource(0x5111DE))
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	digest, err := NewWindow(5*time.Minute, 5, LocalRandomNumberGenerator(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ten minutes of samples, a second apart, whose value is the
+	// minute they were taken in
+	for i := 0; i < 600; i++ {
+		at := start.Add(time.Duration(i) * time.Second)
+		for j := 0; j < 10; j++ {
+			_ = digest.AddAt(float64(i/60)+r.Float64(), at)
+		}
+
+		if i%60 == 59 {
+			// The window spans the last five minutes
+			minute := i / 60
+			lowest := minute - 4
+			if lowest < 0 {
+				lowest = 0
+			}
+			if digest.Quantile(0) < float64(lowest) || digest.Quantile(1) > float64(minute+1) {
+				t.Errorf("minute %d: expected samples from minute %d on, got a range of %f to %f", minute, lowest, digest.Quantile(0), digest.Quantile(1))
+			}
+			if expected := uint64(600 * (minute - lowest + 1)); digest.Count() != expected {
+				t.Errorf("minute %d: expected %d samples, got %d", minute, expected, digest.Count())
+			}
+		}
+	}
+
+	// A new bucket only holds the samples of its own minute
+	digest.Advance(start.Add(10 * time.Minute))
+	if digest.Count() != 2400 || digest.CDF(6) != 0 {
+		t.Errorf("Expected the 6th minute to be gone, got %d samples and CDF(6)=%f", digest.Count(), digest.CDF(6))
+	}
+
+	// Late samples go to the bucket of their time, if still around
+	_ = digest.AddAt(6.5, start.Add(6*time.Minute+30*time.Second))
+	_ = digest.AddAt(-1, start.Add(5*time.Minute))
+	if digest.Count() != 2401 || digest.Quantile(0) < 6 {
+		t.Errorf("Expected a single late sample, got %d samples and a minimum of %f", digest.Count(), digest.Quantile(0))
+	}
+
+	// Once the whole window has passed nothing is left
+	digest.Advance(start.Add(time.Hour))
+	if digest.Count() != 0 || !math.IsNaN(digest.Quantile(0.5)) {
+		t.Errorf("Expected an empty window, got %d samples", digest.Count())
+	}
+}
+
+func TestNewWindow(t *testing.T) {
+	inputs := []struct {
+		window  time.Duration
+		buckets int
+	}{
+		{time.Minute, 0},
+		{0, 10},
+		{-time.Minute, 10},
+		{5, 10},
+	}
+	for _, input := range inputs {
+		if _, err := NewWindow(input.window, input.buckets); err == nil {
+			t.Errorf("Expected NewWindow(%v, %d) to fail", input.window, input.buckets)
+		}
+	}
+
+	if _, err := NewWindow(time.Minute, 10, Compression(-1)); err == nil {
+		t.Errorf("Expected invalid options to be rejected")
+	}
+}
+
+func BenchmarkWindowQuantile(b *testing.B) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	digest, _ := NewWindow(5*time.Minute, 30)
+	for i := 0; i < 300; i++ {
+		for j := 0; j < 1000; j++ {
+			_ = digest.AddAt(rand.Float64(), start.Add(time.Duration(i)*time.Second))
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		// Every query sees a new sample, so buckets are merged again
+		_ = digest.AddAt(rand.Float64(), start.Add(300*time.Second))
+		digest.Quantile(0.99)
+	}
+}